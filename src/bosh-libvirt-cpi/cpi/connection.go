@@ -0,0 +1,200 @@
+package cpi
+
+import (
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+	libvirt "libvirt.org/go/libvirt"
+
+	"bosh-libvirt-cpi/driver"
+)
+
+const (
+	systemLibvirtSocket = "/var/run/libvirt/libvirt-sock"
+)
+
+// Connection holds the transports shared by the CPI calls of a process.
+// With a remote Host, libvirt's RPC is tunnelled through the SSH client
+// that the runner uses, so domains and files always end up on the same host.
+type Connection struct {
+	Conn driver.LibvirtConn
+
+	// Runner is nil for a local libvirt; the factory then runs commands locally.
+	Runner driver.RawRunner
+
+	closers []io.Closer
+}
+
+func Connect(opts FactoryOpts, fs boshsys.FileSystem, logger boshlog.Logger) (Connection, error) {
+	u, _ := url.Parse(opts.BackendURI) // already validated in Validate()
+
+	var c Connection
+	var sshRunner *driver.SSHRunner
+
+	if len(opts.Host) > 0 {
+		sshRunner = driver.NewSSHRunner(opts.SSHRunnerOpts(), fs, logger)
+		c.Runner = sshRunner
+		c.onClose(sshRunner)
+	}
+
+	uri := opts.BackendURI
+
+	var err error
+
+	switch {
+	case backendTransport(u) == "tls":
+		uri, err = c.writePKI(opts, fs)
+	case sshRunner != nil:
+		uri, err = c.tunnel(u, sshRunner)
+	}
+
+	if err != nil {
+		_ = c.Close()
+		return Connection{}, err
+	}
+
+	conn, err := connectLibvirt(uri, opts)
+	if err != nil {
+		_ = c.Close()
+		return Connection{}, bosherr.WrapErrorf(err, "Connecting to libvirt at '%s'", opts.BackendURI)
+	}
+
+	// A tunnel or PKI dir stays in place, so reconnecting reuses the URI
+	c.Conn = driver.NewLibvirtConnImpl(conn, func() (*libvirt.Connect, error) { return connectLibvirt(uri, opts) })
+	c.onClose(libvirtCloser{c.Conn})
+
+	return c, nil
+}
+
+// Close closes the libvirt connection before the transport it runs over.
+func (c Connection) Close() error {
+	var firstErr error
+
+	for _, closer := range c.closers {
+		err := closer.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// onClose registers closer to run before those registered earlier.
+func (c *Connection) onClose(closer io.Closer) {
+	c.closers = append([]io.Closer{closer}, c.closers...)
+}
+
+// tunnel forwards libvirtd's socket on the host over SSH and returns the URI to reach it.
+func (c *Connection) tunnel(u *url.URL, runner *driver.SSHRunner) (string, error) {
+	remoteSocket, err := remoteLibvirtSocket(u, runner)
+	if err != nil {
+		return "", err
+	}
+
+	localSocket, tunnel, err := runner.ForwardUnixSocket(remoteSocket)
+	if err != nil {
+		return "", bosherr.WrapError(err, "Tunnelling libvirt over SSH")
+	}
+
+	c.onClose(tunnel)
+
+	return backendDriver(u) + "+unix://" + u.Path + "?socket=" + url.QueryEscape(localSocket), nil
+}
+
+// writePKI stores the TLS credentials in a private temp dir, kept until
+// the connection is closed, and returns the URI that uses them.
+func (c *Connection) writePKI(opts FactoryOpts, fs boshsys.FileSystem) (string, error) {
+	dir, err := fs.TempDir("bosh-libvirt-cpi-pki")
+	if err != nil {
+		return "", bosherr.WrapError(err, "Creating PKI dir")
+	}
+
+	c.onClose(tempDir{dir, fs})
+
+	files := []struct{ name, contents string }{
+		{"cacert.pem", opts.CACert},
+		{"clientcert.pem", opts.ClientCert},
+		{"clientkey.pem", opts.ClientKey},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+
+		err = fs.WriteFileString(path, file.contents)
+		if err == nil {
+			err = fs.Chmod(path, 0600)
+		}
+		if err != nil {
+			return "", bosherr.WrapErrorf(err, "Writing '%s'", file.name)
+		}
+	}
+
+	return opts.TLSBackendURI(dir), nil
+}
+
+func connectLibvirt(uri string, opts FactoryOpts) (*libvirt.Connect, error) {
+	if len(opts.SASLUsername) == 0 {
+		return libvirt.NewConnect(uri)
+	}
+
+	auth := &libvirt.ConnectAuth{
+		CredType: []libvirt.ConnectCredentialType{libvirt.CRED_AUTHNAME, libvirt.CRED_PASSPHRASE},
+		Callback: func(creds []*libvirt.ConnectCredential) {
+			for _, cred := range creds {
+				switch cred.Type {
+				case libvirt.CRED_AUTHNAME:
+					cred.Result = opts.SASLUsername
+				case libvirt.CRED_PASSPHRASE:
+					cred.Result = opts.SASLPassword
+				default:
+					continue
+				}
+				cred.ResultLen = len(cred.Result)
+			}
+		},
+	}
+
+	return libvirt.NewConnectWithAuth(uri, auth, 0)
+}
+
+// remoteLibvirtSocket returns the libvirtd socket on the host: the one named
+// by the URI's socket parameter, or the default of the system or session daemon.
+func remoteLibvirtSocket(u *url.URL, runner driver.Runner) (string, error) {
+	if socket := u.Query().Get("socket"); len(socket) > 0 {
+		return socket, nil
+	}
+
+	if u.Path != "/session" {
+		return systemLibvirtSocket, nil
+	}
+
+	// The session daemon is not started on demand through the tunnel, so it must already be running
+	output, _, err := runner.Execute("id", "-u")
+	if err != nil {
+		return "", bosherr.WrapError(err, "Finding remote user id")
+	}
+
+	return "/run/user/" + strings.TrimSpace(output) + "/libvirt/libvirt-sock", nil
+}
+
+type tempDir struct {
+	path string
+	fs   boshsys.FileSystem
+}
+
+func (d tempDir) Close() error { return d.fs.RemoveAll(d.path) }
+
+type libvirtCloser struct {
+	conn driver.LibvirtConn
+}
+
+func (c libvirtCloser) Close() error {
+	_, err := c.conn.Close()
+	return err
+}
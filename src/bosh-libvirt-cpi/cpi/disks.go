@@ -18,10 +18,15 @@ func NewDisks(creator bdisk.Creator, finder bdisk.Finder, vmFinder bvm.Finder) D
 	return Disks{creator, finder, vmFinder}
 }
 
-func (a Disks) CreateDisk(size int, _ apiv1.DiskCloudProps, _ *apiv1.VMCID) (apiv1.DiskCID, error) {
-	disk, err := a.creator.Create(size)
+func (a Disks) CreateDisk(size int, cloudProps apiv1.DiskCloudProps, _ *apiv1.VMCID) (apiv1.DiskCID, error) {
+	props, err := bdisk.NewDiskProps(cloudProps)
 	if err != nil {
-		return apiv1.DiskCID{}, bosherr.WrapErrorf(err, "Creating disk of size '%d'", size)
+		return apiv1.DiskCID{}, bosherr.WrapError(err, "Parsing disk cloud properties")
+	}
+
+	disk, err := a.creator.Create(size, props)
+	if err != nil {
+		return apiv1.DiskCID{}, classifyErr(bosherr.WrapErrorf(err, "Creating disk of size '%d'", size))
 	}
 
 	return disk.ID(), nil
@@ -35,7 +40,7 @@ func (a Disks) DeleteDisk(cid apiv1.DiskCID) error {
 
 	err = disk.Delete()
 	if err != nil {
-		return bosherr.WrapErrorf(err, "Deleting disk '%s'", cid)
+		return classifyErr(bosherr.WrapErrorf(err, "Deleting disk '%s'", cid))
 	}
 
 	return nil
@@ -57,9 +62,16 @@ func (a Disks) AttachDiskV2(vmCID apiv1.VMCID, diskCID apiv1.DiskCID) (apiv1.Dis
 		return apiv1.DiskHint{}, bosherr.WrapErrorf(err, "Finding disk '%s'", diskCID)
 	}
 
+	found, err := disk.Exists()
+	if err != nil {
+		return apiv1.DiskHint{}, classifyErr(bosherr.WrapErrorf(err, "Checking disk '%s'", diskCID))
+	} else if !found {
+		return apiv1.DiskHint{}, NewDiskNotFoundError(diskCID, false)
+	}
+
 	hint, err := vm.AttachDisk(disk)
 	if err != nil {
-		return apiv1.DiskHint{}, bosherr.WrapErrorf(err, "Attaching disk '%s' to VM '%s'", diskCID, vmCID)
+		return apiv1.DiskHint{}, vmErr(vm, bosherr.WrapErrorf(err, "Attaching disk '%s' to VM '%s'", diskCID, vmCID))
 	}
 
 	return hint, nil
@@ -76,9 +88,23 @@ func (a Disks) DetachDisk(vmCID apiv1.VMCID, diskCID apiv1.DiskCID) error {
 		return bosherr.WrapErrorf(err, "Finding disk '%s'", diskCID)
 	}
 
+	found, err := vm.Exists()
+	if err != nil {
+		return classifyErr(bosherr.WrapErrorf(err, "Checking VM '%s'", vmCID))
+	} else if !found {
+		return NewVMNotFoundError(vmCID)
+	}
+
+	attached, err := vm.DiskIDs()
+	if err != nil {
+		return classifyErr(bosherr.WrapErrorf(err, "Listing disks of VM '%s'", vmCID))
+	} else if !containsDiskCID(attached, diskCID) {
+		return NewDiskNotAttachedError(vmCID, diskCID, false)
+	}
+
 	err = vm.DetachDisk(disk)
 	if err != nil {
-		return bosherr.WrapErrorf(err, "Detaching disk '%s' to VM '%s'", diskCID, vmCID)
+		return vmErr(vm, bosherr.WrapErrorf(err, "Detaching disk '%s' to VM '%s'", diskCID, vmCID))
 	}
 
 	return nil
@@ -90,13 +116,24 @@ func (a Disks) HasDisk(cid apiv1.DiskCID) (bool, error) {
 		return false, bosherr.WrapErrorf(err, "Finding disk '%s'", cid)
 	}
 
-	return disk.Exists()
+	found, err := disk.Exists()
+	return found, classifyErr(err)
 }
 
 func (a Disks) SetDiskMetadata(cid apiv1.DiskCID, meta apiv1.DiskMeta) error {
 	return nil
 }
 
+// ResizeDisk is not supported, so the director copies the data to a new disk instead.
 func (a Disks) ResizeDisk(cid apiv1.DiskCID, size int) error {
-	return nil
+	return NewNotSupportedError("Resizing disks is not supported")
+}
+
+func containsDiskCID(cids []apiv1.DiskCID, cid apiv1.DiskCID) bool {
+	for _, c := range cids {
+		if c == cid {
+			return true
+		}
+	}
+	return false
 }
@@ -1,6 +1,7 @@
 package cpi_test
 
 import (
+	"encoding/json"
 	"errors"
 
 	. "github.com/onsi/ginkgo"
@@ -9,6 +10,7 @@ import (
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 
 	"bosh-libvirt-cpi/cpi"
+	bdisk "bosh-libvirt-cpi/disk"
 	diskfakes "bosh-libvirt-cpi/disk/fakes"
 	vmfakes "bosh-libvirt-cpi/vm/fakes"
 )
@@ -29,20 +31,51 @@ var _ = Describe("Disks", func() {
 	})
 
 	Describe("CreateDisk", func() {
+		var cloudProps apiv1.CloudPropsImpl
+
+		BeforeEach(func() {
+			cloudProps = apiv1.CloudPropsImpl{RawMessage: json.RawMessage("{}")}
+		})
+
 		It("creates disk and returns disk ID", func() {
 			fakeDisk := diskfakes.NewFakeDisk("disk-1")
 			creator.CreateResult = fakeDisk
 
-			cid, err := disks.CreateDisk(1024, apiv1.CloudPropsImpl{}, nil)
+			cid, err := disks.CreateDisk(1024, cloudProps, nil)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(cid.AsString()).To(Equal("disk-1"))
 			Expect(creator.CreateSizeArg).To(Equal(1024))
+			Expect(creator.CreatePropsArg).To(Equal(bdisk.DefaultDiskProps()))
+		})
+
+		It("passes disk cloud properties to the creator", func() {
+			creator.CreateResult = diskfakes.NewFakeDisk("disk-1")
+			cloudProps.RawMessage = json.RawMessage(
+				`{"bus":"sata","format":"qcow2","preallocation":"metadata","pool":"fast","read_only":true}`)
+
+			_, err := disks.CreateDisk(1024, cloudProps, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(creator.CreatePropsArg).To(Equal(bdisk.DiskProps{
+				Bus:           "sata",
+				Format:        "qcow2",
+				Preallocation: "metadata",
+				Pool:          "fast",
+				ReadOnly:      true,
+			}))
+		})
+
+		It("returns error when disk cloud properties are invalid", func() {
+			cloudProps.RawMessage = json.RawMessage(`{"bus":"floppy"}`)
+
+			_, err := disks.CreateDisk(1024, cloudProps, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Parsing disk cloud properties"))
 		})
 
 		It("returns error when creator fails", func() {
 			creator.CreateErr = errors.New("create failed")
 
-			_, err := disks.CreateDisk(1024, apiv1.CloudPropsImpl{}, nil)
+			_, err := disks.CreateDisk(1024, cloudProps, nil)
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("create failed"))
 		})
@@ -100,6 +133,7 @@ var _ = Describe("Disks", func() {
 			fakeVM := vmfakes.NewFakeVM("vm-1")
 			vmFinder.FindResult = fakeVM
 			fakeDisk := diskfakes.NewFakeDisk("disk-1")
+			fakeDisk.ExistsResult = true
 			finder.FindResult = fakeDisk
 
 			err := disks.AttachDisk(apiv1.NewVMCID("vm-1"), apiv1.NewDiskCID("disk-1"))
@@ -107,6 +141,17 @@ var _ = Describe("Disks", func() {
 			Expect(fakeVM.AttachDiskArg).To(Equal(fakeDisk))
 		})
 
+		It("returns DiskNotFound when the disk does not exist", func() {
+			fakeVM := vmfakes.NewFakeVM("vm-1")
+			vmFinder.FindResult = fakeVM
+			finder.FindResult = diskfakes.NewFakeDisk("disk-1")
+
+			err := disks.AttachDisk(apiv1.NewVMCID("vm-1"), apiv1.NewDiskCID("disk-1"))
+			Expect(err).To(MatchError("Disk 'disk-1' not found"))
+			Expect(err.(cpi.CloudError).Type()).To(Equal("Bosh::Clouds::DiskNotFound"))
+			Expect(fakeVM.AttachDiskArg).To(BeNil())
+		})
+
 		It("returns error when VM finder fails", func() {
 			vmFinder.FindErr = errors.New("vm missing")
 
@@ -130,6 +175,7 @@ var _ = Describe("Disks", func() {
 			fakeVM.AttachDiskErr = errors.New("attach failed")
 			vmFinder.FindResult = fakeVM
 			fakeDisk := diskfakes.NewFakeDisk("disk-1")
+			fakeDisk.ExistsResult = true
 			finder.FindResult = fakeDisk
 
 			err := disks.AttachDisk(apiv1.NewVMCID("vm-1"), apiv1.NewDiskCID("disk-1"))
@@ -145,6 +191,7 @@ var _ = Describe("Disks", func() {
 			fakeVM.AttachDiskHint = expectedHint
 			vmFinder.FindResult = fakeVM
 			fakeDisk := diskfakes.NewFakeDisk("disk-1")
+			fakeDisk.ExistsResult = true
 			finder.FindResult = fakeDisk
 
 			hint, err := disks.AttachDiskV2(apiv1.NewVMCID("vm-1"), apiv1.NewDiskCID("disk-1"))
@@ -156,6 +203,8 @@ var _ = Describe("Disks", func() {
 	Describe("DetachDisk", func() {
 		It("detaches the disk from the VM", func() {
 			fakeVM := vmfakes.NewFakeVM("vm-1")
+			fakeVM.ExistsResult = true
+			fakeVM.DiskIDsResult = []apiv1.DiskCID{apiv1.NewDiskCID("disk-1")}
 			vmFinder.FindResult = fakeVM
 			fakeDisk := diskfakes.NewFakeDisk("disk-1")
 			finder.FindResult = fakeDisk
@@ -165,6 +214,27 @@ var _ = Describe("Disks", func() {
 			Expect(fakeVM.DetachDiskArg).To(Equal(fakeDisk))
 		})
 
+		It("returns VMNotFound when the VM does not exist", func() {
+			vmFinder.FindResult = vmfakes.NewFakeVM("vm-1")
+			finder.FindResult = diskfakes.NewFakeDisk("disk-1")
+
+			err := disks.DetachDisk(apiv1.NewVMCID("vm-1"), apiv1.NewDiskCID("disk-1"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(cpi.CloudError).Type()).To(Equal("Bosh::Clouds::VMNotFound"))
+		})
+
+		It("returns DiskNotAttached when the disk is not attached", func() {
+			fakeVM := vmfakes.NewFakeVM("vm-1")
+			fakeVM.ExistsResult = true
+			vmFinder.FindResult = fakeVM
+			finder.FindResult = diskfakes.NewFakeDisk("disk-1")
+
+			err := disks.DetachDisk(apiv1.NewVMCID("vm-1"), apiv1.NewDiskCID("disk-1"))
+			Expect(err).To(MatchError("Disk 'disk-1' not attached to VM 'vm-1'"))
+			Expect(err.(cpi.CloudError).Type()).To(Equal("Bosh::Clouds::DiskNotAttached"))
+			Expect(fakeVM.DetachDiskArg).To(BeNil())
+		})
+
 		It("returns error when VM finder fails", func() {
 			vmFinder.FindErr = errors.New("vm missing")
 
@@ -184,6 +254,8 @@ var _ = Describe("Disks", func() {
 		It("returns error when detach fails", func() {
 			fakeVM := vmfakes.NewFakeVM("vm-1")
 			fakeVM.DetachDiskErr = errors.New("detach failed")
+			fakeVM.ExistsResult = true
+			fakeVM.DiskIDsResult = []apiv1.DiskCID{apiv1.NewDiskCID("disk-1")}
 			vmFinder.FindResult = fakeVM
 			fakeDisk := diskfakes.NewFakeDisk("disk-1")
 			finder.FindResult = fakeDisk
@@ -193,4 +265,12 @@ var _ = Describe("Disks", func() {
 			Expect(err.Error()).To(ContainSubstring("detach failed"))
 		})
 	})
+
+	Describe("ResizeDisk", func() {
+		It("is not supported", func() {
+			err := disks.ResizeDisk(apiv1.NewDiskCID("disk-1"), 2048)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(cpi.CloudError).Type()).To(Equal("Bosh::Clouds::NotSupported"))
+		})
+	})
 })
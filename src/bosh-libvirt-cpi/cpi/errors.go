@@ -0,0 +1,88 @@
+package cpi
+
+import (
+	"fmt"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+
+	"bosh-libvirt-cpi/driver"
+	bvm "bosh-libvirt-cpi/vm"
+)
+
+// The errors below are the Bosh::Clouds errors the director acts upon.
+// The rpc package reports Type and CanRetry of returned errors; other
+// errors become a generic Bosh::Clouds::CloudError.
+
+type CloudError interface {
+	error
+	Type() string
+}
+
+type RetryableError interface {
+	error
+	CanRetry() bool
+}
+
+type cloudError struct {
+	errType  string
+	message  string
+	canRetry bool
+}
+
+func (e cloudError) Error() string  { return e.message }
+func (e cloudError) Type() string   { return e.errType }
+func (e cloudError) CanRetry() bool { return e.canRetry }
+
+func NewVMNotFoundError(cid apiv1.VMCID) error {
+	return cloudError{"Bosh::Clouds::VMNotFound", fmt.Sprintf("VM '%s' not found", cid.AsString()), false}
+}
+
+func NewDiskNotFoundError(cid apiv1.DiskCID, canRetry bool) error {
+	return cloudError{"Bosh::Clouds::DiskNotFound", fmt.Sprintf("Disk '%s' not found", cid.AsString()), canRetry}
+}
+
+func NewDiskNotAttachedError(vmCID apiv1.VMCID, diskCID apiv1.DiskCID, canRetry bool) error {
+	msg := fmt.Sprintf("Disk '%s' not attached to VM '%s'", diskCID.AsString(), vmCID.AsString())
+	return cloudError{"Bosh::Clouds::DiskNotAttached", msg, canRetry}
+}
+
+func NewVMCreationFailedError(reason string, canRetry bool) error {
+	return cloudError{"Bosh::Clouds::VMCreationFailed", reason, canRetry}
+}
+
+func NewNotSupportedError(reason string) error {
+	return cloudError{"Bosh::Clouds::NotSupported", reason, false}
+}
+
+// classifyErr reports transient failures of the driver or the Runner as
+// retryable and leaves other errors alone.
+func classifyErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(CloudError); ok {
+		return err
+	}
+
+	switch driver.ClassifyError(err) {
+	case driver.ErrorClassTransient:
+		return cloudError{"Bosh::Clouds::CloudError", err.Error(), true}
+	case driver.ErrorClassNotSupported:
+		return NewNotSupportedError(err.Error())
+	default:
+		return err
+	}
+}
+
+// vmErr is like classifyErr but reports err as VMNotFound if it was
+// caused by the VM having gone away, as opposed to e.g. a missing volume.
+func vmErr(vm bvm.VM, err error) error {
+	if err != nil && driver.ClassifyError(err) == driver.ErrorClassNotFound {
+		found, existsErr := vm.Exists()
+		if existsErr == nil && !found {
+			return NewVMNotFoundError(vm.ID())
+		}
+	}
+	return classifyErr(err)
+}
@@ -2,29 +2,45 @@ package cpi
 
 import (
 	"net/url"
+	"sync"
 
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 	boshcmd "github.com/cloudfoundry/bosh-utils/fileutil"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 	boshsys "github.com/cloudfoundry/bosh-utils/system"
 	boshuuid "github.com/cloudfoundry/bosh-utils/uuid"
-	libvirt "libvirt.org/go/libvirt"
 
 	bdisk "bosh-libvirt-cpi/disk"
 	"bosh-libvirt-cpi/driver"
 	"bosh-libvirt-cpi/driver/domains"
+	"bosh-libvirt-cpi/inventory"
 	bstem "bosh-libvirt-cpi/stemcell"
 	bvm "bosh-libvirt-cpi/vm"
 )
 
 type Factory struct {
-	fs          boshsys.FileSystem
-	cmdRunner   boshsys.CmdRunner
-	uuidGen     boshuuid.Generator
-	compressor  boshcmd.Compressor
-	opts        FactoryOpts
-	logger      boshlog.Logger
-	libvirtConn driver.LibvirtConn // non-nil when conn is owned by the caller
+	fs         boshsys.FileSystem
+	cmdRunner  boshsys.CmdRunner
+	uuidGen    boshuuid.Generator
+	compressor boshcmd.Compressor
+	opts       FactoryOpts
+	logger     boshlog.Logger
+	conn       Connection // Conn is non-nil when the connection is owned by the caller
+
+	// runner is shared by the CPIs made with conn, so that e.g. the home
+	// dir is resolved once per connection
+	runner driver.Runner
+
+	// owned is the connection a Factory made by NewFactory opens on first
+	// use; Close closes it
+	owned *ownedConn
+}
+
+type ownedConn struct {
+	mu     sync.Mutex
+	conn   Connection
+	runner driver.Runner
 }
 
 var _ apiv1.CPIFactory = Factory{}
@@ -47,15 +63,19 @@ func NewFactory(
 	opts FactoryOpts,
 	logger boshlog.Logger,
 ) Factory {
-	return Factory{fs: fs, cmdRunner: cmdRunner, uuidGen: uuidGen, compressor: compressor, opts: opts, logger: logger}
+	return Factory{
+		fs: fs, cmdRunner: cmdRunner, uuidGen: uuidGen, compressor: compressor, opts: opts, logger: logger,
+		owned: &ownedConn{},
+	}
 }
 
-// NewFactoryWithConn is like NewFactory but accepts a pre-opened LibvirtConn
+// NewFactoryWithConn is like NewFactory but accepts a pre-opened Connection
 // whose lifecycle is managed by the caller. Factory.New() will use this conn
 // instead of opening its own, so the caller can defer conn.Close() to ensure
-// the connection is closed after the CPI request completes.
+// the connection is closed after the CPI request completes. A daemon serving
+// many requests uses one such Factory for all of them.
 func NewFactoryWithConn(
-	conn driver.LibvirtConn,
+	conn Connection,
 	fs boshsys.FileSystem,
 	cmdRunner boshsys.CmdRunner,
 	uuidGen boshuuid.Generator,
@@ -63,28 +83,109 @@ func NewFactoryWithConn(
 	opts FactoryOpts,
 	logger boshlog.Logger,
 ) Factory {
-	return Factory{fs: fs, cmdRunner: cmdRunner, uuidGen: uuidGen, compressor: compressor, opts: opts, logger: logger, libvirtConn: conn}
+	f := Factory{fs: fs, cmdRunner: cmdRunner, uuidGen: uuidGen, compressor: compressor, opts: opts, logger: logger, conn: conn}
+	f.runner = f.newRunner(conn)
+	return f
 }
 
-func (f Factory) New(ctx apiv1.CallContext) (apiv1.CPI, error) {
-	rawRunner := driver.RawRunner(driver.NewLocalRunner(f.fs, f.cmdRunner, f.logger))
-
-	if len(f.opts.Host) > 0 {
-		runnerOpts := driver.SSHRunnerOpts{
-			Host:       f.opts.Host,
-			Port:       f.opts.Port,
-			Username:   f.opts.Username,
-			PrivateKey: f.opts.PrivateKey,
-			HostKey:    f.opts.HostKey,
+// Close closes the connection the Factory opened itself, if any. A
+// connection passed to NewFactoryWithConn is left to the caller.
+func (f Factory) Close() error {
+	if f.owned == nil {
+		return nil
+	}
+
+	f.owned.mu.Lock()
+	defer f.owned.mu.Unlock()
+
+	if f.owned.conn.Conn == nil {
+		return nil
+	}
+
+	err := f.owned.conn.Close()
+	f.owned.conn, f.owned.runner = Connection{}, nil
+
+	return err
+}
+
+// connection returns the caller's connection, or opens one owned by the
+// Factory that later calls share until Close.
+func (f Factory) connection() (Connection, driver.Runner, error) {
+	if f.conn.Conn != nil || f.owned == nil {
+		return f.conn, f.runner, nil
+	}
+
+	f.owned.mu.Lock()
+	defer f.owned.mu.Unlock()
+
+	if f.owned.conn.Conn == nil {
+		conn, err := Connect(f.opts, f.fs, f.logger)
+		if err != nil {
+			return Connection{}, nil, err
 		}
-		rawRunner = driver.NewSSHRunner(runnerOpts, f.fs, f.logger)
+
+		f.owned.conn, f.owned.runner = conn, f.newRunner(conn)
 	}
 
-	runner := driver.NewExpandingPathRunner(rawRunner)
+	return f.owned.conn, f.owned.runner, nil
+}
+
+func (f Factory) New(ctx apiv1.CallContext) (apiv1.CPI, error) {
+	c, err := f.components(apiv1.NewStemcellAPIVersion(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return CPI{
+		NewMisc(),
+		NewStemcells(c.stemcells, c.stemcells),
+		NewVMs(c.stemcells, c.vms, c.vms, c.disks),
+		NewDisks(c.disks, c.disks, c.vms),
+		NewSnapshots(),
+	}, nil
+}
+
+// Inventory returns the resources the CPI manages on the host, for operators.
+func (f Factory) Inventory() (inventory.Inventory, error) {
+	// Only attaching disks depends on the stemcell API version
+	c, err := f.components(apiv1.StemcellAPIVersion{})
+	if err != nil {
+		return inventory.Inventory{}, err
+	}
+
+	return inventory.New(c.vms, c.disks, c.stemcells, c.driver, c.runner, f.logger), nil
+}
+
+type components struct {
+	driver driver.Driver
+	runner driver.Runner
+
+	stemcells bstem.Factory
+	disks     bdisk.Factory
+	vms       bvm.Factory
+}
+
+func (f Factory) components(stemcellAPIVersion apiv1.StemcellAPIVersion) (components, error) {
+	conn, runner, err := f.connection()
+	if err != nil {
+		return components{}, err
+	}
+
+	if conn.Conn == nil {
+		return components{}, bosherr.Error("Factory has no libvirt connection")
+	}
+
+	// Lock on the host holding the store so that every CPI process sees the same locks
+	var locker driver.Locker
+	if conn.Runner == nil {
+		locker = driver.NewFlockLocker(f.opts.LocksDir(), f.fs, f.opts.LockerOpts(), f.logger)
+	} else {
+		locker = driver.NewRunnerLocker(f.opts.LocksDir(), runner, f.opts.LockerOpts(), f.logger)
+	}
 
 	u, _ := url.Parse(f.opts.BackendURI) // already validated in Validate()
 	var domBuilder driver.DomainBuilder
-	switch u.Scheme {
+	switch backendDriver(u) {
 	case "vbox":
 		domBuilder = domains.VBoxDomainBuilder{}
 	case "lxc":
@@ -93,26 +194,16 @@ func (f Factory) New(ctx apiv1.CallContext) (apiv1.CPI, error) {
 		domBuilder = domains.QEMUDomainBuilder{}
 	}
 
-	var libvirtConn driver.LibvirtConn
-	if f.libvirtConn != nil {
-		libvirtConn = f.libvirtConn
-	} else {
-		conn, err := libvirt.NewConnect(f.opts.BackendURI)
-		if err != nil {
-			return nil, err
-		}
-		libvirtConn = driver.NewLibvirtConnImpl(conn)
-	}
-	d := driver.NewLibvirtDriver(libvirtConn, domBuilder, f.logger)
+	d := driver.NewLibvirtDriver(conn.Conn, domBuilder, f.opts.LibvirtDriverOpts(), f.logger)
 
 	stemcellsOpts := bstem.FactoryOpts{
 		DirPath: f.opts.StemcellsDir(),
 	}
 
 	stemcells := bstem.NewFactory(
-		stemcellsOpts, d, domBuilder, runner, f.fs, f.uuidGen, f.compressor, f.logger)
+		stemcellsOpts, d, domBuilder, runner, locker, f.fs, f.uuidGen, f.compressor, f.logger)
 
-	disks := bdisk.NewFactory(f.opts.DisksDir(), f.uuidGen, d, runner, f.logger)
+	disks := bdisk.NewFactory(f.opts.DisksDir(), f.uuidGen, d, runner, locker, f.logger)
 
 	vmsOpts := bvm.FactoryOpts{
 		DirPath: f.opts.VMsDir(),
@@ -120,14 +211,17 @@ func (f Factory) New(ctx apiv1.CallContext) (apiv1.CPI, error) {
 	}
 
 	vms := bvm.NewFactory(
-		vmsOpts, f.uuidGen, d, runner, domBuilder, disks,
-		f.opts.Agent, apiv1.NewStemcellAPIVersion(ctx), f.logger)
+		vmsOpts, f.uuidGen, d, runner, locker, domBuilder, disks, stemcells,
+		f.opts.Agent, stemcellAPIVersion, f.logger)
 
-	return CPI{
-		NewMisc(),
-		NewStemcells(stemcells, stemcells),
-		NewVMs(stemcells, vms, vms),
-		NewDisks(disks, disks, vms),
-		NewSnapshots(),
-	}, nil
+	return components{driver: d, runner: runner, stemcells: stemcells, disks: disks, vms: vms}, nil
+}
+
+func (f Factory) newRunner(conn Connection) driver.Runner {
+	rawRunner := conn.Runner
+	if rawRunner == nil {
+		rawRunner = driver.NewLocalRunner(f.fs, f.cmdRunner, f.logger)
+	}
+
+	return driver.NewExpandingPathRunner(rawRunner)
 }
@@ -3,25 +3,74 @@ package cpi
 import (
 	"net/url"
 	"path/filepath"
+	"strings"
+	"time"
 
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+
+	"bosh-libvirt-cpi/driver"
 )
 
 type FactoryOpts struct {
 	// Connection
-	BackendURI string // e.g. "vbox:///session", "lxc:///", "qemu:///system"
+	// BackendURI is e.g. "vbox:///session", "lxc:///", "qemu:///system".
+	// With Host set, libvirt is reached through the SSH connection to Host,
+	// so the URI needs no transport or host of its own.
+	BackendURI string
 	Host       string
 	Port       int // SSH port for remote Host connections; defaults to 22 if zero
 	Username   string
 	PrivateKey string
-	HostKey    string // SSH host public key in authorized_keys format; required when Host is set
+	HostKey    string // SSH host keys, see driver.SSHRunnerOpts; required when Host is set
+
+	// Certificate is an OpenSSH user certificate for PrivateKey.
+	Certificate string
+
+	// UseSSHAgent authenticates with the keys of the agent at $SSH_AUTH_SOCK;
+	// PrivateKey is then optional.
+	UseSSHAgent bool
+
+	// JumpHosts are bastions to reach Host through, in order.
+	JumpHosts []driver.SSHJumpHost
+
+	// CompressUploads gzips stemcell images in transit to a remote Host.
+	CompressUploads bool
+
+	// SSH timeouts in seconds; zero selects the runner's defaults
+	SSHDialTimeout       int
+	SSHCommandTimeout    int
+	SSHKeepaliveInterval int
+
+	// TLS credentials for "+tls" BackendURIs, as inline PEM like PrivateKey.
+	// The host is taken from Host unless the URI names it. TLS only replaces
+	// the SSH tunnel to libvirtd: files are still stored on a remote libvirt
+	// host over SSH, so Host and its SSH credentials are required there too.
+	CACert     string
+	ClientCert string
+	ClientKey  string
+
+	// SASL credentials, if libvirtd requires them
+	SASLUsername string
+	SASLPassword string
 
 	// Network is the libvirt network name for VM interfaces. Defaults to "default" if empty.
 	Network string
 
 	StoreDir string
 
+	// LibvirtRetryAttempts is how many times a libvirt operation is tried
+	// while it fails transiently; zero selects the driver's default.
+	LibvirtRetryAttempts int
+
+	// LibvirtRetryDelay is the pause in seconds after the first failed
+	// attempt, doubled after each further one; zero selects the driver's default.
+	LibvirtRetryDelay int
+
+	// LockTimeout is how many seconds a CPI call waits for another call
+	// changing the same VM, disk or stemcell; zero selects 15 minutes.
+	LockTimeout int
+
 	Agent apiv1.AgentOptions
 }
 
@@ -30,12 +79,28 @@ func (o FactoryOpts) Validate() error {
 		if o.Username == "" {
 			return bosherr.Error("Must provide non-empty Username")
 		}
-		if o.PrivateKey == "" {
-			return bosherr.Error("Must provide non-empty PrivateKey")
+		if o.PrivateKey == "" && !o.UseSSHAgent {
+			return bosherr.Error("Must provide non-empty PrivateKey unless UseSSHAgent is set")
+		}
+		if len(o.Certificate) > 0 && o.PrivateKey == "" {
+			return bosherr.Error("Certificate requires PrivateKey")
 		}
 		if o.HostKey == "" {
 			return bosherr.Error("Must provide non-empty HostKey when Host is set")
 		}
+		if o.SSHDialTimeout < 0 || o.SSHCommandTimeout < 0 || o.SSHKeepaliveInterval < 0 {
+			return bosherr.Error("SSH timeouts must not be negative")
+		}
+		for i, jump := range o.JumpHosts {
+			if jump.Host == "" || jump.Username == "" || jump.HostKey == "" {
+				return bosherr.Errorf("Must provide non-empty Host, Username and HostKey for jump host %d", i)
+			}
+			if jump.PrivateKey == "" && !o.UseSSHAgent {
+				return bosherr.Errorf("Must provide non-empty PrivateKey for jump host %d unless UseSSHAgent is set", i)
+			}
+		}
+	} else if len(o.JumpHosts) > 0 {
+		return bosherr.Error("JumpHosts require Host")
 	}
 
 	if o.BackendURI == "" {
@@ -47,17 +112,54 @@ func (o FactoryOpts) Validate() error {
 		return bosherr.WrapError(err, "Parsing BackendURI")
 	}
 
-	switch u.Scheme {
+	switch backendDriver(u) {
 	case "vbox", "lxc", "qemu":
 		// valid
 	default:
 		return bosherr.Errorf("Unsupported BackendURI scheme '%s': expected 'vbox', 'lxc', or 'qemu'", u.Scheme)
 	}
 
+	switch backendTransport(u) {
+	case "", "unix", "ssh":
+		if len(o.CACert) > 0 || len(o.ClientCert) > 0 || len(o.ClientKey) > 0 {
+			return bosherr.Error("CACert, ClientCert and ClientKey require a '+tls' BackendURI")
+		}
+	case "tls":
+		if o.CACert == "" || o.ClientCert == "" || o.ClientKey == "" {
+			return bosherr.Error("Must provide non-empty CACert, ClientCert and ClientKey for a '+tls' BackendURI")
+		}
+	default:
+		return bosherr.Errorf("Unsupported BackendURI transport '%s': expected 'unix', 'ssh', or 'tls'", backendTransport(u))
+	}
+
+	if (len(o.SASLUsername) > 0) != (len(o.SASLPassword) > 0) {
+		return bosherr.Error("SASLUsername and SASLPassword must be provided together")
+	}
+
+	// Files are stored on Host, so libvirt has to run there too
+	if hostname := u.Hostname(); len(hostname) > 0 {
+		if len(o.Host) == 0 {
+			return bosherr.Errorf(
+				"BackendURI points at host '%s' but Host is not set: SSH access to the libvirt host is required to store files there",
+				hostname)
+		}
+		if !strings.EqualFold(hostname, o.Host) {
+			return bosherr.Errorf("BackendURI host '%s' does not match Host '%s'", hostname, o.Host)
+		}
+	}
+
 	if o.StoreDir == "" {
 		return bosherr.Error("Must provide non-empty StoreDir")
 	}
 
+	if o.LockTimeout < 0 {
+		return bosherr.Error("LockTimeout must not be negative")
+	}
+
+	if o.LibvirtRetryAttempts < 0 || o.LibvirtRetryDelay < 0 {
+		return bosherr.Error("LibvirtRetryAttempts and LibvirtRetryDelay must not be negative")
+	}
+
 	err = o.Agent.Validate()
 	if err != nil {
 		return bosherr.WrapError(err, "Validating Agent configuration")
@@ -66,6 +168,47 @@ func (o FactoryOpts) Validate() error {
 	return nil
 }
 
+func (o FactoryOpts) SSHRunnerOpts() driver.SSHRunnerOpts {
+	return driver.SSHRunnerOpts{
+		Host:       o.Host,
+		Port:       o.Port,
+		Username:   o.Username,
+		PrivateKey: o.PrivateKey,
+		HostKey:    o.HostKey,
+		Compress:   o.CompressUploads,
+
+		Certificate: o.Certificate,
+		UseAgent:    o.UseSSHAgent,
+		JumpHosts:   o.JumpHosts,
+
+		DialTimeout:       time.Duration(o.SSHDialTimeout) * time.Second,
+		CommandTimeout:    time.Duration(o.SSHCommandTimeout) * time.Second,
+		KeepaliveInterval: time.Duration(o.SSHKeepaliveInterval) * time.Second,
+	}
+}
+
+func (o FactoryOpts) LibvirtDriverOpts() driver.LibvirtDriverOpts {
+	return driver.LibvirtDriverOpts{
+		RetryAttempts: o.LibvirtRetryAttempts,
+		RetryDelay:    time.Duration(o.LibvirtRetryDelay) * time.Second,
+	}
+}
+
+// TLSBackendURI returns BackendURI pointing libvirt at the certificates in pkiDir.
+func (o FactoryOpts) TLSBackendURI(pkiDir string) string {
+	u, _ := url.Parse(o.BackendURI) // already validated in Validate()
+
+	if len(u.Host) == 0 {
+		u.Host = o.Host
+	}
+
+	query := u.Query()
+	query.Set("pkipath", pkiDir)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
 func (o FactoryOpts) StemcellsDir() string {
 	return filepath.Join(o.StoreDir, "stemcells")
 }
@@ -77,3 +220,23 @@ func (o FactoryOpts) VMsDir() string {
 func (o FactoryOpts) DisksDir() string {
 	return filepath.Join(o.StoreDir, "disks")
 }
+
+func (o FactoryOpts) LocksDir() string {
+	return filepath.Join(o.StoreDir, "locks")
+}
+
+func (o FactoryOpts) LockerOpts() driver.LockerOpts {
+	return driver.LockerOpts{Timeout: time.Duration(o.LockTimeout) * time.Second}
+}
+
+// backendDriver returns the hypervisor driver of a libvirt URI, e.g. "qemu" for "qemu+ssh://host/system".
+func backendDriver(u *url.URL) string {
+	driver, _, _ := strings.Cut(u.Scheme, "+")
+	return driver
+}
+
+// backendTransport returns the transport of a libvirt URI, e.g. "ssh" for "qemu+ssh://host/system".
+func backendTransport(u *url.URL) string {
+	_, transport, _ := strings.Cut(u.Scheme, "+")
+	return transport
+}
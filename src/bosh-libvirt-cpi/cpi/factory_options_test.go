@@ -1,12 +1,15 @@
 package cpi_test
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 
 	"bosh-libvirt-cpi/cpi"
+	"bosh-libvirt-cpi/driver"
 )
 
 var _ = Describe("FactoryOpts", func() {
@@ -45,11 +48,74 @@ var _ = Describe("FactoryOpts", func() {
 			Expect(err.Error()).To(ContainSubstring("BackendURI"))
 		})
 
-		It("returns error for qemu+ssh URI scheme (not yet supported)", func() {
+		It("returns error for a remote BackendURI without Host", func() {
 			opts.BackendURI = "qemu+ssh://user@remote/system"
 			err := opts.Validate()
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("Unsupported BackendURI scheme"))
+			Expect(err.Error()).To(ContainSubstring("Host is not set"))
+		})
+
+		It("returns error for a TLS BackendURI naming a host without Host", func() {
+			opts.BackendURI = "qemu+tls://libvirt-host/system"
+			opts.CACert, opts.ClientCert, opts.ClientKey = "ca", "cert", "key"
+
+			err := opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("SSH access to the libvirt host is required"))
+		})
+
+		It("returns error for unsupported transports", func() {
+			opts.BackendURI = "qemu+ext:///system"
+			err := opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Unsupported BackendURI transport"))
+		})
+
+		Context("with a TLS BackendURI", func() {
+			BeforeEach(func() {
+				opts.BackendURI = "qemu+tls:///system"
+				opts.CACert = "ca"
+				opts.ClientCert = "cert"
+				opts.ClientKey = "key"
+			})
+
+			It("succeeds with CA, client cert and key", func() {
+				Expect(opts.Validate()).ToNot(HaveOccurred())
+			})
+
+			It("returns error when a certificate is missing", func() {
+				opts.ClientKey = ""
+
+				err := opts.Validate()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("ClientKey"))
+			})
+
+			It("returns error when SASL password is missing", func() {
+				opts.SASLUsername = "admin"
+
+				err := opts.Validate()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("SASLPassword"))
+			})
+
+			It("points the URI at Host and the PKI dir", func() {
+				opts.Host = "remote.example.com"
+				Expect(opts.TLSBackendURI("/tmp/pki")).To(Equal("qemu+tls://remote.example.com/system?pkipath=%2Ftmp%2Fpki"))
+			})
+
+			It("keeps the host and port named by the URI", func() {
+				opts.BackendURI = "qemu+tls://remote.example.com:16515/system"
+				Expect(opts.TLSBackendURI("/tmp/pki")).To(Equal("qemu+tls://remote.example.com:16515/system?pkipath=%2Ftmp%2Fpki"))
+			})
+		})
+
+		It("returns error for certificates without a TLS BackendURI", func() {
+			opts.CACert = "ca"
+
+			err := opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("'+tls' BackendURI"))
 		})
 
 		It("returns error when scheme is unknown", func() {
@@ -68,6 +134,22 @@ var _ = Describe("FactoryOpts", func() {
 			Expect(err.Error()).To(ContainSubstring("StoreDir"))
 		})
 
+		It("returns error for a negative LockTimeout", func() {
+			opts.LockTimeout = -1
+
+			err := opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("LockTimeout"))
+		})
+
+		It("returns error for negative libvirt retry settings", func() {
+			opts.LibvirtRetryDelay = -1
+
+			err := opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("LibvirtRetryDelay"))
+		})
+
 		It("returns error when Agent options invalid", func() {
 			opts.Agent = apiv1.AgentOptions{}
 
@@ -116,6 +198,70 @@ var _ = Describe("FactoryOpts", func() {
 
 				Expect(opts.Validate()).ToNot(HaveOccurred())
 			})
+
+			Context("with valid SSH options", func() {
+				BeforeEach(func() {
+					opts.Username = "user"
+					opts.PrivateKey = "key"
+					opts.HostKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAA..."
+				})
+
+				It("succeeds when BackendURI points at Host", func() {
+					opts.BackendURI = "qemu+ssh://user@Remote.example.com/system"
+					Expect(opts.Validate()).ToNot(HaveOccurred())
+				})
+
+				It("returns error for negative SSH timeouts", func() {
+					opts.SSHCommandTimeout = -1
+
+					err := opts.Validate()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("SSH timeouts"))
+				})
+
+				It("converts SSH timeouts to runner durations", func() {
+					opts.SSHDialTimeout = 10
+					opts.SSHCommandTimeout = 600
+
+					runnerOpts := opts.SSHRunnerOpts()
+					Expect(runnerOpts.DialTimeout).To(Equal(10 * time.Second))
+					Expect(runnerOpts.CommandTimeout).To(Equal(10 * time.Minute))
+					Expect(runnerOpts.KeepaliveInterval).To(BeZero())
+				})
+
+				It("allows PrivateKey to be empty when UseSSHAgent is set", func() {
+					opts.PrivateKey = ""
+					opts.UseSSHAgent = true
+
+					Expect(opts.Validate()).ToNot(HaveOccurred())
+				})
+
+				It("returns error for a Certificate without PrivateKey", func() {
+					opts.PrivateKey = ""
+					opts.UseSSHAgent = true
+					opts.Certificate = "ssh-ed25519-cert-v01@openssh.com AAAA..."
+
+					err := opts.Validate()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("Certificate requires PrivateKey"))
+				})
+
+				It("returns error for incomplete jump hosts", func() {
+					opts.JumpHosts = []driver.SSHJumpHost{{Host: "bastion.example.com", Username: "jump", PrivateKey: "key"}}
+
+					err := opts.Validate()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("jump host 0"))
+				})
+
+				It("returns error when BackendURI points at another host", func() {
+					opts.BackendURI = "qemu+ssh://user@other.example.com/system"
+
+					err := opts.Validate()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("does not match Host"))
+				})
+			})
 		})
 	})
 
@@ -135,5 +281,20 @@ var _ = Describe("FactoryOpts", func() {
 		It("returns DisksDir under StoreDir", func() {
 			Expect(opts.DisksDir()).To(Equal("/store/disks"))
 		})
+
+		It("returns LocksDir under StoreDir", func() {
+			Expect(opts.LocksDir()).To(Equal("/store/locks"))
+		})
+
+		It("converts LockTimeout to a locker duration", func() {
+			opts.LockTimeout = 60
+			Expect(opts.LockerOpts().Timeout).To(Equal(time.Minute))
+		})
+
+		It("converts the libvirt retry settings to driver options", func() {
+			opts.LibvirtRetryAttempts = 3
+			opts.LibvirtRetryDelay = 2
+			Expect(opts.LibvirtDriverOpts()).To(Equal(driver.LibvirtDriverOpts{RetryAttempts: 3, RetryDelay: 2 * time.Second}))
+		})
 	})
 })
@@ -2,6 +2,8 @@ package cpi
 
 import (
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+
+	bstem "bosh-libvirt-cpi/stemcell"
 )
 
 type Misc struct{}
@@ -12,6 +14,6 @@ func NewMisc() Misc {
 
 func (m Misc) Info() (apiv1.Info, error) {
 	return apiv1.Info{
-		StemcellFormats: []string{"general-ovf", "vsphere-ovf"},
+		StemcellFormats: append(append([]string{}, bstem.SupportedFormats...), bstem.LightStemcellFormat),
 	}, nil
 }
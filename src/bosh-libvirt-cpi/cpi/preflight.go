@@ -0,0 +1,259 @@
+package cpi
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+
+	"bosh-libvirt-cpi/driver"
+)
+
+const (
+	defaultNetwork = "default"
+
+	preflightFileName = ".preflight"
+)
+
+// hostBinaries are the commands the CPI runs on the host.
+var hostBinaries = []string{"qemu-img", "cp", "ln", "mv", "rm", "mkdir", "stat", "dd", "df"}
+
+// PreflightOpts selects the checks that depend on the deployment rather
+// than on the CPI's config.
+type PreflightOpts struct {
+	// StoragePools are the libvirt pools that cloud properties refer to.
+	StoragePools []string
+
+	// MinFreeMB is the space StoreDir needs; zero only reports it.
+	MinFreeMB int
+}
+
+// PreflightResult is the outcome of one check; it passed if Err is nil.
+type PreflightResult struct {
+	Check  string
+	Detail string
+	Err    error
+}
+
+// Preflight connects to the host as CPI calls do and checks that it can
+// run VMs, so that a misconfiguration shows up before a deployment does.
+// The checks that need a connection are skipped if connecting fails.
+// A connection the Factory opens stays open until Close.
+func (f Factory) Preflight(popts PreflightOpts) []PreflightResult {
+	var results []PreflightResult
+
+	if len(f.opts.Host) > 0 {
+		result := PreflightResult{Check: "ssh", Detail: f.opts.Username + "@" + f.opts.Host}
+
+		runner := driver.NewSSHRunner(f.opts.SSHRunnerOpts(), f.fs, f.logger)
+		_, _, result.Err = runner.Execute("true")
+		_ = runner.Close()
+
+		results = append(results, result)
+		if result.Err != nil {
+			return results
+		}
+	}
+
+	conn, runner, err := f.connection()
+	results = append(results, PreflightResult{Check: "libvirt", Detail: f.opts.BackendURI, Err: err})
+	if err != nil {
+		return results
+	}
+
+	d := driver.NewLibvirtDriver(conn.Conn, nil, f.opts.LibvirtDriverOpts(), f.logger)
+
+	checks := NewHostChecks(f.opts, popts, d, runner)
+
+	return append(results, checks.Run()...)
+}
+
+// HostChecks checks a connected host.
+type HostChecks struct {
+	opts  FactoryOpts
+	popts PreflightOpts
+
+	driver driver.Driver
+	runner driver.Runner
+}
+
+func NewHostChecks(opts FactoryOpts, popts PreflightOpts, driver driver.Driver, runner driver.Runner) HostChecks {
+	return HostChecks{opts: opts, popts: popts, driver: driver, runner: runner}
+}
+
+// Run runs every check, including those after a failed one.
+func (c HostChecks) Run() []PreflightResult {
+	results := []PreflightResult{c.checkBackend(), c.checkNetwork()}
+
+	for _, pool := range c.popts.StoragePools {
+		results = append(results, c.checkStoragePool(pool))
+	}
+
+	return append(results, c.checkStoreDir(), c.checkBinaries(), c.checkFreeSpace())
+}
+
+// checkBackend looks for the domain type the CPI defines domains with,
+// e.g. "kvm", which libvirt only offers if the host supports it.
+func (c HostChecks) checkBackend() PreflightResult {
+	u, _ := url.Parse(c.opts.BackendURI) // already validated in Validate()
+
+	domainType := backendDriver(u)
+	if domainType == "qemu" {
+		domainType = "kvm"
+	}
+
+	result := PreflightResult{Check: "backend", Detail: domainType}
+
+	capsXML, err := c.driver.Capabilities()
+	if err != nil {
+		result.Err = bosherr.WrapError(err, "Getting host capabilities")
+		return result
+	}
+
+	var caps struct {
+		Guests []struct {
+			Arch struct {
+				Name    string `xml:"name,attr"`
+				Domains []struct {
+					Type string `xml:"type,attr"`
+				} `xml:"domain"`
+			} `xml:"arch"`
+		} `xml:"guest"`
+	}
+
+	err = xml.Unmarshal([]byte(capsXML), &caps)
+	if err != nil {
+		result.Err = bosherr.WrapError(err, "Parsing host capabilities")
+		return result
+	}
+
+	for _, guest := range caps.Guests {
+		for _, domain := range guest.Arch.Domains {
+			if domain.Type == domainType {
+				result.Detail += " on " + guest.Arch.Name
+				return result
+			}
+		}
+	}
+
+	result.Err = bosherr.Errorf("Host offers no '%s' domains", domainType)
+	return result
+}
+
+func (c HostChecks) checkNetwork() PreflightResult {
+	network := c.opts.Network
+	if network == "" {
+		network = defaultNetwork
+	}
+
+	active, err := c.driver.NetworkActive(network)
+	if err == nil && !active {
+		err = bosherr.Errorf("Network '%s' is not active", network)
+	}
+
+	return PreflightResult{Check: "network", Detail: network, Err: err}
+}
+
+func (c HostChecks) checkStoragePool(pool string) PreflightResult {
+	active, err := c.driver.StoragePoolActive(pool)
+	if err == nil && !active {
+		err = bosherr.Errorf("Storage pool '%s' is not active", pool)
+	}
+
+	return PreflightResult{Check: "storage pool", Detail: pool, Err: err}
+}
+
+func (c HostChecks) checkStoreDir() PreflightResult {
+	result := PreflightResult{Check: "store dir", Detail: c.opts.StoreDir}
+
+	// Only report a missing dir: creating it here would hide a mistyped StoreDir
+	stat, err := c.runner.Stat(c.opts.StoreDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			result.Err = bosherr.Errorf("Store dir '%s' does not exist", c.opts.StoreDir)
+		} else {
+			result.Err = bosherr.WrapErrorf(err, "Checking '%s'", c.opts.StoreDir)
+		}
+		return result
+	}
+
+	if !stat.IsDir() {
+		result.Err = bosherr.Errorf("Store dir '%s' is not a directory", c.opts.StoreDir)
+		return result
+	}
+
+	path := filepath.Join(c.opts.StoreDir, preflightFileName)
+
+	err = c.runner.Put(path, []byte{})
+	if err == nil {
+		err = c.runner.Remove(path)
+	}
+	if err != nil {
+		result.Err = bosherr.WrapErrorf(err, "Writing to '%s'", c.opts.StoreDir)
+	}
+
+	return result
+}
+
+func (c HostChecks) checkBinaries() PreflightResult {
+	var missing []string
+
+	for _, bin := range hostBinaries {
+		_, _, err := c.runner.Execute("sh", "-c", "command -v "+bin)
+		if err != nil {
+			missing = append(missing, bin)
+		}
+	}
+
+	result := PreflightResult{Check: "host binaries", Detail: strings.Join(hostBinaries, ", ")}
+
+	if len(missing) > 0 {
+		result.Err = bosherr.Errorf("Missing on the host: %s", strings.Join(missing, ", "))
+	}
+
+	return result
+}
+
+func (c HostChecks) checkFreeSpace() PreflightResult {
+	result := PreflightResult{Check: "free space"}
+
+	freeMB, err := c.freeMB(c.opts.StoreDir)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Detail = fmt.Sprintf("%d MB free in '%s'", freeMB, c.opts.StoreDir)
+
+	if freeMB < c.popts.MinFreeMB {
+		result.Err = bosherr.Errorf("Need at least %d MB free in '%s'", c.popts.MinFreeMB, c.opts.StoreDir)
+	}
+
+	return result
+}
+
+func (c HostChecks) freeMB(dir string) (int, error) {
+	output, _, err := c.runner.Execute("df", "-Pk", dir)
+	if err != nil {
+		return 0, bosherr.WrapErrorf(err, "Checking free space in '%s'", dir)
+	}
+
+	// The line after the header is: filesystem, blocks, used, available, capacity, mount point
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) >= 2 {
+		fields := strings.Fields(lines[1])
+		if len(fields) >= 4 {
+			availableKB, err := strconv.Atoi(fields[3])
+			if err == nil {
+				return availableKB / 1024, nil
+			}
+		}
+	}
+
+	return 0, bosherr.Errorf("Unexpected df output for '%s': '%s'", dir, output)
+}
@@ -0,0 +1,111 @@
+package cpi_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bosh-libvirt-cpi/cpi"
+	driverfakes "bosh-libvirt-cpi/driver/fakes"
+)
+
+var _ = Describe("HostChecks", func() {
+	var (
+		drv    *driverfakes.FakeDriver
+		runner *driverfakes.FakeRunner
+		opts   cpi.FactoryOpts
+		popts  cpi.PreflightOpts
+	)
+
+	BeforeEach(func() {
+		drv = &driverfakes.FakeDriver{
+			CapabilitiesResult: `<capabilities><guest><arch name='x86_64'>` +
+				`<domain type='qemu'/><domain type='kvm'/></arch></guest></capabilities>`,
+			NetworkActiveResult:     true,
+			StoragePoolActiveResult: true,
+		}
+		runner = &driverfakes.FakeRunner{
+			ExecuteOutputs: map[string]string{
+				"df -Pk /store": "Filesystem 1024-blocks Used Available Capacity Mounted on\n" +
+					"/dev/sda1 104857600 52428800 52428800 50% /\n",
+			},
+			MkdirAllCalls: []string{"/store"},
+		}
+		opts = cpi.FactoryOpts{BackendURI: "qemu:///system", StoreDir: "/store"}
+		popts = cpi.PreflightOpts{StoragePools: []string{"images"}, MinFreeMB: 10240}
+	})
+
+	run := func() map[string]cpi.PreflightResult {
+		results := map[string]cpi.PreflightResult{}
+		for _, result := range cpi.NewHostChecks(opts, popts, drv, runner).Run() {
+			results[result.Check] = result
+		}
+		return results
+	}
+
+	It("passes on a host that can run VMs", func() {
+		results := run()
+		Expect(results).To(HaveLen(6))
+
+		for _, result := range results {
+			Expect(result.Err).ToNot(HaveOccurred(), result.Check)
+		}
+
+		Expect(results["backend"].Detail).To(Equal("kvm on x86_64"))
+		Expect(results["free space"].Detail).To(Equal("51200 MB free in '/store'"))
+		Expect(drv.NetworkActiveName).To(Equal("default"))
+		Expect(drv.StoragePoolActiveName).To(Equal("images"))
+		Expect(runner.RemoveCalls).To(Equal([]string{"/store/.preflight"}))
+		Expect(runner.MkdirAllCalls).To(Equal([]string{"/store"}))
+	})
+
+	It("fails the backend check when the host cannot run the backend's domains", func() {
+		drv.CapabilitiesResult = `<capabilities><guest><arch name='x86_64'><domain type='qemu'/></arch></guest></capabilities>`
+
+		Expect(run()["backend"].Err).To(MatchError(ContainSubstring("no 'kvm' domains")))
+	})
+
+	It("fails the network and pool checks when they are missing or inactive", func() {
+		opts.Network = "bosh"
+		drv.NetworkActiveErr = errors.New("fake-network-err")
+		drv.StoragePoolActiveResult = false
+
+		results := run()
+		Expect(results["network"].Err).To(MatchError("fake-network-err"))
+		Expect(results["network"].Detail).To(Equal("bosh"))
+		Expect(results["storage pool"].Err).To(MatchError(ContainSubstring("not active")))
+	})
+
+	It("fails the store dir check when it cannot write there", func() {
+		runner.PutErr = errors.New("fake-put-err")
+
+		Expect(run()["store dir"].Err).To(MatchError(ContainSubstring("fake-put-err")))
+	})
+
+	It("fails the store dir check without creating it when it does not exist", func() {
+		runner.MkdirAllCalls = nil
+
+		Expect(run()["store dir"].Err).To(MatchError(ContainSubstring("Store dir '/store' does not exist")))
+		Expect(runner.MkdirAllCalls).To(BeEmpty())
+		Expect(runner.PutContents).To(BeEmpty())
+	})
+
+	It("fails the store dir check when it cannot be checked", func() {
+		runner.StatErr = errors.New("fake-stat-err")
+
+		Expect(run()["store dir"].Err).To(MatchError(ContainSubstring("fake-stat-err")))
+	})
+
+	It("fails the binaries check when commands are missing", func() {
+		runner.ExecuteErr = errors.New("fake-exec-err")
+
+		Expect(run()["host binaries"].Err).To(MatchError(ContainSubstring("qemu-img")))
+	})
+
+	It("fails the free space check below the minimum", func() {
+		popts.MinFreeMB = 100000
+
+		Expect(run()["free space"].Err).To(MatchError(ContainSubstring("Need at least 100000 MB")))
+	})
+})
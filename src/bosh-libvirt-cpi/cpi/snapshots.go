@@ -10,8 +10,9 @@ func NewSnapshots() Snapshots {
 	return Snapshots{}
 }
 
+// SnapshotDisk is not supported by any backend, so the director skips snapshots.
 func (s Snapshots) SnapshotDisk(cid apiv1.DiskCID, meta apiv1.DiskMeta) (apiv1.SnapshotCID, error) {
-	return apiv1.SnapshotCID{}, nil
+	return apiv1.SnapshotCID{}, NewNotSupportedError("Disk snapshots are not supported")
 }
 
 func (s Snapshots) DeleteSnapshot(cid apiv1.SnapshotCID) error {
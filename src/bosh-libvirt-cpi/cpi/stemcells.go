@@ -17,11 +17,26 @@ func NewStemcells(importer bstem.Importer, finder bstem.Finder) Stemcells {
 }
 
 func (a Stemcells) CreateStemcell(
-	imagePath string, _ apiv1.StemcellCloudProps) (apiv1.StemcellCID, error) {
+	imagePath string, cloudProps apiv1.StemcellCloudProps) (apiv1.StemcellCID, error) {
+
+	props, err := bstem.NewStemcellProps(cloudProps)
+	if err != nil {
+		return apiv1.StemcellCID{}, bosherr.WrapError(err, "Parsing stemcell cloud properties")
+	}
+
+	// Light stemcells carry no image; their properties point at one on the host
+	if props.IsLight() {
+		stemcell, err := a.importer.ImportFromReference(props)
+		if err != nil {
+			return apiv1.StemcellCID{}, classifyErr(bosherr.WrapError(err, "Importing light stemcell"))
+		}
+
+		return stemcell.ID(), nil
+	}
 
 	stemcell, err := a.importer.ImportFromPath(imagePath)
 	if err != nil {
-		return apiv1.StemcellCID{}, bosherr.WrapErrorf(err, "Importing stemcell from '%s'", imagePath)
+		return apiv1.StemcellCID{}, classifyErr(bosherr.WrapErrorf(err, "Importing stemcell from '%s'", imagePath))
 	}
 
 	return stemcell.ID(), nil
@@ -35,7 +50,7 @@ func (a Stemcells) DeleteStemcell(cid apiv1.StemcellCID) error {
 
 	err = stemcell.Delete()
 	if err != nil {
-		return bosherr.WrapErrorf(err, "Deleting stemcell '%s'", cid)
+		return classifyErr(bosherr.WrapErrorf(err, "Deleting stemcell '%s'", cid))
 	}
 
 	return nil
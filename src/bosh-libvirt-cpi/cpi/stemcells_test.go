@@ -1,6 +1,7 @@
 package cpi_test
 
 import (
+	"encoding/json"
 	"errors"
 
 	. "github.com/onsi/ginkgo"
@@ -9,6 +10,7 @@ import (
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 
 	"bosh-libvirt-cpi/cpi"
+	bstem "bosh-libvirt-cpi/stemcell"
 	stemcellfakes "bosh-libvirt-cpi/stemcell/fakes"
 )
 
@@ -19,6 +21,8 @@ var _ = Describe("Stemcells", func() {
 		stemcells cpi.Stemcells
 	)
 
+	noProps := apiv1.CloudPropsImpl{RawMessage: json.RawMessage(`{}`)}
+
 	BeforeEach(func() {
 		importer = &stemcellfakes.FakeImporter{}
 		finder = &stemcellfakes.FakeStemcellFinder{}
@@ -30,16 +34,35 @@ var _ = Describe("Stemcells", func() {
 			fakeStemcell := stemcellfakes.NewFakeStemcell("sc-123")
 			importer.ImportResult = fakeStemcell
 
-			cid, err := stemcells.CreateStemcell("/path/to/image", apiv1.CloudPropsImpl{})
+			cid, err := stemcells.CreateStemcell("/path/to/image", noProps)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(cid.AsString()).To(Equal("sc-123"))
 			Expect(importer.ImportFromPathArg).To(Equal("/path/to/image"))
 		})
 
+		It("imports light stemcells from the referenced image", func() {
+			importer.ImportResult = stemcellfakes.NewFakeStemcell("sc-light")
+			props := apiv1.CloudPropsImpl{RawMessage: json.RawMessage(`{"pool":"images","volume":"ubuntu-jammy"}`)}
+
+			cid, err := stemcells.CreateStemcell("/path/to/image", props)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cid.AsString()).To(Equal("sc-light"))
+			Expect(importer.ImportFromReferenceArg).To(Equal(&bstem.StemcellProps{Pool: "images", Volume: "ubuntu-jammy"}))
+			Expect(importer.ImportFromPathArg).To(BeEmpty())
+		})
+
+		It("returns error for invalid cloud properties", func() {
+			props := apiv1.CloudPropsImpl{RawMessage: json.RawMessage(`{"image_path":"relative.qcow2"}`)}
+
+			_, err := stemcells.CreateStemcell("/path/to/image", props)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("must be an absolute path"))
+		})
+
 		It("returns error when import fails", func() {
 			importer.ImportErr = errors.New("import failed")
 
-			_, err := stemcells.CreateStemcell("/path/to/image", apiv1.CloudPropsImpl{})
+			_, err := stemcells.CreateStemcell("/path/to/image", noProps)
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("import failed"))
 		})
@@ -4,6 +4,8 @@ import (
 	"github.com/cloudfoundry/bosh-cpi-go/apiv1"
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 
+	bdisk "bosh-libvirt-cpi/disk"
+	"bosh-libvirt-cpi/driver"
 	bstem "bosh-libvirt-cpi/stemcell"
 	bvm "bosh-libvirt-cpi/vm"
 )
@@ -12,10 +14,11 @@ type VMs struct {
 	stemcellFinder bstem.Finder
 	creator        bvm.Creator
 	finder         bvm.Finder
+	diskFinder     bdisk.Finder
 }
 
-func NewVMs(stemcellFinder bstem.Finder, creator bvm.Creator, finder bvm.Finder) VMs {
-	return VMs{stemcellFinder, creator, finder}
+func NewVMs(stemcellFinder bstem.Finder, creator bvm.Creator, finder bvm.Finder, diskFinder bdisk.Finder) VMs {
+	return VMs{stemcellFinder, creator, finder, diskFinder}
 }
 
 func (a VMs) CreateVM(
@@ -30,21 +33,51 @@ func (a VMs) CreateVM(
 func (a VMs) CreateVMV2(
 	agentID apiv1.AgentID, stemcellCID apiv1.StemcellCID,
 	cloudProps apiv1.VMCloudProps, networks apiv1.Networks,
-	_ []apiv1.DiskCID, env apiv1.VMEnv) (apiv1.VMCID, apiv1.Networks, error) {
+	diskCIDs []apiv1.DiskCID, env apiv1.VMEnv) (apiv1.VMCID, apiv1.Networks, error) {
 
 	stemcell, err := a.stemcellFinder.Find(stemcellCID)
 	if err != nil {
-		return apiv1.VMCID{}, networks, bosherr.WrapErrorf(err, "Finding stemcell '%s'", stemcellCID)
+		return apiv1.VMCID{}, networks, classifyErr(bosherr.WrapErrorf(err, "Finding stemcell '%s'", stemcellCID))
 	}
 
-	vm, err := a.creator.Create(agentID, stemcell, cloudProps, networks, env)
+	disks, err := a.findDisks(diskCIDs)
 	if err != nil {
-		return apiv1.VMCID{}, networks, bosherr.WrapErrorf(err, "Creating VM with agent ID '%s'", agentID)
+		return apiv1.VMCID{}, networks, classifyErr(err)
+	}
+
+	vm, err := a.creator.Create(agentID, stemcell, cloudProps, networks, disks, env)
+	if err != nil {
+		err = bosherr.WrapErrorf(err, "Creating VM with agent ID '%s'", agentID)
+		return apiv1.VMCID{}, networks, NewVMCreationFailedError(err.Error(), driver.ClassifyError(err) == driver.ErrorClassTransient)
 	}
 
 	return vm.ID(), networks, nil
 }
 
+// findDisks resolves the persistent disks a VM is created with,
+// failing before anything is created if one of them is missing.
+func (a VMs) findDisks(cids []apiv1.DiskCID) ([]bdisk.Disk, error) {
+	var disks []bdisk.Disk
+
+	for _, cid := range cids {
+		disk, err := a.diskFinder.Find(cid)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Finding disk '%s'", cid.AsString())
+		}
+
+		found, err := disk.Exists()
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Checking disk '%s'", cid.AsString())
+		} else if !found {
+			return nil, NewDiskNotFoundError(cid, false)
+		}
+
+		disks = append(disks, disk)
+	}
+
+	return disks, nil
+}
+
 func (a VMs) DeleteVM(cid apiv1.VMCID) error {
 	vm, err := a.finder.Find(cid)
 	if err != nil {
@@ -53,7 +86,7 @@ func (a VMs) DeleteVM(cid apiv1.VMCID) error {
 
 	err = vm.Delete()
 	if err != nil {
-		return bosherr.WrapErrorf(err, "Deleting vm '%s'", cid)
+		return classifyErr(bosherr.WrapErrorf(err, "Deleting vm '%s'", cid))
 	}
 
 	return nil
@@ -65,7 +98,15 @@ func (a VMs) SetVMMetadata(cid apiv1.VMCID, metadata apiv1.VMMeta) error {
 		return bosherr.WrapErrorf(err, "Finding VM '%s'", cid)
 	}
 
-	return vm.SetMetadata(metadata)
+	// Metadata only goes to the store, which would not notice a missing VM
+	found, err := vm.Exists()
+	if err != nil {
+		return classifyErr(err)
+	} else if !found {
+		return NewVMNotFoundError(cid)
+	}
+
+	return classifyErr(vm.SetMetadata(metadata))
 }
 
 func (a VMs) HasVM(cid apiv1.VMCID) (bool, error) {
@@ -74,7 +115,8 @@ func (a VMs) HasVM(cid apiv1.VMCID) (bool, error) {
 		return false, bosherr.WrapErrorf(err, "Finding VM '%s'", cid)
 	}
 
-	return vm.Exists()
+	found, err := vm.Exists()
+	return found, classifyErr(err)
 }
 
 func (a VMs) RebootVM(cid apiv1.VMCID) error {
@@ -83,7 +125,7 @@ func (a VMs) RebootVM(cid apiv1.VMCID) error {
 		return bosherr.WrapErrorf(err, "Finding VM '%s'", cid)
 	}
 
-	return vm.Reboot()
+	return vmErr(vm, vm.Reboot())
 }
 
 func (a VMs) GetDisks(cid apiv1.VMCID) ([]apiv1.DiskCID, error) {
@@ -92,7 +134,8 @@ func (a VMs) GetDisks(cid apiv1.VMCID) ([]apiv1.DiskCID, error) {
 		return nil, bosherr.WrapErrorf(err, "Finding VM '%s'", cid)
 	}
 
-	return vm.DiskIDs()
+	ids, err := vm.DiskIDs()
+	return ids, classifyErr(err)
 }
 
 func (a VMs) CalculateVMCloudProperties(res apiv1.VMResources) (apiv1.VMCloudProps, error) {
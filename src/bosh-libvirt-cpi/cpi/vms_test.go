@@ -7,8 +7,13 @@ import (
 	. "github.com/onsi/gomega"
 
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	libvirt "libvirt.org/go/libvirt"
 
 	"bosh-libvirt-cpi/cpi"
+	bdisk "bosh-libvirt-cpi/disk"
+	diskfakes "bosh-libvirt-cpi/disk/fakes"
+	"bosh-libvirt-cpi/driver"
 	stemcellfakes "bosh-libvirt-cpi/stemcell/fakes"
 	vmfakes "bosh-libvirt-cpi/vm/fakes"
 )
@@ -18,6 +23,7 @@ var _ = Describe("VMs", func() {
 		stemcellFinder *stemcellfakes.FakeStemcellFinder
 		creator        *vmfakes.FakeCreator
 		finder         *vmfakes.FakeVMFinder
+		diskFinder     *diskfakes.FakeDiskFinder
 		vms            cpi.VMs
 
 		agentID     apiv1.AgentID
@@ -31,7 +37,8 @@ var _ = Describe("VMs", func() {
 		stemcellFinder = &stemcellfakes.FakeStemcellFinder{}
 		creator = &vmfakes.FakeCreator{}
 		finder = &vmfakes.FakeVMFinder{}
-		vms = cpi.NewVMs(stemcellFinder, creator, finder)
+		diskFinder = &diskfakes.FakeDiskFinder{}
+		vms = cpi.NewVMs(stemcellFinder, creator, finder, diskFinder)
 
 		agentID = apiv1.NewAgentID("agent-1")
 		stemcellCID = apiv1.NewStemcellCID("sc-1")
@@ -87,6 +94,33 @@ var _ = Describe("VMs", func() {
 			Expect(cid.AsString()).To(Equal("vm-2"))
 			Expect(retNets).To(Equal(networks))
 		})
+
+		It("passes the referenced persistent disks to the creator", func() {
+			stemcellFinder.FindResult = stemcellfakes.NewFakeStemcell("sc-1")
+			creator.CreateResult = vmfakes.NewFakeVM("vm-2")
+
+			fakeDisk := diskfakes.NewFakeDisk("disk-1")
+			fakeDisk.ExistsResult = true
+			diskFinder.FindResult = fakeDisk
+
+			_, _, err := vms.CreateVMV2(agentID, stemcellCID, cloudProps, networks,
+				[]apiv1.DiskCID{apiv1.NewDiskCID("disk-1")}, env)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(diskFinder.FindArg).To(Equal(apiv1.NewDiskCID("disk-1")))
+			Expect(creator.CreateDisksArg).To(Equal([]bdisk.Disk{fakeDisk}))
+		})
+
+		It("returns error without creating a VM when a referenced disk does not exist", func() {
+			stemcellFinder.FindResult = stemcellfakes.NewFakeStemcell("sc-1")
+			diskFinder.FindResult = diskfakes.NewFakeDisk("disk-1")
+
+			_, _, err := vms.CreateVMV2(agentID, stemcellCID, cloudProps, networks,
+				[]apiv1.DiskCID{apiv1.NewDiskCID("disk-1")}, env)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Disk 'disk-1' not found"))
+			Expect(err.(cpi.CloudError).Type()).To(Equal("Bosh::Clouds::DiskNotFound"))
+			Expect(creator.CreateAgentIDArg).To(Equal(apiv1.AgentID{}))
+		})
 	})
 
 	Describe("DeleteVM", func() {
@@ -151,11 +185,44 @@ var _ = Describe("VMs", func() {
 			err := vms.RebootVM(apiv1.NewVMCID("vm-1"))
 			Expect(err).To(HaveOccurred())
 		})
+
+		It("returns VMNotFound when the domain is gone", func() {
+			fakeVM := vmfakes.NewFakeVM("vm-1")
+			fakeVM.RebootErr = bosherr.WrapError(libvirt.Error{Code: libvirt.ERR_NO_DOMAIN}, "Rebooting")
+			finder.FindResult = fakeVM
+
+			err := vms.RebootVM(apiv1.NewVMCID("vm-1"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(cpi.CloudError).Type()).To(Equal("Bosh::Clouds::VMNotFound"))
+		})
+
+		It("does not report VMNotFound when the VM still exists", func() {
+			fakeVM := vmfakes.NewFakeVM("vm-1")
+			fakeVM.RebootErr = bosherr.WrapError(libvirt.Error{Code: libvirt.ERR_NO_DOMAIN}, "Rebooting")
+			fakeVM.ExistsResult = true
+			finder.FindResult = fakeVM
+
+			err := vms.RebootVM(apiv1.NewVMCID("vm-1"))
+			Expect(err).To(HaveOccurred())
+			Expect(err).ToNot(BeAssignableToTypeOf(cpi.NewVMNotFoundError(apiv1.NewVMCID("vm-1"))))
+		})
+
+		It("marks transient failures as retryable", func() {
+			fakeVM := vmfakes.NewFakeVM("vm-1")
+			fakeVM.RebootErr = bosherr.WrapError(driver.RetryableErrorImpl{Err: errors.New("connection reset")}, "Rebooting")
+			finder.FindResult = fakeVM
+
+			err := vms.RebootVM(apiv1.NewVMCID("vm-1"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(cpi.RetryableError).CanRetry()).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("connection reset"))
+		})
 	})
 
 	Describe("SetVMMetadata", func() {
 		It("sets metadata on the VM", func() {
 			fakeVM := vmfakes.NewFakeVM("vm-1")
+			fakeVM.ExistsResult = true
 			finder.FindResult = fakeVM
 
 			err := vms.SetVMMetadata(apiv1.NewVMCID("vm-1"), apiv1.VMMeta{})
@@ -168,6 +235,14 @@ var _ = Describe("VMs", func() {
 			err := vms.SetVMMetadata(apiv1.NewVMCID("vm-1"), apiv1.VMMeta{})
 			Expect(err).To(HaveOccurred())
 		})
+
+		It("returns VMNotFound when the VM does not exist", func() {
+			finder.FindResult = vmfakes.NewFakeVM("vm-1")
+
+			err := vms.SetVMMetadata(apiv1.NewVMCID("vm-1"), apiv1.VMMeta{})
+			Expect(err).To(MatchError("VM 'vm-1' not found"))
+			Expect(err.(cpi.CloudError).Type()).To(Equal("Bosh::Clouds::VMNotFound"))
+		})
 	})
 
 	Describe("GetDisks", func() {
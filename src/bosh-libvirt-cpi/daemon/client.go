@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+const defaultDialTimeout = 5 * time.Second
+
+// Client forwards CPI requests to a Server.
+type Client struct {
+	socketPath  string
+	dialTimeout time.Duration
+}
+
+func NewClient(socketPath string) Client {
+	return Client{socketPath: socketPath, dialTimeout: defaultDialTimeout}
+}
+
+// NotRunningError is returned by Call when no daemon accepted the request,
+// so that it may be handled in-process instead.
+type NotRunningError struct {
+	SocketPath string
+	Err        error
+}
+
+func (e NotRunningError) Error() string {
+	return fmt.Sprintf("No daemon serving '%s': %s", e.SocketPath, e.Err)
+}
+
+// Call sends request and returns the daemon's response. Errors other than
+// NotRunningError mean the daemon may have acted on the request.
+func (c Client) Call(request []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", c.socketPath, c.dialTimeout)
+	if err != nil {
+		return nil, NotRunningError{SocketPath: c.socketPath, Err: err}
+	}
+	defer conn.Close() //nolint:errcheck
+
+	_, err = conn.Write(request)
+	if err == nil {
+		err = conn.(*net.UnixConn).CloseWrite()
+	}
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Sending request to daemon")
+	}
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Reading response from daemon")
+	}
+
+	if len(response) == 0 {
+		return nil, bosherr.Error("Daemon closed the connection without responding")
+	}
+
+	return response, nil
+}
@@ -0,0 +1,143 @@
+package daemon_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bosh-libvirt-cpi/cpi"
+	"bosh-libvirt-cpi/daemon"
+)
+
+type fakeCPIFactory struct {
+	calls chan apiv1.CallContext
+	err   error
+}
+
+func (f fakeCPIFactory) New(ctx apiv1.CallContext) (apiv1.CPI, error) {
+	f.calls <- ctx
+	if f.err != nil {
+		return nil, f.err
+	}
+	return cpi.CPI{Misc: cpi.NewMisc()}, nil
+}
+
+var _ = Describe("Server and Client", func() {
+	var (
+		dir        string
+		socketPath string
+		factory    fakeCPIFactory
+		logger     boshlog.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "daemon-test")
+		Expect(err).ToNot(HaveOccurred())
+
+		socketPath = filepath.Join(dir, "cpi.sock")
+		factory = fakeCPIFactory{calls: make(chan apiv1.CallContext, 10)}
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	start := func() *daemon.Server {
+		server, err := daemon.Listen(socketPath, factory, logger)
+		Expect(err).ToNot(HaveOccurred())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(server.Serve()).To(Succeed())
+		}()
+
+		return server
+	}
+
+	It("answers requests with the daemon's CPI", func() {
+		server := start()
+		defer server.Close() //nolint:errcheck
+
+		for i := 0; i < 2; i++ {
+			response, err := daemon.NewClient(socketPath).Call([]byte(`{"method":"info","arguments":[],"context":{"director_uuid":"uuid"}}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			var resp struct {
+				Result apiv1.Info
+				Error  interface{}
+			}
+			Expect(json.Unmarshal(response, &resp)).To(Succeed())
+			Expect(resp.Error).To(BeNil())
+			Expect(resp.Result.StemcellFormats).ToNot(BeEmpty())
+		}
+
+		Expect(factory.calls).To(HaveLen(2))
+	})
+
+	It("returns the CPI's errors as responses", func() {
+		factory.err = errors.New("fake-err")
+		server := start()
+		defer server.Close() //nolint:errcheck
+
+		response, err := daemon.NewClient(socketPath).Call([]byte(`{"method":"info","arguments":[],"context":{}}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(response)).To(ContainSubstring("fake-err"))
+	})
+
+	It("makes the socket accessible to its user only", func() {
+		server := start()
+		defer server.Close() //nolint:errcheck
+
+		info, err := os.Stat(socketPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("removes the socket on Close", func() {
+		Expect(start().Close()).To(Succeed())
+		Expect(socketPath).ToNot(BeAnExistingFile())
+
+		server, err := daemon.Listen(socketPath, factory, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.Close()).To(Succeed())
+	})
+
+	It("closes servers whose socket was removed already", func() {
+		server := start()
+		Expect(os.Remove(socketPath)).To(Succeed())
+
+		Expect(server.Close()).To(Succeed())
+	})
+
+	It("replaces a socket left behind by a daemon that died", func() {
+		Expect(os.WriteFile(socketPath, nil, 0600)).To(Succeed())
+
+		server := start()
+		defer server.Close() //nolint:errcheck
+
+		_, err := daemon.NewClient(socketPath).Call([]byte(`{"method":"info","arguments":[],"context":{}}`))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("does not take over the socket of a running daemon", func() {
+		server := start()
+		defer server.Close() //nolint:errcheck
+
+		_, err := daemon.Listen(socketPath, factory, logger)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Another daemon is serving"))
+	})
+
+	It("reports that no daemon runs so that the caller can handle the request itself", func() {
+		_, err := daemon.NewClient(socketPath).Call([]byte(`{}`))
+		Expect(err).To(BeAssignableToTypeOf(daemon.NotRunningError{}))
+	})
+})
@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	"github.com/cloudfoundry/bosh-cpi-go/rpc"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+// Server answers CPI requests on a unix socket with a long-lived
+// CPIFactory, so that calls share its connections to the host.
+// Every request gets a connection of its own: the client writes the
+// request, closes its side for writing and reads the response.
+type Server struct {
+	rpcFactory rpc.Factory
+	cpiFactory apiv1.CPIFactory
+
+	socketPath string
+	listener   *net.UnixListener
+	requests   sync.WaitGroup
+
+	logTag string
+	logger boshlog.Logger
+}
+
+// Listen creates the socket at socketPath, readable by the current user
+// only. A socket left behind by a daemon that died is replaced, but one
+// that is still served is not.
+func Listen(socketPath string, cpiFactory apiv1.CPIFactory, logger boshlog.Logger) (*Server, error) {
+	if _, err := os.Lstat(socketPath); err == nil {
+		conn, err := net.Dial("unix", socketPath)
+		if err == nil {
+			_ = conn.Close()
+			return nil, bosherr.Errorf("Another daemon is serving '%s'", socketPath)
+		}
+
+		err = os.Remove(socketPath)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Removing stale socket '%s'", socketPath)
+		}
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Listening on '%s'", socketPath)
+	}
+
+	// Close removes the socket itself
+	listener.SetUnlinkOnClose(false)
+
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		_ = listener.Close()
+		_ = os.Remove(socketPath)
+		return nil, bosherr.WrapErrorf(err, "Restricting access to '%s'", socketPath)
+	}
+
+	return &Server{
+		rpcFactory: rpc.NewFactory(logger),
+		cpiFactory: cpiFactory,
+		socketPath: socketPath,
+		listener:   listener,
+		logTag:     "daemon.Server",
+		logger:     logger,
+	}, nil
+}
+
+// Serve handles requests concurrently until Close is called.
+func (s *Server) Serve() error {
+	s.logger.Info(s.logTag, "Serving CPI requests on '%s'", s.listener.Addr())
+
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return bosherr.WrapError(err, "Accepting request")
+		}
+
+		s.requests.Add(1)
+
+		go func() {
+			defer s.requests.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// Close stops accepting requests, removes the socket and waits for the
+// requests in progress. A socket removed already is not an error.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	removeErr := os.Remove(s.socketPath)
+	if removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+		err = bosherr.WrapErrorf(removeErr, "Removing socket '%s'", s.socketPath)
+	}
+
+	s.requests.Wait()
+	return err
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close() //nolint:errcheck
+
+	err := s.rpcFactory.NewCLIWithInOut(conn, conn, s.cpiFactory).ServeOnce()
+	if err != nil {
+		s.logger.Error(s.logTag, "Serving request: %s", err)
+	}
+}
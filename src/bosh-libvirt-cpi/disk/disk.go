@@ -1,6 +1,7 @@
 package disk
 
 import (
+	"os"
 	"path/filepath"
 
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
@@ -10,46 +11,108 @@ import (
 	"bosh-libvirt-cpi/driver"
 )
 
+// Record is persisted next to each disk so that later calls
+// (attach, detach, delete) see how the disk was created.
+type Record struct {
+	Props DiskProps
+
+	// ImagePath is empty unless the image lives outside the disk dir,
+	// e.g. in a storage pool or an adopted source image.
+	ImagePath string
+
+	// SecretUUID is the libvirt secret holding the LUKS passphrase; empty unless encrypted.
+	SecretUUID string `json:",omitempty"`
+
+	// SourceImage is the image the disk was imported from, if any.
+	SourceImage string `json:",omitempty"`
+
+	// Adopted disks use SourceImage in place; their data is not owned by the CPI.
+	Adopted bool `json:",omitempty"`
+}
+
 type DiskImpl struct {
 	cid  apiv1.DiskCID
 	path string
+	rec  Record
 
+	driver driver.Driver
 	runner driver.Runner
+	locker driver.Locker
 	logger boshlog.Logger
 }
 
 func NewDiskImpl(
 	cid apiv1.DiskCID,
 	path string,
+	rec Record,
+	driver driver.Driver,
 	runner driver.Runner,
+	locker driver.Locker,
 	logger boshlog.Logger,
 ) DiskImpl {
-	return DiskImpl{cid, path, runner, logger}
+	return DiskImpl{cid, path, rec, driver, runner, locker, logger}
+}
+
+// LockName names the lock held while a disk is changed.
+func LockName(cid apiv1.DiskCID) string {
+	return "disk-" + cid.AsString()
 }
 
 func (d DiskImpl) ID() apiv1.DiskCID { return d.cid }
 
 func (d DiskImpl) Path() string { return d.path }
 
+func (d DiskImpl) Props() DiskProps { return d.rec.Props }
+
 func (d DiskImpl) ImagePath() string {
+	if len(d.rec.ImagePath) > 0 {
+		return d.rec.ImagePath
+	}
 	return filepath.Join(d.path, "disk.img")
 }
 
+func (d DiskImpl) EncryptionSecret() string { return d.rec.SecretUUID }
+
 func (d DiskImpl) Exists() (bool, error) {
-	_, _, err := d.runner.Execute("ls", d.path)
+	_, err := d.runner.Stat(d.path)
 	if err != nil {
-		// directory does not exist
-		return false, nil
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, bosherr.WrapErrorf(err, "Checking disk '%s'", d.path)
 	}
 
 	return true, nil
 }
 
 func (d DiskImpl) Delete() error {
-	_, _, err := d.runner.Execute("rm", "-rf", d.path)
+	return driver.WithLock(d.locker, LockName(d.cid), d.delete)
+}
+
+func (d DiskImpl) delete() error {
+	if len(d.rec.Props.Pool) > 0 {
+		err := d.driver.DeleteStorageVol(d.rec.Props.Pool, d.cid.AsString())
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Deleting disk volume '%s' from pool '%s'", d.cid.AsString(), d.rec.Props.Pool)
+		}
+	}
+
+	if d.rec.Adopted {
+		d.logger.Debug("disk.DiskImpl", "Leaving adopted image '%s' in place", d.rec.ImagePath)
+	}
+
+	// Adopted images live outside the disk dir, so removing it only drops the record
+	err := d.runner.Remove(d.path)
 	if err != nil {
 		return bosherr.WrapErrorf(err, "Deleting disk '%s'", d.path)
 	}
 
+	if len(d.rec.SecretUUID) > 0 {
+		err = d.driver.DeleteSecret(d.rec.SecretUUID)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Deleting disk secret '%s'", d.rec.SecretUUID)
+		}
+	}
+
 	return nil
 }
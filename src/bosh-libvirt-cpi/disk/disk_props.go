@@ -0,0 +1,156 @@
+package disk
+
+import (
+	"path/filepath"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+const (
+	BusVirtio = "virtio"
+	BusSCSI   = "scsi"
+	BusSATA   = "sata"
+
+	FormatRaw   = "raw"
+	FormatQcow2 = "qcow2"
+
+	PreallocationOff      = "off"
+	PreallocationMetadata = "metadata"
+	PreallocationFalloc   = "falloc"
+	PreallocationFull     = "full"
+
+	CacheNone         = "none"
+	CacheWritethrough = "writethrough"
+	CacheWriteback    = "writeback"
+	CacheDirectsync   = "directsync"
+	CacheUnsafe       = "unsafe"
+
+	ImportClone   = "clone"
+	ImportConvert = "convert"
+	ImportAdopt   = "adopt"
+)
+
+type DiskProps struct {
+	// Bus is one of BusVirtio, BusSCSI or BusSATA. SATA disks cannot be
+	// hot-attached, so they can only be attached when the VM is created.
+	Bus           string `json:"bus"`
+	Format        string `json:"format"`
+	Preallocation string `json:"preallocation"`
+
+	// Cache is the QEMU cache mode of the disk. If empty, the hypervisor's
+	// default is used. Other backends ignore it.
+	Cache string `json:"cache"`
+
+	// Pool is the libvirt storage pool to create the disk image in.
+	// If empty, the image is stored next to the disk record under the disks dir.
+	Pool string `json:"pool"`
+
+	ReadOnly bool `json:"read_only"`
+
+	// Encrypted disks are LUKS-formatted; their passphrase is kept in a libvirt secret.
+	Encrypted bool `json:"encrypted"`
+
+	// SourceImage is an existing image on the host to import instead of creating an empty disk.
+	// ImportMode selects how: "clone" copies it as is, "convert" rewrites it
+	// in Format, and "adopt" uses it in place without taking ownership of its data.
+	SourceImage string `json:"source_image"`
+	ImportMode  string `json:"import_mode"`
+}
+
+func DefaultDiskProps() DiskProps {
+	return DiskProps{
+		Bus:           BusVirtio,
+		Format:        FormatRaw,
+		Preallocation: PreallocationOff,
+	}
+}
+
+func NewDiskProps(props apiv1.DiskCloudProps) (DiskProps, error) {
+	diskProps := DefaultDiskProps()
+
+	err := props.As(&diskProps)
+	if err != nil {
+		return DiskProps{}, err
+	}
+
+	if len(diskProps.SourceImage) > 0 && len(diskProps.ImportMode) == 0 {
+		diskProps.ImportMode = ImportConvert
+	}
+
+	err = diskProps.Validate()
+	if err != nil {
+		return DiskProps{}, err
+	}
+
+	return diskProps, nil
+}
+
+func (p DiskProps) Validate() error {
+	switch p.Bus {
+	case BusVirtio, BusSCSI, BusSATA:
+		// valid
+	default:
+		return bosherr.Errorf("Unsupported disk bus '%s': expected 'virtio', 'scsi', or 'sata'", p.Bus)
+	}
+
+	switch p.Format {
+	case FormatRaw, FormatQcow2:
+		// valid
+	default:
+		return bosherr.Errorf("Unsupported disk format '%s': expected 'raw' or 'qcow2'", p.Format)
+	}
+
+	switch p.Preallocation {
+	case PreallocationOff, PreallocationFalloc, PreallocationFull:
+		// valid
+	case PreallocationMetadata:
+		if p.Format != FormatQcow2 {
+			return bosherr.Error("Disk preallocation 'metadata' requires format 'qcow2'")
+		}
+	default:
+		return bosherr.Errorf(
+			"Unsupported disk preallocation '%s': expected 'off', 'metadata', 'falloc', or 'full'", p.Preallocation)
+	}
+
+	switch p.Cache {
+	case "", CacheNone, CacheWritethrough, CacheWriteback, CacheDirectsync, CacheUnsafe:
+		// valid
+	default:
+		return bosherr.Errorf(
+			"Unsupported disk cache '%s': expected 'none', 'writethrough', 'writeback', 'directsync', or 'unsafe'", p.Cache)
+	}
+
+	return p.validateImport()
+}
+
+func (p DiskProps) validateImport() error {
+	if len(p.SourceImage) == 0 {
+		if len(p.ImportMode) > 0 {
+			return bosherr.Error("Disk import_mode requires source_image")
+		}
+		return nil
+	}
+
+	if !filepath.IsAbs(p.SourceImage) {
+		return bosherr.Errorf("Disk source_image '%s' must be an absolute path", p.SourceImage)
+	}
+
+	switch p.ImportMode {
+	case ImportClone, ImportConvert, ImportAdopt:
+		// valid
+	default:
+		return bosherr.Errorf(
+			"Unsupported disk import_mode '%s': expected 'clone', 'convert', or 'adopt'", p.ImportMode)
+	}
+
+	if len(p.Pool) > 0 {
+		return bosherr.Error("Disk source_image cannot be combined with pool")
+	}
+
+	if p.Encrypted {
+		return bosherr.Error("Disk source_image cannot be combined with encrypted")
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package disk_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+
+	"bosh-libvirt-cpi/disk"
+)
+
+var _ = Describe("DiskProps", func() {
+	newProps := func(raw string) (disk.DiskProps, error) {
+		return disk.NewDiskProps(apiv1.CloudPropsImpl{RawMessage: json.RawMessage(raw)})
+	}
+
+	It("defaults to a sparse raw virtio disk", func() {
+		props, err := newProps("{}")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(props).To(Equal(disk.DiskProps{Bus: "virtio", Format: "raw", Preallocation: "off"}))
+	})
+
+	It("reads all supported properties", func() {
+		props, err := newProps(`{"bus":"scsi","format":"qcow2","preallocation":"falloc","pool":"p","read_only":true}`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(props).To(Equal(disk.DiskProps{
+			Bus: "scsi", Format: "qcow2", Preallocation: "falloc", Pool: "p", ReadOnly: true}))
+	})
+
+	It("serializes all properties with the names they are configured with", func() {
+		bytes, err := json.Marshal(disk.DiskProps{Bus: "scsi", Format: "qcow2", Preallocation: "falloc", Pool: "p"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes).To(MatchJSON(`{"bus":"scsi","format":"qcow2","preallocation":"falloc","pool":"p",` +
+			`"cache":"","read_only":false,"encrypted":false,"source_image":"","import_mode":""}`))
+	})
+
+	It("reads properties recorded with the field names", func() {
+		var props disk.DiskProps
+		Expect(json.Unmarshal([]byte(`{"Bus":"scsi","Format":"qcow2","Preallocation":"falloc","Pool":"p"}`), &props)).To(Succeed())
+		Expect(props).To(Equal(disk.DiskProps{Bus: "scsi", Format: "qcow2", Preallocation: "falloc", Pool: "p"}))
+	})
+
+	It("reads the cache mode", func() {
+		props, err := newProps(`{"cache":"none"}`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(props.Cache).To(Equal("none"))
+	})
+
+	It("rejects unknown cache modes", func() {
+		_, err := newProps(`{"cache":"fast"}`)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Unsupported disk cache 'fast'"))
+	})
+
+	It("rejects unknown bus types", func() {
+		_, err := newProps(`{"bus":"ide"}`)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Unsupported disk bus 'ide'"))
+	})
+
+	It("rejects unknown formats", func() {
+		_, err := newProps(`{"format":"vmdk"}`)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Unsupported disk format 'vmdk'"))
+	})
+
+	It("rejects unknown preallocation modes", func() {
+		_, err := newProps(`{"preallocation":"lazy"}`)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Unsupported disk preallocation 'lazy'"))
+	})
+
+	It("rejects metadata preallocation for raw disks", func() {
+		_, err := newProps(`{"preallocation":"metadata"}`)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("requires format 'qcow2'"))
+	})
+
+	Context("when importing a source image", func() {
+		It("defaults to converting the image", func() {
+			props, err := newProps(`{"source_image":"/images/data.qcow2"}`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(props.SourceImage).To(Equal("/images/data.qcow2"))
+			Expect(props.ImportMode).To(Equal("convert"))
+		})
+
+		It("rejects unknown import modes", func() {
+			_, err := newProps(`{"source_image":"/images/data.qcow2","import_mode":"move"}`)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Unsupported disk import_mode 'move'"))
+		})
+
+		It("rejects relative source paths", func() {
+			_, err := newProps(`{"source_image":"data.qcow2"}`)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("must be an absolute path"))
+		})
+
+		It("rejects import_mode without source_image", func() {
+			_, err := newProps(`{"import_mode":"adopt"}`)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("requires source_image"))
+		})
+
+		It("rejects combining source_image with pool or encrypted", func() {
+			_, err := newProps(`{"source_image":"/images/data.qcow2","pool":"fast"}`)
+			Expect(err).To(HaveOccurred())
+
+			_, err = newProps(`{"source_image":"/images/data.qcow2","encrypted":true}`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,97 @@
+package disk_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	"bosh-libvirt-cpi/disk"
+	driverfakes "bosh-libvirt-cpi/driver/fakes"
+)
+
+var _ = Describe("DiskImpl", func() {
+	var (
+		runner *driverfakes.FakeRunner
+		d      *driverfakes.FakeDriver
+		locker *driverfakes.FakeLocker
+		logger boshlog.Logger
+	)
+
+	BeforeEach(func() {
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		runner = &driverfakes.FakeRunner{}
+		d = &driverfakes.FakeDriver{}
+		locker = &driverfakes.FakeLocker{}
+	})
+
+	Describe("Delete", func() {
+		It("deletes the secret of an encrypted disk", func() {
+			dk := disk.NewDiskImpl(apiv1.NewDiskCID("disk-1"), "/store/disks/disk-1",
+				disk.Record{Props: disk.DefaultDiskProps(), SecretUUID: "secret-uuid-1"}, d, runner, locker, logger)
+
+			Expect(dk.Delete()).To(Succeed())
+			Expect(runner.RemoveCalls).To(ContainElement("/store/disks/disk-1"))
+			Expect(d.DeleteSecretUUID).To(Equal("secret-uuid-1"))
+		})
+
+		It("holds the disk lock", func() {
+			dk := disk.NewDiskImpl(apiv1.NewDiskCID("disk-1"), "/store/disks/disk-1",
+				disk.Record{Props: disk.DefaultDiskProps()}, d, runner, locker, logger)
+
+			locker.LockErr = errors.New("fake-lock-err")
+
+			Expect(dk.Delete()).To(MatchError("fake-lock-err"))
+			Expect(locker.LockCalls).To(Equal([]string{"disk-disk-1"}))
+			Expect(runner.RemoveCalls).To(BeEmpty())
+		})
+
+		It("does not touch secrets of unencrypted disks", func() {
+			dk := disk.NewDiskImpl(apiv1.NewDiskCID("disk-1"), "/store/disks/disk-1",
+				disk.Record{Props: disk.DefaultDiskProps()}, d, runner, locker, logger)
+
+			Expect(dk.Delete()).To(Succeed())
+			Expect(d.DeleteSecretUUID).To(BeEmpty())
+		})
+
+		It("returns error when deleting the secret fails", func() {
+			d.DeleteSecretErr = errors.New("secret busy")
+			dk := disk.NewDiskImpl(apiv1.NewDiskCID("disk-1"), "/store/disks/disk-1",
+				disk.Record{Props: disk.DefaultDiskProps(), SecretUUID: "secret-uuid-1"}, d, runner, locker, logger)
+
+			err := dk.Delete()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Deleting disk secret"))
+		})
+	})
+
+	Describe("Exists", func() {
+		var dk disk.DiskImpl
+
+		BeforeEach(func() {
+			dk = disk.NewDiskImpl(apiv1.NewDiskCID("disk-1"), "/store/disks/disk-1",
+				disk.Record{Props: disk.DefaultDiskProps()}, d, runner, locker, logger)
+		})
+
+		It("returns true when the disk dir exists", func() {
+			runner.MkdirAllCalls = []string{"/store/disks/disk-1"}
+
+			Expect(dk.Exists()).To(BeTrue())
+		})
+
+		It("returns false when the disk dir is missing", func() {
+			Expect(dk.Exists()).To(BeFalse())
+		})
+
+		It("returns error when the disk dir cannot be checked", func() {
+			runner.StatErr = errors.New("permission denied")
+
+			_, err := dk.Exists()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Checking disk"))
+		})
+	})
+})
@@ -1,6 +1,10 @@
 package disk
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
 	"path/filepath"
 	"strconv"
 
@@ -18,15 +22,27 @@ type Factory struct {
 
 	driver driver.Driver
 	runner driver.Runner
+	locker driver.Locker
 
+	logTag string
 	logger boshlog.Logger
 }
 
+const (
+	diskRecordName = "disk.json"
+
+	// keyFileName holds the LUKS passphrase only while qemu-img formats the image.
+	keyFileName = "key.tmp"
+
+	passphraseLen = 32
+)
+
 func NewFactory(
 	dirPath string,
 	uuidGen boshuuid.Generator,
 	driver driver.Driver,
 	runner driver.Runner,
+	locker driver.Locker,
 	logger boshlog.Logger,
 ) Factory {
 	return Factory{
@@ -35,12 +51,14 @@ func NewFactory(
 
 		driver: driver,
 		runner: runner,
+		locker: locker,
 
+		logTag: "disk.Factory",
 		logger: logger,
 	}
 }
 
-func (f Factory) Create(size int) (Disk, error) {
+func (f Factory) Create(size int, props DiskProps) (Disk, error) {
 	id, err := f.uuidGen.Generate()
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Generating disk id")
@@ -48,34 +66,215 @@ func (f Factory) Create(size int) (Disk, error) {
 
 	id = "disk-" + id
 
-	disk := f.newDisk(apiv1.NewDiskCID(id))
+	cid := apiv1.NewDiskCID(id)
+	diskPath := f.diskPath(cid)
 
-	_, _, err = f.runner.Execute("mkdir", "-p", disk.Path())
+	err = f.runner.MkdirAll(diskPath)
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Creating disk parent")
 	}
 
-	// Create a sparse raw disk image of `size` MB at disk.ImagePath().
-	_, _, err = f.runner.Execute(
-		"dd",
-		"if=/dev/zero",
-		"of="+disk.ImagePath(),
-		"bs=1M",
-		"count=0",
-		"seek="+strconv.Itoa(size),
-	)
+	partial := func(rec Record) DiskImpl {
+		return NewDiskImpl(cid, diskPath, rec, f.driver, f.runner, f.locker, f.logger)
+	}
+
+	rec := Record{Props: props}
+
+	var passphrase []byte
+
+	if props.Encrypted {
+		passphrase, err = newPassphrase()
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Generating disk passphrase")
+		}
+
+		rec.SecretUUID, err = f.driver.CreateSecret("bosh disk "+id, passphrase)
+		if err != nil {
+			f.cleanUpPartialCreate(partial(Record{}))
+			return nil, bosherr.WrapError(err, "Creating disk secret")
+		}
+	}
+
+	switch {
+	case len(props.SourceImage) > 0:
+		rec, err = f.importImage(diskPath, size, props)
+		if err != nil {
+			f.cleanUpPartialCreate(partial(Record{}))
+			return nil, bosherr.WrapErrorf(err, "Importing disk image '%s'", props.SourceImage)
+		}
+
+	case len(props.Pool) > 0:
+		volProps := driver.StorageVolProps{
+			SizeMB:           size,
+			Format:           props.Format,
+			Preallocation:    props.Preallocation,
+			EncryptionSecret: rec.SecretUUID,
+		}
+
+		rec.ImagePath, err = f.driver.CreateStorageVol(props.Pool, id, volProps)
+		if err != nil {
+			f.cleanUpPartialCreate(partial(Record{SecretUUID: rec.SecretUUID}))
+			return nil, bosherr.WrapErrorf(err, "Creating disk volume in pool '%s'", props.Pool)
+		}
+
+	default:
+		err = f.createImage(diskPath, size, props, passphrase)
+		if err != nil {
+			f.cleanUpPartialCreate(partial(Record{SecretUUID: rec.SecretUUID}))
+			return nil, bosherr.WrapError(err, "Creating disk image")
+		}
+	}
+
+	disk := NewDiskImpl(cid, diskPath, rec, f.driver, f.runner, f.locker, f.logger)
+
+	err = f.saveRecord(disk, rec)
 	if err != nil {
-		return nil, bosherr.WrapError(err, "Creating disk image")
+		f.cleanUpPartialCreate(disk)
+		return nil, err
 	}
 
 	return disk, nil
 }
 
 func (f Factory) Find(cid apiv1.DiskCID) (Disk, error) {
-	return f.newDisk(cid), nil
+	diskPath := f.diskPath(cid)
+
+	rec, _, err := f.record(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDiskImpl(cid, diskPath, rec, f.driver, f.runner, f.locker, f.logger), nil
+}
+
+// record reads the disk record of cid. Disks created before disk.json was
+// introduced have no record; they are raw, sparse virtio disks stored under
+// the disk directory and get the default props.
+func (f Factory) record(cid apiv1.DiskCID) (Record, bool, error) {
+	rec := Record{Props: DefaultDiskProps()}
+
+	recordPath := filepath.Join(f.diskPath(cid), diskRecordName)
+
+	_, err := f.runner.Stat(recordPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rec, false, nil
+		}
+		return rec, false, bosherr.WrapErrorf(err, "Checking disk record '%s'", cid.AsString())
+	}
+
+	bytes, err := f.runner.Get(recordPath)
+	if err != nil {
+		return rec, false, bosherr.WrapErrorf(err, "Reading disk record '%s'", cid.AsString())
+	}
+
+	err = json.Unmarshal(bytes, &rec)
+	if err != nil {
+		return rec, false, bosherr.WrapErrorf(err, "Deserializing disk record '%s'", cid.AsString())
+	}
+
+	return rec, true, nil
+}
+
+func (f Factory) diskPath(cid apiv1.DiskCID) string {
+	return filepath.Join(f.dirPath, cid.AsString())
 }
 
-func (f Factory) newDisk(cid apiv1.DiskCID) DiskImpl {
-	diskPath := filepath.Join(f.dirPath, cid.AsString())
-	return NewDiskImpl(cid, diskPath, f.runner, f.logger)
+func (f Factory) createImage(diskPath string, size int, props DiskProps, passphrase []byte) error {
+	imagePath := filepath.Join(diskPath, "disk.img")
+
+	if props.Encrypted {
+		return f.createEncryptedImage(diskPath, imagePath, size, props, passphrase)
+	}
+
+	if props.Format == FormatRaw && props.Preallocation == PreallocationOff {
+		// Create a sparse raw disk image of `size` MB.
+		return f.runner.CreateSparseFile(imagePath, int64(size)*1024*1024)
+	}
+
+	_, _, err := f.runner.Execute(
+		"qemu-img", "create",
+		"-f", props.Format,
+		"-o", "preallocation="+props.Preallocation,
+		imagePath,
+		strconv.Itoa(size)+"M",
+	)
+	return err
+}
+
+// createEncryptedImage formats a LUKS image. The passphrase is handed to
+// qemu-img through a short-lived key file, readable by its owner only, so
+// it never appears on a command line.
+func (f Factory) createEncryptedImage(diskPath, imagePath string, size int, props DiskProps, passphrase []byte) error {
+	keyPath := filepath.Join(diskPath, keyFileName)
+
+	err := f.runner.PutPrivate(keyPath, passphrase)
+	if err != nil {
+		return bosherr.WrapError(err, "Writing disk key file")
+	}
+
+	defer func() {
+		err := f.runner.Remove(keyPath)
+		if err != nil {
+			f.logger.Error(f.logTag, "Failed to remove disk key file: %s", err)
+		}
+	}()
+
+	var format, opts string
+
+	if props.Format == FormatQcow2 {
+		format = FormatQcow2
+		opts = "encrypt.format=luks,encrypt.key-secret=sec0"
+	} else {
+		// A raw encrypted disk is a bare LUKS container
+		format = "luks"
+		opts = "key-secret=sec0"
+	}
+
+	if props.Preallocation != PreallocationOff {
+		opts += ",preallocation=" + props.Preallocation
+	}
+
+	_, _, err = f.runner.Execute(
+		"qemu-img", "create",
+		"--object", "secret,id=sec0,file="+keyPath,
+		"-f", format,
+		"-o", opts,
+		imagePath,
+		strconv.Itoa(size)+"M",
+	)
+	return err
+}
+
+func newPassphrase() ([]byte, error) {
+	buf := make([]byte, passphraseLen)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encoded so that the passphrase can be typed in for manual recovery
+	return []byte(hex.EncodeToString(buf)), nil
+}
+
+func (f Factory) saveRecord(disk DiskImpl, rec Record) error {
+	bytes, err := json.Marshal(rec)
+	if err != nil {
+		return bosherr.WrapError(err, "Serializing disk record")
+	}
+
+	err = f.runner.Put(filepath.Join(disk.Path(), diskRecordName), bytes)
+	if err != nil {
+		return bosherr.WrapError(err, "Saving disk record")
+	}
+
+	return nil
+}
+
+func (f Factory) cleanUpPartialCreate(disk DiskImpl) {
+	err := disk.Delete()
+	if err != nil {
+		f.logger.Error(f.logTag, "Failed to clean up partially created disk: %s", err)
+	}
 }
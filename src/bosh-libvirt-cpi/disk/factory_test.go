@@ -1,6 +1,7 @@
 package disk_test
 
 import (
+	"encoding/json"
 	"errors"
 
 	. "github.com/onsi/ginkgo"
@@ -10,6 +11,7 @@ import (
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 
 	"bosh-libvirt-cpi/disk"
+	"bosh-libvirt-cpi/driver"
 	driverfakes "bosh-libvirt-cpi/driver/fakes"
 )
 
@@ -25,6 +27,7 @@ var _ = Describe("disk.Factory", func() {
 		uuidGen *stubUUIDGen
 		runner  *driverfakes.FakeRunner
 		d       *driverfakes.FakeDriver
+		locker  *driverfakes.FakeLocker
 		factory disk.Factory
 		logger  boshlog.Logger
 	)
@@ -34,30 +37,227 @@ var _ = Describe("disk.Factory", func() {
 		uuidGen = &stubUUIDGen{result: "abc-123"}
 		runner = &driverfakes.FakeRunner{}
 		d = &driverfakes.FakeDriver{}
-		factory = disk.NewFactory("/store/disks", uuidGen, d, runner, logger)
+		locker = &driverfakes.FakeLocker{}
+		factory = disk.NewFactory("/store/disks", uuidGen, d, runner, locker, logger)
 	})
 
 	Describe("Create", func() {
 		It("returns disk with ID prefixed 'disk-' and correct paths", func() {
-			dk, err := factory.Create(1024)
+			dk, err := factory.Create(1024, disk.DefaultDiskProps())
 			Expect(err).ToNot(HaveOccurred())
 			Expect(dk.ID().AsString()).To(Equal("disk-abc-123"))
 			Expect(dk.Path()).To(Equal("/store/disks/disk-abc-123"))
 			Expect(dk.ImagePath()).To(Equal("/store/disks/disk-abc-123/disk.img"))
 		})
 
+		It("creates raw disks as sparse files", func() {
+			_, err := factory.Create(1024, disk.DefaultDiskProps())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(runner.MkdirAllCalls).To(Equal([]string{"/store/disks/disk-abc-123"}))
+			Expect(runner.SparseFiles).To(Equal(map[string]int64{"/store/disks/disk-abc-123/disk.img": 1024 * 1024 * 1024}))
+			Expect(runner.ExecuteCalls).To(BeEmpty())
+		})
+
 		It("returns error when UUID generation fails", func() {
 			uuidGen.err = errors.New("uuid failure")
-			_, err := factory.Create(1024)
+			_, err := factory.Create(1024, disk.DefaultDiskProps())
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Generating disk id"))
 		})
 
-		It("returns error when runner.Execute fails", func() {
-			runner.ExecuteErr = errors.New("exec failed")
-			_, err := factory.Create(1024)
+		It("returns error when creating the disk dir fails", func() {
+			runner.MkdirAllErr = errors.New("mkdir failed")
+			_, err := factory.Create(1024, disk.DefaultDiskProps())
 			Expect(err).To(HaveOccurred())
 		})
+
+		It("persists the disk props next to the disk", func() {
+			props := disk.DiskProps{Bus: "scsi", Format: "qcow2", Preallocation: "metadata", ReadOnly: true}
+			_, err := factory.Create(1024, props)
+			Expect(err).ToNot(HaveOccurred())
+
+			dk, err := factory.Find(apiv1.NewDiskCID("disk-abc-123"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dk.Props()).To(Equal(props))
+		})
+
+		It("creates the disk in the storage pool when Pool is set", func() {
+			d.CreateStorageVolPath = "/pools/fast/disk-abc-123"
+			props := disk.DiskProps{Bus: "virtio", Format: "qcow2", Preallocation: "full", Pool: "fast"}
+
+			dk, err := factory.Create(2048, props)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.CreateStorageVolPool).To(Equal("fast"))
+			Expect(d.CreateStorageVolName).To(Equal("disk-abc-123"))
+			Expect(d.CreateStorageVolProps).To(Equal(driver.StorageVolProps{
+				SizeMB: 2048, Format: "qcow2", Preallocation: "full"}))
+			Expect(dk.ImagePath()).To(Equal("/pools/fast/disk-abc-123"))
+
+			found, err := factory.Find(dk.ID())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found.ImagePath()).To(Equal("/pools/fast/disk-abc-123"))
+		})
+
+		It("returns error when creating the storage volume fails", func() {
+			d.CreateStorageVolErr = errors.New("pool full")
+			_, err := factory.Create(1024, disk.DiskProps{Format: "raw", Preallocation: "off", Pool: "fast"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("pool full"))
+		})
+
+		Context("when the disk is encrypted", func() {
+			BeforeEach(func() {
+				d.CreateSecretUUID = "secret-uuid-1"
+			})
+
+			It("formats a LUKS qcow2 image with a key file and records the secret", func() {
+				props := disk.DiskProps{Bus: "virtio", Format: "qcow2", Preallocation: "off", Encrypted: true}
+
+				dk, err := factory.Create(1024, props)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dk.EncryptionSecret()).To(Equal("secret-uuid-1"))
+				Expect(d.CreateSecretValue).To(HaveLen(64))
+
+				keyPath := "/store/disks/disk-abc-123/key.tmp"
+				Expect(runner.PutContents[keyPath]).To(Equal(d.CreateSecretValue))
+				Expect(runner.PrivatePaths).To(Equal([]string{keyPath}))
+				Expect(runner.ExecuteCalls).To(ContainElement([]string{
+					"qemu-img", "create",
+					"--object", "secret,id=sec0,file=" + keyPath,
+					"-f", "qcow2",
+					"-o", "encrypt.format=luks,encrypt.key-secret=sec0",
+					"/store/disks/disk-abc-123/disk.img", "1024M",
+				}))
+				Expect(runner.RemoveCalls).To(ContainElement(keyPath))
+
+				found, err := factory.Find(dk.ID())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(found.EncryptionSecret()).To(Equal("secret-uuid-1"))
+			})
+
+			It("formats a bare LUKS container for raw disks", func() {
+				props := disk.DiskProps{Bus: "virtio", Format: "raw", Preallocation: "falloc", Encrypted: true}
+
+				_, err := factory.Create(1024, props)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(runner.ExecuteCalls).To(ContainElement(ContainElements("-f", "luks", "-o", "key-secret=sec0,preallocation=falloc")))
+			})
+
+			It("passes the secret to the storage pool volume", func() {
+				props := disk.DiskProps{Format: "qcow2", Preallocation: "off", Pool: "fast", Encrypted: true}
+
+				_, err := factory.Create(1024, props)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(d.CreateStorageVolProps.EncryptionSecret).To(Equal("secret-uuid-1"))
+			})
+
+			It("returns error when creating the secret fails", func() {
+				d.CreateSecretErr = errors.New("secret failed")
+
+				_, err := factory.Create(1024, disk.DiskProps{Format: "raw", Preallocation: "off", Encrypted: true})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Creating disk secret"))
+			})
+
+			It("deletes the secret when the volume cannot be created", func() {
+				d.CreateStorageVolErr = errors.New("pool full")
+
+				_, err := factory.Create(1024, disk.DiskProps{Format: "raw", Preallocation: "off", Pool: "fast", Encrypted: true})
+				Expect(err).To(HaveOccurred())
+				Expect(d.DeleteSecretUUID).To(Equal("secret-uuid-1"))
+			})
+		})
+
+		Context("when importing a source image", func() {
+			const qcow2Info = `{"format":"qcow2","virtual-size":536870912}`
+
+			importProps := func(mode string) disk.DiskProps {
+				return disk.DiskProps{Bus: "virtio", Format: "raw", Preallocation: "off",
+					SourceImage: "/images/data.qcow2", ImportMode: mode}
+			}
+
+			BeforeEach(func() {
+				runner.ExecuteOutput = qcow2Info
+			})
+
+			It("converts the image into the requested format", func() {
+				dk, err := factory.Create(512, importProps("convert"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(runner.ExecuteCalls).To(ContainElement([]string{
+					"qemu-img", "convert", "-f", "qcow2", "-O", "raw",
+					"/images/data.qcow2", "/store/disks/disk-abc-123/disk.img"}))
+				Expect(dk.Props().Format).To(Equal("raw"))
+				Expect(dk.ImagePath()).To(Equal("/store/disks/disk-abc-123/disk.img"))
+			})
+
+			It("clones the image keeping its format", func() {
+				dk, err := factory.Create(512, importProps("clone"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(runner.ExecuteCalls).To(ContainElement([]string{
+					"cp", "--sparse=always", "/images/data.qcow2", "/store/disks/disk-abc-123/disk.img"}))
+				Expect(dk.Props().Format).To(Equal("qcow2"))
+			})
+
+			It("grows imported images smaller than the requested size", func() {
+				_, err := factory.Create(1024, importProps("clone"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(runner.ExecuteCalls).To(ContainElement([]string{
+					"qemu-img", "resize", "-f", "qcow2", "/store/disks/disk-abc-123/disk.img", "1024M"}))
+			})
+
+			It("adopts the image in place and records that the data is not owned", func() {
+				dk, err := factory.Create(512, importProps("adopt"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dk.ImagePath()).To(Equal("/images/data.qcow2"))
+				Expect(dk.Props().Format).To(Equal("qcow2"))
+
+				var rec disk.Record
+				Expect(json.Unmarshal(runner.PutContents["/store/disks/disk-abc-123/disk.json"], &rec)).To(Succeed())
+				Expect(rec.Adopted).To(BeTrue())
+				Expect(rec.SourceImage).To(Equal("/images/data.qcow2"))
+
+				runner.ExecuteCalls = nil
+				found, err := factory.Find(dk.ID())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(found.Delete()).To(Succeed())
+				Expect(runner.ExecuteCalls).To(BeEmpty())
+				Expect(runner.RemoveCalls).To(Equal([]string{"/store/disks/disk-abc-123"}))
+			})
+
+			It("rejects adopting an image of a different size", func() {
+				_, err := factory.Create(1024, importProps("adopt"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("does not match requested disk size"))
+			})
+
+			It("rejects images larger than the requested size", func() {
+				_, err := factory.Create(256, importProps("convert"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("exceeds requested disk size 256 MB"))
+			})
+
+			It("rejects unsupported image formats", func() {
+				runner.ExecuteOutput = `{"format":"vmdk","virtual-size":536870912}`
+				_, err := factory.Create(512, importProps("convert"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Unsupported source image format 'vmdk'"))
+			})
+
+			It("cleans up the disk dir when the import fails", func() {
+				runner.ExecuteOutput = "not json"
+				_, err := factory.Create(512, importProps("convert"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Importing disk image '/images/data.qcow2'"))
+				Expect(runner.RemoveCalls).To(ContainElement("/store/disks/disk-abc-123"))
+			})
+		})
+
+		It("returns error when saving the disk record fails", func() {
+			runner.PutErr = errors.New("put failed")
+			_, err := factory.Create(1024, disk.DefaultDiskProps())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Saving disk record"))
+		})
 	})
 
 	Describe("Find", func() {
@@ -67,5 +267,34 @@ var _ = Describe("disk.Factory", func() {
 			Expect(dk.ID().AsString()).To(Equal("disk-xyz"))
 			Expect(dk.Path()).To(Equal("/store/disks/disk-xyz"))
 		})
+
+		It("uses default props for disks without a record", func() {
+			dk, err := factory.Find(apiv1.NewDiskCID("disk-xyz"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dk.Props()).To(Equal(disk.DefaultDiskProps()))
+			Expect(dk.ImagePath()).To(Equal("/store/disks/disk-xyz/disk.img"))
+		})
+
+		It("returns error when the disk record is corrupt", func() {
+			runner.PutContents = map[string][]byte{"/store/disks/disk-xyz/disk.json": []byte("{not json")}
+			_, err := factory.Find(apiv1.NewDiskCID("disk-xyz"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Deserializing disk record"))
+		})
+
+		It("returns error when the disk record cannot be checked", func() {
+			runner.StatErr = errors.New("stat failed")
+			_, err := factory.Find(apiv1.NewDiskCID("disk-xyz"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Checking disk record"))
+		})
+
+		It("returns error when the disk record cannot be read", func() {
+			runner.PutContents = map[string][]byte{"/store/disks/disk-xyz/disk.json": []byte("{}")}
+			runner.GetErr = errors.New("read failed")
+			_, err := factory.Find(apiv1.NewDiskCID("disk-xyz"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Reading disk record"))
+		})
 	})
 })
@@ -5,14 +5,16 @@ import (
 )
 
 type FakeDiskCreator struct {
-	CreateSizeArg int
-	CreateResult  bdisk.Disk
-	CreateErr     error
+	CreateSizeArg  int
+	CreatePropsArg bdisk.DiskProps
+	CreateResult   bdisk.Disk
+	CreateErr      error
 }
 
 var _ bdisk.Creator = &FakeDiskCreator{}
 
-func (c *FakeDiskCreator) Create(size int) (bdisk.Disk, error) {
+func (c *FakeDiskCreator) Create(size int, props bdisk.DiskProps) (bdisk.Disk, error) {
 	c.CreateSizeArg = size
+	c.CreatePropsArg = props
 	return c.CreateResult, c.CreateErr
 }
@@ -11,6 +11,8 @@ type FakeDisk struct {
 
 	PathResult      string
 	ImagePathResult string
+	PropsResult     bdisk.DiskProps
+	SecretResult    string
 	ExistsResult    bool
 	ExistsErr       error
 	DeleteErr       error
@@ -22,8 +24,10 @@ func NewFakeDisk(cid string) *FakeDisk {
 	return &FakeDisk{cid: apiv1.NewDiskCID(cid)}
 }
 
-func (d *FakeDisk) ID() apiv1.DiskCID     { return d.cid }
-func (d *FakeDisk) Path() string          { return d.PathResult }
-func (d *FakeDisk) ImagePath() string     { return d.ImagePathResult }
-func (d *FakeDisk) Exists() (bool, error) { return d.ExistsResult, d.ExistsErr }
-func (d *FakeDisk) Delete() error         { return d.DeleteErr }
+func (d *FakeDisk) ID() apiv1.DiskCID        { return d.cid }
+func (d *FakeDisk) Path() string             { return d.PathResult }
+func (d *FakeDisk) ImagePath() string        { return d.ImagePathResult }
+func (d *FakeDisk) Props() bdisk.DiskProps   { return d.PropsResult }
+func (d *FakeDisk) EncryptionSecret() string { return d.SecretResult }
+func (d *FakeDisk) Exists() (bool, error)    { return d.ExistsResult, d.ExistsErr }
+func (d *FakeDisk) Delete() error            { return d.DeleteErr }
@@ -0,0 +1,110 @@
+package disk
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// imageInfo is the subset of `qemu-img info --output=json` used to validate imports.
+type imageInfo struct {
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+	Encrypted   bool   `json:"encrypted"`
+}
+
+// importImage brings props.SourceImage into the disk dir according to
+// props.ImportMode and returns the record describing the result.
+func (f Factory) importImage(diskPath string, size int, props DiskProps) (Record, error) {
+	info, err := f.inspectImage(props.SourceImage)
+	if err != nil {
+		return Record{}, err
+	}
+
+	sizeBytes := int64(size) * 1024 * 1024
+
+	if info.VirtualSize > sizeBytes {
+		return Record{}, bosherr.Errorf(
+			"Source image virtual size %d bytes exceeds requested disk size %d MB", info.VirtualSize, size)
+	}
+
+	rec := Record{Props: props, SourceImage: props.SourceImage}
+	imagePath := filepath.Join(diskPath, "disk.img")
+
+	switch props.ImportMode {
+	case ImportAdopt:
+		// The image is not ours to grow, so it has to fit exactly
+		if info.VirtualSize != sizeBytes {
+			return Record{}, bosherr.Errorf(
+				"Adopted image virtual size %d bytes does not match requested disk size %d MB", info.VirtualSize, size)
+		}
+
+		rec.Props.Format = info.Format
+		rec.ImagePath = props.SourceImage
+		rec.Adopted = true
+
+		return rec, nil
+
+	case ImportClone:
+		rec.Props.Format = info.Format
+
+		_, _, err = f.runner.Execute("cp", "--sparse=always", props.SourceImage, imagePath)
+		if err != nil {
+			return Record{}, bosherr.WrapError(err, "Copying source image")
+		}
+
+	case ImportConvert:
+		args := []string{"convert", "-f", info.Format, "-O", props.Format}
+		if props.Preallocation != PreallocationOff {
+			args = append(args, "-o", "preallocation="+props.Preallocation)
+		}
+		args = append(args, props.SourceImage, imagePath)
+
+		_, _, err = f.runner.Execute("qemu-img", args...)
+		if err != nil {
+			return Record{}, bosherr.WrapError(err, "Converting source image")
+		}
+
+	default:
+		return Record{}, bosherr.Errorf("Unsupported disk import_mode '%s'", props.ImportMode)
+	}
+
+	if info.VirtualSize < sizeBytes {
+		_, _, err = f.runner.Execute("qemu-img", "resize", "-f", rec.Props.Format, imagePath, strconv.Itoa(size)+"M")
+		if err != nil {
+			return Record{}, bosherr.WrapError(err, "Growing imported image")
+		}
+	}
+
+	return rec, nil
+}
+
+func (f Factory) inspectImage(path string) (imageInfo, error) {
+	output, _, err := f.runner.Execute("qemu-img", "info", "--output=json", path)
+	if err != nil {
+		return imageInfo{}, bosherr.WrapErrorf(err, "Inspecting source image '%s'", path)
+	}
+
+	var info imageInfo
+
+	err = json.Unmarshal([]byte(output), &info)
+	if err != nil {
+		return imageInfo{}, bosherr.WrapErrorf(err, "Parsing image info of '%s'", path)
+	}
+
+	switch info.Format {
+	case FormatRaw, FormatQcow2:
+		// valid
+	default:
+		return imageInfo{}, bosherr.Errorf(
+			"Unsupported source image format '%s': expected 'raw' or 'qcow2'", info.Format)
+	}
+
+	if info.Encrypted {
+		return imageInfo{}, bosherr.Error("Encrypted source images are not supported")
+	}
+
+	return info, nil
+}
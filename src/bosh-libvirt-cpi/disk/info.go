@@ -0,0 +1,82 @@
+package disk
+
+import (
+	"os"
+	"strings"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// Info describes a disk as recorded in its dir, for operators.
+type Info struct {
+	CID       string
+	Path      string
+	ImagePath string
+	Props     DiskProps
+
+	// Size is the size of the image file; zero if there is none.
+	Size int64 `json:",omitempty"`
+
+	SourceImage string `json:",omitempty"`
+	Adopted     bool   `json:",omitempty"`
+
+	// HasRecord is false for disks created before disk.json was
+	// introduced and for the leftovers of failed creates.
+	HasRecord bool
+	HasImage  bool
+}
+
+// List returns the disks that have a dir.
+func (f Factory) List() ([]apiv1.DiskCID, error) {
+	err := f.runner.MkdirAll(f.dirPath)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Creating disks dir")
+	}
+
+	names, err := f.runner.List(f.dirPath)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing disks")
+	}
+
+	var cids []apiv1.DiskCID
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "disk-") {
+			cids = append(cids, apiv1.NewDiskCID(name))
+		}
+	}
+
+	return cids, nil
+}
+
+func (f Factory) Info(cid apiv1.DiskCID) (Info, error) {
+	diskPath := f.diskPath(cid)
+
+	rec, hasRecord, err := f.record(cid)
+	if err != nil {
+		return Info{}, err
+	}
+
+	disk := NewDiskImpl(cid, diskPath, rec, f.driver, f.runner, f.locker, f.logger)
+
+	info := Info{
+		CID:         cid.AsString(),
+		Path:        diskPath,
+		ImagePath:   disk.ImagePath(),
+		Props:       rec.Props,
+		SourceImage: rec.SourceImage,
+		Adopted:     rec.Adopted,
+		HasRecord:   hasRecord,
+	}
+
+	stat, err := f.runner.Stat(info.ImagePath)
+	if err == nil {
+		info.HasImage = true
+		info.Size = stat.Size()
+	} else if !os.IsNotExist(err) {
+		return info, bosherr.WrapErrorf(err, "Checking disk image '%s'", info.ImagePath)
+	}
+
+	return info, nil
+}
@@ -5,7 +5,7 @@ import (
 )
 
 type Creator interface {
-	Create(int) (Disk, error)
+	Create(int, DiskProps) (Disk, error)
 }
 
 var _ Creator = Factory{}
@@ -21,6 +21,11 @@ type Disk interface {
 
 	Path() string
 	ImagePath() string
+	Props() DiskProps
+
+	// EncryptionSecret returns the UUID of the libvirt secret holding
+	// the LUKS passphrase, or an empty string for unencrypted disks.
+	EncryptionSecret() string
 
 	Exists() (bool, error)
 	Delete() error
@@ -1,5 +1,17 @@
 package driver
 
+import "time"
+
+// DomainMetadataNamespace identifies the metadata element the CPI adds to
+// the domains it defines.
+const DomainMetadataNamespace = "https://bosh.io/libvirt-cpi/vm"
+
+// DomainMetadata is what the CPI records in the domains it defines, so that
+// they can be told apart from domains defined by others.
+type DomainMetadata struct {
+	Created time.Time
+}
+
 // VMDomainProps holds backend-agnostic VM parameters for domain building.
 type VMDomainProps struct {
 	CPUs     int
@@ -7,17 +19,55 @@ type VMDomainProps struct {
 	// Network is the libvirt network name for the VM's interface (e.g. "default").
 	// If empty, builders use "default".
 	Network string
+
+	// Created is recorded in the domain metadata.
+	Created time.Time
 }
 
 // DomainDiskPaths holds the paths to disk images for a VM domain.
 type DomainDiskPaths struct {
 	RootDisk      string
 	EphemeralDisk string
+
+	// EphemeralFormat is the image format of EphemeralDisk, "raw" if empty.
+	EphemeralFormat string
+
+	// Serials are exposed to the guest so the agent can find disks under /dev/disk/by-id.
+	RootSerial      string
+	EphemeralSerial string
+
+	// Persistent disks present at first boot, e.g. when a VM is recreated.
+	Persistent []DomainDisk
+}
+
+// maxDiskSerialLen is the longest serial QEMU passes through for virtio-blk devices.
+const maxDiskSerialLen = 20
+
+// DiskSerial derives the guest-visible serial for a disk from its CID.
+func DiskSerial(cid string) string {
+	if len(cid) > maxDiskSerialLen {
+		return cid[:maxDiskSerialLen]
+	}
+	return cid
+}
+
+// DomainDisk describes a disk device to be attached to an existing domain.
+type DomainDisk struct {
+	Path     string
+	Format   string // "raw", "qcow2"
+	Bus      string // "virtio", "scsi", "sata"
+	Cache    string // "none", "writethrough", "writeback", "directsync", "unsafe"; hypervisor default if empty
+	Target   string // guest device name, e.g. "vdc"
+	Serial   string
+	ReadOnly bool
+
+	// EncryptionSecret is the UUID of the libvirt secret unlocking a LUKS image.
+	EncryptionSecret string
 }
 
 // DomainBuilder produces libvirt XML domain definitions for a specific backend.
 type DomainBuilder interface {
 	BuildDomain(id string, props VMDomainProps, disks DomainDiskPaths) (string, error)
-	BuildStemcellDomain(id string, imagePath string) (string, error)
+	BuildDiskDevice(disk DomainDisk) (string, error)
 	DiskImageFormat() string // "vmdk", "raw", "qcow2"
 }
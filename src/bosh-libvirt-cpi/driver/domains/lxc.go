@@ -17,8 +17,12 @@ func (b LXCDomainBuilder) BuildDomain(id string, props driver.VMDomainProps, dis
 	if network == "" {
 		network = "default"
 	}
+	persistent, err := diskDeviceElems(disks.Persistent, b.BuildDiskDevice)
+	if err != nil {
+		return "", err
+	}
 	xml := fmt.Sprintf(`<domain type='lxc'>
-  <name>%s</name>
+  <name>%s</name>%s
   <memory unit='KiB'>%d</memory>
   <vcpu>%d</vcpu>
   <os><type>exe</type><init>/sbin/init</init></os>
@@ -34,27 +38,28 @@ func (b LXCDomainBuilder) BuildDomain(id string, props driver.VMDomainProps, dis
     <filesystem type='file'>
       <source file='%s'/>
       <target dir='/mnt/ephemeral'/>
-    </filesystem>
+    </filesystem>%s
     <interface type='network'>
       <source network='%s'/>
     </interface>
   </devices>
-</domain>`, xmlEscape(id), props.MemoryMB*1024, props.CPUs, xmlEscape(disks.RootDisk), xmlEscape(disks.EphemeralDisk), xmlEscape(network))
+</domain>`, xmlEscape(id), metadataElem(props.Created), props.MemoryMB*1024, props.CPUs, xmlEscape(disks.RootDisk), xmlEscape(disks.EphemeralDisk), persistent, xmlEscape(network))
 	return xml, nil
 }
 
-func (b LXCDomainBuilder) BuildStemcellDomain(id string, imagePath string) (string, error) {
-	xml := fmt.Sprintf(`<domain type='lxc'>
-  <name>%s</name>
-  <memory unit='KiB'>524288</memory>
-  <vcpu>1</vcpu>
-  <os><type>exe</type><init>/sbin/init</init></os>
-  <devices>
-    <filesystem type='file'>
-      <source file='%s'/>
-      <target dir='/mnt/root'/>
-    </filesystem>
-  </devices>
-</domain>`, xmlEscape(id), xmlEscape(imagePath))
+func (b LXCDomainBuilder) BuildDiskDevice(disk driver.DomainDisk) (string, error) {
+	if disk.EncryptionSecret != "" {
+		return "", fmt.Errorf("encrypted disks are not supported by the LXC backend")
+	}
+	// Containers have no block bus; the image is loop-mounted into the guest instead.
+	format := disk.Format
+	if format == "" {
+		format = "raw"
+	}
+	xml := fmt.Sprintf(`<filesystem type='file'>
+  <driver type='loop' format='%s'/>
+  <source file='%s'/>
+  <target dir='/mnt/%s'/>%s
+</filesystem>`, xmlEscape(format), xmlEscape(disk.Path), xmlEscape(disk.Target), readOnlyElem(disk.ReadOnly))
 	return xml, nil
 }
@@ -74,18 +74,17 @@ var _ = Describe("LXCDomainBuilder", func() {
 		})
 	})
 
-	Describe("BuildStemcellDomain", func() {
-		It("contains stemcell name and image path", func() {
-			xml, err := builder.BuildStemcellDomain("sc-lxc-1", "/image.raw")
+	Describe("BuildDiskDevice", func() {
+		It("loop-mounts the image as a filesystem", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{
+				Path: "/d.img", Format: "raw", Target: "vdc", ReadOnly: true})
 			Expect(err).To(BeNil())
-			Expect(xml).To(ContainSubstring("sc-lxc-1"))
-			Expect(xml).To(ContainSubstring("/image.raw"))
-		})
-
-		It("uses lxc domain type", func() {
-			xml, err := builder.BuildStemcellDomain("sc-lxc-2", "/img.raw")
-			Expect(err).To(BeNil())
-			Expect(xml).To(ContainSubstring("type='lxc'"))
+			Expect(result).To(ContainSubstring("<filesystem type='file'>"))
+			Expect(result).To(ContainSubstring("format='raw'"))
+			Expect(result).To(ContainSubstring("<target dir='/mnt/vdc'/>"))
+			Expect(result).To(ContainSubstring("<readonly/>"))
+			var v interface{}
+			Expect(xml.NewDecoder(strings.NewReader(result)).Decode(&v)).To(Succeed())
 		})
 	})
 })
@@ -17,8 +17,16 @@ func (b QEMUDomainBuilder) BuildDomain(id string, props driver.VMDomainProps, di
 	if network == "" {
 		network = "default"
 	}
+	ephemeralFormat := disks.EphemeralFormat
+	if ephemeralFormat == "" {
+		ephemeralFormat = "raw"
+	}
+	persistent, err := diskDeviceElems(disks.Persistent, b.BuildDiskDevice)
+	if err != nil {
+		return "", err
+	}
 	xml := fmt.Sprintf(`<domain type='kvm'>
-  <name>%s</name>
+  <name>%s</name>%s
   <memory unit='KiB'>%d</memory>
   <vcpu>%d</vcpu>
   <os><type arch='x86_64' machine='pc'>hvm</type></os>
@@ -27,36 +35,40 @@ func (b QEMUDomainBuilder) BuildDomain(id string, props driver.VMDomainProps, di
     <disk type='file' device='disk'>
       <driver name='qemu' type='qcow2'/>
       <source file='%s'/>
-      <target dev='vda' bus='virtio'/>
+      <target dev='vda' bus='virtio'/>%s
     </disk>
     <disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
+      <driver name='qemu' type='%s'/>
       <source file='%s'/>
-      <target dev='vdb' bus='virtio'/>
-    </disk>
+      <target dev='vdb' bus='virtio'/>%s
+    </disk>%s
+    <controller type='scsi' model='virtio-scsi'/>
     <interface type='network'>
       <source network='%s'/>
       <model type='virtio'/>
     </interface>
   </devices>
-</domain>`, xmlEscape(id), props.MemoryMB*1024, props.CPUs, xmlEscape(disks.RootDisk), xmlEscape(disks.EphemeralDisk), xmlEscape(network))
+</domain>`, xmlEscape(id), metadataElem(props.Created), props.MemoryMB*1024, props.CPUs,
+		xmlEscape(disks.RootDisk), serialElem("      ", disks.RootSerial),
+		xmlEscape(ephemeralFormat), xmlEscape(disks.EphemeralDisk), serialElem("      ", disks.EphemeralSerial), persistent,
+		xmlEscape(network))
 	return xml, nil
 }
 
-func (b QEMUDomainBuilder) BuildStemcellDomain(id string, imagePath string) (string, error) {
-	xml := fmt.Sprintf(`<domain type='kvm'>
-  <name>%s</name>
-  <memory unit='KiB'>524288</memory>
-  <vcpu>1</vcpu>
-  <os><type arch='x86_64' machine='pc'>hvm</type></os>
-  <features><acpi/><apic/></features>
-  <devices>
-    <disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
-      <source file='%s'/>
-      <target dev='vda' bus='virtio'/>
-    </disk>
-  </devices>
-</domain>`, xmlEscape(id), xmlEscape(imagePath))
+func (b QEMUDomainBuilder) BuildDiskDevice(disk driver.DomainDisk) (string, error) {
+	format := disk.Format
+	if format == "" {
+		format = "raw"
+	}
+	bus := disk.Bus
+	if bus == "" {
+		bus = "virtio"
+	}
+	xml := fmt.Sprintf(`<disk type='file' device='disk'>
+  <driver name='qemu' type='%s'%s/>
+  <source file='%s'/>
+  <target dev='%s' bus='%s'/>%s%s%s
+</disk>`, xmlEscape(format), cacheAttr(disk.Cache), xmlEscape(disk.Path), xmlEscape(disk.Target), xmlEscape(bus),
+		serialElem("  ", disk.Serial), readOnlyElem(disk.ReadOnly), encryptionElem(disk.EncryptionSecret))
 	return xml, nil
 }
@@ -3,6 +3,7 @@ package domains_test
 import (
 	"encoding/xml"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -48,6 +49,25 @@ var _ = Describe("QEMUDomainBuilder", func() {
 			Expect(xml).To(ContainSubstring("network='bosh'"))
 		})
 
+		It("includes persistent disks as well-formed devices", func() {
+			out, err := builder.BuildDomain("vm-kvm-p", driver.VMDomainProps{CPUs: 1, MemoryMB: 512},
+				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.qcow2",
+					Persistent: []driver.DomainDisk{{Path: "/p.img", Target: "vdc", Serial: "disk-p"}}})
+			Expect(err).To(BeNil())
+			Expect(out).To(ContainSubstring("<source file='/p.img'/>"))
+			Expect(out).To(ContainSubstring("<target dev='vdc' bus='virtio'/>"))
+			Expect(xml.Unmarshal([]byte(out), new(interface{}))).To(Succeed())
+		})
+
+		It("records the creation time in the CPI's metadata", func() {
+			created := time.Date(2024, 5, 6, 7, 8, 9, 0, time.FixedZone("CEST", 2*60*60))
+			out, err := builder.BuildDomain("vm-kvm-m", driver.VMDomainProps{CPUs: 1, MemoryMB: 512, Created: created},
+				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.qcow2"})
+			Expect(err).To(BeNil())
+			Expect(out).To(ContainSubstring("<cpi:vm xmlns:cpi='" + driver.DomainMetadataNamespace + "' created='2024-05-06T05:08:09Z'/>"))
+			Expect(xml.Unmarshal([]byte(out), new(interface{}))).To(Succeed())
+		})
+
 		It("uses kvm domain type", func() {
 			xml, err := builder.BuildDomain("vm-kvm-2", driver.VMDomainProps{CPUs: 1, MemoryMB: 512},
 				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.qcow2"})
@@ -63,6 +83,18 @@ var _ = Describe("QEMUDomainBuilder", func() {
 			Expect(xml).To(ContainSubstring("2097152"))
 		})
 
+		It("declares the ephemeral disk in its format, raw by default", func() {
+			out, err := builder.BuildDomain("vm-kvm-e", driver.VMDomainProps{CPUs: 1, MemoryMB: 512},
+				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.img"})
+			Expect(err).To(BeNil())
+			Expect(out).To(ContainSubstring("<driver name='qemu' type='raw'/>\n      <source file='/e.img'/>"))
+
+			out, err = builder.BuildDomain("vm-kvm-e", driver.VMDomainProps{CPUs: 1, MemoryMB: 512},
+				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.qcow2", EphemeralFormat: "qcow2"})
+			Expect(err).To(BeNil())
+			Expect(out).To(ContainSubstring("<driver name='qemu' type='qcow2'/>\n      <source file='/e.qcow2'/>"))
+		})
+
 		It("specifies qcow2 disk driver type", func() {
 			xml, err := builder.BuildDomain("vm-kvm-4", driver.VMDomainProps{CPUs: 1, MemoryMB: 512},
 				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.qcow2"})
@@ -82,18 +114,69 @@ var _ = Describe("QEMUDomainBuilder", func() {
 		})
 	})
 
-	Describe("BuildStemcellDomain", func() {
-		It("contains stemcell name and image path", func() {
-			xml, err := builder.BuildStemcellDomain("sc-kvm-1", "/image.qcow2")
+	Describe("disk serials", func() {
+		It("exposes root and ephemeral serials to the guest", func() {
+			result, err := builder.BuildDomain("vm-kvm-5", driver.VMDomainProps{CPUs: 1, MemoryMB: 512},
+				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.qcow2",
+					RootSerial: "vm-kvm-5", EphemeralSerial: "disk-eph"})
 			Expect(err).To(BeNil())
-			Expect(xml).To(ContainSubstring("sc-kvm-1"))
-			Expect(xml).To(ContainSubstring("/image.qcow2"))
+			Expect(result).To(ContainSubstring("<serial>vm-kvm-5</serial>"))
+			Expect(result).To(ContainSubstring("<serial>disk-eph</serial>"))
+			var v interface{}
+			Expect(xml.NewDecoder(strings.NewReader(result)).Decode(&v)).To(Succeed())
 		})
 
-		It("uses kvm domain type", func() {
-			xml, err := builder.BuildStemcellDomain("sc-kvm-2", "/img.qcow2")
+		It("omits serials when none are given", func() {
+			result, err := builder.BuildDomain("vm-kvm-6", driver.VMDomainProps{CPUs: 1, MemoryMB: 512},
+				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.qcow2"})
 			Expect(err).To(BeNil())
-			Expect(xml).To(ContainSubstring("type='kvm'"))
+			Expect(result).ToNot(ContainSubstring("<serial>"))
+		})
+
+		It("exposes the serial of attached disks", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{Path: "/d.img", Target: "vdc", Serial: "disk-1"})
+			Expect(err).To(BeNil())
+			Expect(result).To(ContainSubstring("<serial>disk-1</serial>"))
+		})
+	})
+
+	Describe("BuildDiskDevice", func() {
+		It("uses the disk format, bus and target", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{
+				Path: "/disks/disk-1/disk.img", Format: "qcow2", Bus: "scsi", Target: "sdc"})
+			Expect(err).To(BeNil())
+			Expect(result).To(ContainSubstring("type='qcow2'"))
+			Expect(result).To(ContainSubstring("<source file='/disks/disk-1/disk.img'/>"))
+			Expect(result).To(ContainSubstring("<target dev='sdc' bus='scsi'/>"))
+			Expect(result).ToNot(ContainSubstring("<readonly/>"))
+			var v interface{}
+			Expect(xml.NewDecoder(strings.NewReader(result)).Decode(&v)).To(Succeed())
+		})
+
+		It("defaults to a raw virtio disk", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{Path: "/d.img", Target: "vdc"})
+			Expect(err).To(BeNil())
+			Expect(result).To(ContainSubstring("<driver name='qemu' type='raw'/>"))
+			Expect(result).To(ContainSubstring("bus='virtio'"))
+		})
+
+		It("sets the cache mode of the disk", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{Path: "/d.img", Target: "vdc", Cache: "writeback"})
+			Expect(err).To(BeNil())
+			Expect(result).To(ContainSubstring("<driver name='qemu' type='raw' cache='writeback'/>"))
+		})
+
+		It("marks read-only disks", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{Path: "/d.img", Target: "vdc", ReadOnly: true})
+			Expect(err).To(BeNil())
+			Expect(result).To(ContainSubstring("<readonly/>"))
+		})
+
+		It("references the LUKS secret of encrypted disks", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{Path: "/d.img", Target: "vdc", EncryptionSecret: "secret-1"})
+			Expect(err).To(BeNil())
+			Expect(result).To(ContainSubstring("<encryption format='luks'>"))
+			Expect(result).To(ContainSubstring("<secret type='passphrase' uuid='secret-1'/>"))
 		})
 	})
 })
@@ -17,40 +17,48 @@ func (b VBoxDomainBuilder) BuildDomain(id string, props driver.VMDomainProps, di
 	if network == "" {
 		network = "default"
 	}
+	persistent, err := diskDeviceElems(disks.Persistent, b.BuildDiskDevice)
+	if err != nil {
+		return "", err
+	}
 	xml := fmt.Sprintf(`<domain type='vbox'>
-  <name>%s</name>
+  <name>%s</name>%s
   <memory unit='KiB'>%d</memory>
   <vcpu>%d</vcpu>
   <os><type>hvm</type></os>
   <devices>
     <disk type='file' device='disk'>
       <source file='%s'/>
-      <target dev='sda' bus='ide'/>
+      <target dev='sda' bus='ide'/>%s
     </disk>
     <disk type='file' device='disk'>
       <source file='%s'/>
-      <target dev='sdb' bus='ide'/>
-    </disk>
+      <target dev='sdb' bus='ide'/>%s
+    </disk>%s
     <interface type='network'>
       <source network='%s'/>
     </interface>
   </devices>
-</domain>`, xmlEscape(id), props.MemoryMB*1024, props.CPUs, xmlEscape(disks.RootDisk), xmlEscape(disks.EphemeralDisk), xmlEscape(network))
+</domain>`, xmlEscape(id), metadataElem(props.Created), props.MemoryMB*1024, props.CPUs,
+		xmlEscape(disks.RootDisk), serialElem("      ", disks.RootSerial),
+		xmlEscape(disks.EphemeralDisk), serialElem("      ", disks.EphemeralSerial), persistent,
+		xmlEscape(network))
 	return xml, nil
 }
 
-func (b VBoxDomainBuilder) BuildStemcellDomain(id string, imagePath string) (string, error) {
-	xml := fmt.Sprintf(`<domain type='vbox'>
-  <name>%s</name>
-  <memory unit='KiB'>524288</memory>
-  <vcpu>1</vcpu>
-  <os><type>hvm</type></os>
-  <devices>
-    <disk type='file' device='disk'>
-      <source file='%s'/>
-      <target dev='sda' bus='ide'/>
-    </disk>
-  </devices>
-</domain>`, xmlEscape(id), xmlEscape(imagePath))
+func (b VBoxDomainBuilder) BuildDiskDevice(disk driver.DomainDisk) (string, error) {
+	if disk.EncryptionSecret != "" {
+		return "", fmt.Errorf("encrypted disks are not supported by the VirtualBox backend")
+	}
+	// VirtualBox has no virtio block devices; attach those to the SATA controller.
+	bus := disk.Bus
+	if bus == "" || bus == "virtio" {
+		bus = "sata"
+	}
+	xml := fmt.Sprintf(`<disk type='file' device='disk'>
+  <source file='%s'/>
+  <target dev='%s' bus='%s'/>%s%s
+</disk>`, xmlEscape(disk.Path), xmlEscape(disk.Target), xmlEscape(bus),
+		serialElem("  ", disk.Serial), readOnlyElem(disk.ReadOnly))
 	return xml, nil
 }
@@ -75,18 +75,24 @@ var _ = Describe("VBoxDomainBuilder", func() {
 		})
 	})
 
-	Describe("BuildStemcellDomain", func() {
-		It("contains stemcell name and image path", func() {
-			xml, err := builder.BuildStemcellDomain("sc-123", "/image.vmdk")
+	Describe("BuildDiskDevice", func() {
+		It("attaches virtio disks to the SATA bus", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{Path: "/d.img", Bus: "virtio", Target: "sdc"})
 			Expect(err).To(BeNil())
-			Expect(xml).To(ContainSubstring("sc-123"))
-			Expect(xml).To(ContainSubstring("/image.vmdk"))
+			Expect(result).To(ContainSubstring("<target dev='sdc' bus='sata'/>"))
+			var v interface{}
+			Expect(xml.NewDecoder(strings.NewReader(result)).Decode(&v)).To(Succeed())
 		})
 
-		It("uses vbox domain type", func() {
-			xml, err := builder.BuildStemcellDomain("sc-vbox", "/img.vmdk")
+		It("keeps an explicit scsi bus", func() {
+			result, err := builder.BuildDiskDevice(driver.DomainDisk{Path: "/d.img", Bus: "scsi", Target: "sdc"})
 			Expect(err).To(BeNil())
-			Expect(xml).To(ContainSubstring("type='vbox'"))
+			Expect(result).To(ContainSubstring("bus='scsi'"))
+		})
+
+		It("rejects encrypted disks", func() {
+			_, err := builder.BuildDiskDevice(driver.DomainDisk{Path: "/d.img", Target: "sdc", EncryptionSecret: "secret-1"})
+			Expect(err).To(HaveOccurred())
 		})
 	})
 })
@@ -3,6 +3,10 @@ package domains
 import (
 	"bytes"
 	"encoding/xml"
+	"strings"
+	"time"
+
+	"bosh-libvirt-cpi/driver"
 )
 
 func xmlEscape(s string) string {
@@ -10,3 +14,50 @@ func xmlEscape(s string) string {
 	_ = xml.EscapeText(&b, []byte(s))
 	return b.String()
 }
+
+// metadataElem marks the domain as defined by the CPI.
+func metadataElem(created time.Time) string {
+	return "\n  <metadata>\n    <cpi:vm xmlns:cpi='" + driver.DomainMetadataNamespace +
+		"' created='" + created.UTC().Format(time.RFC3339) + "'/>\n  </metadata>"
+}
+
+func cacheAttr(cache string) string {
+	if cache == "" {
+		return ""
+	}
+	return " cache='" + xmlEscape(cache) + "'"
+}
+
+func readOnlyElem(readOnly bool) string {
+	if readOnly {
+		return "\n  <readonly/>"
+	}
+	return ""
+}
+
+func serialElem(indent, serial string) string {
+	if serial == "" {
+		return ""
+	}
+	return "\n" + indent + "<serial>" + xmlEscape(serial) + "</serial>"
+}
+
+func encryptionElem(secretUUID string) string {
+	if secretUUID == "" {
+		return ""
+	}
+	return "\n  <encryption format='luks'>\n    <secret type='passphrase' uuid='" + xmlEscape(secretUUID) + "'/>\n  </encryption>"
+}
+
+// diskDeviceElems builds each disk and indents the result to sit inside <devices>.
+func diskDeviceElems(disks []driver.DomainDisk, build func(driver.DomainDisk) (string, error)) (string, error) {
+	var b strings.Builder
+	for _, disk := range disks {
+		elem, err := build(disk)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("\n    " + strings.ReplaceAll(elem, "\n", "\n    "))
+	}
+	return b.String(), nil
+}
@@ -1,6 +1,7 @@
 package driver_test
 
 import (
+	"os"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
@@ -11,3 +12,23 @@ func TestDriver(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Driver Suite")
 }
+
+var tempDirs []string
+
+// tempDir returns a directory that is removed after the current spec;
+// GinkgoT().TempDir is a no-op in this version of ginkgo.
+func tempDir() string {
+	dir, err := os.MkdirTemp("", "driver-test")
+	Expect(err).ToNot(HaveOccurred())
+
+	tempDirs = append(tempDirs, dir)
+
+	return dir
+}
+
+var _ = AfterEach(func() {
+	for _, dir := range tempDirs {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	}
+	tempDirs = nil
+})
@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// ErrorClass tells the CPI how a failure of the driver or a Runner
+// should be reported to the director.
+type ErrorClass int
+
+const (
+	ErrorClassOther        ErrorClass = iota
+	ErrorClassNotFound                // the domain, volume or secret does not exist
+	ErrorClassNotSupported            // the backend cannot perform the operation
+	ErrorClassTransient               // the operation may succeed if retried
+)
+
+// ClassifyError looks through bosherr wrapping for a libvirt error,
+// a retryable Runner error or a lock timeout and returns its class.
+func ClassifyError(err error) ErrorClass {
+	for err != nil {
+		switch typedErr := err.(type) {
+		case libvirt.Error:
+			return classifyLibvirtError(typedErr)
+		case RetryableError, LockTimeoutError:
+			return ErrorClassTransient
+		case bosherr.ComplexError:
+			err = typedErr.Cause
+		default:
+			err = errors.Unwrap(err)
+		}
+	}
+
+	return ErrorClassOther
+}
+
+func classifyLibvirtError(err libvirt.Error) ErrorClass {
+	switch err.Code {
+	case libvirt.ERR_NO_DOMAIN, libvirt.ERR_NO_STORAGE_VOL, libvirt.ERR_NO_SECRET:
+		return ErrorClassNotFound
+
+	case libvirt.ERR_NO_SUPPORT, libvirt.ERR_OPERATION_UNSUPPORTED, libvirt.ERR_ARGUMENT_UNSUPPORTED:
+		return ErrorClassNotSupported
+
+	// Connection failures and operations that did not finish in time
+	case libvirt.ERR_RPC, libvirt.ERR_NO_CONNECT, libvirt.ERR_INVALID_CONN,
+		libvirt.ERR_OPERATION_TIMEOUT, libvirt.ERR_OPERATION_ABORTED, libvirt.ERR_AGENT_UNRESPONSIVE,
+		libvirt.ERR_RESOURCE_BUSY:
+		return ErrorClassTransient
+
+	// Most system errors, e.g. a missing file or a full disk, persist;
+	// only those of the connection to libvirtd go away.
+	case libvirt.ERR_SYSTEM_ERROR:
+		if isLibvirtConnectionErr(err) || isConnectionErrnoMessage(err.Message) {
+			return ErrorClassTransient
+		}
+		return ErrorClassOther
+
+	default:
+		return ErrorClassOther
+	}
+}
+
+// isConnectionErrnoMessage reports messages of ECONNRESET and EPIPE.
+func isConnectionErrnoMessage(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, syscall.ECONNRESET.Error()) || strings.Contains(msg, syscall.EPIPE.Error())
+}
+
+// missingDomainErr reports a lookup that returned no domain like libvirt
+// reports an unknown domain name, so that callers treat both alike.
+func missingDomainErr(id string) error {
+	return libvirt.Error{
+		Code:    libvirt.ERR_NO_DOMAIN,
+		Domain:  libvirt.FROM_DOMAIN,
+		Message: "Domain not found: no domain with matching name '" + id + "'",
+		Level:   libvirt.ERR_ERROR,
+	}
+}
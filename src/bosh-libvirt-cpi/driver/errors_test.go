@@ -0,0 +1,56 @@
+package driver_test
+
+import (
+	"errors"
+	"fmt"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	libvirt "libvirt.org/go/libvirt"
+
+	. "bosh-libvirt-cpi/driver"
+)
+
+var _ = Describe("ClassifyError", func() {
+	It("classifies libvirt errors through bosherr wrapping", func() {
+		err := bosherr.WrapError(bosherr.WrapError(libvirt.Error{Code: libvirt.ERR_NO_DOMAIN}, "Looking up"), "Rebooting")
+		Expect(ClassifyError(err)).To(Equal(ErrorClassNotFound))
+
+		err = bosherr.WrapError(libvirt.Error{Code: libvirt.ERR_OPERATION_UNSUPPORTED}, "Snapshotting")
+		Expect(ClassifyError(err)).To(Equal(ErrorClassNotSupported))
+
+		err = fmt.Errorf("Defining: %w", libvirt.Error{Code: libvirt.ERR_RPC})
+		Expect(ClassifyError(err)).To(Equal(ErrorClassTransient))
+	})
+
+	It("treats retryable Runner errors and lock timeouts as transient", func() {
+		err := bosherr.WrapError(RetryableErrorImpl{Err: errors.New("connection reset")}, "Running")
+		Expect(ClassifyError(err)).To(Equal(ErrorClassTransient))
+
+		Expect(ClassifyError(LockTimeoutError{Name: "vm-1"})).To(Equal(ErrorClassTransient))
+	})
+
+	It("only treats system errors of the libvirt connection as transient", func() {
+		err := libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR, Domain: libvirt.FROM_RPC, Message: "Cannot recv data"}
+		Expect(ClassifyError(err)).To(Equal(ErrorClassTransient))
+
+		err = libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR, Message: "Cannot write data: Broken pipe"}
+		Expect(ClassifyError(err)).To(Equal(ErrorClassTransient))
+
+		err = libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR, Message: "Cannot read data: Connection reset by peer"}
+		Expect(ClassifyError(err)).To(Equal(ErrorClassTransient))
+
+		err = libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR, Domain: libvirt.FROM_STORAGE, Message: "No space left on device"}
+		Expect(ClassifyError(err)).To(Equal(ErrorClassOther))
+
+		err = libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR, Domain: libvirt.FROM_QEMU, Message: "Permission denied"}
+		Expect(ClassifyError(err)).To(Equal(ErrorClassOther))
+	})
+
+	It("leaves other errors alone", func() {
+		Expect(ClassifyError(errors.New("fake-err"))).To(Equal(ErrorClassOther))
+		Expect(ClassifyError(libvirt.Error{Code: libvirt.ERR_XML_ERROR})).To(Equal(ErrorClassOther))
+		Expect(ClassifyError(nil)).To(Equal(ErrorClassOther))
+	})
+})
@@ -1,21 +1,27 @@
 package driver
 
 import (
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 var (
 	homeMarker = "~"
 )
 
+// ExpandingPathRunner resolves the home dir once and may be shared by
+// concurrent CPI calls.
 type ExpandingPathRunner struct {
-	other           RawRunner
+	other RawRunner
+
+	mu              sync.Mutex
 	resolvedHomeDir string
 }
 
 func NewExpandingPathRunner(other RawRunner) *ExpandingPathRunner {
-	return &ExpandingPathRunner{other, ""}
+	return &ExpandingPathRunner{other: other}
 }
 
 func (r *ExpandingPathRunner) Execute(path string, args ...string) (string, int, error) {
@@ -49,6 +55,30 @@ func (r *ExpandingPathRunner) Put(path string, contents []byte) error {
 	return r.other.Put(path, contents)
 }
 
+func (r *ExpandingPathRunner) PutPrivate(path string, contents []byte) error {
+	path, err := r.expandPath(path)
+	if err != nil {
+		return err
+	}
+	return r.other.PutPrivate(path, contents)
+}
+
+func (r *ExpandingPathRunner) Rename(src, dst string) error {
+	paths, err := r.expandPaths([]string{src, dst})
+	if err != nil {
+		return err
+	}
+	return r.other.Rename(paths[0], paths[1])
+}
+
+func (r *ExpandingPathRunner) Symlink(target, path string) error {
+	paths, err := r.expandPaths([]string{target, path})
+	if err != nil {
+		return err
+	}
+	return r.other.Symlink(paths[0], paths[1])
+}
+
 func (r *ExpandingPathRunner) Get(path string) ([]byte, error) {
 	path, err := r.expandPath(path)
 	if err != nil {
@@ -57,6 +87,46 @@ func (r *ExpandingPathRunner) Get(path string) ([]byte, error) {
 	return r.other.Get(path)
 }
 
+func (r *ExpandingPathRunner) MkdirAll(dir string) error {
+	dir, err := r.expandPath(dir)
+	if err != nil {
+		return err
+	}
+	return r.other.MkdirAll(dir)
+}
+
+func (r *ExpandingPathRunner) List(dir string) ([]string, error) {
+	dir, err := r.expandPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	return r.other.List(dir)
+}
+
+func (r *ExpandingPathRunner) Remove(path string) error {
+	path, err := r.expandPath(path)
+	if err != nil {
+		return err
+	}
+	return r.other.Remove(path)
+}
+
+func (r *ExpandingPathRunner) Stat(path string) (os.FileInfo, error) {
+	path, err := r.expandPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return r.other.Stat(path)
+}
+
+func (r *ExpandingPathRunner) CreateSparseFile(path string, size int64) error {
+	path, err := r.expandPath(path)
+	if err != nil {
+		return err
+	}
+	return r.other.CreateSparseFile(path, size)
+}
+
 func (r *ExpandingPathRunner) expandPaths(args []string) ([]string, error) {
 	var expandedArgs []string
 	var err error
@@ -82,6 +152,9 @@ func (r *ExpandingPathRunner) expandPath(arg string) (string, error) {
 }
 
 func (r *ExpandingPathRunner) homeDir() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if len(r.resolvedHomeDir) > 0 {
 		return r.resolvedHomeDir, nil
 	}
@@ -3,11 +3,14 @@ package fakes
 import "bosh-libvirt-cpi/driver"
 
 type FakeDomainBuilder struct {
-	BuildDomainXML string
-	BuildDomainErr error
+	BuildDomainProps driver.VMDomainProps
+	BuildDomainDisks driver.DomainDiskPaths
+	BuildDomainXML   string
+	BuildDomainErr   error
 
-	BuildStemcellDomainXML string
-	BuildStemcellDomainErr error
+	BuildDiskDeviceArg driver.DomainDisk
+	BuildDiskDeviceXML string
+	BuildDiskDeviceErr error
 
 	DiskImageFormatResult string
 }
@@ -15,11 +18,14 @@ type FakeDomainBuilder struct {
 var _ driver.DomainBuilder = &FakeDomainBuilder{}
 
 func (b *FakeDomainBuilder) BuildDomain(id string, props driver.VMDomainProps, disks driver.DomainDiskPaths) (string, error) {
+	b.BuildDomainProps = props
+	b.BuildDomainDisks = disks
 	return b.BuildDomainXML, b.BuildDomainErr
 }
 
-func (b *FakeDomainBuilder) BuildStemcellDomain(id string, imagePath string) (string, error) {
-	return b.BuildStemcellDomainXML, b.BuildStemcellDomainErr
+func (b *FakeDomainBuilder) BuildDiskDevice(disk driver.DomainDisk) (string, error) {
+	b.BuildDiskDeviceArg = disk
+	return b.BuildDiskDeviceXML, b.BuildDiskDeviceErr
 }
 
 func (b *FakeDomainBuilder) DiskImageFormat() string { return b.DiskImageFormatResult }
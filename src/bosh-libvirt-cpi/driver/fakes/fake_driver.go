@@ -22,6 +22,14 @@ type FakeDriver struct {
 	LookupDomainDom driver.Domain
 	LookupDomainErr error
 
+	ListDomainsResult []string
+	ListDomainsErr    error
+
+	// DomainMetadataResults holds the metadata of each domain; domains
+	// missing from it have none.
+	DomainMetadataResults map[string]driver.DomainMetadata
+	DomainMetadataErr     error
+
 	UpdateMemoryID  string
 	UpdateMemoryMB  int
 	UpdateMemoryErr error
@@ -30,16 +38,48 @@ type FakeDriver struct {
 	UpdateCPUs    int
 	UpdateCPUsErr error
 
-	CreateStorageVolPool   string
-	CreateStorageVolName   string
-	CreateStorageVolSizeMB int
-	CreateStorageVolPath   string
-	CreateStorageVolErr    error
+	AttachDeviceID  string
+	AttachDeviceXML string
+	AttachDeviceErr error
+
+	DetachDeviceID  string
+	DetachDeviceXML string
+	DetachDeviceErr error
+
+	CreateStorageVolPool  string
+	CreateStorageVolName  string
+	CreateStorageVolProps driver.StorageVolProps
+	CreateStorageVolPath  string
+	CreateStorageVolErr   error
 
 	DeleteStorageVolPool string
 	DeleteStorageVolName string
 	DeleteStorageVolErr  error
 
+	LookupStorageVolPathPool   string
+	LookupStorageVolPathName   string
+	LookupStorageVolPathResult string
+	LookupStorageVolPathErr    error
+
+	StoragePoolActiveName   string
+	StoragePoolActiveResult bool
+	StoragePoolActiveErr    error
+
+	NetworkActiveName   string
+	NetworkActiveResult bool
+	NetworkActiveErr    error
+
+	CapabilitiesResult string
+	CapabilitiesErr    error
+
+	CreateSecretDescription string
+	CreateSecretValue       []byte
+	CreateSecretUUID        string
+	CreateSecretErr         error
+
+	DeleteSecretUUID string
+	DeleteSecretErr  error
+
 	IsMissingDomainErrInput  error
 	IsMissingDomainErrResult bool
 }
@@ -76,6 +116,15 @@ func (d *FakeDriver) LookupDomain(id string) (driver.Domain, error) {
 	return d.LookupDomainDom, d.LookupDomainErr
 }
 
+func (d *FakeDriver) ListDomains() ([]string, error) {
+	return d.ListDomainsResult, d.ListDomainsErr
+}
+
+func (d *FakeDriver) DomainMetadata(id string) (driver.DomainMetadata, bool, error) {
+	meta, found := d.DomainMetadataResults[id]
+	return meta, found, d.DomainMetadataErr
+}
+
 func (d *FakeDriver) UpdateDomainMemory(id string, memoryMB int) error {
 	d.UpdateMemoryID = id
 	d.UpdateMemoryMB = memoryMB
@@ -88,10 +137,22 @@ func (d *FakeDriver) UpdateDomainCPUs(id string, cpus int) error {
 	return d.UpdateCPUsErr
 }
 
-func (d *FakeDriver) CreateStorageVol(poolName, volName string, sizeMB int) (string, error) {
+func (d *FakeDriver) AttachDevice(id string, xml string) error {
+	d.AttachDeviceID = id
+	d.AttachDeviceXML = xml
+	return d.AttachDeviceErr
+}
+
+func (d *FakeDriver) DetachDevice(id string, xml string) error {
+	d.DetachDeviceID = id
+	d.DetachDeviceXML = xml
+	return d.DetachDeviceErr
+}
+
+func (d *FakeDriver) CreateStorageVol(poolName, volName string, props driver.StorageVolProps) (string, error) {
 	d.CreateStorageVolPool = poolName
 	d.CreateStorageVolName = volName
-	d.CreateStorageVolSizeMB = sizeMB
+	d.CreateStorageVolProps = props
 	return d.CreateStorageVolPath, d.CreateStorageVolErr
 }
 
@@ -101,6 +162,37 @@ func (d *FakeDriver) DeleteStorageVol(poolName, volName string) error {
 	return d.DeleteStorageVolErr
 }
 
+func (d *FakeDriver) LookupStorageVolPath(poolName, volName string) (string, error) {
+	d.LookupStorageVolPathPool = poolName
+	d.LookupStorageVolPathName = volName
+	return d.LookupStorageVolPathResult, d.LookupStorageVolPathErr
+}
+
+func (d *FakeDriver) StoragePoolActive(poolName string) (bool, error) {
+	d.StoragePoolActiveName = poolName
+	return d.StoragePoolActiveResult, d.StoragePoolActiveErr
+}
+
+func (d *FakeDriver) NetworkActive(name string) (bool, error) {
+	d.NetworkActiveName = name
+	return d.NetworkActiveResult, d.NetworkActiveErr
+}
+
+func (d *FakeDriver) Capabilities() (string, error) {
+	return d.CapabilitiesResult, d.CapabilitiesErr
+}
+
+func (d *FakeDriver) CreateSecret(description string, value []byte) (string, error) {
+	d.CreateSecretDescription = description
+	d.CreateSecretValue = value
+	return d.CreateSecretUUID, d.CreateSecretErr
+}
+
+func (d *FakeDriver) DeleteSecret(uuid string) error {
+	d.DeleteSecretUUID = uuid
+	return d.DeleteSecretErr
+}
+
 func (d *FakeDriver) IsMissingDomainErr(err error) bool {
 	d.IsMissingDomainErrInput = err
 	return d.IsMissingDomainErrResult
@@ -6,38 +6,111 @@ import (
 )
 
 type FakeLibvirtConn struct {
-	DomainDefineXMLArg string
-	DomainDefineXMLErr error
+	DomainDefineXMLArg   string
+	DomainDefineXMLCalls int
+	DomainDefineXMLErr   error
+	DomainDefineXMLErrs  []error // returned by the first calls, before DomainDefineXMLErr
 
-	LookupDomainByNameErr error
+	LookupDomainByNameCalls int
+	LookupDomainByNameErr   error
+	LookupDomainByNameErrs  []error // returned by the first calls, before LookupDomainByNameErr
 
-	LookupStoragePoolByNameErr error
+	ListAllDomainsErr error
+
+	LookupStoragePoolByNameCalls int
+	LookupStoragePoolByNameErr   error
+	LookupStoragePoolByNameErrs  []error // returned by the first calls, before LookupStoragePoolByNameErr
+
+	LookupNetworkByNameErr error
+
+	GetCapabilitiesResult string
+	GetCapabilitiesErr    error
+
+	SecretDefineXMLArg   string
+	SecretDefineXMLCalls int
+	SecretDefineXMLErr   error
+	SecretDefineXMLErrs  []error // returned by the first calls, before SecretDefineXMLErr
+
+	LookupSecretByUUIDStringArg string
+	LookupSecretByUUIDStringErr error
+
+	ReconnectCalls int
+	ReconnectErr   error
 }
 
 var _ driver.LibvirtConn = &FakeLibvirtConn{}
 
 func (c *FakeLibvirtConn) DomainDefineXML(xml string) (*libvirt.Domain, error) {
 	c.DomainDefineXMLArg = xml
-	if c.DomainDefineXMLErr != nil {
-		return nil, c.DomainDefineXMLErr
+	c.DomainDefineXMLCalls++
+	if err := nextErr(&c.DomainDefineXMLErrs, c.DomainDefineXMLErr); err != nil {
+		return nil, err
 	}
 	return nil, nil
 }
 
 func (c *FakeLibvirtConn) LookupDomainByName(id string) (*libvirt.Domain, error) {
-	if c.LookupDomainByNameErr != nil {
-		return nil, c.LookupDomainByNameErr
+	c.LookupDomainByNameCalls++
+	if err := nextErr(&c.LookupDomainByNameErrs, c.LookupDomainByNameErr); err != nil {
+		return nil, err
 	}
 	return nil, nil
 }
 
+func (c *FakeLibvirtConn) ListAllDomains() ([]libvirt.Domain, error) {
+	return nil, c.ListAllDomainsErr
+}
+
 func (c *FakeLibvirtConn) LookupStoragePoolByName(name string) (*libvirt.StoragePool, error) {
-	if c.LookupStoragePoolByNameErr != nil {
-		return nil, c.LookupStoragePoolByNameErr
+	c.LookupStoragePoolByNameCalls++
+	if err := nextErr(&c.LookupStoragePoolByNameErrs, c.LookupStoragePoolByNameErr); err != nil {
+		return nil, err
 	}
 	return nil, nil
 }
 
+func (c *FakeLibvirtConn) LookupNetworkByName(name string) (*libvirt.Network, error) {
+	if c.LookupNetworkByNameErr != nil {
+		return nil, c.LookupNetworkByNameErr
+	}
+	return nil, nil
+}
+
+func (c *FakeLibvirtConn) GetCapabilities() (string, error) {
+	return c.GetCapabilitiesResult, c.GetCapabilitiesErr
+}
+
+func (c *FakeLibvirtConn) SecretDefineXML(xml string) (*libvirt.Secret, error) {
+	c.SecretDefineXMLArg = xml
+	c.SecretDefineXMLCalls++
+	if err := nextErr(&c.SecretDefineXMLErrs, c.SecretDefineXMLErr); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (c *FakeLibvirtConn) LookupSecretByUUIDString(uuid string) (*libvirt.Secret, error) {
+	c.LookupSecretByUUIDStringArg = uuid
+	if c.LookupSecretByUUIDStringErr != nil {
+		return nil, c.LookupSecretByUUIDStringErr
+	}
+	return nil, nil
+}
+
+func (c *FakeLibvirtConn) Reconnect() error {
+	c.ReconnectCalls++
+	return c.ReconnectErr
+}
+
 func (c *FakeLibvirtConn) Close() (int, error) {
 	return 0, nil
 }
+
+func nextErr(errs *[]error, last error) error {
+	if len(*errs) == 0 {
+		return last
+	}
+	err := (*errs)[0]
+	*errs = (*errs)[1:]
+	return err
+}
@@ -0,0 +1,53 @@
+package fakes
+
+import (
+	"sync"
+
+	"bosh-libvirt-cpi/driver"
+)
+
+type FakeLocker struct {
+	mu sync.Mutex
+
+	LockCalls   []string // names of every Lock call
+	UnlockCalls []string // names of every Unlock call
+	LockErr     error
+	UnlockErr   error
+
+	// Held lists the names currently locked.
+	Held map[string]bool
+}
+
+var _ driver.Locker = &FakeLocker{}
+
+type fakeLock struct {
+	locker *FakeLocker
+	name   string
+}
+
+func (l *FakeLocker) Lock(name string) (driver.Lock, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.LockCalls = append(l.LockCalls, name)
+	if l.LockErr != nil {
+		return nil, l.LockErr
+	}
+
+	if l.Held == nil {
+		l.Held = map[string]bool{}
+	}
+	l.Held[name] = true
+
+	return fakeLock{l, name}, nil
+}
+
+func (l fakeLock) Unlock() error {
+	l.locker.mu.Lock()
+	defer l.locker.mu.Unlock()
+
+	l.locker.UnlockCalls = append(l.locker.UnlockCalls, l.name)
+	delete(l.locker.Held, l.name)
+
+	return l.locker.UnlockErr
+}
@@ -1,30 +1,76 @@
 package fakes
 
-import "bosh-libvirt-cpi/driver"
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"bosh-libvirt-cpi/driver"
+)
 
 type FakeRunner struct {
 	ExecuteOutput string
 	ExecuteStatus int
 	ExecuteErr    error
+	ExecuteCalls  [][]string // command and args of every Execute call
+
+	// ExecuteOutputs overrides ExecuteOutput for specific command lines,
+	// keyed by the command and its args joined with spaces.
+	ExecuteOutputs map[string]string
 
-	UploadErr error
+	UploadCalls [][2]string // src and dst of every Upload call
+	UploadErr   error
 
-	PutContents map[string][]byte // keyed by path; populated by Put calls
+	PutContents map[string][]byte // keyed by path; populated by Put and PutPrivate calls
 	PutErr      error
 
+	PrivatePaths []string // paths of every PutPrivate call
+
 	// GetResult, if non-nil, is returned for every Get call regardless of path.
 	// If nil, Get returns whatever was last Put to the same path.
 	GetResult []byte
 	GetErr    error
+
+	MkdirAllCalls []string
+	MkdirAllErr   error
+
+	// ListResults overrides List for specific dirs. Otherwise List
+	// returns the names of the files Put directly into dir.
+	ListResults map[string][]string
+	ListErr     error
+
+	RemoveCalls []string // paths of every Remove call; files stay in PutContents
+	RemoveErr   error
+
+	// StatErr, if set, is returned for every Stat call. Otherwise Stat finds
+	// files that were Put or created as sparse files and dirs created with MkdirAll.
+	StatErr error
+
+	SparseFiles         map[string]int64 // sizes keyed by path; populated by CreateSparseFile calls
+	CreateSparseFileErr error
+
+	RenameCalls [][2]string // src and dst of every Rename call; files are not moved
+	RenameErr   error
+
+	SymlinkCalls [][2]string // target and path of every Symlink call
+	SymlinkErr   error
 }
 
 var _ driver.Runner = &FakeRunner{}
 
 func (r *FakeRunner) Execute(path string, args ...string) (string, int, error) {
+	cmd := append([]string{path}, args...)
+	r.ExecuteCalls = append(r.ExecuteCalls, cmd)
+	if output, ok := r.ExecuteOutputs[strings.Join(cmd, " ")]; ok {
+		return output, r.ExecuteStatus, r.ExecuteErr
+	}
 	return r.ExecuteOutput, r.ExecuteStatus, r.ExecuteErr
 }
 
 func (r *FakeRunner) Upload(srcDir, dstDir string) error {
+	r.UploadCalls = append(r.UploadCalls, [2]string{srcDir, dstDir})
 	return r.UploadErr
 }
 
@@ -36,6 +82,11 @@ func (r *FakeRunner) Put(path string, contents []byte) error {
 	return r.PutErr
 }
 
+func (r *FakeRunner) PutPrivate(path string, contents []byte) error {
+	r.PrivatePaths = append(r.PrivatePaths, path)
+	return r.Put(path, contents)
+}
+
 func (r *FakeRunner) Get(path string) ([]byte, error) {
 	if r.GetResult != nil {
 		return r.GetResult, r.GetErr
@@ -47,3 +98,99 @@ func (r *FakeRunner) Get(path string) ([]byte, error) {
 	}
 	return nil, r.GetErr
 }
+
+func (r *FakeRunner) MkdirAll(dir string) error {
+	r.MkdirAllCalls = append(r.MkdirAllCalls, dir)
+	return r.MkdirAllErr
+}
+
+func (r *FakeRunner) List(dir string) ([]string, error) {
+	if r.ListErr != nil {
+		return nil, r.ListErr
+	}
+
+	if names, ok := r.ListResults[dir]; ok {
+		return names, nil
+	}
+
+	var names []string
+	for path := range r.PutContents {
+		if filepath.Dir(path) == dir {
+			names = append(names, filepath.Base(path))
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (r *FakeRunner) Remove(path string) error {
+	r.RemoveCalls = append(r.RemoveCalls, path)
+	return r.RemoveErr
+}
+
+func (r *FakeRunner) Rename(src, dst string) error {
+	r.RenameCalls = append(r.RenameCalls, [2]string{src, dst})
+	return r.RenameErr
+}
+
+func (r *FakeRunner) Symlink(target, path string) error {
+	r.SymlinkCalls = append(r.SymlinkCalls, [2]string{target, path})
+	return r.SymlinkErr
+}
+
+func (r *FakeRunner) Stat(path string) (os.FileInfo, error) {
+	if r.StatErr != nil {
+		return nil, r.StatErr
+	}
+
+	if contents, ok := r.PutContents[path]; ok {
+		return FakeFileInfo{FileName: filepath.Base(path), FileSize: int64(len(contents))}, nil
+	}
+
+	if size, ok := r.SparseFiles[path]; ok {
+		return FakeFileInfo{FileName: filepath.Base(path), FileSize: size}, nil
+	}
+
+	for _, dir := range r.MkdirAllCalls {
+		if dir == path || strings.HasPrefix(dir, path+"/") {
+			return FakeFileInfo{FileName: filepath.Base(path), Dir: true}, nil
+		}
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
+func (r *FakeRunner) CreateSparseFile(path string, size int64) error {
+	if r.CreateSparseFileErr != nil {
+		return r.CreateSparseFileErr
+	}
+
+	if r.SparseFiles == nil {
+		r.SparseFiles = make(map[string]int64)
+	}
+	r.SparseFiles[path] = size
+
+	return nil
+}
+
+type FakeFileInfo struct {
+	FileName string
+	FileSize int64
+	Dir      bool
+}
+
+func (i FakeFileInfo) Name() string { return i.FileName }
+func (i FakeFileInfo) Size() int64  { return i.FileSize }
+
+func (i FakeFileInfo) Mode() os.FileMode {
+	if i.Dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i FakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (i FakeFileInfo) IsDir() bool        { return i.Dir }
+func (i FakeFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+)
+
+// FlockLocker locks files in dir with flock(2). It is used when the store
+// is on the local host. The kernel drops the lock of a process that dies,
+// so these locks never go stale. Lock files are left in place, since
+// removing one while another process waits on it would let two holders in.
+type FlockLocker struct {
+	dir  string
+	fs   boshsys.FileSystem
+	opts LockerOpts
+
+	logTag string
+	logger boshlog.Logger
+}
+
+type flockLock struct {
+	file *os.File
+}
+
+func NewFlockLocker(dir string, fs boshsys.FileSystem, opts LockerOpts, logger boshlog.Logger) FlockLocker {
+	return FlockLocker{dir, fs, opts.withDefaults(), "driver.FlockLocker", logger}
+}
+
+func (l FlockLocker) Lock(name string) (Lock, error) {
+	dir, err := l.fs.ExpandPath(l.dir)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Expanding lock dir '%s'", l.dir)
+	}
+
+	path, err := lockPath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Creating lock dir '%s'", dir)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Opening lock '%s'", path)
+	}
+
+	deadline := time.Now().Add(l.opts.Timeout)
+
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			l.logger.Debug(l.logTag, "Acquired lock '%s'", name)
+			return flockLock{file}, nil
+		}
+
+		if err != syscall.EWOULDBLOCK {
+			_ = file.Close()
+			return nil, bosherr.WrapErrorf(err, "Locking '%s'", path)
+		}
+
+		if time.Now().After(deadline) {
+			_ = file.Close()
+			return nil, lockTimeoutErr(name, l.opts.Timeout)
+		}
+
+		time.Sleep(l.opts.PollInterval)
+	}
+}
+
+func (l flockLock) Unlock() error {
+	// Closing the file releases the lock
+	return l.file.Close()
+}
@@ -1,5 +1,7 @@
 package driver
 
+import "os"
+
 type Driver interface {
 	// Domain lifecycle
 	DefineDomain(xml string) error
@@ -9,18 +11,52 @@ type Driver interface {
 	RebootDomain(id string) error
 	LookupDomain(id string) (Domain, error)
 
+	// ListDomains returns the names of all domains, running or not.
+	ListDomains() ([]string, error)
+
+	// DomainMetadata returns the metadata the CPI recorded in the domain,
+	// and false if it has none, e.g. because it was not defined by the CPI.
+	DomainMetadata(id string) (DomainMetadata, bool, error)
+
 	// Domain config
 	UpdateDomainMemory(id string, memoryMB int) error
 	UpdateDomainCPUs(id string, cpus int) error
 
+	// Domain devices
+	AttachDevice(id string, xml string) error
+	DetachDevice(id string, xml string) error
+
 	// Storage
-	CreateStorageVol(poolName, volName string, sizeMB int) (string, error)
+	CreateStorageVol(poolName, volName string, props StorageVolProps) (string, error)
 	DeleteStorageVol(poolName, volName string) error
+	LookupStorageVolPath(poolName, volName string) (string, error)
+
+	// StoragePoolActive and NetworkActive fail if the pool or network does not exist.
+	StoragePoolActive(poolName string) (bool, error)
+	NetworkActive(name string) (bool, error)
+
+	// Capabilities returns the host's capabilities XML.
+	Capabilities() (string, error)
+
+	// Secrets
+	CreateSecret(description string, value []byte) (string, error)
+	DeleteSecret(uuid string) error
 
 	// Error helpers
 	IsMissingDomainErr(err error) bool
 }
 
+// StorageVolProps describes a volume to be created in a libvirt storage pool.
+type StorageVolProps struct {
+	SizeMB        int
+	Format        string // "raw", "qcow2"; pool default if empty
+	Preallocation string // "off", "metadata", "falloc", "full"; treated as "off" if empty
+
+	// EncryptionSecret is the UUID of a libvirt secret holding the LUKS passphrase.
+	// If empty, the volume is not encrypted.
+	EncryptionSecret string
+}
+
 type Domain interface {
 	GetName() (string, error)
 	GetState() (int, int, error)
@@ -31,8 +67,39 @@ type Domain interface {
 type Runner interface {
 	Execute(path string, args ...string) (string, int, error)
 	Upload(srcDir, dstDir string) error
+
+	// Put replaces path atomically: contents are written to a temporary
+	// file, synced to disk and renamed into place.
 	Put(path string, contents []byte) error
+
+	// PutPrivate is like Put, but the file is readable by its owner only
+	// from the moment it is created, e.g. for keys.
+	PutPrivate(path string, contents []byte) error
+
 	Get(path string) ([]byte, error)
+
+	// MkdirAll creates dir and any missing parents.
+	MkdirAll(dir string) error
+
+	// List returns the sorted names of the entries in dir.
+	List(dir string) ([]string, error)
+
+	// Remove deletes path, including its contents if it is a directory.
+	// A missing path is not an error.
+	Remove(path string) error
+
+	// Rename replaces dst with src.
+	Rename(src, dst string) error
+
+	// Symlink makes path a symbolic link to target, replacing whatever path
+	// was, even a link to a directory, without a moment where it is missing.
+	Symlink(target, path string) error
+
+	// Stat describes path. If path does not exist, os.IsNotExist(err) is true.
+	Stat(path string) (os.FileInfo, error)
+
+	// CreateSparseFile creates path with size bytes that take no space until written.
+	CreateSparseFile(path string, size int64) error
 }
 
 var _ Runner = LocalRunner{}
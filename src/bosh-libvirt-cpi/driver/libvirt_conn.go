@@ -1,34 +1,95 @@
 package driver
 
-import libvirt "libvirt.org/go/libvirt"
+import (
+	"sync"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	libvirt "libvirt.org/go/libvirt"
+)
 
 // LibvirtConn wraps *libvirt.Connect to make LibvirtDriver unit-testable.
 type LibvirtConn interface {
 	DomainDefineXML(xml string) (*libvirt.Domain, error)
 	LookupDomainByName(id string) (*libvirt.Domain, error)
+	ListAllDomains() ([]libvirt.Domain, error)
 	LookupStoragePoolByName(name string) (*libvirt.StoragePool, error)
+	LookupNetworkByName(name string) (*libvirt.Network, error)
+	GetCapabilities() (string, error)
+	SecretDefineXML(xml string) (*libvirt.Secret, error)
+	LookupSecretByUUIDString(uuid string) (*libvirt.Secret, error)
+
+	// Reconnect replaces a connection that was dropped, e.g. by a libvirtd restart.
+	Reconnect() error
+
 	Close() (int, error)
 }
 
 // LibvirtConnImpl wraps a real *libvirt.Connect.
 type LibvirtConnImpl struct {
+	dial func() (*libvirt.Connect, error)
+
+	mu   sync.RWMutex
 	conn *libvirt.Connect
 }
 
 // NewLibvirtConnImpl wraps a real *libvirt.Connect in a LibvirtConnImpl.
-func NewLibvirtConnImpl(conn *libvirt.Connect) LibvirtConnImpl {
-	return LibvirtConnImpl{conn: conn}
+// Reconnect opens a new connection with dial; it fails if dial is nil.
+func NewLibvirtConnImpl(conn *libvirt.Connect, dial func() (*libvirt.Connect, error)) *LibvirtConnImpl {
+	return &LibvirtConnImpl{conn: conn, dial: dial}
 }
 
-func (c LibvirtConnImpl) DomainDefineXML(xml string) (*libvirt.Domain, error) {
-	return c.conn.DomainDefineXML(xml)
+func (c *LibvirtConnImpl) current() *libvirt.Connect {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+func (c *LibvirtConnImpl) DomainDefineXML(xml string) (*libvirt.Domain, error) {
+	return c.current().DomainDefineXML(xml)
+}
+func (c *LibvirtConnImpl) LookupDomainByName(id string) (*libvirt.Domain, error) {
+	return c.current().LookupDomainByName(id)
+}
+func (c *LibvirtConnImpl) ListAllDomains() ([]libvirt.Domain, error) {
+	return c.current().ListAllDomains(0)
+}
+func (c *LibvirtConnImpl) LookupStoragePoolByName(name string) (*libvirt.StoragePool, error) {
+	return c.current().LookupStoragePoolByName(name)
 }
-func (c LibvirtConnImpl) LookupDomainByName(id string) (*libvirt.Domain, error) {
-	return c.conn.LookupDomainByName(id)
+func (c *LibvirtConnImpl) LookupNetworkByName(name string) (*libvirt.Network, error) {
+	return c.current().LookupNetworkByName(name)
 }
-func (c LibvirtConnImpl) LookupStoragePoolByName(name string) (*libvirt.StoragePool, error) {
-	return c.conn.LookupStoragePoolByName(name)
+func (c *LibvirtConnImpl) GetCapabilities() (string, error) {
+	return c.current().GetCapabilities()
 }
-func (c LibvirtConnImpl) Close() (int, error) {
-	return c.conn.Close()
+func (c *LibvirtConnImpl) SecretDefineXML(xml string) (*libvirt.Secret, error) {
+	return c.current().SecretDefineXML(xml, 0)
+}
+func (c *LibvirtConnImpl) LookupSecretByUUIDString(uuid string) (*libvirt.Secret, error) {
+	return c.current().LookupSecretByUUIDString(uuid)
+}
+
+func (c *LibvirtConnImpl) Reconnect() error {
+	if c.dial == nil {
+		return bosherr.Error("Reconnecting to libvirt is not supported")
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return bosherr.WrapError(err, "Reconnecting to libvirt")
+	}
+
+	c.mu.Lock()
+	old := c.conn
+	c.conn = conn
+	c.mu.Unlock()
+
+	// The old connection is dead; closing it only releases its resources
+	_, _ = old.Close()
+
+	return nil
+}
+
+func (c *LibvirtConnImpl) Close() (int, error) {
+	return c.current().Close()
 }
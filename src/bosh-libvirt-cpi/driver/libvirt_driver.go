@@ -5,48 +5,146 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"time"
 
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshuuid "github.com/cloudfoundry/bosh-utils/uuid"
 	libvirt "libvirt.org/go/libvirt"
 )
 
+type LibvirtDriverOpts struct {
+	// RetryAttempts is how many times an operation is tried while it fails
+	// transiently; defaults to 5 if zero.
+	RetryAttempts int
+
+	// RetryDelay is the pause after the first failed attempt, doubled after
+	// each further one up to RetryMaxDelay; defaults to 1s if zero.
+	RetryDelay time.Duration
+
+	// RetryMaxDelay defaults to 30s if zero.
+	RetryMaxDelay time.Duration
+}
+
+const (
+	defaultLibvirtRetryAttempts = 5
+	defaultLibvirtRetryDelay    = 1 * time.Second
+	defaultLibvirtRetryMaxDelay = 30 * time.Second
+)
+
 type LibvirtDriver struct {
 	conn       LibvirtConn
 	domBuilder DomainBuilder
+	opts       LibvirtDriverOpts
+	retrier    Retrier
+	uuidGen    boshuuid.Generator
 	logTag     string
 	logger     boshlog.Logger
 }
 
-func NewLibvirtDriver(conn LibvirtConn, builder DomainBuilder, logger boshlog.Logger) LibvirtDriver {
+func NewLibvirtDriver(conn LibvirtConn, builder DomainBuilder, opts LibvirtDriverOpts, logger boshlog.Logger) LibvirtDriver {
+	if opts.RetryAttempts == 0 {
+		opts.RetryAttempts = defaultLibvirtRetryAttempts
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = defaultLibvirtRetryDelay
+	}
+	if opts.RetryMaxDelay == 0 {
+		opts.RetryMaxDelay = defaultLibvirtRetryMaxDelay
+	}
+
 	return LibvirtDriver{
 		conn:       conn,
 		domBuilder: builder,
+		opts:       opts,
+		retrier:    RetrierImpl{},
+		uuidGen:    boshuuid.NewGenerator(),
 		logTag:     "driver.LibvirtDriver",
 		logger:     logger,
 	}
 }
 
+// retry runs op again while it fails with a transient libvirt error,
+// reconnecting first if the connection was lost. Other errors are
+// returned as they are. op must be safe to repeat after an attempt that
+// took effect but still failed, e.g. because the reply was lost.
+func (d LibvirtDriver) retry(op func() error) error {
+	var lastErr error
+	reconnect := false
+
+	err := d.retrier.RetryBackoff(func() error {
+		if reconnect {
+			lastErr = d.conn.Reconnect()
+			if lastErr != nil {
+				d.logger.Warn(d.logTag, "Reconnecting to libvirt failed: %s", lastErr)
+				lastErr = RetryableErrorImpl{lastErr}
+				return lastErr
+			}
+			reconnect = false
+		}
+
+		lastErr = op()
+
+		if isTransientLibvirtErr(lastErr) {
+			d.logger.Warn(d.logTag, "Retrying after transient libvirt failure: %s", lastErr)
+			reconnect = isLibvirtConnectionErr(lastErr)
+			lastErr = RetryableErrorImpl{lastErr}
+		}
+
+		return lastErr
+	}, d.opts.RetryAttempts, d.opts.RetryDelay, d.opts.RetryMaxDelay)
+
+	if _, ok := lastErr.(RetryableError); !ok {
+		return lastErr
+	}
+
+	return err
+}
+
+// withDomain looks up the domain and runs fn on it, retrying both. fn must
+// be idempotent; use withDomainOnce otherwise.
 func (d LibvirtDriver) withDomain(id string, fn func(*libvirt.Domain) error) error {
-	dom, err := d.conn.LookupDomainByName(id)
+	return d.retry(func() error {
+		dom, err := d.conn.LookupDomainByName(id)
+		if err != nil {
+			return err
+		}
+		if dom == nil {
+			return missingDomainErr(id)
+		}
+		defer dom.Free() //nolint // releases C-level reference per libvirt Go binding docs
+		return fn(dom)
+	})
+}
+
+// withDomainOnce retries looking up the domain but runs fn only once, for
+// operations that must not be repeated if a failed attempt took effect.
+func (d LibvirtDriver) withDomainOnce(id string, fn func(*libvirt.Domain) error) error {
+	var dom *libvirt.Domain
+	err := d.retry(func() (err error) {
+		dom, err = d.conn.LookupDomainByName(id)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	if dom == nil {
-		return fmt.Errorf("domain '%s' not found", id)
+		return missingDomainErr(id)
 	}
-	defer dom.Free() //nolint // releases C-level reference per libvirt Go binding docs
+	defer dom.Free() //nolint
 	return fn(dom)
 }
 
 func (d LibvirtDriver) DefineDomain(xml string) error {
 	d.logger.Debug(d.logTag, "Defining domain")
-	_, err := d.conn.DomainDefineXML(xml)
-	return err
+	return d.retry(func() error {
+		_, err := d.conn.DomainDefineXML(xml)
+		return err
+	})
 }
 
 func (d LibvirtDriver) StartDomain(id string) error {
 	d.logger.Debug(d.logTag, "Starting domain '%s'", id)
-	return d.withDomain(id, func(dom *libvirt.Domain) error { return dom.Create() })
+	return d.withDomainOnce(id, func(dom *libvirt.Domain) error { return dom.Create() })
 }
 
 func (d LibvirtDriver) ShutdownDomain(id string) error {
@@ -70,18 +168,83 @@ func (d LibvirtDriver) DestroyDomain(id string) error {
 
 func (d LibvirtDriver) RebootDomain(id string) error {
 	d.logger.Debug(d.logTag, "Rebooting domain '%s'", id)
-	return d.withDomain(id, func(dom *libvirt.Domain) error { return dom.Reboot(libvirt.DOMAIN_REBOOT_DEFAULT) })
+	return d.withDomainOnce(id, func(dom *libvirt.Domain) error { return dom.Reboot(libvirt.DOMAIN_REBOOT_DEFAULT) })
 }
 
 func (d LibvirtDriver) LookupDomain(id string) (Domain, error) {
 	d.logger.Debug(d.logTag, "Looking up domain '%s'", id)
-	dom, err := d.conn.LookupDomainByName(id)
+	var dom *libvirt.Domain
+	err := d.retry(func() (err error) {
+		dom, err = d.conn.LookupDomainByName(id)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return &LibvirtDomainWrapper{dom}, nil
 }
 
+func (d LibvirtDriver) ListDomains() ([]string, error) {
+	var names []string
+	err := d.retry(func() error {
+		doms, err := d.conn.ListAllDomains()
+		if err != nil {
+			return err
+		}
+		names = nil
+		for i := range doms {
+			name, err := doms[i].GetName()
+			_ = doms[i].Free()
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (d LibvirtDriver) DomainMetadata(id string) (DomainMetadata, bool, error) {
+	var (
+		meta  DomainMetadata
+		found bool
+	)
+	err := d.withDomain(id, func(dom *libvirt.Domain) error {
+		elem, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, DomainMetadataNamespace, libvirt.DOMAIN_AFFECT_CONFIG)
+		if err != nil {
+			// Backends that do not keep metadata cannot have domains marked as ours
+			if errors.Is(err, libvirt.ERR_NO_DOMAIN_METADATA) || errors.Is(err, libvirt.ERR_NO_SUPPORT) {
+				found = false
+				return nil
+			}
+			return err
+		}
+		meta, err = parseDomainMetadata(elem)
+		found = err == nil
+		return err
+	})
+	return meta, found, err
+}
+
+func parseDomainMetadata(elem string) (DomainMetadata, error) {
+	var parsed struct {
+		Created string `xml:"created,attr"`
+	}
+
+	err := xml.Unmarshal([]byte(elem), &parsed)
+	if err != nil {
+		return DomainMetadata{}, fmt.Errorf("parsing domain metadata: %w", err)
+	}
+
+	created, err := time.Parse(time.RFC3339, parsed.Created)
+	if err != nil {
+		return DomainMetadata{}, fmt.Errorf("parsing domain creation time: %w", err)
+	}
+
+	return DomainMetadata{Created: created}, nil
+}
+
 func (d LibvirtDriver) UpdateDomainMemory(id string, memoryMB int) error {
 	d.logger.Debug(d.logTag, "Updating memory for domain '%s' to %dMB", id, memoryMB)
 	return d.withDomain(id, func(dom *libvirt.Domain) error {
@@ -105,16 +268,72 @@ func (d LibvirtDriver) UpdateDomainCPUs(id string, cpus int) error {
 	})
 }
 
-func (d LibvirtDriver) CreateStorageVol(poolName, volName string, sizeMB int) (string, error) {
+func (d LibvirtDriver) AttachDevice(id string, xml string) error {
+	d.logger.Debug(d.logTag, "Attaching device to domain '%s'", id)
+	return d.withDomainOnce(id, func(dom *libvirt.Domain) error {
+		flags, err := d.deviceModifyFlags(dom)
+		if err != nil {
+			return err
+		}
+		return dom.AttachDeviceFlags(xml, flags)
+	})
+}
+
+func (d LibvirtDriver) DetachDevice(id string, xml string) error {
+	d.logger.Debug(d.logTag, "Detaching device from domain '%s'", id)
+	return d.withDomain(id, func(dom *libvirt.Domain) error {
+		flags, err := d.deviceModifyFlags(dom)
+		if err != nil {
+			return err
+		}
+		err = dom.DetachDeviceFlags(xml, flags)
+		if errors.Is(err, libvirt.ERR_DEVICE_MISSING) {
+			return nil
+		}
+		return err
+	})
+}
+
+// deviceModifyFlags always updates the persistent config, and additionally
+// the live config when the domain is running so that hotplug takes effect.
+func (d LibvirtDriver) deviceModifyFlags(dom *libvirt.Domain) (libvirt.DomainDeviceModifyFlags, error) {
+	flags := libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+	active, err := dom.IsActive()
+	if err != nil {
+		return flags, err
+	}
+	if active {
+		flags |= libvirt.DOMAIN_DEVICE_MODIFY_LIVE
+	}
+	return flags, nil
+}
+
+func (d LibvirtDriver) CreateStorageVol(poolName, volName string, props StorageVolProps) (string, error) {
 	d.logger.Debug(d.logTag, "Creating storage vol '%s' in pool '%s'", volName, poolName)
+	var path string
+	attempted := false
+	err := d.retry(func() (err error) {
+		if attempted {
+			// An earlier attempt may have created the volume before failing.
+			path, err = d.lookupStorageVolPath(poolName, volName)
+			if !errors.Is(err, libvirt.ERR_NO_STORAGE_VOL) {
+				return err
+			}
+		}
+		attempted = true
+		path, err = d.createStorageVol(poolName, volName, props)
+		return err
+	})
+	return path, err
+}
+
+func (d LibvirtDriver) createStorageVol(poolName, volName string, props StorageVolProps) (string, error) {
 	pool, err := d.conn.LookupStoragePoolByName(poolName)
 	if err != nil {
 		return "", err
 	}
 	defer pool.Free() //nolint
-	sizeBytes := uint64(sizeMB) * 1024 * 1024
-	xml := fmt.Sprintf(`<volume><name>%s</name><capacity unit="bytes">%d</capacity></volume>`, xmlEscape(volName), sizeBytes)
-	vol, err := pool.StorageVolCreateXML(xml, 0)
+	vol, err := pool.StorageVolCreateXML(storageVolXML(volName, props), storageVolCreateFlags(props))
 	if err != nil {
 		return "", err
 	}
@@ -128,6 +347,10 @@ func (d LibvirtDriver) CreateStorageVol(poolName, volName string, sizeMB int) (s
 
 func (d LibvirtDriver) DeleteStorageVol(poolName, volName string) error {
 	d.logger.Debug(d.logTag, "Deleting storage vol '%s' from pool '%s'", volName, poolName)
+	return d.retry(func() error { return d.deleteStorageVol(poolName, volName) })
+}
+
+func (d LibvirtDriver) deleteStorageVol(poolName, volName string) error {
 	pool, err := d.conn.LookupStoragePoolByName(poolName)
 	if err != nil {
 		if errors.Is(err, libvirt.ERR_NO_STORAGE_POOL) {
@@ -147,10 +370,194 @@ func (d LibvirtDriver) DeleteStorageVol(poolName, volName string) error {
 	return vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
 }
 
+func (d LibvirtDriver) LookupStorageVolPath(poolName, volName string) (string, error) {
+	var path string
+	err := d.retry(func() (err error) {
+		path, err = d.lookupStorageVolPath(poolName, volName)
+		return err
+	})
+	return path, err
+}
+
+func (d LibvirtDriver) lookupStorageVolPath(poolName, volName string) (string, error) {
+	pool, err := d.conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return "", err
+	}
+	if pool == nil {
+		return "", fmt.Errorf("storage pool '%s' not found", poolName)
+	}
+	defer pool.Free() //nolint
+	vol, err := pool.LookupStorageVolByName(volName)
+	if err != nil {
+		return "", err
+	}
+	defer vol.Free() //nolint
+	return vol.GetPath()
+}
+
+func (d LibvirtDriver) StoragePoolActive(poolName string) (bool, error) {
+	var active bool
+	err := d.retry(func() error {
+		pool, err := d.conn.LookupStoragePoolByName(poolName)
+		if err != nil {
+			return err
+		}
+		if pool == nil {
+			return fmt.Errorf("storage pool '%s' not found", poolName)
+		}
+		defer pool.Free() //nolint
+		active, err = pool.IsActive()
+		return err
+	})
+	return active, err
+}
+
+func (d LibvirtDriver) NetworkActive(name string) (bool, error) {
+	var active bool
+	err := d.retry(func() error {
+		network, err := d.conn.LookupNetworkByName(name)
+		if err != nil {
+			return err
+		}
+		if network == nil {
+			return fmt.Errorf("network '%s' not found", name)
+		}
+		defer network.Free() //nolint
+		active, err = network.IsActive()
+		return err
+	})
+	return active, err
+}
+
+func (d LibvirtDriver) Capabilities() (string, error) {
+	var caps string
+	err := d.retry(func() (err error) {
+		caps, err = d.conn.GetCapabilities()
+		return err
+	})
+	return caps, err
+}
+
+func (d LibvirtDriver) CreateSecret(description string, value []byte) (string, error) {
+	d.logger.Debug(d.logTag, "Creating secret '%s'", description)
+	// The UUID is chosen here so that a retry can find a secret defined by
+	// an earlier attempt that failed afterwards.
+	uuid, err := d.uuidGen.Generate()
+	if err != nil {
+		return "", err
+	}
+
+	attempted := false
+	err = d.retry(func() error {
+		if attempted {
+			found, err := d.setExistingSecretValue(uuid, value)
+			if err != nil || found {
+				return err
+			}
+		}
+		attempted = true
+		return d.createSecret(uuid, description, value)
+	})
+	if err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
+
+func (d LibvirtDriver) createSecret(uuid, description string, value []byte) error {
+	xml := fmt.Sprintf(
+		`<secret ephemeral='no' private='yes'><uuid>%s</uuid><description>%s</description></secret>`,
+		xmlEscape(uuid), xmlEscape(description),
+	)
+	secret, err := d.conn.SecretDefineXML(xml)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("secret '%s' was not defined", description)
+	}
+	defer secret.Free() //nolint
+	err = secret.SetValue(value, 0)
+	if err != nil {
+		_ = secret.Undefine()
+		return err
+	}
+	return nil
+}
+
+// setExistingSecretValue sets the value of the secret uuid if it exists.
+func (d LibvirtDriver) setExistingSecretValue(uuid string, value []byte) (bool, error) {
+	secret, err := d.conn.LookupSecretByUUIDString(uuid)
+	if err != nil {
+		if errors.Is(err, libvirt.ERR_NO_SECRET) {
+			return false, nil
+		}
+		return false, err
+	}
+	if secret == nil {
+		return false, nil
+	}
+	defer secret.Free() //nolint
+	return true, secret.SetValue(value, 0)
+}
+
+func (d LibvirtDriver) DeleteSecret(uuid string) error {
+	d.logger.Debug(d.logTag, "Deleting secret '%s'", uuid)
+	return d.retry(func() error { return d.deleteSecret(uuid) })
+}
+
+func (d LibvirtDriver) deleteSecret(uuid string) error {
+	secret, err := d.conn.LookupSecretByUUIDString(uuid)
+	if err != nil {
+		if errors.Is(err, libvirt.ERR_NO_SECRET) {
+			return nil
+		}
+		return err
+	}
+	if secret == nil {
+		return nil
+	}
+	defer secret.Free() //nolint
+	return secret.Undefine()
+}
+
 func (d LibvirtDriver) IsMissingDomainErr(err error) bool {
 	return errors.Is(err, libvirt.ERR_NO_DOMAIN)
 }
 
+// isTransientLibvirtErr reports failures that may go away if the operation
+// is tried again: timeouts, e.g. waiting for another job on the domain,
+// locks held by another process and lost connections.
+func isTransientLibvirtErr(err error) bool {
+	var lverr libvirt.Error
+	if !errors.As(err, &lverr) {
+		return false
+	}
+
+	switch lverr.Code {
+	case libvirt.ERR_OPERATION_TIMEOUT, libvirt.ERR_AGENT_UNRESPONSIVE, libvirt.ERR_RESOURCE_BUSY:
+		return true
+	default:
+		return isLibvirtConnectionErr(lverr)
+	}
+}
+
+func isLibvirtConnectionErr(err error) bool {
+	var lverr libvirt.Error
+	if !errors.As(err, &lverr) {
+		return false
+	}
+
+	switch lverr.Code {
+	case libvirt.ERR_NO_CONNECT, libvirt.ERR_INVALID_CONN, libvirt.ERR_RPC:
+		return true
+	default:
+		// e.g. "client socket is closed" or "Cannot write data: Broken pipe"
+		return lverr.Domain == libvirt.FROM_RPC
+	}
+}
+
 // LibvirtDomainWrapper wraps *libvirt.Domain to implement the Domain interface.
 type LibvirtDomainWrapper struct {
 	dom *libvirt.Domain
@@ -172,6 +579,37 @@ func (w *LibvirtDomainWrapper) IsActive() (bool, error) {
 
 func (w *LibvirtDomainWrapper) Free() error { return w.dom.Free() }
 
+func storageVolXML(volName string, props StorageVolProps) string {
+	sizeBytes := uint64(props.SizeMB) * 1024 * 1024
+
+	var allocation, format string
+	switch props.Preallocation {
+	case "falloc", "full":
+		allocation = fmt.Sprintf(`<allocation unit="bytes">%d</allocation>`, sizeBytes)
+	}
+	if props.Format != "" || props.EncryptionSecret != "" {
+		var formatElem, encryptionElem string
+		if props.Format != "" {
+			formatElem = fmt.Sprintf(`<format type="%s"/>`, xmlEscape(props.Format))
+		}
+		if props.EncryptionSecret != "" {
+			encryptionElem = fmt.Sprintf(`<encryption format="luks"><secret type="passphrase" uuid="%s"/></encryption>`,
+				xmlEscape(props.EncryptionSecret))
+		}
+		format = "<target>" + formatElem + encryptionElem + "</target>"
+	}
+
+	return fmt.Sprintf(`<volume><name>%s</name><capacity unit="bytes">%d</capacity>%s%s</volume>`,
+		xmlEscape(volName), sizeBytes, allocation, format)
+}
+
+func storageVolCreateFlags(props StorageVolProps) libvirt.StorageVolCreateFlags {
+	if props.Preallocation == "metadata" {
+		return libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA
+	}
+	return 0
+}
+
 func xmlEscape(s string) string {
 	var b bytes.Buffer
 	_ = xml.EscapeText(&b, []byte(s))
@@ -4,6 +4,7 @@ package driver_test
 
 import (
 	"os"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -35,8 +36,8 @@ var _ = Describe("LibvirtDriver (integration)", func() {
 		}
 
 		logger := boshlog.NewWriterLogger(boshlog.LevelDebug, os.Stderr)
-		libvirtConn := driver.NewLibvirtConnImpl(conn)
-		d = driver.NewLibvirtDriver(libvirtConn, domains.QEMUDomainBuilder{}, logger)
+		libvirtConn := driver.NewLibvirtConnImpl(conn, nil)
+		d = driver.NewLibvirtDriver(libvirtConn, domains.QEMUDomainBuilder{}, driver.LibvirtDriverOpts{}, logger)
 	})
 
 	AfterEach(func() {
@@ -78,6 +79,41 @@ var _ = Describe("LibvirtDriver (integration)", func() {
 		})
 	})
 
+	Describe("DomainMetadata", func() {
+		const metadataTestName = "bosh-integration-metadata-test"
+
+		AfterEach(func() {
+			_ = d.DestroyDomain(metadataTestName)
+		})
+
+		It("reads the metadata of domains built by the CPI", func() {
+			created := time.Now().Add(-time.Hour).Truncate(time.Second)
+			xml, err := domains.QEMUDomainBuilder{}.BuildDomain(metadataTestName,
+				driver.VMDomainProps{CPUs: 1, MemoryMB: 64, Created: created},
+				driver.DomainDiskPaths{RootDisk: "/r.qcow2", EphemeralDisk: "/e.qcow2"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.DefineDomain(xml)).To(Succeed())
+
+			meta, found, err := d.DomainMetadata(metadataTestName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(meta.Created).To(BeTemporally("==", created))
+		})
+
+		It("reports domains without metadata", func() {
+			Expect(d.DefineDomain(`<domain type='kvm'>
+  <name>` + metadataTestName + `</name>
+  <memory unit='KiB'>65536</memory>
+  <vcpu>1</vcpu>
+  <os><type arch='x86_64'>hvm</type></os>
+</domain>`)).To(Succeed())
+
+			_, found, err := d.DomainMetadata(metadataTestName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+	})
+
 	Describe("UpdateDomainMemory / UpdateDomainCPUs", func() {
 		const updateTestXML = `<domain type='kvm'>
   <name>bosh-integration-update-test</name>
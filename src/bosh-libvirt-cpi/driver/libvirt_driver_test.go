@@ -2,6 +2,7 @@ package driver_test
 
 import (
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -25,7 +26,7 @@ var _ = Describe("LibvirtDriver", func() {
 		logger = boshlog.NewLogger(boshlog.LevelNone)
 		conn = &fakes.FakeLibvirtConn{}
 		builder = &fakes.FakeDomainBuilder{}
-		d = driver.NewLibvirtDriver(conn, builder, logger)
+		d = driver.NewLibvirtDriver(conn, builder, driver.LibvirtDriverOpts{RetryAttempts: 3, RetryDelay: time.Millisecond}, logger)
 	})
 
 	Describe("DefineDomain", func() {
@@ -42,6 +43,84 @@ var _ = Describe("LibvirtDriver", func() {
 		})
 	})
 
+	Describe("retries", func() {
+		It("retries operations that time out", func() {
+			conn.DomainDefineXMLErrs = []error{libvirt.Error{Code: libvirt.ERR_OPERATION_TIMEOUT}}
+
+			Expect(d.DefineDomain("<domain/>")).To(Succeed())
+			Expect(conn.DomainDefineXMLCalls).To(Equal(2))
+			Expect(conn.ReconnectCalls).To(BeZero())
+		})
+
+		It("reconnects before retrying when the connection was lost", func() {
+			conn.DomainDefineXMLErrs = []error{libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR, Domain: libvirt.FROM_RPC}}
+
+			Expect(d.DefineDomain("<domain/>")).To(Succeed())
+			Expect(conn.DomainDefineXMLCalls).To(Equal(2))
+			Expect(conn.ReconnectCalls).To(Equal(1))
+		})
+
+		It("gives up after RetryAttempts with a retryable error", func() {
+			conn.DomainDefineXMLErr = libvirt.Error{Code: libvirt.ERR_RESOURCE_BUSY}
+
+			err := d.DefineDomain("<domain/>")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Retried '3' times"))
+			Expect(driver.ClassifyError(err)).To(Equal(driver.ErrorClassTransient))
+			Expect(conn.DomainDefineXMLCalls).To(Equal(3))
+		})
+
+		It("looks up a secret defined by a failed attempt before defining it again", func() {
+			conn.SecretDefineXMLErrs = []error{libvirt.Error{Code: libvirt.ERR_OPERATION_TIMEOUT}}
+			conn.SecretDefineXMLErr = errors.New("define failed")
+			conn.LookupSecretByUUIDStringErr = libvirt.Error{Code: libvirt.ERR_NO_SECRET}
+
+			_, err := d.CreateSecret("disk-1", []byte("pass"))
+			Expect(err).To(MatchError("define failed"))
+			Expect(conn.SecretDefineXMLCalls).To(Equal(2))
+			Expect(conn.LookupSecretByUUIDStringArg).ToNot(BeEmpty())
+			Expect(conn.SecretDefineXMLArg).To(ContainSubstring("<uuid>" + conn.LookupSecretByUUIDStringArg + "</uuid>"))
+		})
+
+		It("does not define a secret again when looking it up fails", func() {
+			conn.SecretDefineXMLErrs = []error{libvirt.Error{Code: libvirt.ERR_OPERATION_TIMEOUT}}
+			conn.LookupSecretByUUIDStringErr = errors.New("lookup failed")
+
+			_, err := d.CreateSecret("disk-1", []byte("pass"))
+			Expect(err).To(MatchError("lookup failed"))
+			Expect(conn.SecretDefineXMLCalls).To(Equal(1))
+		})
+
+		It("looks up a volume created by a failed attempt before creating it again", func() {
+			conn.LookupStoragePoolByNameErrs = []error{
+				libvirt.Error{Code: libvirt.ERR_OPERATION_TIMEOUT}, // creating
+				libvirt.Error{Code: libvirt.ERR_NO_STORAGE_VOL},    // looking up
+			}
+			conn.LookupStoragePoolByNameErr = errors.New("pool lookup failed")
+
+			_, err := d.CreateStorageVol("default", "vol-1", driver.StorageVolProps{SizeMB: 100})
+			Expect(err).To(MatchError("pool lookup failed"))
+			Expect(conn.LookupStoragePoolByNameCalls).To(Equal(3))
+		})
+
+		It("does not create a volume again when looking it up fails", func() {
+			conn.LookupStoragePoolByNameErrs = []error{libvirt.Error{Code: libvirt.ERR_OPERATION_TIMEOUT}}
+			conn.LookupStoragePoolByNameErr = errors.New("pool lookup failed")
+
+			_, err := d.CreateStorageVol("default", "vol-1", driver.StorageVolProps{SizeMB: 100})
+			Expect(err).To(MatchError("pool lookup failed"))
+			Expect(conn.LookupStoragePoolByNameCalls).To(Equal(2))
+		})
+
+		It("returns other errors as they are", func() {
+			conn.LookupDomainByNameErrs = []error{libvirt.Error{Code: libvirt.ERR_NO_DOMAIN}}
+
+			err := d.StartDomain("vm-1")
+			Expect(d.IsMissingDomainErr(err)).To(BeTrue())
+			Expect(conn.LookupDomainByNameCalls).To(Equal(1))
+		})
+	})
+
 	Describe("LookupDomain", func() {
 		It("returns error when LookupDomainByName fails", func() {
 			conn.LookupDomainByNameErr = errors.New("domain not found")
@@ -89,6 +168,38 @@ var _ = Describe("LibvirtDriver", func() {
 		})
 	})
 
+	Describe("LookupStorageVolPath", func() {
+		It("returns error when pool not found", func() {
+			conn.LookupStoragePoolByNameErr = libvirt.Error{Code: libvirt.ERR_NO_STORAGE_POOL}
+			_, err := d.LookupStorageVolPath("default", "vol-1")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns error when lookup returns nil pool with no error", func() {
+			_, err := d.LookupStorageVolPath("default", "vol-1")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("StoragePoolActive / NetworkActive", func() {
+		It("returns error when the pool is not found", func() {
+			conn.LookupStoragePoolByNameErr = libvirt.Error{Code: libvirt.ERR_NO_STORAGE_POOL}
+			_, err := d.StoragePoolActive("default")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns error when the network is not found", func() {
+			conn.LookupNetworkByNameErr = libvirt.Error{Code: libvirt.ERR_NO_NETWORK}
+			_, err := d.NetworkActive("default")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns error when lookup returns nil network with no error", func() {
+			_, err := d.NetworkActive("default")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Describe("StartDomain / ShutdownDomain / RebootDomain", func() {
 		It("returns error when domain not found for Start", func() {
 			conn.LookupDomainByNameErr = errors.New("not found")
@@ -136,10 +247,48 @@ var _ = Describe("LibvirtDriver", func() {
 		})
 	})
 
+	Describe("AttachDevice / DetachDevice", func() {
+		It("returns error when domain not found for AttachDevice", func() {
+			conn.LookupDomainByNameErr = errors.New("not found")
+			Expect(d.AttachDevice("vm-1", "<disk/>")).To(HaveOccurred())
+		})
+
+		It("returns error when domain not found for DetachDevice", func() {
+			conn.LookupDomainByNameErr = errors.New("not found")
+			Expect(d.DetachDevice("vm-1", "<disk/>")).To(HaveOccurred())
+		})
+
+		It("returns error when lookup returns nil domain with no error", func() {
+			Expect(d.AttachDevice("vm-1", "<disk/>")).To(HaveOccurred())
+			Expect(d.DetachDevice("vm-1", "<disk/>")).To(HaveOccurred())
+		})
+	})
+
+	Describe("CreateSecret / DeleteSecret", func() {
+		It("returns error when defining the secret fails", func() {
+			conn.SecretDefineXMLErr = errors.New("define failed")
+			_, err := d.CreateSecret("disk-1", []byte("pass"))
+			Expect(err).To(HaveOccurred())
+			Expect(conn.SecretDefineXMLArg).To(ContainSubstring("<description>disk-1</description>"))
+			Expect(conn.SecretDefineXMLArg).To(ContainSubstring("private='yes'"))
+		})
+
+		It("returns nil when the secret is already gone (idempotent)", func() {
+			conn.LookupSecretByUUIDStringErr = libvirt.Error{Code: libvirt.ERR_NO_SECRET}
+			Expect(d.DeleteSecret("uuid-1")).To(Succeed())
+			Expect(conn.LookupSecretByUUIDStringArg).To(Equal("uuid-1"))
+		})
+
+		It("returns error for other secret lookup failures", func() {
+			conn.LookupSecretByUUIDStringErr = errors.New("unexpected secret error")
+			Expect(d.DeleteSecret("uuid-1")).To(HaveOccurred())
+		})
+	})
+
 	Describe("CreateStorageVol", func() {
 		It("returns error when pool not found", func() {
 			conn.LookupStoragePoolByNameErr = errors.New("pool not found")
-			_, err := d.CreateStorageVol("default", "vol-1", 100)
+			_, err := d.CreateStorageVol("default", "vol-1", driver.StorageVolProps{SizeMB: 100})
 			Expect(err).To(HaveOccurred())
 		})
 	})
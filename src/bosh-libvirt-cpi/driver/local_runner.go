@@ -1,7 +1,10 @@
 package driver
 
 import (
+	"os"
 	"os/user"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
@@ -65,10 +68,136 @@ func (r LocalRunner) Upload(srcPath, dstPath string) error {
 
 func (r LocalRunner) Put(path string, contents []byte) error {
 	r.logger.Debug(r.logTag, "Put into '%s' %d contents", path, len(contents))
-	return r.fs.WriteFile(path, contents)
+	return r.put(path, contents, false)
+}
+
+func (r LocalRunner) PutPrivate(path string, contents []byte) error {
+	r.logger.Debug(r.logTag, "PutPrivate into '%s' %d contents", path, len(contents))
+	return r.put(path, contents, true)
+}
+
+func (r LocalRunner) put(path string, contents []byte, private bool) error {
+	err := r.fs.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	partPath := path + putPartSuffix
+
+	flags, mode := os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644)
+
+	if private {
+		// A part file left behind keeps its mode when truncated
+		err = r.fs.RemoveAll(partPath)
+		if err != nil {
+			return err
+		}
+
+		flags, mode = os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600
+	}
+
+	file, err := r.fs.OpenFile(partPath, flags, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(contents)
+	if err == nil {
+		err = syncFile(file)
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = r.fs.RemoveAll(partPath)
+		return err
+	}
+
+	return r.fs.Rename(partPath, path)
+}
+
+func syncFile(file boshsys.File) error {
+	if syncer, ok := file.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
 }
 
 func (r LocalRunner) Get(path string) ([]byte, error) {
 	r.logger.Debug(r.logTag, "Get '%s'", path)
 	return r.fs.ReadFile(path)
 }
+
+func (r LocalRunner) MkdirAll(dir string) error {
+	r.logger.Debug(r.logTag, "MkdirAll '%s'", dir)
+	return r.fs.MkdirAll(dir, 0755)
+}
+
+func (r LocalRunner) List(dir string) ([]string, error) {
+	r.logger.Debug(r.logTag, "List '%s'", dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (r LocalRunner) Remove(path string) error {
+	r.logger.Debug(r.logTag, "Remove '%s'", path)
+	return r.fs.RemoveAll(path)
+}
+
+func (r LocalRunner) Rename(src, dst string) error {
+	r.logger.Debug(r.logTag, "Rename '%s' to '%s'", src, dst)
+	return r.fs.Rename(src, dst)
+}
+
+func (r LocalRunner) Symlink(target, path string) error {
+	r.logger.Debug(r.logTag, "Symlink '%s' to '%s'", path, target)
+
+	partPath := path + symlinkPartSuffix
+
+	err := os.Remove(partPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Symlink(target, partPath)
+	if err != nil {
+		return err
+	}
+
+	return r.fs.Rename(partPath, path)
+}
+
+func (r LocalRunner) Stat(path string) (os.FileInfo, error) {
+	return r.fs.Stat(path)
+}
+
+func (r LocalRunner) CreateSparseFile(path string, size int64) error {
+	r.logger.Debug(r.logTag, "CreateSparseFile '%s' %d", path, size)
+
+	file, err := r.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Truncate(path, size)
+}
@@ -1,6 +1,9 @@
 package driver_test
 
 import (
+	"os"
+	"path/filepath"
+
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 	boshsys "github.com/cloudfoundry/bosh-utils/system"
 	. "github.com/onsi/ginkgo"
@@ -19,7 +22,7 @@ var _ = Describe("LocalRunner", func() {
 	BeforeEach(func() {
 		logger = boshlog.NewLogger(boshlog.LevelNone)
 		cmdRunner = boshsys.NewExecCmdRunner(logger)
-		runner = NewLocalRunner(nil, cmdRunner, logger)
+		runner = NewLocalRunner(boshsys.NewOsFileSystem(logger), cmdRunner, logger)
 	})
 
 	Context("HomeDir", func() {
@@ -31,4 +34,82 @@ var _ = Describe("LocalRunner", func() {
 			Expect(path).ToNot(ContainSubstring("~"))
 		})
 	})
+
+	Context("filesystem operations", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir = tempDir()
+		})
+
+		It("creates, lists and removes directories", func() {
+			Expect(runner.MkdirAll(filepath.Join(dir, "b", "nested"))).To(Succeed())
+			Expect(runner.MkdirAll(filepath.Join(dir, "a"))).To(Succeed())
+
+			Expect(runner.List(dir)).To(Equal([]string{"a", "b"}))
+
+			Expect(runner.Remove(filepath.Join(dir, "b"))).To(Succeed())
+			Expect(runner.Remove(filepath.Join(dir, "missing"))).To(Succeed())
+			Expect(runner.List(dir)).To(Equal([]string{"a"}))
+		})
+
+		It("creates sparse files", func() {
+			path := filepath.Join(dir, "disk.img")
+
+			Expect(runner.CreateSparseFile(path, 1024*1024)).To(Succeed())
+
+			info, err := runner.Stat(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Size()).To(Equal(int64(1024 * 1024)))
+			Expect(info.IsDir()).To(BeFalse())
+		})
+
+		It("replaces files without leaving temporary files behind", func() {
+			path := filepath.Join(dir, "sub", "env.json")
+
+			Expect(runner.Put(path, []byte("first"))).To(Succeed())
+			Expect(runner.Put(path, []byte("second"))).To(Succeed())
+
+			Expect(runner.Get(path)).To(Equal([]byte("second")))
+			Expect(runner.List(filepath.Join(dir, "sub"))).To(Equal([]string{"env.json"}))
+		})
+
+		It("writes private files readable by their owner only", func() {
+			path := filepath.Join(dir, "key.tmp")
+			Expect(os.WriteFile(path+".put", []byte("stale"), 0644)).To(Succeed())
+
+			Expect(runner.PutPrivate(path, []byte("secret"))).To(Succeed())
+			Expect(runner.Get(path)).To(Equal([]byte("secret")))
+			Expect(path + ".put").ToNot(BeAnExistingFile())
+
+			info, err := os.Stat(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("renames files, replacing the destination", func() {
+			src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			Expect(os.WriteFile(src, []byte("new"), 0644)).To(Succeed())
+			Expect(os.WriteFile(dst, []byte("old"), 0644)).To(Succeed())
+
+			Expect(runner.Rename(src, dst)).To(Succeed())
+			Expect(os.ReadFile(dst)).To(Equal([]byte("new")))
+			Expect(src).ToNot(BeAnExistingFile())
+		})
+
+		It("replaces symlinks, including those to directories", func() {
+			path := filepath.Join(dir, "link")
+			Expect(os.Mkdir(filepath.Join(dir, "old"), 0755)).To(Succeed())
+			Expect(os.Symlink("old", path)).To(Succeed())
+
+			Expect(runner.Symlink("new", path)).To(Succeed())
+			Expect(os.Readlink(path)).To(Equal("new"))
+			Expect(runner.List(dir)).To(Equal([]string{"link", "old"}))
+		})
+
+		It("reports missing files", func() {
+			_, err := runner.Stat(filepath.Join(dir, "missing"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
 })
@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// Locker serializes changes to a resource (VM, disk, stemcell) across
+// the CPI processes the director runs in parallel.
+type Locker interface {
+	// Lock blocks until the caller holds name or LockerOpts.Timeout passes.
+	// Locks are not reentrant.
+	Lock(name string) (Lock, error)
+}
+
+type Lock interface {
+	Unlock() error
+}
+
+var _ Locker = FlockLocker{}
+var _ Locker = RunnerLocker{}
+
+type LockerOpts struct {
+	// Timeout is how long Lock waits for another holder; defaults to 15 minutes.
+	Timeout time.Duration
+
+	// StaleAfter is how long a lock held over a Runner may go without a
+	// heartbeat before waiters break it; defaults to 2 minutes.
+	StaleAfter time.Duration
+
+	// PollInterval is how often waiters retry; defaults to 1 second.
+	PollInterval time.Duration
+}
+
+func (o LockerOpts) withDefaults() LockerOpts {
+	if o.Timeout == 0 {
+		o.Timeout = 15 * time.Minute
+	}
+	if o.StaleAfter == 0 {
+		o.StaleAfter = 2 * time.Minute
+	}
+	if o.PollInterval == 0 {
+		o.PollInterval = time.Second
+	}
+	return o
+}
+
+// WithLock runs fn while holding name.
+func WithLock(locker Locker, name string, fn func() error) error {
+	lock, err := locker.Lock(name)
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+
+	unlockErr := lock.Unlock()
+	if err == nil && unlockErr != nil {
+		return bosherr.WrapErrorf(unlockErr, "Releasing lock '%s'", name)
+	}
+
+	return err
+}
+
+func lockPath(dir, name string) (string, error) {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", bosherr.Errorf("Invalid lock name %q: must be a plain filename", name)
+	}
+	return filepath.Join(dir, name+".lock"), nil
+}
+
+// LockTimeoutError is returned by Lock when another holder kept the lock
+// for longer than LockerOpts.Timeout.
+type LockTimeoutError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (e LockTimeoutError) Error() string {
+	return fmt.Sprintf("Timed out after %s waiting for lock '%s'", e.Timeout, e.Name)
+}
+
+func lockTimeoutErr(name string, timeout time.Duration) error {
+	return LockTimeoutError{Name: name, Timeout: timeout}
+}
@@ -0,0 +1,205 @@
+package driver_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "bosh-libvirt-cpi/driver"
+	"bosh-libvirt-cpi/driver/fakes"
+)
+
+var _ = Describe("Lockers", func() {
+	var (
+		logger boshlog.Logger
+		fs     boshsys.FileSystem
+		dir    string
+		opts   LockerOpts
+	)
+
+	BeforeEach(func() {
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		fs = boshsys.NewOsFileSystem(logger)
+		dir = filepath.Join(tempDir(), "locks")
+		opts = LockerOpts{Timeout: 300 * time.Millisecond, PollInterval: 10 * time.Millisecond}
+	})
+
+	sharedExamples := func(newLocker func() Locker) {
+		It("lets one holder in at a time", func() {
+			lock, err := newLocker().Lock("vm-1")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = newLocker().Lock("vm-1")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Timed out after 300ms waiting for lock 'vm-1'"))
+
+			other, err := newLocker().Lock("vm-2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(other.Unlock()).To(Succeed())
+
+			Expect(lock.Unlock()).To(Succeed())
+
+			lock, err = newLocker().Lock("vm-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lock.Unlock()).To(Succeed())
+		})
+
+		It("waits for the holder to unlock", func() {
+			lock, err := newLocker().Lock("vm-1")
+			Expect(err).ToNot(HaveOccurred())
+
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(50 * time.Millisecond)
+				Expect(lock.Unlock()).To(Succeed())
+			}()
+
+			next, err := newLocker().Lock("vm-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(next.Unlock()).To(Succeed())
+		})
+
+		It("rejects names that are not plain filenames", func() {
+			_, err := newLocker().Lock("../vm-1")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Invalid lock name"))
+		})
+	}
+
+	Context("FlockLocker", func() {
+		sharedExamples(func() Locker { return NewFlockLocker(dir, fs, opts, logger) })
+	})
+
+	Context("RunnerLocker", func() {
+		var runner LocalRunner
+
+		BeforeEach(func() {
+			runner = NewLocalRunner(fs, boshsys.NewExecCmdRunner(logger), logger)
+			opts.StaleAfter = 200 * time.Millisecond
+		})
+
+		sharedExamples(func() Locker { return NewRunnerLocker(dir, runner, opts, logger) })
+
+		It("removes the lock dir on unlock", func() {
+			lock, err := NewRunnerLocker(dir, runner, opts, logger).Lock("vm-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filepath.Join(dir, "vm-1.lock", "owner")).To(BeAnExistingFile())
+
+			Expect(lock.Unlock()).To(Succeed())
+			Expect(filepath.Join(dir, "vm-1.lock")).ToNot(BeADirectory())
+		})
+
+		It("breaks locks whose holder stopped refreshing them", func() {
+			Expect(os.MkdirAll(filepath.Join(dir, "vm-1.lock"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "vm-1.lock", "owner"), []byte("gone:1:1 1"), 0644)).To(Succeed())
+
+			opts.Timeout = 2 * time.Second
+
+			lock, err := NewRunnerLocker(dir, runner, opts, logger).Lock("vm-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lock.Unlock()).To(Succeed())
+		})
+
+		It("puts back locks that are refreshed while breaking them", func() {
+			Expect(os.MkdirAll(filepath.Join(dir, "vm-1.lock"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "vm-1.lock", "owner"), []byte("slow:1:1 1"), 0644)).To(Succeed())
+
+			refreshing := &refreshingRunner{LocalRunner: runner}
+
+			_, err := NewRunnerLocker(dir, refreshing, opts, logger).Lock("vm-1")
+			Expect(err).To(BeAssignableToTypeOf(LockTimeoutError{}))
+			Expect(refreshing.refreshed).To(BeTrue())
+
+			Expect(os.ReadFile(filepath.Join(dir, "vm-1.lock", "owner"))).To(Equal([]byte("slow:1:1 2")))
+			Expect(os.ReadDir(dir)).To(HaveLen(1))
+		})
+
+		It("does not leave broken locks behind", func() {
+			Expect(os.MkdirAll(filepath.Join(dir, "vm-1.lock"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "vm-1.lock", "owner"), []byte("gone:1:1 1"), 0644)).To(Succeed())
+
+			opts.Timeout = 2 * time.Second
+
+			lock, err := NewRunnerLocker(dir, runner, opts, logger).Lock("vm-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.ReadDir(dir)).To(HaveLen(1))
+			Expect(lock.Unlock()).To(Succeed())
+		})
+
+		It("returns failures to create the lock right away", func() {
+			opts.Timeout = time.Minute
+
+			fakeRunner := &fakes.FakeRunner{ExecuteErr: errors.New("mkdir: Permission denied")}
+
+			_, err := NewRunnerLocker(dir, fakeRunner, opts, logger).Lock("vm-1")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Creating lock"))
+			Expect(err.Error()).To(ContainSubstring("Permission denied"))
+		})
+
+		It("does not break locks that are refreshed", func() {
+			opts.StaleAfter = 100 * time.Millisecond
+
+			lock, err := NewRunnerLocker(dir, runner, opts, logger).Lock("vm-1")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = NewRunnerLocker(dir, runner, opts, logger).Lock("vm-1")
+			Expect(err).To(HaveOccurred())
+
+			Expect(lock.Unlock()).To(Succeed())
+		})
+	})
+
+	Describe("WithLock", func() {
+		var locker *fakes.FakeLocker
+
+		BeforeEach(func() {
+			locker = &fakes.FakeLocker{}
+		})
+
+		It("holds the lock while running the function", func() {
+			err := WithLock(locker, "vm-1", func() error {
+				Expect(locker.Held).To(HaveKey("vm-1"))
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(locker.Held).To(BeEmpty())
+		})
+
+		It("unlocks when the function fails", func() {
+			err := WithLock(locker, "vm-1", func() error { return errors.New("fake-err") })
+			Expect(err).To(MatchError("fake-err"))
+			Expect(locker.UnlockCalls).To(Equal([]string{"vm-1"}))
+		})
+
+		It("does not run the function without the lock", func() {
+			locker.LockErr = errors.New("fake-lock-err")
+
+			called := false
+			err := WithLock(locker, "vm-1", func() error { called = true; return nil })
+			Expect(err).To(MatchError("fake-lock-err"))
+			Expect(called).To(BeFalse())
+		})
+	})
+})
+
+// refreshingRunner refreshes the owner of a lock right before it is first
+// renamed, as a slow holder would while a waiter breaks the lock.
+type refreshingRunner struct {
+	LocalRunner
+	refreshed bool
+}
+
+func (r *refreshingRunner) Execute(path string, args ...string) (string, int, error) {
+	if path == "mv" && !r.refreshed {
+		r.refreshed = true
+		Expect(os.WriteFile(filepath.Join(args[1], "owner"), []byte("slow:1:1 2"), 0644)).To(Succeed())
+	}
+	return r.LocalRunner.Execute(path, args...)
+}
@@ -16,10 +16,15 @@ type RetryableErrorImpl struct {
 
 func (RetryableErrorImpl) Retryable()      {}
 func (e RetryableErrorImpl) Error() string { return e.Err.Error() }
+func (e RetryableErrorImpl) Unwrap() error { return e.Err }
 
 type Retrier interface {
 	Retry(func() error) error
 	RetryComplex(func() error, int, time.Duration) error
+
+	// RetryBackoff is like RetryComplex but doubles the pause after every
+	// attempt, up to maxSleep.
+	RetryBackoff(actionFunc func() error, times int, sleep, maxSleep time.Duration) error
 }
 
 type RetrierImpl struct{}
@@ -28,7 +33,11 @@ func (r RetrierImpl) Retry(actionFunc func() error) error {
 	return r.RetryComplex(actionFunc, 30, 2*time.Second)
 }
 
-func (RetrierImpl) RetryComplex(actionFunc func() error, times int, sleep time.Duration) error {
+func (r RetrierImpl) RetryComplex(actionFunc func() error, times int, sleep time.Duration) error {
+	return r.RetryBackoff(actionFunc, times, sleep, sleep)
+}
+
+func (RetrierImpl) RetryBackoff(actionFunc func() error, times int, sleep, maxSleep time.Duration) error {
 	var lastErr error
 
 	for i := 0; i < times; i++ {
@@ -41,7 +50,14 @@ func (RetrierImpl) RetryComplex(actionFunc func() error, times int, sleep time.D
 			return bosherr.WrapError(lastErr, "Encountered non-retryable error")
 		}
 
-		time.Sleep(sleep)
+		if i < times-1 {
+			time.Sleep(sleep)
+		}
+
+		sleep *= 2
+		if sleep > maxSleep {
+			sleep = maxSleep
+		}
 	}
 
 	return bosherr.WrapErrorf(lastErr, "Retried '%d' times", times)
@@ -0,0 +1,244 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+)
+
+const lockOwnerName = "owner"
+
+// RunnerLocker locks resources on the host behind a Runner, e.g. over SSH.
+// A lock is a directory created with mkdir, which fails if it exists.
+// The holder rewrites the owner file inside it every StaleAfter/4. Waiters
+// break a lock whose owner file has not changed for StaleAfter. They use
+// their own clock for this, so clock skew between hosts does not matter.
+// Failing to create the lock dir for any other reason, e.g. missing
+// permissions, is returned without waiting.
+type RunnerLocker struct {
+	dir    string
+	runner Runner
+	opts   LockerOpts
+
+	logTag string
+	logger boshlog.Logger
+}
+
+type runnerLock struct {
+	path   string
+	owner  string
+	runner Runner
+	opts   LockerOpts
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	beats int
+
+	logTag string
+	logger boshlog.Logger
+}
+
+func NewRunnerLocker(dir string, runner Runner, opts LockerOpts, logger boshlog.Logger) RunnerLocker {
+	return RunnerLocker{dir, runner, opts.withDefaults(), "driver.RunnerLocker", logger}
+}
+
+func (l RunnerLocker) Lock(name string) (Lock, error) {
+	path, err := lockPath(l.dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.runner.MkdirAll(l.dir)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Creating lock dir '%s'", l.dir)
+	}
+
+	deadline := time.Now().Add(l.opts.Timeout)
+
+	var seenOwner string
+	var seenAt time.Time
+	var mkdirErrs int
+
+	for {
+		_, _, err = l.runner.Execute("mkdir", path)
+		if err == nil {
+			return l.acquired(name, path)
+		}
+
+		now := time.Now()
+
+		owner, statErr := l.currentOwner(path)
+		if statErr != nil && !os.IsNotExist(statErr) {
+			return nil, bosherr.WrapErrorf(statErr, "Checking lock '%s'", path)
+		}
+
+		if statErr != nil {
+			// mkdir failed although there is no lock. The holder may have
+			// released it in between, so only give up if this happens again.
+			mkdirErrs++
+			if mkdirErrs > 1 {
+				return nil, bosherr.WrapErrorf(err, "Creating lock '%s'", path)
+			}
+			continue
+		}
+
+		mkdirErrs = 0
+
+		if seenAt.IsZero() || owner != seenOwner {
+			seenOwner, seenAt = owner, now
+		} else if now.Sub(seenAt) >= l.opts.StaleAfter {
+			l.logger.Warn(l.logTag, "Breaking stale lock '%s' held by '%s'", name, owner)
+
+			err = l.breakStale(path, owner)
+			if err != nil {
+				return nil, bosherr.WrapErrorf(err, "Breaking stale lock '%s'", path)
+			}
+
+			seenAt = time.Time{}
+			continue
+		}
+
+		if now.After(deadline) {
+			return nil, lockTimeoutErr(name, l.opts.Timeout)
+		}
+
+		time.Sleep(l.opts.PollInterval)
+	}
+}
+
+// breakStale removes the lock at path if its owner file still reads owner.
+// The lock is first renamed to a name unique to this waiter so that only
+// the lock that was checked is removed, even if other waiters break or
+// take it at the same time. A lock that turns out to have changed is put
+// back.
+func (l RunnerLocker) breakStale(path, owner string) error {
+	stalePath := fmt.Sprintf("%s.stale-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+
+	_, _, err := l.runner.Execute("mv", "-T", path, stalePath)
+	if err != nil {
+		_, statErr := l.runner.Stat(path)
+		if os.IsNotExist(statErr) {
+			// Another waiter broke it or the holder released it.
+			return nil
+		}
+		return err
+	}
+
+	current, err := l.currentOwner(stalePath)
+	if err != nil {
+		return err
+	}
+
+	if current != owner {
+		l.logger.Warn(l.logTag, "Lock '%s' was refreshed while breaking it, putting it back", path)
+
+		_, _, err = l.runner.Execute("mv", "-T", stalePath, path)
+		return err
+	}
+
+	return l.runner.Remove(stalePath)
+}
+
+// currentOwner returns the owner file of the lock at path. It is empty
+// if the holder has not written it yet.
+func (l RunnerLocker) currentOwner(path string) (string, error) {
+	_, err := l.runner.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = l.runner.Stat(filepath.Join(path, lockOwnerName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	bytes, err := l.runner.Get(filepath.Join(path, lockOwnerName))
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+func (l RunnerLocker) acquired(name, path string) (Lock, error) {
+	hostname, _ := os.Hostname()
+
+	lock := &runnerLock{
+		path:   path,
+		owner:  fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		runner: l.runner,
+		opts:   l.opts,
+		stopCh: make(chan struct{}),
+		logTag: l.logTag,
+		logger: l.logger,
+	}
+
+	err := lock.beat()
+	if err != nil {
+		_ = l.runner.Remove(path)
+		return nil, bosherr.WrapErrorf(err, "Recording owner of lock '%s'", path)
+	}
+
+	lock.wg.Add(1)
+	go lock.keepAlive()
+
+	l.logger.Debug(l.logTag, "Acquired lock '%s'", name)
+
+	return lock, nil
+}
+
+func (l *runnerLock) contents() string {
+	return fmt.Sprintf("%s %d", l.owner, l.beats)
+}
+
+func (l *runnerLock) beat() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.beats++
+
+	return l.runner.Put(filepath.Join(l.path, lockOwnerName), []byte(l.contents()))
+}
+
+func (l *runnerLock) keepAlive() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.opts.StaleAfter / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-ticker.C:
+			err := l.beat()
+			if err != nil {
+				l.logger.Warn(l.logTag, "Refreshing lock '%s': %s", l.path, err)
+			}
+		}
+	}
+}
+
+// Unlock removes the lock unless a waiter has broken it in the meantime.
+func (l *runnerLock) Unlock() error {
+	close(l.stopCh)
+	l.wg.Wait()
+
+	bytes, err := l.runner.Get(filepath.Join(l.path, lockOwnerName))
+	if err != nil || string(bytes) != l.contents() {
+		l.logger.Warn(l.logTag, "Lock '%s' was taken over by '%s'", l.path, string(bytes))
+		return nil
+	}
+
+	return l.runner.Remove(l.path)
+}
@@ -0,0 +1,271 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHJumpHost is a bastion that the connection to Host is tunnelled through.
+type SSHJumpHost struct {
+	Host        string
+	Port        int // SSH port; defaults to 22 if zero
+	Username    string
+	PrivateKey  string
+	Certificate string
+	HostKey     string // same format as SSHRunnerOpts.HostKey
+}
+
+// sshHop is one connection in the chain from the CPI to Host.
+type sshHop struct {
+	addr        string
+	username    string
+	privateKey  string
+	certificate string
+	hostKey     string
+}
+
+func (r *SSHRunner) hops() []sshHop {
+	var hops []sshHop
+
+	for _, jump := range r.opts.JumpHosts {
+		port := jump.Port
+		if port == 0 {
+			port = 22
+		}
+
+		hops = append(hops, sshHop{
+			addr:        net.JoinHostPort(jump.Host, fmt.Sprint(port)),
+			username:    jump.Username,
+			privateKey:  jump.PrivateKey,
+			certificate: jump.Certificate,
+			hostKey:     jump.HostKey,
+		})
+	}
+
+	return append(hops, sshHop{
+		addr:        net.JoinHostPort(r.opts.Host, fmt.Sprint(r.sshPort())),
+		username:    r.opts.Username,
+		privateKey:  r.opts.PrivateKey,
+		certificate: r.opts.Certificate,
+		hostKey:     r.opts.HostKey,
+	})
+}
+
+// dial connects to Host through the jump hosts, if any. The jump host
+// connections are closed once the connection to Host ends.
+func (r *SSHRunner) dial() (*ssh.Client, error) {
+	var agentClient agent.Agent
+
+	if r.opts.UseAgent {
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Connecting to SSH agent")
+		}
+
+		// The agent is only needed to authenticate while connecting
+		defer conn.Close() //nolint:errcheck
+
+		agentClient = agent.NewClient(conn)
+	}
+
+	var clients []*ssh.Client
+
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			_ = clients[i].Close()
+		}
+	}
+
+	for _, hop := range r.hops() {
+		config, err := hop.clientConfig(agentClient, r.dialTimeout())
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		var client *ssh.Client
+
+		if len(clients) == 0 {
+			client, err = ssh.Dial("tcp", hop.addr, config)
+		} else {
+			client, err = dialVia(clients[len(clients)-1], hop.addr, config)
+		}
+
+		if err != nil {
+			closeAll()
+			return nil, RetryableErrorImpl{bosherr.WrapErrorf(err, "Connecting via SSH to '%s'", hop.addr)}
+		}
+
+		clients = append(clients, client)
+	}
+
+	target := clients[len(clients)-1]
+
+	if len(clients) > 1 {
+		go func() {
+			_ = target.Wait()
+			closeAll()
+		}()
+	}
+
+	return target, nil
+}
+
+func dialVia(jump *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+func (h sshHop) clientConfig(agentClient agent.Agent, timeout time.Duration) (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := hostKeyCallback(h.hostKey)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Parsing host key of '%s'", h.addr)
+	}
+
+	auth, err := h.authMethod(agentClient)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            h.username,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}, nil
+}
+
+// authMethod offers the hop's certificate, its private key and then the
+// agent's keys. They form a single method since the client tries each
+// method only once.
+func (h sshHop) authMethod(agentClient agent.Agent) (ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+
+	if len(h.privateKey) > 0 {
+		keySigner, err := ssh.ParsePrivateKey([]byte(h.privateKey))
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Parsing private key for '%s'", h.addr)
+		}
+
+		if len(h.certificate) > 0 {
+			certSigner, err := newCertSigner(h.certificate, keySigner)
+			if err != nil {
+				return nil, bosherr.WrapErrorf(err, "Parsing certificate for '%s'", h.addr)
+			}
+
+			signers = append(signers, certSigner)
+		}
+
+		signers = append(signers, keySigner)
+	}
+
+	if len(signers) == 0 && agentClient == nil {
+		return nil, bosherr.Errorf("No SSH credentials for '%s': expected a private key or an agent", h.addr)
+	}
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if agentClient == nil {
+			return signers, nil
+		}
+
+		agentSigners, err := agentClient.Signers()
+		if err != nil {
+			return nil, err
+		}
+
+		return append(append([]ssh.Signer{}, signers...), agentSigners...), nil
+	}), nil
+}
+
+func newCertSigner(certificate string, keySigner ssh.Signer) (ssh.Signer, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certificate))
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, bosherr.Errorf("Expected an SSH certificate, got a '%s' key", pubKey.Type())
+	}
+
+	return ssh.NewCertSigner(cert, keySigner)
+}
+
+// hostKeyCallback accepts any of hostKeys, one per line in authorized_keys
+// or known_hosts format. Keys marked @cert-authority accept the host
+// certificates they signed; host patterns on known_hosts lines are ignored
+// since the keys are configured for this connection only.
+func hostKeyCallback(hostKeys string) (ssh.HostKeyCallback, error) {
+	var keys, authorities []ssh.PublicKey
+
+	for _, line := range strings.Split(hostKeys, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil {
+			keys = append(keys, pubKey)
+			continue
+		}
+
+		marker, _, pubKey, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			return nil, err
+		}
+
+		switch marker {
+		case "":
+			keys = append(keys, pubKey)
+		case "cert-authority":
+			authorities = append(authorities, pubKey)
+		default:
+			return nil, bosherr.Errorf("Unsupported host key marker '@%s'", marker)
+		}
+	}
+
+	if len(keys) == 0 && len(authorities) == 0 {
+		return nil, bosherr.Error("No host keys")
+	}
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			return containsKey(authorities, auth)
+		},
+		HostKeyFallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if containsKey(keys, key) {
+				return nil
+			}
+			return bosherr.Errorf("Host key '%s' is not accepted", ssh.FingerprintSHA256(key))
+		},
+	}
+
+	return checker.CheckHostKey, nil
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if string(k.Marshal()) == string(key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,296 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	"github.com/pkg/sftp"
+)
+
+// Filesystem operations use SFTP when the host has it and shell commands
+// otherwise. All of them can safely be repeated after a dropped connection.
+
+func (r *SSHRunner) MkdirAll(dir string) error {
+	r.logger.Debug(r.logTag, "MkdirAll '%s'", dir)
+
+	return r.retryIdempotent(func() error {
+		client, err := r.sftp()
+		if err != nil {
+			return err
+		}
+
+		if client != nil {
+			err = client.MkdirAll(dir)
+			if err != nil {
+				return classifySFTPErr(bosherr.WrapErrorf(err, "Creating directory '%s'", dir), err)
+			}
+			return nil
+		}
+
+		_, _, err = r.execute(r.shCmd("mkdir", []string{"-p", dir}, ""), r.opts.CommandTimeout)
+		return err
+	})
+}
+
+func (r *SSHRunner) List(dir string) ([]string, error) {
+	r.logger.Debug(r.logTag, "List '%s'", dir)
+
+	var names []string
+
+	err := r.retryIdempotent(func() error {
+		names = nil
+
+		client, err := r.sftp()
+		if err != nil {
+			return err
+		}
+
+		if client != nil {
+			infos, err := client.ReadDir(dir)
+			if err != nil {
+				return classifySFTPErr(bosherr.WrapErrorf(err, "Listing directory '%s'", dir), err)
+			}
+
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+
+			return nil
+		}
+
+		output, _, err := r.execute(r.shCmd("ls", []string{"-1A", dir}, ""), r.opts.CommandTimeout)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range strings.Split(output, "\n") {
+			if len(name) > 0 {
+				names = append(names, name)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (r *SSHRunner) Remove(filePath string) error {
+	r.logger.Debug(r.logTag, "Remove '%s'", filePath)
+
+	return r.retryIdempotent(func() error {
+		client, err := r.sftp()
+		if err != nil {
+			return err
+		}
+
+		if client != nil {
+			err = client.RemoveAll(filePath)
+			if err != nil && !os.IsNotExist(err) {
+				return classifySFTPErr(bosherr.WrapErrorf(err, "Removing '%s'", filePath), err)
+			}
+			return nil
+		}
+
+		_, _, err = r.execute(r.shCmd("rm", []string{"-rf", filePath}, ""), r.opts.CommandTimeout)
+		return err
+	})
+}
+
+// Rename is repeated after a dropped connection only while srcPath exists,
+// since the failed attempt may have moved it already.
+func (r *SSHRunner) Rename(srcPath, dstPath string) error {
+	r.logger.Debug(r.logTag, "Rename '%s' to '%s'", srcPath, dstPath)
+
+	var attempted bool
+
+	return r.retryIdempotent(func() error {
+		if attempted {
+			_, err := r.Stat(srcPath)
+			if os.IsNotExist(err) {
+				_, err = r.Stat(dstPath)
+				return err
+			}
+		}
+
+		attempted = true
+
+		return r.remoteRename(srcPath, dstPath)
+	})
+}
+
+func (r *SSHRunner) Symlink(target, linkPath string) error {
+	r.logger.Debug(r.logTag, "Symlink '%s' to '%s'", linkPath, target)
+
+	return r.retryIdempotent(func() error {
+		client, err := r.sftp()
+		if err != nil {
+			return err
+		}
+
+		if client == nil {
+			_, _, err = r.execute(r.shCmd("ln", []string{"-sfn", target, linkPath}, ""), r.opts.CommandTimeout)
+			return err
+		}
+
+		partPath := linkPath + symlinkPartSuffix
+
+		err = client.Remove(partPath)
+		if err != nil && !os.IsNotExist(err) {
+			return classifySFTPErr(bosherr.WrapErrorf(err, "Removing '%s'", partPath), err)
+		}
+
+		err = client.Symlink(target, partPath)
+		if err != nil {
+			return classifySFTPErr(bosherr.WrapErrorf(err, "Linking '%s'", partPath), err)
+		}
+
+		return r.renameSFTP(client, partPath, linkPath)
+	})
+}
+
+func (r *SSHRunner) Stat(filePath string) (os.FileInfo, error) {
+	var info os.FileInfo
+
+	err := r.retryIdempotent(func() error {
+		client, err := r.sftp()
+		if err != nil {
+			return err
+		}
+
+		if client != nil {
+			info, err = client.Stat(filePath)
+			if os.IsNotExist(err) {
+				return &os.PathError{Op: "stat", Path: filePath, Err: os.ErrNotExist}
+			} else if err != nil {
+				return classifySFTPErr(bosherr.WrapErrorf(err, "Checking '%s'", filePath), err)
+			}
+			return nil
+		}
+
+		info, err = r.statShell(filePath)
+		return err
+	})
+
+	return info, err
+}
+
+func (r *SSHRunner) statShell(filePath string) (os.FileInfo, error) {
+	output, _, err := r.execute(r.shCmd("stat", []string{"-L", "-c", "%s %f %Y", filePath}, ""), r.opts.CommandTimeout)
+	if err != nil {
+		_, status, testErr := r.execute(r.shCmd("test", []string{"-e", filePath}, ""), r.opts.CommandTimeout)
+		if testErr != nil && status == 1 {
+			return nil, &os.PathError{Op: "stat", Path: filePath, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) != 3 {
+		return nil, bosherr.Errorf("Unexpected stat output for '%s': '%s'", filePath, output)
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Parsing size of '%s'", filePath)
+	}
+
+	rawMode, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Parsing mode of '%s'", filePath)
+	}
+
+	modTime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Parsing modification time of '%s'", filePath)
+	}
+
+	mode := os.FileMode(rawMode & 0777)
+	if rawMode&unixTypeMask == unixTypeDir {
+		mode |= os.ModeDir
+	}
+
+	return shellFileInfo{name: path.Base(filePath), size: size, mode: mode, modTime: time.Unix(modTime, 0)}, nil
+}
+
+func (r *SSHRunner) CreateSparseFile(filePath string, size int64) error {
+	r.logger.Debug(r.logTag, "CreateSparseFile '%s' %d", filePath, size)
+
+	return r.retryIdempotent(func() error {
+		client, err := r.sftp()
+		if err != nil {
+			return err
+		}
+
+		if client != nil {
+			return r.createSparseFileSFTP(client, filePath, size)
+		}
+
+		_, _, err = r.execute(r.shCmd("dd", []string{
+			"if=/dev/zero",
+			"of=" + filePath,
+			"bs=1",
+			"count=0",
+			"seek=" + strconv.FormatInt(size, 10),
+		}, ""), r.opts.CommandTimeout)
+		return err
+	})
+}
+
+func (r *SSHRunner) createSparseFileSFTP(client *sftp.Client, filePath string, size int64) error {
+	file, err := client.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Creating '%s'", filePath), err)
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	err = file.Chmod(sftpFileMode)
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Setting mode of '%s'", filePath), err)
+	}
+
+	err = file.Truncate(size)
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Resizing '%s'", filePath), err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Closing '%s'", filePath), err)
+	}
+
+	return nil
+}
+
+const (
+	unixTypeMask = 0170000
+	unixTypeDir  = 0040000
+)
+
+// shellFileInfo describes a file from the output of stat(1).
+type shellFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i shellFileInfo) Name() string       { return i.name }
+func (i shellFileInfo) Size() int64        { return i.size }
+func (i shellFileInfo) Mode() os.FileMode  { return i.mode }
+func (i shellFileInfo) ModTime() time.Time { return i.modTime }
+func (i shellFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i shellFileInfo) Sys() interface{}   { return nil }
+
+var _ os.FileInfo = shellFileInfo{}
@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
@@ -19,10 +20,17 @@ type SSHRunner struct {
 
 	fs boshsys.FileSystem
 
+	retrier Retrier
+
 	logTag string
 	logger boshlog.Logger
 
-	existingClient *ssh.Client
+	// mu guards existingClient, which forwarded connections share with
+	// sessions, and the SFTP client running over it
+	mu              sync.Mutex
+	existingClient  *ssh.Client
+	sftpConn        *sftpConn
+	sftpUnsupported bool
 }
 
 type SSHRunnerOpts struct {
@@ -30,15 +38,70 @@ type SSHRunnerOpts struct {
 	Port       int // SSH port; defaults to 22 if zero
 	Username   string
 	PrivateKey string
-	HostKey    string // authorized_keys format, e.g. "ssh-ed25519 AAAA..."
+
+	// Certificate is an OpenSSH user certificate for PrivateKey, e.g. "ssh-ed25519-cert-v01@openssh.com AAAA...".
+	Certificate string
+
+	// UseAgent authenticates with the keys of the agent at $SSH_AUTH_SOCK, in addition to PrivateKey.
+	UseAgent bool
+
+	// HostKey lists the accepted host keys, one per line, in authorized_keys
+	// format (e.g. "ssh-ed25519 AAAA...") or as known_hosts lines, which may
+	// be marked @cert-authority to accept host certificates.
+	HostKey string
+
+	// JumpHosts are bastions to reach Host through, in order (like ProxyJump).
+	JumpHosts []SSHJumpHost
+
+	// Compress gzips uploads in transit.
+	Compress bool
+
+	// DialTimeout bounds connecting to Host; defaults to 30s if zero.
+	DialTimeout time.Duration
+
+	// CommandTimeout bounds each command other than uploads; no limit if zero.
+	CommandTimeout time.Duration
+
+	// KeepaliveInterval is the time between keepalives, after which an
+	// unanswered keepalive drops the connection; defaults to 30s if zero.
+	KeepaliveInterval time.Duration
+
+	// RetryDelay is the pause before retrying an idempotent operation; defaults to 1s if zero.
+	RetryDelay time.Duration
+}
+
+const (
+	defaultSSHDialTimeout       = 30 * time.Second
+	defaultSSHKeepaliveInterval = 30 * time.Second
+	defaultSSHRetryDelay        = 1 * time.Second
+
+	sshRetryAttempts = 3
+)
+
+// idempotentCommands can safely run again if the connection drops before they report back.
+var idempotentCommands = map[string]bool{
+	"cat":       true,
+	"getent":    true,
+	"id":        true,
+	"ls":        true,
+	"readlink":  true,
+	"sha256sum": true,
+	"stat":      true,
+	"test":      true,
 }
 
 func NewSSHRunner(opts SSHRunnerOpts, fs boshsys.FileSystem, logger boshlog.Logger) *SSHRunner {
-	return &SSHRunner{opts, fs, "driver.SSHRunner", logger, nil}
+	return &SSHRunner{opts: opts, fs: fs, retrier: RetrierImpl{}, logTag: "driver.SSHRunner", logger: logger}
 }
 
 func (r *SSHRunner) HomeDir() (string, error) {
-	output, _, err := r.execute("getent passwd $(id -u) | cut -d: -f6")
+	var output string
+
+	err := r.retryIdempotent(func() error {
+		var err error
+		output, _, err = r.execute("getent passwd $(id -u) | cut -d: -f6", r.opts.CommandTimeout)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -52,10 +115,25 @@ func (r *SSHRunner) HomeDir() (string, error) {
 }
 
 func (r *SSHRunner) Execute(path string, args ...string) (string, int, error) {
-	return r.execute(r.shCmd(path, args, ""))
+	cmd := r.shCmd(path, args, "")
+
+	if !isIdempotent(path, args) {
+		return r.execute(cmd, r.opts.CommandTimeout)
+	}
+
+	var output string
+	var status int
+
+	err := r.retryIdempotent(func() error {
+		var err error
+		output, status, err = r.execute(cmd, r.opts.CommandTimeout)
+		return err
+	})
+
+	return output, status, err
 }
 
-func (r *SSHRunner) execute(cmd string) (string, int, error) {
+func (r *SSHRunner) execute(cmd string, timeout time.Duration) (string, int, error) {
 	r.logger.Debug(r.logTag, "Execute '%s'", cmd)
 
 	sess, err := r.session()
@@ -69,43 +147,58 @@ func (r *SSHRunner) execute(cmd string) (string, int, error) {
 	sess.Stdout = &stdout
 	sess.Stderr = &stderr
 
-	err = sess.Run(cmd)
+	err = r.run(sess, cmd, timeout)
 	output := stdout.String() + "\n" + stderr.String()
 
 	if err == nil {
 		return output, 0, nil
 	}
 
+	// Anything but the command's own exit status means the connection failed
 	switch typedErr := err.(type) {
 	case *ssh.ExitMissingError:
-		return output, 0, bosherr.WrapError(typedErr, "Missing exit info")
+		return output, 0, RetryableErrorImpl{bosherr.WrapError(typedErr, "Missing exit info")}
 	case *ssh.ExitError:
 		status := typedErr.ExitStatus()
 		return output, status, bosherr.WrapErrorf(typedErr, "Exit (Output: '%s')", output)
+	case commandTimeoutError:
+		return output, 0, RetryableErrorImpl{bosherr.WrapErrorf(typedErr, "Running '%s'", cmd)}
 	default:
-		return output, 0, bosherr.WrapErrorf(typedErr, "Unknown SSH error (Output: '%s')", output)
+		return output, 0, RetryableErrorImpl{bosherr.WrapErrorf(typedErr, "Unknown SSH error (Output: '%s')", output)}
 	}
 }
 
-func (r *SSHRunner) Upload(srcPath, dstPath string) error {
-	r.logger.Debug(r.logTag, "Upload from '%s' to '%s'", srcPath, dstPath)
+func (r *SSHRunner) Put(path string, contents []byte) error {
+	r.logger.Debug(r.logTag, "Put to '%s' %d ", path, len(contents))
 
-	file, err := r.fs.OpenFile(srcPath, os.O_RDONLY, os.ModePerm)
-	if err != nil {
-		return bosherr.WrapError(err, "Opening source file for upload")
-	}
+	// Overwriting the whole file is idempotent
+	return r.retryIdempotent(func() error {
+		client, err := r.sftp()
+		if err != nil {
+			return err
+		}
 
-	defer file.Close() //nolint:errcheck
+		if client != nil {
+			return r.putSFTP(client, path, contents)
+		}
 
-	return r.putFromReader(dstPath, file)
+		return r.putFromReader(path, bytes.NewBuffer(contents), false)
+	})
 }
 
-func (r *SSHRunner) Put(path string, contents []byte) error {
-	r.logger.Debug(r.logTag, "Put to '%s' %d ", path, len(contents))
-	return r.putFromReader(path, bytes.NewBuffer(contents))
+// PutPrivate always uses the shell since SFTP cannot create files with a
+// mode, leaving them readable by others until they are changed.
+func (r *SSHRunner) PutPrivate(path string, contents []byte) error {
+	r.logger.Debug(r.logTag, "PutPrivate to '%s' %d ", path, len(contents))
+
+	return r.retryIdempotent(func() error {
+		return r.putFromReader(path, bytes.NewBuffer(contents), true)
+	})
 }
 
-func (r *SSHRunner) putFromReader(path string, in io.Reader) error {
+// putFromReader writes in next to path, syncs it with dd and renames it
+// into place. Private files are created with umask 077.
+func (r *SSHRunner) putFromReader(path string, in io.Reader, private bool) error {
 	sess, err := r.session()
 	if err != nil {
 		return err
@@ -115,9 +208,23 @@ func (r *SSHRunner) putFromReader(path string, in io.Reader) error {
 
 	sess.Stdin = in
 
-	err = sess.Run(r.shCmd("cat", nil, path))
+	partPath := path + putPartSuffix
+
+	cmd := r.shCmd("dd", []string{"of=" + partPath, "conv=fsync"}, "")
+	if private {
+		// A part file left behind keeps its mode when truncated
+		cmd = fmt.Sprintf(`sh -c "export %s; umask 077 && rm -f %s && dd %s conv=fsync"`,
+			shEnvPath, r.shellEscape(partPath), r.shellEscape("of="+partPath))
+	}
+
+	err = r.run(sess, cmd, r.opts.CommandTimeout)
+	if err != nil {
+		return classifySSHErr(bosherr.WrapError(err, "Putting file"), err)
+	}
+
+	_, _, err = r.execute(r.shCmd("mv", []string{"-f", partPath, path}, ""), r.opts.CommandTimeout)
 	if err != nil {
-		return bosherr.WrapError(err, "Putting file")
+		return bosherr.WrapError(err, "Renaming put file")
 	}
 
 	return nil
@@ -126,6 +233,27 @@ func (r *SSHRunner) putFromReader(path string, in io.Reader) error {
 func (r *SSHRunner) Get(path string) ([]byte, error) {
 	r.logger.Debug(r.logTag, "Get '%s'", path)
 
+	var contents []byte
+
+	err := r.retryIdempotent(func() error {
+		var err error
+		contents, err = r.get(path)
+		return err
+	})
+
+	return contents, err
+}
+
+func (r *SSHRunner) get(path string) ([]byte, error) {
+	client, err := r.sftp()
+	if err != nil {
+		return nil, err
+	}
+
+	if client != nil {
+		return r.getSFTP(client, path)
+	}
+
 	sess, err := r.session()
 	if err != nil {
 		return nil, err
@@ -136,14 +264,71 @@ func (r *SSHRunner) Get(path string) ([]byte, error) {
 	var stdout bytes.Buffer
 	sess.Stdout = &stdout
 
-	err = sess.Run(r.shCmd("cat", []string{path}, ""))
+	err = r.run(sess, r.shCmd("cat", []string{path}, ""), r.opts.CommandTimeout)
 	if err != nil {
-		return nil, bosherr.WrapError(err, "Getting file")
+		return nil, classifySSHErr(bosherr.WrapError(err, "Getting file"), err)
 	}
 
 	return stdout.Bytes(), nil
 }
 
+// run runs cmd in sess, giving up once timeout has passed if it is positive.
+func (r *SSHRunner) run(sess *ssh.Session, cmd string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return sess.Run(cmd)
+	}
+
+	err := sess.Start(cmd)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	go func() { done <- sess.Wait() }()
+
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(timeout):
+		_ = sess.Close()
+
+		// Wait for the session to stop writing its output; dropping
+		// the connection ends it if the host does not close it in time
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			r.resetClient()
+			<-done
+		}
+
+		return commandTimeoutError{timeout}
+	}
+}
+
+// retryIdempotent runs action again, over a new connection, while it fails
+// with a RetryableError. Other errors are returned as they are.
+func (r *SSHRunner) retryIdempotent(action func() error) error {
+	var lastErr error
+
+	err := r.retrier.RetryComplex(func() error {
+		lastErr = action()
+
+		if _, ok := lastErr.(RetryableError); ok {
+			r.logger.Warn(r.logTag, "Retrying after connection failure: %s", lastErr)
+			r.resetClient()
+		}
+
+		return lastErr
+	}, sshRetryAttempts, r.retryDelay())
+
+	if _, ok := lastErr.(RetryableError); !ok {
+		return lastErr
+	}
+
+	return err
+}
+
 func (r *SSHRunner) session() (*ssh.Session, error) {
 	client, err := r.client()
 	if err != nil {
@@ -152,39 +337,141 @@ func (r *SSHRunner) session() (*ssh.Session, error) {
 
 	sess, err := client.NewSession()
 	if err != nil {
-		return nil, bosherr.WrapError(err, "Opening SSH session")
+		// The connection may have dropped since it was last used, and
+		// nothing has run yet, so reconnecting is always safe
+		r.forgetClient(client)
+
+		client, err = r.client()
+		if err != nil {
+			return nil, err
+		}
+
+		sess, err = client.NewSession()
+		if err != nil {
+			return nil, RetryableErrorImpl{bosherr.WrapError(err, "Opening SSH session")}
+		}
 	}
 
 	return sess, nil
 }
 
 func (r *SSHRunner) client() (*ssh.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if r.existingClient != nil {
 		return r.existingClient, nil
 	}
 
-	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.opts.HostKey))
+	client, err := r.dial()
 	if err != nil {
-		return nil, bosherr.WrapError(err, "Parsing host key")
+		return nil, err
 	}
 
-	keySigner, err := ssh.ParsePrivateKey([]byte(r.opts.PrivateKey))
-	if err != nil {
-		return nil, bosherr.WrapError(err, "Parsing private key")
+	r.existingClient = client
+
+	go r.keepalive(client)
+
+	return client, nil
+}
+
+// keepalive checks that client is still answering and forgets it once its
+// connection is gone, so that the next session reconnects.
+func (r *SSHRunner) keepalive(client *ssh.Client) {
+	closed := make(chan struct{})
+
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(r.keepaliveInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			r.forgetClient(client)
+			return
+
+		case <-ticker.C:
+			replied := make(chan error, 1)
+
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				replied <- err
+			}()
+
+			select {
+			case err := <-replied:
+				if err == nil {
+					continue
+				}
+				r.logger.Warn(r.logTag, "SSH keepalive failed: %s", err)
+			case <-time.After(r.keepaliveInterval()):
+				r.logger.Warn(r.logTag, "SSH keepalive unanswered after %s", r.keepaliveInterval())
+			case <-closed:
+			}
+
+			_ = client.Close()
+		}
 	}
+}
+
+// forgetClient closes client and stops reusing it unless it has already been replaced.
+func (r *SSHRunner) forgetClient(client *ssh.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	config := &ssh.ClientConfig{
-		User:            r.opts.Username,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(keySigner)},
-		HostKeyCallback: ssh.FixedHostKey(pubKey),
+	_ = client.Close()
+
+	if r.existingClient == client {
+		r.existingClient = nil
 	}
 
-	r.existingClient, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", r.opts.Host, r.sshPort()), config)
-	if err != nil {
-		return nil, bosherr.WrapError(err, "Connecting via SSH")
+	if r.sftpConn != nil && r.sftpConn.owner == client {
+		r.closeSFTP()
 	}
+}
 
-	return r.existingClient, nil
+// Close closes the SSH connection, ending any forwarded connections.
+func (r *SSHRunner) Close() error {
+	r.resetClient()
+	return nil
+}
+
+// resetClient drops the cached connection so that the next session reconnects.
+func (r *SSHRunner) resetClient() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closeSFTP()
+
+	if r.existingClient != nil {
+		_ = r.existingClient.Close()
+		r.existingClient = nil
+	}
+}
+
+func (r *SSHRunner) dialTimeout() time.Duration {
+	if r.opts.DialTimeout > 0 {
+		return r.opts.DialTimeout
+	}
+	return defaultSSHDialTimeout
+}
+
+func (r *SSHRunner) keepaliveInterval() time.Duration {
+	if r.opts.KeepaliveInterval > 0 {
+		return r.opts.KeepaliveInterval
+	}
+	return defaultSSHKeepaliveInterval
+}
+
+func (r *SSHRunner) retryDelay() time.Duration {
+	if r.opts.RetryDelay > 0 {
+		return r.opts.RetryDelay
+	}
+	return defaultSSHRetryDelay
 }
 
 func (r *SSHRunner) sshPort() int {
@@ -194,7 +481,7 @@ func (r *SSHRunner) sshPort() int {
 	return 22
 }
 
-func (r SSHRunner) shCmd(path string, args []string, stdoutPath string) string {
+func (r *SSHRunner) shCmd(path string, args []string, stdoutPath string) string {
 	escapedCmd := r.shellJoin(append([]string{path}, args...))
 	stdoutRedir := ""
 
@@ -202,12 +489,23 @@ func (r SSHRunner) shCmd(path string, args []string, stdoutPath string) string {
 		stdoutRedir = "> " + r.shellEscape(stdoutPath)
 	}
 
-	envPath := "PATH=$PATH:/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin"
+	return fmt.Sprintf(`sh -c "%s %s %s"`, shEnvPath, escapedCmd, stdoutRedir)
+}
 
-	return fmt.Sprintf(`sh -c "%s %s %s"`, envPath, escapedCmd, stdoutRedir)
+// shPipeCmd is like shCmd but connects cmds with pipes. redir is
+// appended as is, so paths in it must already be escaped.
+func (r *SSHRunner) shPipeCmd(cmds [][]string, redir string) string {
+	var escapedCmds []string
+	for _, cmd := range cmds {
+		escapedCmds = append(escapedCmds, r.shellJoin(cmd))
+	}
+
+	return fmt.Sprintf(`sh -c "export %s; %s %s"`, shEnvPath, strings.Join(escapedCmds, " | "), redir)
 }
 
-func (r SSHRunner) shellJoin(args []string) string {
+const shEnvPath = "PATH=$PATH:/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin"
+
+func (r *SSHRunner) shellJoin(args []string) string {
 	var escapedArgs []string
 	for _, arg := range args {
 		escapedArgs = append(escapedArgs, r.shellEscape(arg))
@@ -221,7 +519,7 @@ var (
 )
 
 // http://ruby-doc.org/stdlib-2.0.0/libdoc/shellwords/rdoc/Shellwords.html#method-c-shelljoin
-func (SSHRunner) shellEscape(arg string) string {
+func (*SSHRunner) shellEscape(arg string) string {
 	if len(arg) == 0 {
 		return "''"
 	}
@@ -231,3 +529,32 @@ func (SSHRunner) shellEscape(arg string) string {
 
 	return arg
 }
+
+func isIdempotent(path string, args []string) bool {
+	if path == "mkdir" {
+		for _, arg := range args {
+			if arg == "-p" {
+				return true
+			}
+		}
+		return false
+	}
+
+	return idempotentCommands[path]
+}
+
+// classifySSHErr returns wrapped as retryable unless cause is the exit status of the command.
+func classifySSHErr(wrapped, cause error) error {
+	if _, ok := cause.(*ssh.ExitError); ok {
+		return wrapped
+	}
+	return RetryableErrorImpl{wrapped}
+}
+
+type commandTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e commandTimeoutError) Error() string {
+	return fmt.Sprintf("Command timed out after %s", e.timeout)
+}
@@ -1,11 +1,21 @@
 package driver_test
 
 import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	. "bosh-libvirt-cpi/driver"
 )
@@ -90,4 +100,532 @@ var _ = Describe("SSHRunner", func() {
 			Expect(err.Error()).To(ContainSubstring("Parsing private key"))
 		})
 	})
+
+	Context("Upload", func() {
+		var (
+			server  *testSSHServer
+			tmpDir  string
+			srcPath string
+			dstPath string
+			content []byte
+			opts    SSHRunnerOpts
+			logger  boshlog.Logger
+		)
+
+		BeforeEach(func() {
+			server = newTestSSHServer()
+			tmpDir = tempDir()
+
+			content = make([]byte, 256*1024)
+			_, err := rand.Read(content)
+			Expect(err).ToNot(HaveOccurred())
+
+			srcPath = filepath.Join(tmpDir, "image.src")
+			dstPath = filepath.Join(tmpDir, "image.dst")
+			Expect(os.WriteFile(srcPath, content, 0600)).To(Succeed())
+
+			opts = SSHRunnerOpts{
+				Host:       "127.0.0.1",
+				Port:       server.Port(),
+				Username:   "user",
+				PrivateKey: server.PrivateKey,
+				HostKey:    server.HostKey,
+			}
+			logger = boshlog.NewLogger(boshlog.LevelNone)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		upload := func() error {
+			runner := NewSSHRunner(opts, boshsys.NewOsFileSystem(logger), logger)
+			return runner.Upload(srcPath, dstPath)
+		}
+
+		It("renames the verified upload into place", func() {
+			Expect(upload()).To(Succeed())
+			Expect(os.ReadFile(dstPath)).To(Equal(content))
+			Expect(dstPath + ".upload").ToNot(BeAnExistingFile())
+		})
+
+		It("decompresses compressed uploads on the host", func() {
+			opts.Compress = true
+
+			Expect(upload()).To(Succeed())
+			Expect(os.ReadFile(dstPath)).To(Equal(content))
+		})
+
+		It("resumes an interrupted upload from the transferred part", func() {
+			server.DropAfter(100 * 1024)
+
+			Expect(upload()).To(Succeed())
+			Expect(os.ReadFile(dstPath)).To(Equal(content))
+			Expect(dstPath + ".upload").ToNot(BeAnExistingFile())
+		})
+
+		It("resumes an interrupted upload without SFTP", func() {
+			server.DisableSFTP()
+			server.DropAfter(100 * 1024)
+
+			Expect(upload()).To(Succeed())
+			Expect(os.ReadFile(dstPath)).To(Equal(content))
+
+			var appends int
+			for _, cmd := range server.Commands() {
+				if strings.Contains(cmd, ">> ") {
+					appends++
+				}
+			}
+			Expect(appends).To(Equal(1))
+		})
+
+		It("discards a partial upload that does not match the source", func() {
+			Expect(os.WriteFile(dstPath+".upload", []byte("stale"), 0600)).To(Succeed())
+
+			Expect(upload()).To(Succeed())
+			Expect(os.ReadFile(dstPath)).To(Equal(content))
+		})
+
+		It("uploads empty files", func() {
+			Expect(os.WriteFile(srcPath, nil, 0600)).To(Succeed())
+
+			Expect(upload()).To(Succeed())
+			Expect(os.ReadFile(dstPath)).To(BeEmpty())
+			Expect(dstPath + ".upload").ToNot(BeAnExistingFile())
+
+			server.DisableSFTP()
+			opts.Compress = true
+			Expect(os.WriteFile(dstPath, []byte("stale"), 0600)).To(Succeed())
+
+			Expect(upload()).To(Succeed())
+			Expect(os.ReadFile(dstPath)).To(BeEmpty())
+		})
+	})
+
+	Context("Put and Get", func() {
+		var (
+			server *testSSHServer
+			runner *SSHRunner
+			dir    string
+		)
+
+		BeforeEach(func() {
+			server = newTestSSHServer()
+			dir = tempDir()
+		})
+
+		JustBeforeEach(func() {
+			logger := boshlog.NewLogger(boshlog.LevelNone)
+			opts := SSHRunnerOpts{
+				Host:       "127.0.0.1",
+				Port:       server.Port(),
+				Username:   "user",
+				PrivateKey: server.PrivateKey,
+				HostKey:    server.HostKey,
+			}
+			runner = NewSSHRunner(opts, nil, logger)
+		})
+
+		AfterEach(func() {
+			_ = runner.Close()
+			server.Close()
+		})
+
+		It("writes files over SFTP, creating their directory", func() {
+			path := filepath.Join(dir, "sub", "file")
+
+			Expect(runner.Put(path, []byte("contents"))).To(Succeed())
+			Expect(os.ReadFile(path)).To(Equal([]byte("contents")))
+			Expect(path + ".put").ToNot(BeAnExistingFile())
+
+			info, err := os.Stat(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+
+			Expect(runner.Get(path)).To(Equal([]byte("contents")))
+			Expect(server.Commands()).To(BeEmpty())
+		})
+
+		It("replaces existing files", func() {
+			path := filepath.Join(dir, "file")
+			Expect(os.WriteFile(path, []byte("old contents"), 0600)).To(Succeed())
+
+			Expect(runner.Put(path, []byte("new"))).To(Succeed())
+			Expect(os.ReadFile(path)).To(Equal([]byte("new")))
+		})
+
+		It("does not retry reading missing files", func() {
+			_, err := runner.Get(filepath.Join(dir, "missing"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).ToNot(ContainSubstring("Retried"))
+		})
+
+		filesystemOperations := func() {
+			It("creates, lists and removes directories", func() {
+				Expect(runner.MkdirAll(filepath.Join(dir, "b", "nested"))).To(Succeed())
+				Expect(runner.MkdirAll(filepath.Join(dir, "a"))).To(Succeed())
+				Expect(runner.MkdirAll(filepath.Join(dir, "a"))).To(Succeed())
+
+				Expect(runner.List(dir)).To(Equal([]string{"a", "b"}))
+
+				Expect(runner.Remove(filepath.Join(dir, "b"))).To(Succeed())
+				Expect(runner.Remove(filepath.Join(dir, "missing"))).To(Succeed())
+				Expect(runner.List(dir)).To(Equal([]string{"a"}))
+
+				info, err := runner.Stat(filepath.Join(dir, "a"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.IsDir()).To(BeTrue())
+			})
+
+			It("creates sparse files", func() {
+				path := filepath.Join(dir, "disk.img")
+
+				Expect(runner.CreateSparseFile(path, 1024*1024)).To(Succeed())
+
+				info, err := runner.Stat(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Size()).To(Equal(int64(1024 * 1024)))
+				Expect(info.IsDir()).To(BeFalse())
+			})
+
+			It("writes private files readable by their owner only", func() {
+				path := filepath.Join(dir, "key.tmp")
+				Expect(os.WriteFile(path+".put", []byte("stale"), 0644)).To(Succeed())
+
+				Expect(runner.PutPrivate(path, []byte("secret"))).To(Succeed())
+				Expect(os.ReadFile(path)).To(Equal([]byte("secret")))
+				Expect(path + ".put").ToNot(BeAnExistingFile())
+
+				info, err := os.Stat(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			})
+
+			It("renames files, replacing the destination", func() {
+				src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+				Expect(os.WriteFile(src, []byte("new"), 0644)).To(Succeed())
+				Expect(os.WriteFile(dst, []byte("old"), 0644)).To(Succeed())
+
+				Expect(runner.Rename(src, dst)).To(Succeed())
+				Expect(os.ReadFile(dst)).To(Equal([]byte("new")))
+				Expect(src).ToNot(BeAnExistingFile())
+			})
+
+			It("replaces symlinks, including those to directories", func() {
+				path := filepath.Join(dir, "link")
+				Expect(os.Mkdir(filepath.Join(dir, "old"), 0755)).To(Succeed())
+				Expect(os.Symlink("old", path)).To(Succeed())
+
+				Expect(runner.Symlink("new", path)).To(Succeed())
+				Expect(os.Readlink(path)).To(Equal("new"))
+				Expect(runner.List(dir)).To(Equal([]string{"link", "old"}))
+			})
+
+			It("reports missing files", func() {
+				_, err := runner.Stat(filepath.Join(dir, "missing"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		}
+
+		filesystemOperations()
+
+		Context("when the host has no SFTP server", func() {
+			BeforeEach(func() {
+				server.DisableSFTP()
+			})
+
+			filesystemOperations()
+
+			It("falls back to shell commands", func() {
+				path := filepath.Join(dir, "file")
+
+				Expect(runner.Put(path, []byte("contents"))).To(Succeed())
+				Expect(runner.Get(path)).To(Equal([]byte("contents")))
+				Expect(server.Commands()).To(HaveLen(3))
+				Expect(server.Commands()[0]).To(ContainSubstring("fsync"))
+				Expect(server.Commands()[1]).To(ContainSubstring("mv -f"))
+				Expect(path + ".put").ToNot(BeAnExistingFile())
+			})
+		})
+	})
+
+	Context("ForwardUnixSocket", func() {
+		var (
+			server *testSSHServer
+			runner *SSHRunner
+		)
+
+		BeforeEach(func() {
+			server = newTestSSHServer()
+
+			logger := boshlog.NewLogger(boshlog.LevelNone)
+			opts := SSHRunnerOpts{
+				Host:       "127.0.0.1",
+				Port:       server.Port(),
+				Username:   "user",
+				PrivateKey: server.PrivateKey,
+				HostKey:    server.HostKey,
+			}
+			runner = NewSSHRunner(opts, boshsys.NewOsFileSystem(logger), logger)
+		})
+
+		AfterEach(func() {
+			_ = runner.Close()
+			server.Close()
+		})
+
+		It("forwards connections to the remote socket over SSH", func() {
+			remotePath := filepath.Join(tempDir(), "libvirt-sock")
+
+			remote, err := net.Listen("unix", remotePath)
+			Expect(err).ToNot(HaveOccurred())
+			defer remote.Close() //nolint:errcheck
+
+			go func() {
+				conn, err := remote.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close() //nolint:errcheck
+				_, _ = io.Copy(conn, conn)
+			}()
+
+			localPath, tunnel, err := runner.ForwardUnixSocket(remotePath)
+			Expect(err).ToNot(HaveOccurred())
+
+			conn, err := net.Dial("unix", localPath)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close() //nolint:errcheck
+
+			_, err = conn.Write([]byte("ping"))
+			Expect(err).ToNot(HaveOccurred())
+
+			reply := make([]byte, 4)
+			_, err = io.ReadFull(conn, reply)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(reply)).To(Equal("ping"))
+
+			Expect(tunnel.Close()).To(Succeed())
+			Expect(filepath.Dir(localPath)).ToNot(BeADirectory())
+		})
+	})
+
+	Context("authentication and host keys", func() {
+		var (
+			server *testSSHServer
+			opts   SSHRunnerOpts
+			logger boshlog.Logger
+		)
+
+		BeforeEach(func() {
+			server = newTestSSHServer()
+			logger = boshlog.NewLogger(boshlog.LevelNone)
+			opts = SSHRunnerOpts{
+				Host:       "127.0.0.1",
+				Port:       server.Port(),
+				Username:   "user",
+				PrivateKey: server.PrivateKey,
+				HostKey:    server.HostKey,
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		execute := func() error {
+			runner := NewSSHRunner(opts, nil, logger)
+			defer runner.Close() //nolint:errcheck
+
+			_, _, err := runner.Execute("true")
+			return err
+		}
+
+		It("accepts any of several host keys", func() {
+			other := newTestSSHServer()
+			defer other.Close()
+
+			opts.HostKey = "# unrelated host\n" + other.HostKey + "\n" + server.HostKey
+			Expect(execute()).To(Succeed())
+		})
+
+		It("rejects host keys that are not listed", func() {
+			other := newTestSSHServer()
+			defer other.Close()
+
+			opts.HostKey = other.HostKey
+			err := execute()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("is not accepted"))
+		})
+
+		It("accepts host certificates signed by a @cert-authority", func() {
+			opts.HostKey = "@cert-authority 127.0.0.1 " + server.UseHostCertificate()
+			Expect(execute()).To(Succeed())
+		})
+
+		It("rejects host certificates signed by another authority", func() {
+			other := newTestSSHServer()
+			defer other.Close()
+
+			server.UseHostCertificate()
+			opts.HostKey = "@cert-authority * " + other.UseHostCertificate()
+			Expect(execute()).ToNot(Succeed())
+		})
+
+		It("authenticates with a user certificate", func() {
+			cert := server.RequireUserCertificate()
+			Expect(execute()).ToNot(Succeed())
+
+			opts.Certificate = cert
+			Expect(execute()).To(Succeed())
+		})
+
+		It("authenticates with the keys of the SSH agent", func() {
+			key, err := ssh.ParseRawPrivateKey([]byte(server.PrivateKey))
+			Expect(err).ToNot(HaveOccurred())
+
+			keyring := agent.NewKeyring()
+			Expect(keyring.Add(agent.AddedKey{PrivateKey: key})).To(Succeed())
+
+			sockPath := filepath.Join(tempDir(), "agent.sock")
+			listener, err := net.Listen("unix", sockPath)
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close() //nolint:errcheck
+
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go agent.ServeAgent(keyring, conn) //nolint:errcheck
+				}
+			}()
+
+			prevSock, hadSock := os.LookupEnv("SSH_AUTH_SOCK")
+			os.Setenv("SSH_AUTH_SOCK", sockPath) //nolint:errcheck
+			defer func() {
+				if hadSock {
+					os.Setenv("SSH_AUTH_SOCK", prevSock) //nolint:errcheck
+				} else {
+					os.Unsetenv("SSH_AUTH_SOCK") //nolint:errcheck
+				}
+			}()
+
+			opts.PrivateKey = ""
+			opts.UseAgent = true
+			Expect(execute()).To(Succeed())
+		})
+
+		It("requires credentials", func() {
+			opts.PrivateKey = ""
+			err := execute()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("No SSH credentials"))
+		})
+
+		It("connects through jump hosts", func() {
+			jump := newTestSSHServer()
+			defer jump.Close()
+
+			opts.JumpHosts = []SSHJumpHost{{
+				Host:       "127.0.0.1",
+				Port:       jump.Port(),
+				Username:   "jump",
+				PrivateKey: jump.PrivateKey,
+				HostKey:    jump.HostKey,
+			}}
+			Expect(execute()).To(Succeed())
+
+			Expect(jump.Tunnels()).To(Equal([]string{net.JoinHostPort("127.0.0.1", fmt.Sprint(server.Port()))}))
+			Expect(jump.Commands()).To(BeEmpty())
+			Expect(server.Commands()).To(HaveLen(1))
+		})
+
+		It("verifies the host keys of jump hosts", func() {
+			jump := newTestSSHServer()
+			defer jump.Close()
+
+			opts.JumpHosts = []SSHJumpHost{{
+				Host:       "127.0.0.1",
+				Port:       jump.Port(),
+				Username:   "jump",
+				PrivateKey: jump.PrivateKey,
+				HostKey:    server.HostKey,
+			}}
+			err := execute()
+			Expect(err).To(HaveOccurred())
+			Expect(server.Commands()).To(BeEmpty())
+		})
+	})
+
+	Context("with a connection that fails", func() {
+		var (
+			server *testSSHServer
+			opts   SSHRunnerOpts
+			logger boshlog.Logger
+		)
+
+		BeforeEach(func() {
+			server = newTestSSHServer()
+			logger = boshlog.NewLogger(boshlog.LevelNone)
+			opts = SSHRunnerOpts{
+				Host:       "127.0.0.1",
+				Port:       server.Port(),
+				Username:   "user",
+				PrivateKey: server.PrivateKey,
+				HostKey:    server.HostKey,
+				RetryDelay: time.Millisecond,
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("reconnects after the connection drops", func() {
+			runner := NewSSHRunner(opts, nil, logger)
+			defer runner.Close() //nolint:errcheck
+
+			_, _, err := runner.Execute("true")
+			Expect(err).ToNot(HaveOccurred())
+
+			server.DropConnections()
+
+			output, _, err := runner.Execute("echo", "again")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).To(ContainSubstring("again"))
+		})
+
+		It("retries idempotent commands interrupted by a dropped connection", func() {
+			runner := NewSSHRunner(opts, nil, logger)
+			defer runner.Close() //nolint:errcheck
+
+			server.DropAfter(1)
+
+			Expect(runner.Put(filepath.Join(tempDir(), "file"), []byte("contents"))).To(Succeed())
+		})
+
+		It("does not retry commands that fail on their own", func() {
+			runner := NewSSHRunner(opts, nil, logger)
+			defer runner.Close() //nolint:errcheck
+
+			_, status, err := runner.Execute("ls", "/nonexistent")
+			Expect(err).To(HaveOccurred())
+			Expect(status).To(Equal(2))
+			Expect(server.Commands()).To(HaveLen(1))
+		})
+
+		It("gives up on commands that exceed the command timeout", func() {
+			opts.CommandTimeout = 100 * time.Millisecond
+			runner := NewSSHRunner(opts, nil, logger)
+			defer runner.Close() //nolint:errcheck
+
+			_, _, err := runner.Execute("sleep", "5")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("timed out after 100ms"))
+		})
+	})
 })
@@ -0,0 +1,392 @@
+package driver_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/onsi/gomega"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer runs the commands it receives with the local shell,
+// standing in for a libvirt host in SSHRunner tests.
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	hostSigner   ssh.Signer
+	clientSigner ssh.Signer
+
+	HostKey    string // authorized_keys format
+	PrivateKey string // PEM client key accepted by the server
+
+	// dropAfter, if set, closes the connection once a session has
+	// read that many bytes from its stdin. It applies to one session only.
+	dropAfter int64
+
+	// noSFTP rejects the sftp subsystem, as on hosts without an SFTP server.
+	noSFTP int32
+
+	mu       sync.Mutex
+	commands []string
+	tunnels  []string
+	conns    []net.Conn
+}
+
+func newTestSSHServer() *testSSHServer {
+	hostPub, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	Expect(err).ToNot(HaveOccurred())
+
+	hostSSHPub, err := ssh.NewPublicKey(hostPub)
+	Expect(err).ToNot(HaveOccurred())
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	clientSSHPub, err := ssh.NewPublicKey(clientPub)
+	Expect(err).ToNot(HaveOccurred())
+
+	clientDER, err := x509.MarshalPKCS8PrivateKey(clientPriv)
+	Expect(err).ToNot(HaveOccurred())
+
+	clientSigner, err := ssh.NewSignerFromKey(clientPriv)
+	Expect(err).ToNot(HaveOccurred())
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientSSHPub.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	s := &testSSHServer{
+		listener:     listener,
+		config:       config,
+		hostSigner:   hostSigner,
+		clientSigner: clientSigner,
+		HostKey:      strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostSSHPub))),
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: clientDER})),
+	}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *testSSHServer) Port() int { return s.listener.Addr().(*net.TCPAddr).Port }
+
+func (s *testSSHServer) Close() { _ = s.listener.Close() }
+
+func (s *testSSHServer) DropAfter(n int64) { atomic.StoreInt64(&s.dropAfter, n) }
+
+func (s *testSSHServer) DisableSFTP() { atomic.StoreInt32(&s.noSFTP, 1) }
+
+// DropConnections closes all open connections, as a restarting sshd would.
+func (s *testSSHServer) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSSHServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Tunnels lists the addresses of direct-tcpip channels, i.e. the
+// connections made with this server as a jump host.
+func (s *testSSHServer) Tunnels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.tunnels...)
+}
+
+// UseHostCertificate makes the server present a host certificate for
+// 127.0.0.1 and returns the signing CA key in authorized_keys format.
+// It applies to later connections.
+func (s *testSSHServer) UseHostCertificate() string {
+	ca := newTestSigner()
+
+	cert := &ssh.Certificate{
+		Key:             s.hostSigner.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	Expect(cert.SignCert(rand.Reader, ca)).To(Succeed())
+
+	certSigner, err := ssh.NewCertSigner(cert, s.hostSigner)
+	Expect(err).ToNot(HaveOccurred())
+
+	s.mu.Lock()
+	s.config.AddHostKey(certSigner)
+	s.mu.Unlock()
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+}
+
+// RequireUserCertificate makes the server accept only a certificate for
+// PrivateKey with principal "user", and returns that certificate.
+// It applies to later connections.
+func (s *testSSHServer) RequireUserCertificate() string {
+	ca := newTestSigner()
+
+	cert := &ssh.Certificate{
+		Key:             s.clientSigner.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"user"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	Expect(cert.SignCert(rand.Reader, ca)).To(Succeed())
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+	}
+	s.mu.Lock()
+	s.config.PublicKeyCallback = checker.Authenticate
+	s.mu.Unlock()
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+}
+
+func newTestSigner() ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	Expect(err).ToNot(HaveOccurred())
+
+	return signer
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *testSSHServer) handleConn(conn net.Conn) {
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	config := *s.config
+	s.mu.Unlock()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, &config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "session":
+			ch, chReqs, err := newChan.Accept()
+			if err != nil {
+				continue
+			}
+
+			go s.handleSession(conn, ch, chReqs)
+
+		case "direct-streamlocal@openssh.com":
+			go s.handleStreamLocal(newChan)
+
+		case "direct-tcpip":
+			go s.handleDirectTCPIP(newChan)
+
+		default:
+			_ = newChan.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func (s *testSSHServer) handleStreamLocal(newChan ssh.NewChannel) {
+	var payload struct {
+		SocketPath string
+		Reserved0  string
+		Reserved1  uint32
+	}
+	_ = ssh.Unmarshal(newChan.ExtraData(), &payload)
+
+	s.forward(newChan, "unix", payload.SocketPath)
+}
+
+func (s *testSSHServer) handleDirectTCPIP(newChan ssh.NewChannel) {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	_ = ssh.Unmarshal(newChan.ExtraData(), &payload)
+
+	addr := net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
+
+	s.mu.Lock()
+	s.tunnels = append(s.tunnels, addr)
+	s.mu.Unlock()
+
+	s.forward(newChan, "tcp", addr)
+}
+
+func (s *testSSHServer) forward(newChan ssh.NewChannel, network, addr string) {
+	target, err := net.Dial(network, addr)
+	if err != nil {
+		_ = newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	defer target.Close() //nolint:errcheck
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+
+	defer ch.Close() //nolint:errcheck
+
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		_, _ = io.Copy(target, ch)
+		_ = target.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+
+	_, _ = io.Copy(ch, target)
+}
+
+func (s *testSSHServer) handleSession(conn net.Conn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close() //nolint:errcheck
+
+	for req := range reqs {
+		var payload struct{ Command string }
+		_ = ssh.Unmarshal(req.Payload, &payload)
+
+		switch {
+		case req.Type == "exec":
+			// handled below
+		case req.Type == "subsystem" && payload.Command == "sftp" && atomic.LoadInt32(&s.noSFTP) == 0:
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			s.serveSFTP(conn, ch)
+			return
+		default:
+			_ = req.Reply(false, nil)
+			continue
+		}
+
+		_ = req.Reply(true, nil)
+
+		s.mu.Lock()
+		s.commands = append(s.commands, payload.Command)
+		s.mu.Unlock()
+
+		stdin := s.stdin(conn, ch)
+
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdin = stdin
+		cmd.Stdout = ch
+		cmd.Stderr = ch.Stderr()
+
+		status := uint32(0)
+
+		err := cmd.Run()
+		if err != nil {
+			status = 1
+
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				status = uint32(exitErr.ExitCode())
+			}
+		}
+
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+func (s *testSSHServer) serveSFTP(conn net.Conn, ch ssh.Channel) {
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{s.stdin(conn, ch), ch})
+	if err != nil {
+		return
+	}
+
+	_ = server.Serve()
+}
+
+// stdin reads from ch, dropping conn as set up by DropAfter.
+func (s *testSSHServer) stdin(conn net.Conn, ch ssh.Channel) io.Reader {
+	limit := atomic.LoadInt64(&s.dropAfter)
+	if limit <= 0 {
+		return ch
+	}
+
+	return &droppingReader{r: ch, left: limit, conn: conn, armed: func() bool {
+		return atomic.CompareAndSwapInt64(&s.dropAfter, limit, 0)
+	}}
+}
+
+// droppingReader passes through left bytes, then closes conn
+// unless another session has already dropped it.
+type droppingReader struct {
+	r     io.Reader
+	left  int64
+	conn  net.Conn
+	armed func() bool
+}
+
+func (d *droppingReader) Read(buf []byte) (int, error) {
+	if d.left <= 0 {
+		if !d.armed() {
+			return d.r.Read(buf)
+		}
+
+		_ = d.conn.Close()
+		return 0, errors.New("connection dropped")
+	}
+
+	if int64(len(buf)) > d.left {
+		buf = buf[:d.left]
+	}
+
+	n, err := d.r.Read(buf)
+	d.left -= int64(n)
+
+	return n, err
+}
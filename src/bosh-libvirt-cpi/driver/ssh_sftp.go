@@ -0,0 +1,272 @@
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sftpFileMode is the mode of files written over SFTP. Images and
+	// config drives have to stay readable by the hypervisor.
+	sftpFileMode = 0644
+
+	// putPartSuffix names the file Put writes before renaming it into place.
+	putPartSuffix = ".put"
+
+	// symlinkPartSuffix names the link Symlink creates before renaming it into place.
+	symlinkPartSuffix = ".link"
+)
+
+// sftpConn is an SFTP client running over one SSH connection.
+type sftpConn struct {
+	client *sftp.Client
+	sess   *ssh.Session
+	owner  *ssh.Client
+}
+
+func (c *sftpConn) close() {
+	_ = c.client.Close()
+	_ = c.sess.Close()
+}
+
+// sftp returns an SFTP client on the current connection. It returns nil if
+// the host has no SFTP server, in which case files are moved with shell commands.
+func (r *SSHRunner) sftp() (*sftp.Client, error) {
+	client, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sftpUnsupported {
+		return nil, nil
+	}
+
+	if r.sftpConn != nil {
+		if r.sftpConn.owner == client {
+			return r.sftpConn.client, nil
+		}
+
+		r.sftpConn.close()
+		r.sftpConn = nil
+	}
+
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, RetryableErrorImpl{bosherr.WrapError(err, "Opening SFTP session")}
+	}
+
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		_ = sess.Close()
+		return nil, bosherr.WrapError(err, "Opening SFTP stdin")
+	}
+
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		_ = sess.Close()
+		return nil, bosherr.WrapError(err, "Opening SFTP stdout")
+	}
+
+	err = sess.RequestSubsystem("sftp")
+	if err != nil {
+		_ = sess.Close()
+		r.logger.Info(r.logTag, "SFTP is not available on '%s', transferring files with shell commands: %s", r.opts.Host, err)
+		r.sftpUnsupported = true
+		return nil, nil
+	}
+
+	sftpClient, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		_ = sess.Close()
+		return nil, RetryableErrorImpl{bosherr.WrapError(err, "Starting SFTP client")}
+	}
+
+	r.sftpConn = &sftpConn{client: sftpClient, sess: sess, owner: client}
+
+	return sftpClient, nil
+}
+
+// closeSFTP stops the SFTP client; r.mu must be held.
+func (r *SSHRunner) closeSFTP() {
+	if r.sftpConn != nil {
+		r.sftpConn.close()
+		r.sftpConn = nil
+	}
+}
+
+// putSFTP writes contents next to dstPath and renames the file into place
+// once its size is confirmed, so that readers never see a partial file.
+func (r *SSHRunner) putSFTP(client *sftp.Client, dstPath string, contents []byte) error {
+	err := client.MkdirAll(path.Dir(dstPath))
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Creating parent directory of '%s'", dstPath), err)
+	}
+
+	partPath := dstPath + putPartSuffix
+
+	err = r.writeSFTP(client, partPath, bytes.NewReader(contents), 0, int64(len(contents)))
+	if err != nil {
+		return err
+	}
+
+	return r.renameSFTP(client, partPath, dstPath)
+}
+
+// writeSFTP writes in to filePath starting at offset, truncating the file
+// if offset is zero, and checks that the file then has size bytes.
+func (r *SSHRunner) writeSFTP(client *sftp.Client, filePath string, in io.Reader, offset, size int64) error {
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	file, err := client.OpenFile(filePath, flags)
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Opening '%s'", filePath), err)
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	err = file.Chmod(sftpFileMode)
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Setting mode of '%s'", filePath), err)
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Seeking '%s'", filePath)
+	}
+
+	_, err = io.Copy(file, in)
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Writing '%s'", filePath), err)
+	}
+
+	if _, ok := client.HasExtension("fsync@openssh.com"); ok {
+		err = file.Sync()
+		if err != nil {
+			return classifySFTPErr(bosherr.WrapErrorf(err, "Syncing '%s'", filePath), err)
+		}
+	}
+
+	err = file.Close()
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Closing '%s'", filePath), err)
+	}
+
+	info, err := client.Stat(filePath)
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Checking size of '%s'", filePath), err)
+	}
+
+	if info.Size() != size {
+		return RetryableErrorImpl{bosherr.Errorf("Wrote '%s' with %d bytes, expected %d", filePath, info.Size(), size)}
+	}
+
+	return nil
+}
+
+// renameSFTP replaces dstPath with srcPath, atomically if the server supports POSIX renames.
+func (r *SSHRunner) renameSFTP(client *sftp.Client, srcPath, dstPath string) error {
+	var err error
+
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		err = client.PosixRename(srcPath, dstPath)
+	} else {
+		// Plain SFTP renames do not overwrite
+		err = client.Remove(dstPath)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			err = client.Rename(srcPath, dstPath)
+		}
+	}
+
+	if err != nil {
+		return classifySFTPErr(bosherr.WrapErrorf(err, "Renaming '%s' to '%s'", srcPath, dstPath), err)
+	}
+
+	return nil
+}
+
+func (r *SSHRunner) getSFTP(client *sftp.Client, filePath string) ([]byte, error) {
+	file, err := client.Open(filePath)
+	if err != nil {
+		return nil, classifySFTPErr(bosherr.WrapErrorf(err, "Opening '%s'", filePath), err)
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	var contents bytes.Buffer
+
+	_, err = file.WriteTo(&contents)
+	if err != nil {
+		return nil, classifySFTPErr(bosherr.WrapErrorf(err, "Reading '%s'", filePath), err)
+	}
+
+	return contents.Bytes(), nil
+}
+
+// remoteSize returns the size of filePath, or an error if it does not exist.
+func (r *SSHRunner) remoteSize(filePath string) (int64, error) {
+	client, err := r.sftp()
+	if err != nil {
+		return 0, err
+	}
+
+	if client != nil {
+		info, err := client.Stat(filePath)
+		if err != nil {
+			return 0, classifySFTPErr(bosherr.WrapErrorf(err, "Checking size of '%s'", filePath), err)
+		}
+		return info.Size(), nil
+	}
+
+	output, _, err := r.execute(r.shCmd("stat", []string{"-c", "%s", filePath}, ""), r.opts.CommandTimeout)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+}
+
+// remoteRename replaces dstPath with srcPath.
+func (r *SSHRunner) remoteRename(srcPath, dstPath string) error {
+	client, err := r.sftp()
+	if err != nil {
+		return err
+	}
+
+	if client != nil {
+		return r.renameSFTP(client, srcPath, dstPath)
+	}
+
+	_, _, err = r.execute(r.shCmd("mv", []string{"-f", srcPath, dstPath}, ""), r.opts.CommandTimeout)
+
+	return err
+}
+
+// classifySFTPErr returns wrapped as retryable unless the server refused the operation.
+func classifySFTPErr(wrapped, cause error) error {
+	var statusErr *sftp.StatusError
+
+	switch {
+	case errors.As(cause, &statusErr),
+		errors.Is(cause, os.ErrNotExist),
+		errors.Is(cause, os.ErrPermission),
+		errors.Is(cause, os.ErrExist):
+		return wrapped
+	default:
+		return RetryableErrorImpl{wrapped}
+	}
+}
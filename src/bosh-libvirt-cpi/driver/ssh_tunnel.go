@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+)
+
+// ForwardUnixSocket listens on a local unix socket and forwards each
+// connection to remotePath on the host through the runner's SSH client.
+// It returns the local socket path; closing the returned closer stops
+// accepting connections and removes the socket.
+func (r *SSHRunner) ForwardUnixSocket(remotePath string) (string, io.Closer, error) {
+	// The temp dir is private to the current user, and so is the socket in it
+	dir, err := r.fs.TempDir("bosh-libvirt-cpi-tunnel")
+	if err != nil {
+		return "", nil, bosherr.WrapError(err, "Creating tunnel dir")
+	}
+
+	localPath := filepath.Join(dir, "sock")
+
+	listener, err := net.Listen("unix", localPath)
+	if err != nil {
+		_ = r.fs.RemoveAll(dir)
+		return "", nil, bosherr.WrapErrorf(err, "Listening on '%s'", localPath)
+	}
+
+	r.logger.Debug(r.logTag, "Forwarding '%s' to '%s' on '%s'", localPath, remotePath, r.opts.Host)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go r.forward(conn, remotePath)
+		}
+	}()
+
+	return localPath, tunnel{listener, dir, r.fs}, nil
+}
+
+func (r *SSHRunner) forward(local net.Conn, remotePath string) {
+	defer local.Close() //nolint:errcheck
+
+	client, err := r.client()
+	if err != nil {
+		r.logger.Error(r.logTag, "Forwarding to '%s': %s", remotePath, err)
+		return
+	}
+
+	remote, err := client.Dial("unix", remotePath)
+	if err != nil {
+		r.logger.Error(r.logTag, "Forwarding to '%s': %s", remotePath, err)
+		return
+	}
+
+	defer remote.Close() //nolint:errcheck
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, _ = io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, _ = io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+
+	// Either side closing ends the forwarded connection
+	<-done
+}
+
+type tunnel struct {
+	listener net.Listener
+	dir      string
+	fs       boshsys.FileSystem
+}
+
+func (t tunnel) Close() error {
+	err := t.listener.Close()
+	_ = t.fs.RemoveAll(t.dir)
+	return err
+}
@@ -0,0 +1,260 @@
+package driver
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+)
+
+const (
+	// uploadPartSuffix names the file an upload is streamed into before
+	// it is verified and renamed into place.
+	uploadPartSuffix = ".upload"
+
+	uploadAttempts = 3
+
+	// uploadProgressInterval is the number of bytes between progress log lines.
+	uploadProgressInterval = 256 * 1024 * 1024
+)
+
+// Upload streams srcPath to dstPath. Data goes to a temporary file that is
+// checked against the SHA-256 of the source before it is renamed into place.
+// An interrupted upload resumes from the part of the temporary file that
+// matches the source, both within this call and on a later one.
+func (r *SSHRunner) Upload(srcPath, dstPath string) error {
+	r.logger.Debug(r.logTag, "Upload from '%s' to '%s'", srcPath, dstPath)
+
+	file, err := r.fs.OpenFile(srcPath, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return bosherr.WrapError(err, "Opening source file for upload")
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	info, err := file.Stat()
+	if err != nil {
+		return bosherr.WrapError(err, "Reading source file size")
+	}
+
+	checksum, err := checksumPrefix(file, info.Size())
+	if err != nil {
+		return bosherr.WrapError(err, "Calculating source file checksum")
+	}
+
+	partPath := dstPath + uploadPartSuffix
+
+	for attempt := 1; ; attempt++ {
+		err = r.uploadPart(file, info.Size(), partPath)
+		if err == nil {
+			break
+		}
+
+		if attempt == uploadAttempts {
+			return bosherr.WrapErrorf(err, "Uploading '%s' after %d attempts", srcPath, attempt)
+		}
+
+		r.logger.Warn(r.logTag, "Upload attempt %d of '%s' failed, resuming: %s", attempt, srcPath, err)
+		r.resetClient()
+	}
+
+	remoteChecksum, err := r.remoteChecksum(partPath, -1)
+	if err != nil {
+		return err
+	}
+
+	if remoteChecksum != checksum {
+		_, _, _ = r.execute(r.shCmd("rm", []string{"-f", partPath}, ""), r.opts.CommandTimeout)
+		return bosherr.Errorf("Uploaded file checksum '%s' does not match source checksum '%s'", remoteChecksum, checksum)
+	}
+
+	err = r.remoteRename(partPath, dstPath)
+	if err != nil {
+		return bosherr.WrapError(err, "Renaming uploaded file")
+	}
+
+	return nil
+}
+
+// uploadPart appends the part of file that is missing from partPath.
+func (r *SSHRunner) uploadPart(file boshsys.File, size int64, partPath string) error {
+	offset, err := r.resumeOffset(file, size, partPath)
+	if err != nil {
+		return err
+	}
+
+	// An empty source is still written so that there is a part file to verify
+	if offset == size && size > 0 {
+		return nil
+	}
+
+	if offset > 0 {
+		r.logger.Info(r.logTag, "Resuming upload to '%s' at byte %d of %d", partPath, offset, size)
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return bosherr.WrapError(err, "Seeking source file")
+	}
+
+	in := io.Reader(&progressReader{r: file, done: offset, total: size, logged: offset, log: func(done, total int64) {
+		r.logger.Info(r.logTag, "Uploaded %d of %d bytes to '%s' (%d%%)", done, total, partPath, done*100/total)
+	}})
+
+	// SFTP cannot decompress, so compressed uploads always go through the shell
+	if !r.opts.Compress {
+		client, err := r.sftp()
+		if err != nil {
+			return err
+		}
+
+		if client != nil {
+			return r.writeSFTP(client, partPath, in, offset, size)
+		}
+	}
+
+	redir := ">> "
+	if offset == 0 {
+		redir = "> "
+	}
+
+	cmds := [][]string{{"cat"}}
+
+	if r.opts.Compress {
+		compressed := gzipReader(in)
+		defer compressed.Close() //nolint:errcheck
+
+		cmds = [][]string{{"gzip", "-dc"}}
+		in = compressed
+	}
+
+	sess, err := r.session()
+	if err != nil {
+		return err
+	}
+
+	defer sess.Close() //nolint:errcheck
+
+	sess.Stdin = in
+
+	err = sess.Run(r.shPipeCmd(cmds, redir+r.shellEscape(partPath)))
+	if err != nil {
+		return bosherr.WrapError(err, "Streaming file")
+	}
+
+	return nil
+}
+
+// resumeOffset returns how much of partPath can be kept: all of it if it is
+// a prefix of file, otherwise nothing.
+func (r *SSHRunner) resumeOffset(file boshsys.File, size int64, partPath string) (int64, error) {
+	offset, err := r.remoteSize(partPath)
+	if err != nil {
+		// No partial upload
+		return 0, nil
+	}
+
+	if offset <= 0 || offset > size {
+		return 0, nil
+	}
+
+	localChecksum, err := checksumPrefix(file, offset)
+	if err != nil {
+		return 0, bosherr.WrapError(err, "Calculating source file checksum")
+	}
+
+	remoteChecksum, err := r.remoteChecksum(partPath, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	if remoteChecksum != localChecksum {
+		r.logger.Info(r.logTag, "Discarding partial upload '%s' that does not match the source", partPath)
+		return 0, nil
+	}
+
+	return offset, nil
+}
+
+// remoteChecksum returns the SHA-256 of the first n bytes of path, or all of it if n is negative.
+func (r *SSHRunner) remoteChecksum(path string, n int64) (string, error) {
+	cmds := [][]string{{"sha256sum", path}}
+	if n >= 0 {
+		cmds = [][]string{{"head", "-c", strconv.FormatInt(n, 10), path}, {"sha256sum"}}
+	}
+
+	// Hashing a large image can take longer than a command is otherwise allowed to
+	output, _, err := r.execute(r.shPipeCmd(cmds, ""), 0)
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Calculating checksum of '%s'", path)
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", bosherr.Errorf("Calculating checksum of '%s': no output", path)
+	}
+
+	return fields[0], nil
+}
+
+func checksumPrefix(file boshsys.File, n int64) (string, error) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+
+	_, err = io.CopyN(hash, file, n)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// gzipReader compresses in on the fly. Closing it stops the compression.
+func gzipReader(in io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		gw := gzip.NewWriter(pw)
+
+		_, err := io.Copy(gw, in)
+		if err == nil {
+			err = gw.Close()
+		}
+
+		pw.CloseWithError(err) //nolint:errcheck
+	}()
+
+	return pr
+}
+
+// progressReader reports every uploadProgressInterval bytes read.
+type progressReader struct {
+	r io.Reader
+
+	done   int64
+	total  int64
+	logged int64
+	log    func(done, total int64)
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.done += int64(n)
+
+	if p.done-p.logged >= uploadProgressInterval || (err == io.EOF && p.done > p.logged) {
+		p.logged = p.done
+		p.log(p.done, p.total)
+	}
+
+	return n, err
+}
@@ -0,0 +1,365 @@
+package inventory
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	bdisk "bosh-libvirt-cpi/disk"
+	"bosh-libvirt-cpi/driver"
+	bstem "bosh-libvirt-cpi/stemcell"
+	bvm "bosh-libvirt-cpi/vm"
+)
+
+// Inventory lists the resources the CPI manages on the host and finds
+// those that failed calls left behind, for operators.
+type Inventory struct {
+	vms       bvm.Factory
+	disks     bdisk.Factory
+	stemcells bstem.Factory
+
+	driver driver.Driver
+	runner driver.Runner
+
+	logTag string
+	logger boshlog.Logger
+}
+
+func New(
+	vms bvm.Factory,
+	disks bdisk.Factory,
+	stemcells bstem.Factory,
+	driver driver.Driver,
+	runner driver.Runner,
+	logger boshlog.Logger,
+) Inventory {
+	return Inventory{
+		vms:       vms,
+		disks:     disks,
+		stemcells: stemcells,
+
+		driver: driver,
+		runner: runner,
+
+		logTag: "inventory.Inventory",
+		logger: logger,
+	}
+}
+
+// Disk is a disk with the VM it is attached to, if any.
+type Disk struct {
+	bdisk.Info
+
+	AttachedTo string `json:",omitempty"`
+	Ephemeral  bool   `json:",omitempty"`
+}
+
+func (i Inventory) VMs() ([]bvm.Info, error) {
+	cids, err := i.vms.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []bvm.Info
+
+	for _, cid := range cids {
+		info, err := i.vms.Info(cid)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Describing VM '%s'", cid.AsString())
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Disks returns the disks with the attachments the VMs record.
+func (i Inventory) Disks() ([]Disk, error) {
+	vms, err := i.VMs()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := map[string]Disk{}
+
+	for _, vm := range vms {
+		for _, att := range vm.Disks {
+			attachments[att.CID] = Disk{AttachedTo: vm.CID, Ephemeral: att.Ephemeral}
+		}
+	}
+
+	cids, err := i.disks.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var disks []Disk
+
+	for _, cid := range cids {
+		info, err := i.disks.Info(cid)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Describing disk '%s'", cid.AsString())
+		}
+
+		disk := attachments[cid.AsString()]
+		disk.Info = info
+
+		disks = append(disks, disk)
+	}
+
+	return disks, nil
+}
+
+func (i Inventory) Stemcells() ([]bstem.Info, error) {
+	cids, err := i.stemcells.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []bstem.Info
+
+	for _, cid := range cids {
+		info, err := i.stemcells.Info(cid)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Describing stemcell '%s'", cid.AsString())
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// AgentEnv returns the agent env the VM was last configured with.
+func (i Inventory) AgentEnv(cid apiv1.VMCID) (json.RawMessage, error) {
+	bytes, err := i.vms.AgentEnv(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(bytes) {
+		return nil, bosherr.Errorf("Agent env of VM '%s' is not valid JSON", cid.AsString())
+	}
+
+	return json.RawMessage(bytes), nil
+}
+
+type OrphanKind string
+
+const (
+	// OrphanDomain is a domain named like a VM without a store dir.
+	OrphanDomain OrphanKind = "domain"
+	// OrphanVMDir is a VM store dir without a domain.
+	OrphanVMDir OrphanKind = "vm-dir"
+	// OrphanDiskDir is a disk dir with neither a record nor an image.
+	OrphanDiskDir OrphanKind = "disk-dir"
+)
+
+type Orphan struct {
+	Kind OrphanKind
+	CID  string
+	Path string `json:",omitempty"`
+}
+
+// Orphans finds the resources failed creates and deletes left behind.
+// Dirs modified and domains defined within minAge are skipped since a call
+// in progress may be about to complete them. Domains without the CPI's
+// metadata are never reported, even if named like its VMs.
+func (i Inventory) Orphans(minAge time.Duration) ([]Orphan, error) {
+	domains, err := i.driver.ListDomains()
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing domains")
+	}
+
+	vmCIDs, err := i.vms.List()
+	if err != nil {
+		return nil, err
+	}
+
+	hasDomain := map[string]bool{}
+	for _, name := range domains {
+		hasDomain[name] = true
+	}
+
+	hasDir := map[string]bool{}
+	for _, cid := range vmCIDs {
+		hasDir[cid.AsString()] = true
+	}
+
+	var orphans []Orphan
+
+	for _, name := range domains {
+		if !strings.HasPrefix(name, "vm-") || hasDir[name] {
+			continue
+		}
+
+		ours, err := i.isOldCPIDomain(name, minAge)
+		if err != nil {
+			return nil, err
+		}
+
+		if ours {
+			orphans = append(orphans, Orphan{Kind: OrphanDomain, CID: name})
+		}
+	}
+
+	for _, cid := range vmCIDs {
+		if hasDomain[cid.AsString()] {
+			continue
+		}
+
+		info, err := i.vms.Info(cid)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Describing VM '%s'", cid.AsString())
+		}
+
+		old, err := i.olderThan(info.Path, minAge)
+		if err != nil {
+			return nil, err
+		}
+
+		if old {
+			orphans = append(orphans, Orphan{Kind: OrphanVMDir, CID: info.CID, Path: info.Path})
+		}
+	}
+
+	diskCIDs, err := i.disks.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cid := range diskCIDs {
+		info, err := i.disks.Info(cid)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Describing disk '%s'", cid.AsString())
+		}
+
+		if info.HasRecord || info.HasImage {
+			continue
+		}
+
+		old, err := i.olderThan(info.Path, minAge)
+		if err != nil {
+			return nil, err
+		}
+
+		if old {
+			orphans = append(orphans, Orphan{Kind: OrphanDiskDir, CID: info.CID, Path: info.Path})
+		}
+	}
+
+	sort.SliceStable(orphans, func(a, b int) bool {
+		if orphans[a].Kind != orphans[b].Kind {
+			return orphans[a].Kind < orphans[b].Kind
+		}
+		return orphans[a].CID < orphans[b].CID
+	})
+
+	return orphans, nil
+}
+
+// DeleteOrphan deletes o after checking that it is still an orphan.
+func (i Inventory) DeleteOrphan(o Orphan) error {
+	i.logger.Info(i.logTag, "Deleting orphaned %s '%s'", o.Kind, o.CID)
+
+	switch o.Kind {
+	case OrphanDomain, OrphanVMDir:
+		return i.deleteOrphanedVM(o)
+	case OrphanDiskDir:
+		return i.deleteOrphanedDisk(o)
+	default:
+		return bosherr.Errorf("Unknown orphan kind '%s'", o.Kind)
+	}
+}
+
+func (i Inventory) deleteOrphanedVM(o Orphan) error {
+	cid := apiv1.NewVMCID(o.CID)
+
+	vm, err := i.vms.Find(cid)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Finding VM '%s'", o.CID)
+	}
+
+	if o.Kind == OrphanDomain {
+		_, found, err := i.driver.DomainMetadata(o.CID)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Reading metadata of domain '%s'", o.CID)
+		}
+
+		if !found {
+			return bosherr.Errorf("Domain '%s' was not defined by the CPI", o.CID)
+		}
+
+		cids, err := i.vms.List()
+		if err != nil {
+			return err
+		}
+
+		for _, c := range cids {
+			if c.AsString() == o.CID {
+				return bosherr.Errorf("VM '%s' has a store dir now", o.CID)
+			}
+		}
+	} else {
+		exists, err := vm.Exists()
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return bosherr.Errorf("VM '%s' has a domain now", o.CID)
+		}
+	}
+
+	// Delete also releases the stemcell the VM recorded
+	return vm.Delete()
+}
+
+func (i Inventory) deleteOrphanedDisk(o Orphan) error {
+	cid := apiv1.NewDiskCID(o.CID)
+
+	info, err := i.disks.Info(cid)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Describing disk '%s'", o.CID)
+	}
+
+	if info.HasRecord || info.HasImage {
+		return bosherr.Errorf("Disk '%s' has a record or an image now", o.CID)
+	}
+
+	disk, err := i.disks.Find(cid)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Finding disk '%s'", o.CID)
+	}
+
+	return disk.Delete()
+}
+
+// isOldCPIDomain reports whether the domain carries the CPI's metadata and
+// was defined at least minAge ago. Domains deleted meanwhile are skipped.
+func (i Inventory) isOldCPIDomain(name string, minAge time.Duration) (bool, error) {
+	meta, found, err := i.driver.DomainMetadata(name)
+	if err != nil {
+		if i.driver.IsMissingDomainErr(err) {
+			return false, nil
+		}
+		return false, bosherr.WrapErrorf(err, "Reading metadata of domain '%s'", name)
+	}
+
+	return found && time.Since(meta.Created) >= minAge, nil
+}
+
+func (i Inventory) olderThan(path string, minAge time.Duration) (bool, error) {
+	stat, err := i.runner.Stat(path)
+	if err != nil {
+		return false, bosherr.WrapErrorf(err, "Checking '%s'", path)
+	}
+
+	return time.Since(stat.ModTime()) >= minAge, nil
+}
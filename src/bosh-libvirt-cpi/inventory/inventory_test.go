@@ -0,0 +1,225 @@
+package inventory_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	bdisk "bosh-libvirt-cpi/disk"
+	"bosh-libvirt-cpi/driver"
+	driverfakes "bosh-libvirt-cpi/driver/fakes"
+	"bosh-libvirt-cpi/inventory"
+	bstem "bosh-libvirt-cpi/stemcell"
+	bvm "bosh-libvirt-cpi/vm"
+)
+
+var _ = Describe("Inventory", func() {
+	var (
+		dir string
+		drv *driverfakes.FakeDriver
+		inv inventory.Inventory
+	)
+
+	put := func(path, contents string) {
+		path = filepath.Join(dir, path)
+		Expect(os.MkdirAll(filepath.Dir(path), 0700)).To(Succeed())
+		Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+	}
+
+	age := func(path string) {
+		old := time.Now().Add(-2 * time.Hour)
+		Expect(os.Chtimes(filepath.Join(dir, path), old, old)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "inventory-test")
+		Expect(err).ToNot(HaveOccurred())
+
+		logger := boshlog.NewLogger(boshlog.LevelNone)
+		fs := boshsys.NewOsFileSystem(logger)
+		runner := driver.NewLocalRunner(fs, boshsys.NewExecCmdRunner(logger), logger)
+		locker := &driverfakes.FakeLocker{}
+		builder := &driverfakes.FakeDomainBuilder{DiskImageFormatResult: "qcow2"}
+
+		drv = &driverfakes.FakeDriver{
+			LookupDomainErr:          errors.New("domain not found"),
+			IsMissingDomainErrResult: true,
+		}
+
+		stemcells := bstem.NewFactory(
+			bstem.FactoryOpts{DirPath: filepath.Join(dir, "stemcells")},
+			drv, builder, runner, locker, fs, nil, nil, logger)
+
+		disks := bdisk.NewFactory(filepath.Join(dir, "disks"), nil, drv, runner, locker, logger)
+
+		vms := bvm.NewFactory(
+			bvm.FactoryOpts{DirPath: filepath.Join(dir, "vms")},
+			nil, drv, runner, locker, builder, disks, stemcells,
+			apiv1.AgentOptions{}, apiv1.StemcellAPIVersion{}, logger)
+
+		inv = inventory.New(vms, disks, stemcells, drv, runner, logger)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Describe("VMs, Disks and Stemcells", func() {
+		BeforeEach(func() {
+			put("vms/vm-1/stemcell.json", `{"CID":"sc-1"}`)
+			put("vms/vm-1/metadata.json", `{"deployment":"dep"}`)
+			put("vms/vm-1/env.json", `{"agent_id":"agent-1"}`)
+			put("vms/vm-1/disk-1-disk-attachment.json", `{"ID":"disk-1","Target":"vdc"}`)
+			put("disks/disk-1/disk.json", `{"Props":{"Format":"raw"}}`)
+			put("disks/disk-2/disk.img", "image")
+			put("stemcells/sc-1/users/vm-1", "")
+		})
+
+		It("describes VMs with their metadata and disks", func() {
+			vms, err := inv.VMs()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(vms).To(HaveLen(1))
+			Expect(vms[0].CID).To(Equal("vm-1"))
+			Expect(vms[0].Stemcell).To(Equal("sc-1"))
+			Expect(vms[0].Metadata).To(Equal(map[string]interface{}{"deployment": "dep"}))
+			Expect(vms[0].Disks).To(Equal([]bvm.DiskAttachmentInfo{{CID: "disk-1", Target: "vdc"}}))
+		})
+
+		It("describes disks with the VMs they are attached to", func() {
+			disks, err := inv.Disks()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(disks).To(HaveLen(2))
+
+			Expect(disks[0].CID).To(Equal("disk-1"))
+			Expect(disks[0].AttachedTo).To(Equal("vm-1"))
+			Expect(disks[0].HasRecord).To(BeTrue())
+
+			Expect(disks[1].CID).To(Equal("disk-2"))
+			Expect(disks[1].AttachedTo).To(BeEmpty())
+			Expect(disks[1].HasRecord).To(BeFalse())
+		})
+
+		It("describes stemcells with the VMs using them", func() {
+			stemcells, err := inv.Stemcells()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stemcells).To(HaveLen(1))
+			Expect(stemcells[0].CID).To(Equal("sc-1"))
+			Expect(stemcells[0].Users).To(Equal([]string{"vm-1"}))
+		})
+
+		It("returns a VM's agent env", func() {
+			env, err := inv.AgentEnv(apiv1.NewVMCID("vm-1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(env).To(MatchJSON(`{"agent_id":"agent-1"}`))
+		})
+	})
+
+	Describe("Orphans", func() {
+		It("finds domains without store dirs and old dirs without domains or images", func() {
+			drv.ListDomainsResult = []string{"vm-1", "vm-2", "other"}
+			drv.DomainMetadataResults = map[string]driver.DomainMetadata{
+				"vm-1": {Created: time.Now().Add(-2 * time.Hour)},
+				"vm-2": {Created: time.Now().Add(-2 * time.Hour)},
+			}
+
+			put("vms/vm-1/env.json", "{}")
+			put("vms/vm-3/env.json", "{}")
+			age("vms/vm-3")
+			Expect(os.MkdirAll(filepath.Join(dir, "disks/disk-1"), 0700)).To(Succeed())
+			age("disks/disk-1")
+			put("disks/disk-2/disk.img", "image")
+			age("disks/disk-2")
+
+			orphans, err := inv.Orphans(time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(orphans).To(Equal([]inventory.Orphan{
+				{Kind: inventory.OrphanDiskDir, CID: "disk-1", Path: filepath.Join(dir, "disks/disk-1")},
+				{Kind: inventory.OrphanDomain, CID: "vm-2"},
+				{Kind: inventory.OrphanVMDir, CID: "vm-3", Path: filepath.Join(dir, "vms/vm-3")},
+			}))
+		})
+
+		It("skips dirs modified within the minimum age", func() {
+			put("vms/vm-1/env.json", "{}")
+			Expect(os.MkdirAll(filepath.Join(dir, "disks/disk-1"), 0700)).To(Succeed())
+
+			orphans, err := inv.Orphans(time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(orphans).To(BeEmpty())
+		})
+
+		It("skips domains defined within the minimum age or without the CPI's metadata", func() {
+			drv.ListDomainsResult = []string{"vm-1", "vm-2"}
+			drv.DomainMetadataResults = map[string]driver.DomainMetadata{
+				"vm-1": {Created: time.Now().Add(-time.Minute)},
+			}
+
+			orphans, err := inv.Orphans(time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(orphans).To(BeEmpty())
+		})
+
+		It("skips domains deleted meanwhile", func() {
+			drv.ListDomainsResult = []string{"vm-1"}
+			drv.DomainMetadataErr = errors.New("domain not found")
+
+			orphans, err := inv.Orphans(time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(orphans).To(BeEmpty())
+		})
+
+		It("returns errors reading domain metadata", func() {
+			drv.ListDomainsResult = []string{"vm-1"}
+			drv.DomainMetadataErr = errors.New("fake-err")
+			drv.IsMissingDomainErrResult = false
+
+			_, err := inv.Orphans(time.Hour)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-err"))
+		})
+
+		It("deletes orphaned dirs and domains", func() {
+			drv.DomainMetadataResults = map[string]driver.DomainMetadata{"vm-2": {}}
+
+			put("vms/vm-3/env.json", "{}")
+			Expect(os.MkdirAll(filepath.Join(dir, "disks/disk-1"), 0700)).To(Succeed())
+
+			Expect(inv.DeleteOrphan(inventory.Orphan{Kind: inventory.OrphanVMDir, CID: "vm-3"})).To(Succeed())
+			Expect(filepath.Join(dir, "vms/vm-3")).ToNot(BeADirectory())
+
+			Expect(inv.DeleteOrphan(inventory.Orphan{Kind: inventory.OrphanDiskDir, CID: "disk-1"})).To(Succeed())
+			Expect(filepath.Join(dir, "disks/disk-1")).ToNot(BeADirectory())
+
+			Expect(inv.DeleteOrphan(inventory.Orphan{Kind: inventory.OrphanDomain, CID: "vm-2"})).To(Succeed())
+			Expect(drv.DestroyDomainID).To(Equal("vm-2"))
+		})
+
+		It("does not delete domains without the CPI's metadata", func() {
+			err := inv.DeleteOrphan(inventory.Orphan{Kind: inventory.OrphanDomain, CID: "vm-2"})
+			Expect(err).To(HaveOccurred())
+			Expect(drv.DestroyDomainID).To(BeEmpty())
+		})
+
+		It("does not delete what is no longer orphaned", func() {
+			drv.DomainMetadataResults = map[string]driver.DomainMetadata{"vm-2": {}}
+			put("vms/vm-2/env.json", "{}")
+			put("disks/disk-1/disk.img", "image")
+
+			err := inv.DeleteOrphan(inventory.Orphan{Kind: inventory.OrphanDomain, CID: "vm-2"})
+			Expect(err).To(HaveOccurred())
+			Expect(drv.DestroyDomainID).To(BeEmpty())
+
+			err = inv.DeleteOrphan(inventory.Orphan{Kind: inventory.OrphanDiskDir, CID: "disk-1"})
+			Expect(err).To(HaveOccurred())
+			Expect(filepath.Join(dir, "disks/disk-1/disk.img")).To(BeAnExistingFile())
+		})
+	})
+})
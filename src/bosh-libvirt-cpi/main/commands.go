@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+
+	"bosh-libvirt-cpi/inventory"
+)
+
+// operatorCommands inspect and clean up the resources on the host
+// configured by -configPath. They print to out and log warnings only.
+var operatorCommands = map[string]func(inventory.Inventory, []string, io.Writer) error{
+	"vms":       vmsCmd,
+	"disks":     disksCmd,
+	"stemcells": stemcellsCmd,
+	"agent-env": agentEnvCmd,
+	"orphans":   orphansCmd,
+}
+
+func vmsCmd(inv inventory.Inventory, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("vms", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print JSON instead of a table")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	vms, err := inv.VMs()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(out, vms)
+	}
+
+	return printTable(out, []string{"CID", "RUNNING", "STEMCELL", "DISKS", "METADATA"}, func(add func(...interface{})) {
+		for _, vm := range vms {
+			var disks []string
+			for _, d := range vm.Disks {
+				if d.Ephemeral {
+					disks = append(disks, d.CID+" (ephemeral)")
+				} else {
+					disks = append(disks, d.CID)
+				}
+			}
+
+			add(vm.CID, vm.Running, orDash(vm.Stemcell), orDash(strings.Join(disks, ",")), orDash(formatMetadata(vm.Metadata)))
+		}
+	})
+}
+
+func disksCmd(inv inventory.Inventory, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("disks", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print JSON instead of a table")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	disks, err := inv.Disks()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(out, disks)
+	}
+
+	return printTable(out, []string{"CID", "SIZE", "FORMAT", "POOL", "ATTACHED TO", "IMAGE"}, func(add func(...interface{})) {
+		for _, d := range disks {
+			image := d.ImagePath
+			if !d.HasImage {
+				image = "(missing) " + image
+			}
+
+			add(d.CID, d.Size, d.Props.Format, orDash(d.Props.Pool), orDash(d.AttachedTo), image)
+		}
+	})
+}
+
+func stemcellsCmd(inv inventory.Inventory, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("stemcells", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print JSON instead of a table")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	stemcells, err := inv.Stemcells()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(out, stemcells)
+	}
+
+	return printTable(out, []string{"CID", "FORMAT", "SOURCE", "USERS", "PENDING DELETE"}, func(add func(...interface{})) {
+		for _, s := range stemcells {
+			add(s.CID, orDash(s.Format), orDash(s.Source), orDash(strings.Join(s.Users, ",")), s.PendingDelete)
+		}
+	})
+}
+
+func agentEnvCmd(inv inventory.Inventory, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return bosherr.Error("Usage: agent-env <vm-cid>")
+	}
+
+	env, err := inv.AgentEnv(apiv1.NewVMCID(args[0]))
+	if err != nil {
+		return err
+	}
+
+	return printJSON(out, env)
+}
+
+func orphansCmd(inv inventory.Inventory, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("orphans", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print JSON instead of a table")
+	minAge := flags.Duration("min-age", time.Hour, "Ignore dirs modified more recently than this")
+	del := flags.Bool("delete", false, "Delete the orphans found")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	orphans, err := inv.Orphans(*minAge)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		err = printJSON(out, orphans)
+	} else {
+		err = printTable(out, []string{"KIND", "CID", "PATH"}, func(add func(...interface{})) {
+			for _, o := range orphans {
+				add(o.Kind, o.CID, orDash(o.Path))
+			}
+		})
+	}
+	if err != nil || !*del {
+		return err
+	}
+
+	var failed int
+
+	for _, o := range orphans {
+		err := inv.DeleteOrphan(o)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "Failed to delete %s '%s': %s\n", o.Kind, o.CID, err) //nolint:errcheck
+		}
+	}
+
+	if failed > 0 {
+		return bosherr.Errorf("Failed to delete %d of %d orphans", failed, len(orphans))
+	}
+
+	return nil
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return bosherr.WrapError(err, "Serializing output")
+	}
+
+	_, err = fmt.Fprintln(out, string(bytes))
+	return err
+}
+
+func printTable(out io.Writer, header []string, rows func(add func(...interface{}))) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, strings.Join(header, "\t")) //nolint:errcheck
+
+	rows(func(cols ...interface{}) {
+		strs := make([]string, len(cols))
+		for i, col := range cols {
+			strs[i] = fmt.Sprint(col)
+		}
+		fmt.Fprintln(w, strings.Join(strs, "\t")) //nolint:errcheck
+	})
+
+	return w.Flush()
+}
+
+func formatMetadata(meta map[string]interface{}) string {
+	var pairs []string
+	for k, v := range meta {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
@@ -2,16 +2,54 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
 
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 	boshsys "github.com/cloudfoundry/bosh-utils/system"
+	"gopkg.in/yaml.v2"
 
 	"bosh-libvirt-cpi/cpi"
 )
 
+const envPrefix = "BOSH_LIBVIRT_CPI_"
+
+const configLogTag = "main.Config"
+
+// ignoredKeys are accepted for compatibility with older configs, but have
+// no effect. They are matched regardless of case.
+var ignoredKeys = []string{
+	"Agent.blobstore",
+}
+
+// secretFields may instead be given as <field>File, e.g. PrivateKeyFile,
+// naming a file to read them from.
+var secretFields = map[string]bool{
+	"PrivateKey":   true,
+	"HostKey":      true,
+	"Certificate":  true,
+	"CACert":       true,
+	"ClientCert":   true,
+	"ClientKey":    true,
+	"SASLPassword": true,
+}
+
 type Config cpi.FactoryOpts
 
-func NewConfigFromPath(path string, fs boshsys.FileSystem) (Config, error) {
+// NewConfigFromPath reads a JSON config, or a YAML one if path ends in
+// .yml or .yaml. Top-level fields may then be overridden by environment
+// variables such as BOSH_LIBVIRT_CPI_STORE_DIR for StoreDir, or
+// BOSH_LIBVIRT_CPI_PRIVATE_KEY_FILE for PrivateKeyFile. Unknown keys are
+// rejected, while unknown variables are only logged since the environment
+// is shared with other programs.
+func NewConfigFromPath(path string, fs boshsys.FileSystem, logger boshlog.Logger) (Config, error) {
 	var config Config
 
 	bytes, err := fs.ReadFile(path)
@@ -19,7 +57,30 @@ func NewConfigFromPath(path string, fs boshsys.FileSystem) (Config, error) {
 		return config, bosherr.WrapErrorf(err, "Reading config '%s'", path)
 	}
 
-	err = json.Unmarshal(bytes, &config)
+	fields, err := parseConfig(path, bytes)
+	if err != nil {
+		return config, bosherr.WrapError(err, "Unmarshalling config")
+	}
+
+	err = checkKeys(fields, reflect.TypeOf(config), "", true, logger)
+	if err != nil {
+		return config, err
+	}
+
+	err = applyEnv(fields, os.Environ(), logger)
+	if err != nil {
+		return config, err
+	}
+
+	err = readSecretFiles(fields, fs)
+	if err != nil {
+		return config, err
+	}
+
+	bytes, err = json.Marshal(fields)
+	if err == nil {
+		err = json.Unmarshal(bytes, &config)
+	}
 	if err != nil {
 		return config, bosherr.WrapError(err, "Unmarshalling config")
 	}
@@ -31,3 +92,263 @@ func NewConfigFromPath(path string, fs boshsys.FileSystem) (Config, error) {
 
 	return config, nil
 }
+
+func parseConfig(path string, bytes []byte) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		var doc interface{}
+
+		err := yaml.Unmarshal(bytes, &doc)
+		if err != nil {
+			return nil, err
+		}
+
+		fields, _ = stringKeys(doc).(map[string]interface{})
+		if fields == nil {
+			return nil, bosherr.Error("Expected a mapping at the top level")
+		}
+
+	default:
+		err := json.Unmarshal(bytes, &fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fields, nil
+}
+
+// stringKeys converts the maps yaml.v2 decodes into ones that JSON can encode.
+func stringKeys(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, v := range typed {
+			m[fmt.Sprint(k)] = stringKeys(v)
+		}
+		return m
+	case []interface{}:
+		for i := range typed {
+			typed[i] = stringKeys(typed[i])
+		}
+		return typed
+	default:
+		return v
+	}
+}
+
+// checkKeys rejects keys in v that name no field of t, so that a typo is not
+// silently ignored. Keys must match field names exactly, except for the
+// agent options, which configs conventionally spell in lowercase. Ignored
+// keys are removed with a warning.
+func checkKeys(v interface{}, t reflect.Type, path string, exact bool, logger boshlog.Logger) error {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return checkKeys(v, t.Elem(), path, exact, logger)
+
+	case reflect.Slice:
+		items, _ := v.([]interface{})
+		for i, item := range items {
+			err := checkKeys(item, t.Elem(), fmt.Sprintf("%s[%d].", strings.TrimSuffix(path, "."), i), exact, logger)
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		// Type mismatches are left to json.Unmarshal
+		m, _ := v.(map[string]interface{})
+
+		for key, value := range m {
+			if isIgnoredKey(path + key) {
+				logger.Warn(configLogTag, "Config key '%s%s' is deprecated and ignored", path, key)
+				delete(m, key)
+				continue
+			}
+
+			field, ok := lookupField(t, key, exact)
+			if !ok {
+				if secretFields[strings.TrimSuffix(key, "File")] {
+					if _, ok := t.FieldByName(strings.TrimSuffix(key, "File")); ok {
+						continue
+					}
+				}
+				return bosherr.Errorf("Unknown config key '%s%s'", path, key)
+			}
+
+			err := checkKeys(value, field.Type, path+key+".", exact && field.Type != reflect.TypeOf(apiv1.AgentOptions{}), logger)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func isIgnoredKey(key string) bool {
+	for _, ignored := range ignoredKeys {
+		if strings.EqualFold(ignored, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupField(t reflect.Type, key string, exact bool) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); len(tag) > 0 {
+			name = tag
+		}
+
+		if name == key || (!exact && strings.EqualFold(name, key)) {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// applyEnv sets the top-level fields named by BOSH_LIBVIRT_CPI_* variables
+// in environ. Only strings, numbers and booleans can be set this way.
+// Variables that name no field are logged and ignored.
+func applyEnv(fields map[string]interface{}, environ []string, logger boshlog.Logger) error {
+	t := reflect.TypeOf(Config{})
+
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+
+		var found bool
+
+		for i := 0; i < t.NumField() && !found; i++ {
+			field := t.Field(i)
+
+			switch name {
+			case envName(field.Name):
+				found = true
+
+				parsed, err := parseEnvValue(value, field.Type.Kind())
+				if err != nil {
+					return bosherr.WrapErrorf(err, "Parsing '%s'", name)
+				}
+
+				fields[field.Name] = parsed
+				delete(fields, field.Name+"File")
+
+			case envName(field.Name) + "_FILE":
+				if !secretFields[field.Name] {
+					continue
+				}
+
+				found = true
+
+				fields[field.Name+"File"] = value
+				delete(fields, field.Name)
+			}
+		}
+
+		if !found {
+			logger.Warn(configLogTag, "Ignoring unknown environment variable '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+func parseEnvValue(value string, kind reflect.Kind) (interface{}, error) {
+	switch kind {
+	case reflect.String:
+		return value, nil
+	case reflect.Int:
+		return strconv.Atoi(value)
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	default:
+		return nil, bosherr.Errorf("Fields of kind '%s' cannot be set from the environment", kind)
+	}
+}
+
+// envName returns the variable overriding field, e.g.
+// BOSH_LIBVIRT_CPI_SSH_DIAL_TIMEOUT for SSHDialTimeout.
+func envName(field string) string {
+	runes := []rune(field)
+
+	var name strings.Builder
+	name.WriteString(envPrefix)
+
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+
+	return name.String()
+}
+
+// readSecretFiles replaces <field>File keys, at the top level and in jump
+// hosts, with the contents of the files they name.
+func readSecretFiles(fields map[string]interface{}, fs boshsys.FileSystem) error {
+	err := readSecretFilesIn(fields, "", fs)
+	if err != nil {
+		return err
+	}
+
+	jumpHosts, _ := fields["JumpHosts"].([]interface{})
+
+	for i, jumpHost := range jumpHosts {
+		m, ok := jumpHost.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		err = readSecretFilesIn(m, fmt.Sprintf("JumpHosts[%d].", i), fs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readSecretFilesIn(fields map[string]interface{}, path string, fs boshsys.FileSystem) error {
+	for field := range secretFields {
+		fileKey := field + "File"
+
+		value, ok := fields[fileKey]
+		if !ok {
+			continue
+		}
+
+		filePath, ok := value.(string)
+		if !ok || len(filePath) == 0 {
+			return bosherr.Errorf("Config key '%s%s' must be a non-empty path", path, fileKey)
+		}
+
+		if inline, _ := fields[field].(string); len(inline) > 0 {
+			return bosherr.Errorf("Config keys '%s%s' and '%s%s' are mutually exclusive", path, field, path, fileKey)
+		}
+
+		contents, err := fs.ReadFileString(filePath)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Reading '%s%s'", path, fileKey)
+		}
+
+		fields[field] = strings.TrimRight(contents, "\r\n")
+		delete(fields, fileKey)
+	}
+
+	return nil
+}
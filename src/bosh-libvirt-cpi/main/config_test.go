@@ -0,0 +1,194 @@
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "bosh-libvirt-cpi/main"
+)
+
+var _ = Describe("NewConfigFromPath", func() {
+	var (
+		dir    string
+		fs     boshsys.FileSystem
+		env    []string
+		logs   *bytes.Buffer
+		logger boshlog.Logger
+	)
+
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		return path
+	}
+
+	setenv := func(name, value string) {
+		Expect(os.Setenv(name, value)).To(Succeed())
+		env = append(env, name)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "config-test")
+		Expect(err).ToNot(HaveOccurred())
+
+		fs = boshsys.NewOsFileSystem(boshlog.NewLogger(boshlog.LevelNone))
+
+		logs = &bytes.Buffer{}
+		logger = boshlog.NewWriterLogger(boshlog.LevelWarn, logs)
+	})
+
+	AfterEach(func() {
+		for _, name := range env {
+			Expect(os.Unsetenv(name)).To(Succeed())
+		}
+		env = nil
+
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("reads JSON", func() {
+		path := write("cpi.json", `{
+			"BackendURI": "qemu:///system",
+			"StoreDir": "/store",
+			"Agent": {"mbus": "nats://nats:4222", "ntp": ["pool.ntp.org"]}
+		}`)
+
+		config, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.BackendURI).To(Equal("qemu:///system"))
+		Expect(config.Agent.Mbus).To(Equal("nats://nats:4222"))
+		Expect(config.Agent.NTP).To(Equal([]string{"pool.ntp.org"}))
+	})
+
+	It("reads YAML", func() {
+		path := write("cpi.yml", `
+BackendURI: qemu:///system
+StoreDir: /store
+LockTimeout: 60
+Host: host
+Username: vcap
+PrivateKey: key
+HostKey: host-key
+JumpHosts:
+- Host: bastion
+  Username: vcap
+  PrivateKey: jump-key
+  HostKey: jump-host-key
+Agent:
+  Mbus: nats://nats:4222
+`)
+
+		config, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.StoreDir).To(Equal("/store"))
+		Expect(config.LockTimeout).To(Equal(60))
+		Expect(config.JumpHosts).To(HaveLen(1))
+		Expect(config.JumpHosts[0].Host).To(Equal("bastion"))
+		Expect(config.Agent.Mbus).To(Equal("nats://nats:4222"))
+	})
+
+	It("rejects unknown keys, including misspelled ones", func() {
+		path := write("cpi.json", `{"BackendUri": "qemu:///system", "StoreDir": "/store", "Agent": {"mbus": "m"}}`)
+
+		_, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).To(MatchError(ContainSubstring("Unknown config key 'BackendUri'")))
+
+		path = write("cpi.yml", "BackendURI: qemu:///system\nStoreDir: /store\nAgent: {mbus: m, blobstor: {}}\n")
+
+		_, err = NewConfigFromPath(path, fs, logger)
+		Expect(err).To(MatchError(ContainSubstring("Unknown config key 'Agent.blobstor'")))
+	})
+
+	It("ignores the agent blobstore of older configs with a warning", func() {
+		path := write("cpi.json", `{
+			"BackendURI": "qemu:///system",
+			"StoreDir": "/store",
+			"Agent": {"mbus": "m", "blobstore": {"provider": "local", "options": {"blobstore_path": "/cache"}}}
+		}`)
+
+		config, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.Agent.Mbus).To(Equal("m"))
+		Expect(logs.String()).To(ContainSubstring("Config key 'Agent.blobstore' is deprecated and ignored"))
+	})
+
+	It("reads secrets from the files named by *File keys", func() {
+		keyPath := write("id_ed25519", "private-key\n")
+		hostKeyPath := write("host_key", "ssh-ed25519 AAAA\n")
+
+		path := write("cpi.json", `{
+			"BackendURI": "qemu:///system",
+			"Host": "host",
+			"Username": "vcap",
+			"PrivateKeyFile": "`+keyPath+`",
+			"HostKeyFile": "`+hostKeyPath+`",
+			"StoreDir": "/store",
+			"Agent": {"mbus": "m"}
+		}`)
+
+		config, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.PrivateKey).To(Equal("private-key"))
+		Expect(config.HostKey).To(Equal("ssh-ed25519 AAAA"))
+	})
+
+	It("rejects a secret given both inline and as a file", func() {
+		path := write("cpi.json", `{"BackendURI": "qemu:///system", "StoreDir": "/store", "CACert": "ca", "CACertFile": "/ca", "Agent": {"mbus": "m"}}`)
+
+		_, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).To(MatchError(ContainSubstring("mutually exclusive")))
+	})
+
+	It("overrides fields from BOSH_LIBVIRT_CPI_* environment variables", func() {
+		keyPath := write("id_ed25519", "env-key")
+
+		path := write("cpi.json", `{
+			"BackendURI": "qemu:///system",
+			"Host": "host",
+			"Username": "vcap",
+			"PrivateKey": "inline-key",
+			"HostKey": "host-key",
+			"StoreDir": "/store",
+			"Agent": {"mbus": "m"}
+		}`)
+
+		setenv("BOSH_LIBVIRT_CPI_STORE_DIR", "/env-store")
+		setenv("BOSH_LIBVIRT_CPI_SSH_DIAL_TIMEOUT", "5")
+		setenv("BOSH_LIBVIRT_CPI_USE_SSH_AGENT", "true")
+		setenv("BOSH_LIBVIRT_CPI_PRIVATE_KEY_FILE", keyPath)
+
+		config, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.StoreDir).To(Equal("/env-store"))
+		Expect(config.SSHDialTimeout).To(Equal(5))
+		Expect(config.UseSSHAgent).To(BeTrue())
+		Expect(config.PrivateKey).To(Equal("env-key"))
+	})
+
+	It("ignores unknown environment variables with a warning", func() {
+		path := write("cpi.json", `{"BackendURI": "qemu:///system", "StoreDir": "/store", "Agent": {"mbus": "m"}}`)
+
+		setenv("BOSH_LIBVIRT_CPI_STOREDIR", "/env-store")
+
+		config, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.StoreDir).To(Equal("/store"))
+		Expect(logs.String()).To(ContainSubstring("Ignoring unknown environment variable 'BOSH_LIBVIRT_CPI_STOREDIR'"))
+	})
+
+	It("rejects malformed values of known environment variables", func() {
+		path := write("cpi.json", `{"BackendURI": "qemu:///system", "StoreDir": "/store", "Agent": {"mbus": "m"}}`)
+
+		setenv("BOSH_LIBVIRT_CPI_SSH_DIAL_TIMEOUT", "soon")
+
+		_, err := NewConfigFromPath(path, fs, logger)
+		Expect(err).To(MatchError(ContainSubstring("Parsing 'BOSH_LIBVIRT_CPI_SSH_DIAL_TIMEOUT'")))
+	})
+})
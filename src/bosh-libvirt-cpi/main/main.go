@@ -1,61 +1,178 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/cloudfoundry/bosh-cpi-go/rpc"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 	boshcmd "github.com/cloudfoundry/bosh-utils/fileutil"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 	boshsys "github.com/cloudfoundry/bosh-utils/system"
 	boshuuid "github.com/cloudfoundry/bosh-utils/uuid"
-	libvirt "libvirt.org/go/libvirt"
 
 	"bosh-libvirt-cpi/cpi"
-	"bosh-libvirt-cpi/driver"
+	"bosh-libvirt-cpi/daemon"
+	"bosh-libvirt-cpi/inventory"
 )
 
 var (
 	configPathOpt = flag.String("configPath", "", "Path to configuration file")
+	socketPathOpt = flag.String("socketPath", "", "Unix socket of the daemon started with 'serve'")
 )
 
+// Without a command, the request on stdin is answered on stdout: by the
+// daemon at -socketPath if one runs, otherwise in-process.
+// The "serve" command runs that daemon, "preflight" checks the config and
+// the host, and the others are operatorCommands.
 func main() {
-	logger, fs, cmdRunner, uuidGen := basicDeps()
+	flag.Parse()
+
+	command, isOperatorCommand := operatorCommands[flag.Arg(0)]
+
+	logLevel := boshlog.LevelDebug
+	if isOperatorCommand || flag.Arg(0) == "preflight" {
+		logLevel = boshlog.LevelWarn
+	}
+
+	logger, fs, cmdRunner, uuidGen := basicDeps(logLevel)
 	defer logger.HandlePanic("Main")
 
-	flag.Parse()
+	var err error
+
+	switch {
+	case flag.Arg(0) == "":
+		err = serveOnce(os.Stdin, os.Stdout, logger, fs, cmdRunner, uuidGen)
+	case flag.Arg(0) == "serve":
+		err = serve(logger, fs, cmdRunner, uuidGen)
+	case flag.Arg(0) == "preflight":
+		err = preflight(flag.Args()[1:], os.Stdout, logger, fs, cmdRunner, uuidGen)
+	case isOperatorCommand:
+		err = runOperatorCommand(command, flag.Args()[1:], os.Stdout, logger, fs, cmdRunner, uuidGen)
+	default:
+		err = bosherr.Errorf("Unknown command '%s'", flag.Arg(0))
+	}
 
-	config, err := NewConfigFromPath(*configPathOpt, fs)
 	if err != nil {
-		logger.Error("main", "Loading config %s", err.Error())
+		logger.Error("main", "%s", err)
 		os.Exit(1)
 	}
+}
 
-	compressor := boshcmd.NewTarballCompressor(cmdRunner, fs)
+func serveOnce(in io.Reader, out io.Writer, logger boshlog.Logger, fs boshsys.FileSystem, cmdRunner boshsys.CmdRunner, uuidGen boshuuid.Generator) error {
+	if len(*socketPathOpt) > 0 {
+		request, err := io.ReadAll(in)
+		if err != nil {
+			return bosherr.WrapError(err, "Reading request")
+		}
+
+		response, err := daemon.NewClient(*socketPathOpt).Call(request)
+		if err == nil {
+			_, err = out.Write(response)
+			return err
+		}
+
+		if _, ok := err.(daemon.NotRunningError); !ok {
+			return bosherr.WrapError(err, "Forwarding request to daemon")
+		}
+
+		logger.Debug("main", "Handling request in-process: %s", err)
 
-	conn, err := libvirt.NewConnect(config.BackendURI)
+		in = bytes.NewReader(request)
+	}
+
+	cpiFactory, conn, err := newCPIFactory(logger, fs, cmdRunner, uuidGen)
 	if err != nil {
-		logger.Error("main", "Connecting to libvirt: %s", err.Error())
-		os.Exit(1)
+		return err
 	}
 	defer conn.Close() //nolint:errcheck
 
-	libvirtConn := driver.NewLibvirtConnImpl(conn)
+	err = rpc.NewFactory(logger).NewCLIWithInOut(in, out, cpiFactory).ServeOnce()
+	if err != nil {
+		return bosherr.WrapError(err, "Serving once")
+	}
 
-	cpiFactory := cpi.NewFactoryWithConn(
-		libvirtConn, fs, cmdRunner, uuidGen, compressor, cpi.FactoryOpts(config), logger)
+	return nil
+}
 
-	cli := rpc.NewFactory(logger).NewCLI(cpiFactory)
+// serve keeps one connection to libvirt and the host for all requests
+// until it receives SIGTERM or SIGINT.
+func serve(logger boshlog.Logger, fs boshsys.FileSystem, cmdRunner boshsys.CmdRunner, uuidGen boshuuid.Generator) error {
+	if len(*socketPathOpt) == 0 {
+		return bosherr.Error("Serving requires -socketPath")
+	}
 
-	err = cli.ServeOnce()
+	cpiFactory, conn, err := newCPIFactory(logger, fs, cmdRunner, uuidGen)
 	if err != nil {
-		logger.Error("main", "Serving once: %s", err)
-		os.Exit(1)
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	server, err := daemon.Listen(*socketPathOpt, cpiFactory, logger)
+	if err != nil {
+		return err
 	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-signals
+		logger.Info("main", "Received %s, finishing requests in progress", sig)
+		_ = server.Close()
+	}()
+
+	return server.Serve()
+}
+
+func runOperatorCommand(
+	command func(inventory.Inventory, []string, io.Writer) error,
+	args []string,
+	out io.Writer,
+	logger boshlog.Logger,
+	fs boshsys.FileSystem,
+	cmdRunner boshsys.CmdRunner,
+	uuidGen boshuuid.Generator,
+) error {
+	cpiFactory, conn, err := newCPIFactory(logger, fs, cmdRunner, uuidGen)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	inv, err := cpiFactory.Inventory()
+	if err != nil {
+		return err
+	}
+
+	return command(inv, args, out)
+}
+
+func newCPIFactory(logger boshlog.Logger, fs boshsys.FileSystem, cmdRunner boshsys.CmdRunner, uuidGen boshuuid.Generator) (cpi.Factory, cpi.Connection, error) {
+	config, err := NewConfigFromPath(*configPathOpt, fs, logger)
+	if err != nil {
+		return cpi.Factory{}, cpi.Connection{}, bosherr.WrapError(err, "Loading config")
+	}
+
+	compressor := boshcmd.NewTarballCompressor(cmdRunner, fs)
+
+	conn, err := cpi.Connect(cpi.FactoryOpts(config), fs, logger)
+	if err != nil {
+		return cpi.Factory{}, cpi.Connection{}, bosherr.WrapError(err, "Connecting to libvirt")
+	}
+
+	cpiFactory := cpi.NewFactoryWithConn(
+		conn, fs, cmdRunner, uuidGen, compressor, cpi.FactoryOpts(config), logger)
+
+	return cpiFactory, conn, nil
 }
 
-func basicDeps() (boshlog.Logger, boshsys.FileSystem, boshsys.CmdRunner, boshuuid.Generator) {
-	logger := boshlog.NewWriterLogger(boshlog.LevelDebug, os.Stderr)
+func basicDeps(logLevel boshlog.LogLevel) (boshlog.Logger, boshsys.FileSystem, boshsys.CmdRunner, boshuuid.Generator) {
+	logger := boshlog.NewWriterLogger(logLevel, os.Stderr)
 	fs := boshsys.NewOsFileSystem(logger)
 	cmdRunner := boshsys.NewExecCmdRunner(logger)
 	uuidGen := boshuuid.NewGenerator()
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"io"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshcmd "github.com/cloudfoundry/bosh-utils/fileutil"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+	boshuuid "github.com/cloudfoundry/bosh-utils/uuid"
+
+	"bosh-libvirt-cpi/cpi"
+)
+
+// preflight checks the config and the host it points at, printing
+// whether each check passed. It fails if any check failed.
+func preflight(args []string, out io.Writer, logger boshlog.Logger, fs boshsys.FileSystem, cmdRunner boshsys.CmdRunner, uuidGen boshuuid.Generator) error {
+	var popts cpi.PreflightOpts
+
+	flags := flag.NewFlagSet("preflight", flag.ContinueOnError)
+	flags.Func("pool", "Storage pool that cloud properties refer to (repeatable)", func(pool string) error {
+		popts.StoragePools = append(popts.StoragePools, pool)
+		return nil
+	})
+	flags.IntVar(&popts.MinFreeMB, "min-free-mb", 10240, "Free space StoreDir needs in MB")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	results := []cpi.PreflightResult{{Check: "config", Detail: *configPathOpt}}
+
+	config, err := NewConfigFromPath(*configPathOpt, fs, logger)
+	if err != nil {
+		results[0].Err = err
+	} else {
+		compressor := boshcmd.NewTarballCompressor(cmdRunner, fs)
+		factory := cpi.NewFactory(fs, cmdRunner, uuidGen, compressor, cpi.FactoryOpts(config), logger)
+
+		results = append(results, factory.Preflight(popts)...)
+
+		err = factory.Close()
+		if err != nil {
+			logger.Warn("main", "Closing the connection to the host: %s", err)
+		}
+	}
+
+	var failed int
+
+	err = printTable(out, []string{"CHECK", "RESULT", "DETAIL"}, func(add func(...interface{})) {
+		for _, result := range results {
+			if result.Err != nil {
+				failed++
+				add(result.Check, "FAIL", result.Err)
+			} else {
+				add(result.Check, "pass", orDash(result.Detail))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return bosherr.Errorf("%d of %d preflight checks failed", failed, len(results))
+	}
+
+	return nil
+}
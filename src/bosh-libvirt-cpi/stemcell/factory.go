@@ -23,6 +23,7 @@ type Factory struct {
 	driver     driver.Driver
 	domBuilder driver.DomainBuilder
 	runner     driver.Runner
+	locker     driver.Locker
 
 	fs         boshsys.FileSystem
 	uuidGen    boshuuid.Generator
@@ -37,6 +38,7 @@ func NewFactory(
 	driver driver.Driver,
 	domBuilder driver.DomainBuilder,
 	runner driver.Runner,
+	locker driver.Locker,
 	fs boshsys.FileSystem,
 	uuidGen boshuuid.Generator,
 	compressor boshcmd.Compressor,
@@ -48,6 +50,7 @@ func NewFactory(
 		driver:     driver,
 		domBuilder: domBuilder,
 		runner:     runner,
+		locker:     locker,
 
 		fs:         fs,
 		uuidGen:    uuidGen,
@@ -66,34 +69,41 @@ func (f Factory) ImportFromPath(imagePath string) (Stemcell, error) {
 
 	id = "sc-" + id
 
-	stemcellPath := filepath.Join(f.opts.DirPath, id)
-
-	err = f.upload(imagePath, stemcellPath)
-	if err != nil {
-		return nil, err
-	}
-
 	stemcell := f.newStemcell(apiv1.NewStemcellCID(id))
 
-	err = stemcell.Prepare()
+	err = f.upload(imagePath, stemcell)
 	if err != nil {
 		f.cleanUpPartialImport(stemcell)
-		return nil, bosherr.WrapErrorf(err, "Preparing stemcell")
+		return nil, err
 	}
 
 	return stemcell, nil
 }
 
 func (f Factory) Find(cid apiv1.StemcellCID) (Stemcell, error) {
-	return f.newStemcell(cid), nil
+	stemcell := f.newStemcell(cid)
+
+	_, found, err := stemcell.record()
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		_, err = stemcell.migrateLegacyDomain()
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Migrating stemcell '%s'", cid.AsString())
+		}
+	}
+
+	return stemcell, nil
 }
 
 func (f Factory) newStemcell(cid apiv1.StemcellCID) StemcellImpl {
 	path := filepath.Join(f.opts.DirPath, cid.AsString())
-	return NewStemcellImpl(cid, path, f.driver, f.domBuilder, f.runner, f.logger)
+	return NewStemcellImpl(cid, path, f.driver, f.domBuilder, f.runner, f.locker, f.logger)
 }
 
-func (f Factory) upload(imagePath, stemcellPath string) error {
+func (f Factory) upload(imagePath string, stemcell StemcellImpl) error {
 	tmpDir, err := f.fs.TempDir("bosh-libvirt-cpi-stemcell-upload")
 	if err != nil {
 		return bosherr.WrapErrorf(err, "Creating tmp stemcell directory")
@@ -106,25 +116,131 @@ func (f Factory) upload(imagePath, stemcellPath string) error {
 		return bosherr.WrapErrorf(err, "Unpacking stemcell '%s' to '%s'", imagePath, tmpDir)
 	}
 
-	_, _, err = f.runner.Execute("mkdir", "-p", stemcellPath)
+	err = f.runner.MkdirAll(stemcell.Path())
 	if err != nil {
 		return bosherr.WrapError(err, "Creating stemcell parent")
 	}
 
-	// The stemcell tarball is expected to contain a file named "image" that
-	// holds the disk image in the format requested by the domain builder
-	// (raw, qcow2, vmdk). We upload it under "image.<format>".
-	srcImage := filepath.Join(tmpDir, "image")
-	dstImage := filepath.Join(stemcellPath, "image."+f.domBuilder.DiskImageFormat())
+	srcImage, err := f.locateImage(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := f.checksum(srcImage)
+	if err != nil {
+		return bosherr.WrapError(err, "Calculating stemcell image checksum")
+	}
+
+	// Images are stored under "image.<format>" in the format
+	// requested by the domain builder (raw, qcow2, vmdk).
+	dstFormat := f.domBuilder.DiskImageFormat()
+	images := newImageStore(f.opts.DirPath, f.runner)
+
+	// Concurrent imports of the same image wait for the first one to store it
+	return driver.WithLock(f.locker, imageLockName(checksum, dstFormat), func() error {
+		return f.useImage(srcImage, images, checksum, dstFormat, stemcell)
+	})
+}
+
+// useImage stores srcImage unless it is already present and links the stemcell to it.
+func (f Factory) useImage(srcImage string, images imageStore, checksum, dstFormat string, stemcell StemcellImpl) error {
+	stored, err := images.Exists(checksum, dstFormat)
+	if err != nil {
+		return err
+	}
+
+	if stored {
+		f.logger.Debug(f.logTag, "Reusing stored stemcell image '%s'", checksum)
+	} else {
+		err = f.storeImage(srcImage, images, checksum, dstFormat)
+		if err != nil {
+			return err
+		}
+	}
 
-	err = f.runner.Upload(srcImage, dstImage)
+	// Record the image before referencing it so that deleting a partial import drops the reference
+	err = stemcell.saveRecord(stemcellRecord{Checksum: checksum, Format: dstFormat})
 	if err != nil {
-		return bosherr.WrapErrorf(err, "Uploading stemcell image")
+		return err
+	}
+
+	err = images.AddRef(checksum, dstFormat, stemcell.ID().AsString())
+	if err != nil {
+		return err
+	}
+
+	relImagePath, err := filepath.Rel(stemcell.Path(), images.ImagePath(checksum, dstFormat))
+	if err != nil {
+		return bosherr.WrapError(err, "Resolving stemcell image link")
+	}
+
+	err = f.runner.Symlink(relImagePath, stemcell.ImagePath())
+	if err != nil {
+		return bosherr.WrapError(err, "Linking stemcell image")
 	}
 
 	return nil
 }
 
+// storeImage uploads srcImage into the image store, converting it on the host
+// if it is not already in dstFormat. Data is written under a temporary name
+// so that an interrupted import is never mistaken for a complete image.
+func (f Factory) storeImage(srcImage string, images imageStore, checksum, dstFormat string) error {
+	srcFormat, err := f.detectImageFormat(srcImage)
+	if err != nil {
+		return err
+	}
+
+	dstImage := images.ImagePath(checksum, dstFormat)
+	partImage := dstImage + imagePartSuffix
+
+	err = f.runner.MkdirAll(filepath.Dir(dstImage))
+	if err != nil {
+		return bosherr.WrapError(err, "Creating stemcell image dir")
+	}
+
+	defer func() {
+		err := f.runner.Remove(partImage)
+		if err != nil {
+			f.logger.Error(f.logTag, "Failed to remove partial stemcell image: %s", err)
+		}
+	}()
+
+	if srcFormat == dstFormat {
+		err = f.runner.Upload(srcImage, partImage)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Uploading stemcell image")
+		}
+	} else {
+		f.logger.Debug(f.logTag, "Converting stemcell image from '%s' to '%s'", srcFormat, dstFormat)
+
+		// Convert on the host so that the larger converted image is not transferred
+		uploadedImage := filepath.Join(filepath.Dir(dstImage), "image.src")
+
+		err = f.runner.Upload(srcImage, uploadedImage)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Uploading stemcell image")
+		}
+
+		_, _, err = f.runner.Execute("qemu-img", "convert", "-f", srcFormat, "-O", dstFormat, uploadedImage, partImage)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Converting stemcell image from '%s' to '%s'", srcFormat, dstFormat)
+		}
+
+		err = f.runner.Remove(uploadedImage)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Removing unconverted stemcell image")
+		}
+	}
+
+	err = f.runner.Rename(partImage, dstImage)
+	if err != nil {
+		return bosherr.WrapError(err, "Finalizing stemcell image")
+	}
+
+	return images.MarkComplete(checksum, dstFormat)
+}
+
 func (f Factory) cleanUpPartialImport(stemcell StemcellImpl) {
 	err := stemcell.Delete()
 	if err != nil {
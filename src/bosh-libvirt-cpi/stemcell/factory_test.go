@@ -1,6 +1,8 @@
 package stemcell_test
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 
 	. "github.com/onsi/ginkgo"
@@ -15,6 +17,17 @@ import (
 	stemcellfakes "bosh-libvirt-cpi/stemcell/fakes"
 )
 
+var (
+	qcow2Image = append([]byte("QFI\xfb"), make([]byte, 64)...)
+	rawImage   = make([]byte, 1024)
+	gzipHeader = []byte{0x1f, 0x8b, 0x08, 0x00}
+)
+
+func checksumOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 var _ = Describe("stemcell.Factory", func() {
 	var (
 		uuidGen    *stemcellfakes.FakeUUIDGen
@@ -23,6 +36,7 @@ var _ = Describe("stemcell.Factory", func() {
 		runner     *driverfakes.FakeRunner
 		drv        *driverfakes.FakeDriver
 		builder    *driverfakes.FakeDomainBuilder
+		locker     *driverfakes.FakeLocker
 		factory    stemcell.Factory
 		logger     boshlog.Logger
 	)
@@ -30,19 +44,24 @@ var _ = Describe("stemcell.Factory", func() {
 	BeforeEach(func() {
 		logger = boshlog.NewLogger(boshlog.LevelNone)
 		uuidGen = &stemcellfakes.FakeUUIDGen{GeneratedUUID: "uuid-1"}
-		compressor = &stemcellfakes.FakeCompressor{}
+		compressor = &stemcellfakes.FakeCompressor{
+			Contents: map[string]map[string][]byte{
+				"stemcell.tgz": {"image": qcow2Image},
+			},
+		}
 		fakeFS = stemcellfakes.NewFakeFS(boshsys.NewOsFileSystem(logger))
 		runner = &driverfakes.FakeRunner{}
 		drv = &driverfakes.FakeDriver{}
+		locker = &driverfakes.FakeLocker{}
 		builder = &driverfakes.FakeDomainBuilder{
-			DiskImageFormatResult:  "qcow2",
-			BuildStemcellDomainXML: "<domain/>",
+			DiskImageFormatResult: "qcow2",
 		}
 		factory = stemcell.NewFactory(
 			stemcell.FactoryOpts{DirPath: "/store/stemcells"},
 			drv,
 			builder,
 			runner,
+			locker,
 			fakeFS,
 			uuidGen,
 			compressor,
@@ -89,22 +108,179 @@ var _ = Describe("stemcell.Factory", func() {
 			Expect(err.Error()).To(ContainSubstring("Uploading stemcell image"))
 		})
 
-		It("returns error when BuildStemcellDomain fails", func() {
-			builder.BuildStemcellDomainErr = errors.New("build failed")
+		It("does not define a placeholder domain", func() {
+			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(drv.DefineDomainXML).To(BeEmpty())
+			Expect(runner.PutContents).To(HaveKey("/store/stemcells/sc-uuid-1/stemcell.json"))
+		})
+	})
+
+	Describe("ImportFromPath image handling", func() {
+		It("uploads images already in the backend format into the image store", func() {
+			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
+			Expect(err).ToNot(HaveOccurred())
+
+			imageDir := "/store/stemcells/.images/" + checksumOf(qcow2Image) + ".qcow2"
+			Expect(runner.UploadCalls).To(HaveLen(1))
+			Expect(runner.UploadCalls[0][0]).To(HaveSuffix("/image"))
+			Expect(runner.UploadCalls[0][1]).To(Equal(imageDir + "/image.qcow2.part"))
+			Expect(runner.ExecuteCalls).ToNot(ContainElement(ContainElement("qemu-img")))
+			Expect(runner.RenameCalls).To(Equal([][2]string{
+				{imageDir + "/image.qcow2.part", imageDir + "/image.qcow2"}}))
+			Expect(runner.PutContents).To(HaveKey(imageDir + "/image.json"))
+			Expect(runner.PutContents).To(HaveKey(imageDir + "/refs/sc-uuid-1"))
+			Expect(runner.SymlinkCalls).To(Equal([][2]string{{
+				"../.images/" + checksumOf(qcow2Image) + ".qcow2/image.qcow2",
+				"/store/stemcells/sc-uuid-1/image.qcow2"}}))
+		})
+
+		It("converts images in other formats on the host", func() {
+			compressor.Contents["stemcell.tgz"] = map[string][]byte{"image": rawImage}
+
+			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
+			Expect(err).ToNot(HaveOccurred())
+
+			imageDir := "/store/stemcells/.images/" + checksumOf(rawImage) + ".qcow2"
+			Expect(runner.UploadCalls[0][1]).To(Equal(imageDir + "/image.src"))
+			Expect(runner.ExecuteCalls).To(ContainElement([]string{
+				"qemu-img", "convert", "-f", "raw", "-O", "qcow2",
+				imageDir + "/image.src", imageDir + "/image.qcow2.part"}))
+			Expect(runner.RemoveCalls).To(ContainElement(imageDir + "/image.src"))
+		})
+
+		It("reuses a stored image with the same checksum instead of uploading again", func() {
+			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
+			Expect(err).ToNot(HaveOccurred())
+
+			uuidGen.GeneratedUUID = "uuid-2"
+			_, err = factory.ImportFromPath("/tmp/stemcell.tgz")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(runner.UploadCalls).To(HaveLen(1))
+			imageDir := "/store/stemcells/.images/" + checksumOf(qcow2Image) + ".qcow2"
+			Expect(runner.PutContents).To(HaveKey(imageDir + "/refs/sc-uuid-2"))
+		})
+
+		It("unpacks the nested image of a full stemcell tarball", func() {
+			compressor.Contents["stemcell.tgz"] = map[string][]byte{
+				"stemcell.MF": []byte("name: bosh-openstack-kvm-ubuntu\nversion: '1.0'\nstemcell_formats: [openstack-qcow2]\n"),
+				"image":       gzipHeader,
+			}
+			compressor.Contents["image"] = map[string][]byte{"root.img": qcow2Image}
+
+			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(runner.UploadCalls[0][0]).To(HaveSuffix("/image-contents/root.img"))
+		})
+
+		It("rejects stemcells whose formats are not supported", func() {
+			compressor.Contents["stemcell.tgz"] = map[string][]byte{
+				"stemcell.MF": []byte("name: bosh-aws\nstemcell_formats: [aws-light]\n"),
+				"image":       qcow2Image,
+			}
+
+			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Stemcell formats [aws-light] are not supported"))
+		})
+
+		It("reads the disk file from an OVF descriptor and converts VMDK images", func() {
+			compressor.Contents["stemcell.tgz"] = map[string][]byte{
+				"image.ovf":        []byte(`<Envelope><References><File href="image-disk1.vmdk"/></References></Envelope>`),
+				"image-disk1.vmdk": append([]byte("KDMV"), make([]byte, 64)...),
+			}
+
+			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(runner.UploadCalls[0][0]).To(HaveSuffix("/image-disk1.vmdk"))
+			Expect(runner.ExecuteCalls).To(ContainElement(ContainElements("-f", "vmdk", "-O", "qcow2")))
+		})
+
+		It("rejects OVF disk files outside the stemcell", func() {
+			compressor.Contents["stemcell.tgz"] = map[string][]byte{
+				"image.ovf": []byte(`<Envelope><References><File href="../etc/passwd"/></References></Envelope>`),
+			}
+
 			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("Building stemcell domain XML"))
+			Expect(err.Error()).To(ContainSubstring("must be in the same directory"))
 		})
 
-		It("returns error when DefineDomain fails", func() {
-			drv.DefineDomainErr = errors.New("define failed")
+		It("returns error when no image is found", func() {
+			compressor.Contents["stemcell.tgz"] = map[string][]byte{"README": []byte("hi")}
+
 			_, err := factory.ImportFromPath("/tmp/stemcell.tgz")
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("Defining stemcell domain"))
+			Expect(err.Error()).To(ContainSubstring("Finding disk image in stemcell"))
+		})
+	})
+
+	Describe("ImportFromReference", func() {
+		const infoCmd = "qemu-img info --output=json /images/jammy.qcow2"
+
+		BeforeEach(func() {
+			runner.ExecuteOutputs = map[string]string{infoCmd: `{"format":"qcow2"}`}
+		})
+
+		It("links the referenced image without transferring it", func() {
+			sc, err := factory.ImportFromReference(stemcell.StemcellProps{ImagePath: "/images/jammy.qcow2"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sc.ID().AsString()).To(Equal("sc-uuid-1"))
+			Expect(runner.UploadCalls).To(BeEmpty())
+			Expect(runner.SymlinkCalls).To(Equal([][2]string{
+				{"/images/jammy.qcow2", "/store/stemcells/sc-uuid-1/image.qcow2"}}))
+			Expect(string(runner.PutContents["/store/stemcells/sc-uuid-1/stemcell.json"])).To(
+				ContainSubstring(`"Source":"/images/jammy.qcow2"`))
+		})
+
+		It("resolves storage volumes to their path", func() {
+			drv.LookupStorageVolPathResult = "/images/jammy.qcow2"
+
+			_, err := factory.ImportFromReference(stemcell.StemcellProps{Pool: "images", Volume: "jammy"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(drv.LookupStorageVolPathPool).To(Equal("images"))
+			Expect(drv.LookupStorageVolPathName).To(Equal("jammy"))
+		})
+
+		It("rejects images not in the backend format", func() {
+			runner.ExecuteOutputs[infoCmd] = `{"format":"raw"}`
+
+			_, err := factory.ImportFromReference(stemcell.StemcellProps{ImagePath: "/images/jammy.qcow2"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("expected 'qcow2'"))
+			Expect(runner.RemoveCalls).To(ContainElement("/store/stemcells/sc-uuid-1"))
+		})
+
+		It("leaves the referenced image in place on delete", func() {
+			sc, err := factory.ImportFromReference(stemcell.StemcellProps{ImagePath: "/images/jammy.qcow2"})
+			Expect(err).ToNot(HaveOccurred())
+
+			runner.ExecuteCalls = nil
+
+			Expect(sc.Delete()).To(Succeed())
+			Expect(runner.RemoveCalls).To(ContainElement("/store/stemcells/sc-uuid-1"))
+			Expect(runner.ExecuteCalls).ToNot(ContainElement(ContainElement(ContainSubstring("/images/"))))
 		})
 	})
 
 	Describe("Find", func() {
+		It("migrates the placeholder domain of stemcells without a manifest", func() {
+			_, err := factory.Find(apiv1.NewStemcellCID("sc-legacy"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(drv.DestroyDomainID).To(Equal("sc-legacy"))
+			Expect(string(runner.PutContents["/store/stemcells/sc-legacy/stemcell.json"])).To(ContainSubstring(`"Format":"qcow2"`))
+		})
+
+		It("leaves stemcells without a manifest or domain untouched", func() {
+			drv.LookupDomainErr = errors.New("domain not found")
+			drv.IsMissingDomainErrResult = true
+
+			_, err := factory.Find(apiv1.NewStemcellCID("sc-gone"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(drv.DestroyDomainID).To(BeEmpty())
+		})
+
 		It("returns stemcell with the given CID", func() {
 			sc, err := factory.Find(apiv1.NewStemcellCID("sc-abc"))
 			Expect(err).ToNot(HaveOccurred())
@@ -1,9 +1,18 @@
 package fakes
 
-import boshcmd "github.com/cloudfoundry/bosh-utils/fileutil"
+import (
+	"os"
+	"path/filepath"
+
+	boshcmd "github.com/cloudfoundry/bosh-utils/fileutil"
+)
 
 type FakeCompressor struct {
 	DecompressFileToDirErr error
+
+	// Contents maps a tarball path to the files (name to contents)
+	// written into the destination dir when it is decompressed.
+	Contents map[string]map[string][]byte
 }
 
 var _ boshcmd.Compressor = &FakeCompressor{}
@@ -17,7 +26,16 @@ func (c *FakeCompressor) CompressSpecificFilesInDir(dir string, files []string)
 }
 
 func (c *FakeCompressor) DecompressFileToDir(path, dir string, opts boshcmd.CompressorOptions) error {
-	return c.DecompressFileToDirErr
+	if c.DecompressFileToDirErr != nil {
+		return c.DecompressFileToDirErr
+	}
+	for name, contents := range c.Contents[filepath.Base(path)] {
+		err := os.WriteFile(filepath.Join(dir, name), contents, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *FakeCompressor) CleanUp(tarballPath string) error {
@@ -5,9 +5,10 @@ import (
 )
 
 type FakeImporter struct {
-	ImportFromPathArg string
-	ImportResult      bstem.Stemcell
-	ImportErr         error
+	ImportFromPathArg      string
+	ImportFromReferenceArg *bstem.StemcellProps
+	ImportResult           bstem.Stemcell
+	ImportErr              error
 }
 
 var _ bstem.Importer = &FakeImporter{}
@@ -16,3 +17,8 @@ func (i *FakeImporter) ImportFromPath(path string) (bstem.Stemcell, error) {
 	i.ImportFromPathArg = path
 	return i.ImportResult, i.ImportErr
 }
+
+func (i *FakeImporter) ImportFromReference(props bstem.StemcellProps) (bstem.Stemcell, error) {
+	i.ImportFromReferenceArg = &props
+	return i.ImportResult, i.ImportErr
+}
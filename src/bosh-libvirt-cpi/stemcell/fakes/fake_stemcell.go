@@ -14,6 +14,11 @@ type FakeStemcell struct {
 	ExistsResult bool
 	ExistsErr    error
 	DeleteErr    error
+
+	AddUserArg    apiv1.VMCID
+	AddUserErr    error
+	RemoveUserArg apiv1.VMCID
+	RemoveUserErr error
 }
 
 var _ bstem.Stemcell = &FakeStemcell{}
@@ -26,3 +31,12 @@ func (s *FakeStemcell) ID() apiv1.StemcellCID { return s.cid }
 func (s *FakeStemcell) ImagePath() string     { return s.ImagePathResult }
 func (s *FakeStemcell) Exists() (bool, error) { return s.ExistsResult, s.ExistsErr }
 func (s *FakeStemcell) Delete() error         { return s.DeleteErr }
+func (s *FakeStemcell) AddUser(cid apiv1.VMCID) error {
+	s.AddUserArg = cid
+	return s.AddUserErr
+}
+
+func (s *FakeStemcell) RemoveUser(cid apiv1.VMCID) error {
+	s.RemoveUserArg = cid
+	return s.RemoveUserErr
+}
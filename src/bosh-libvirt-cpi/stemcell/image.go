@@ -0,0 +1,242 @@
+package stemcell
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshcmd "github.com/cloudfoundry/bosh-utils/fileutil"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ImageFormatRaw   = "raw"
+	ImageFormatQcow2 = "qcow2"
+	ImageFormatVMDK  = "vmdk"
+	ImageFormatVPC   = "vpc"
+	ImageFormatVDI   = "vdi"
+)
+
+// SupportedFormats lists the stemcell formats the importer can consume.
+var SupportedFormats = []string{"openstack-qcow2", "openstack-raw", "vsphere-ovf"}
+
+// LightStemcellFormat is declared by light stemcells, whose cloud
+// properties reference an image on the host (see StemcellProps).
+const LightStemcellFormat = "libvirt-light"
+
+const (
+	manifestName = "stemcell.MF"
+
+	// headerLen covers every magic number checked by detectImageFormat.
+	headerLen = 512
+)
+
+// Candidate image names inside a stemcell, in order of preference.
+var imageNames = []string{"image", "root.img"}
+
+// stemcellManifest is the subset of stemcell.MF used during import.
+type stemcellManifest struct {
+	Name            string   `yaml:"name"`
+	Version         string   `yaml:"version"`
+	StemcellFormats []string `yaml:"stemcell_formats"`
+}
+
+// ovfEnvelope is the subset of an OVF descriptor needed to find the disk file.
+type ovfEnvelope struct {
+	Files []struct {
+		Href string `xml:"href,attr"`
+	} `xml:"References>File"`
+}
+
+// locateImage finds the disk image within an unpacked stemcell. Full stemcell
+// tarballs and OpenStack images wrap the disk in a nested tarball, which is
+// unpacked into a sub directory of dir.
+func (f Factory) locateImage(dir string) (string, error) {
+	manifestPath := filepath.Join(dir, manifestName)
+
+	if f.fs.FileExists(manifestPath) {
+		err := f.checkManifest(manifestPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ovfPaths, err := f.fs.Glob(filepath.Join(dir, "*.ovf"))
+	if err != nil {
+		return "", bosherr.WrapError(err, "Searching for OVF descriptor")
+	}
+
+	if len(ovfPaths) > 0 {
+		return f.imageFromOVF(ovfPaths[0])
+	}
+
+	for _, name := range imageNames {
+		path := filepath.Join(dir, name)
+		if !f.fs.FileExists(path) {
+			continue
+		}
+
+		nested, err := f.isGzip(path)
+		if err != nil {
+			return "", bosherr.WrapErrorf(err, "Reading stemcell image '%s'", name)
+		} else if !nested {
+			return path, nil
+		}
+
+		nestedDir := filepath.Join(dir, name+"-contents")
+
+		err = f.fs.MkdirAll(nestedDir, 0700)
+		if err != nil {
+			return "", bosherr.WrapError(err, "Creating nested image directory")
+		}
+
+		err = f.compressor.DecompressFileToDir(path, nestedDir, boshcmd.CompressorOptions{})
+		if err != nil {
+			return "", bosherr.WrapErrorf(err, "Unpacking stemcell image '%s'", name)
+		}
+
+		return f.locateImage(nestedDir)
+	}
+
+	return "", bosherr.Error("Finding disk image in stemcell: expected an OVF descriptor, 'image' or 'root.img'")
+}
+
+func (f Factory) checkManifest(path string) error {
+	contents, err := f.fs.ReadFile(path)
+	if err != nil {
+		return bosherr.WrapError(err, "Reading stemcell manifest")
+	}
+
+	var manifest stemcellManifest
+
+	err = yaml.Unmarshal(contents, &manifest)
+	if err != nil {
+		return bosherr.WrapError(err, "Parsing stemcell manifest")
+	}
+
+	f.logger.Debug(f.logTag, "Importing stemcell '%s/%s'", manifest.Name, manifest.Version)
+
+	// Older stemcells do not list their formats
+	if len(manifest.StemcellFormats) == 0 {
+		return nil
+	}
+
+	for _, format := range manifest.StemcellFormats {
+		for _, supported := range SupportedFormats {
+			if format == supported {
+				return nil
+			}
+		}
+	}
+
+	return bosherr.Errorf("Stemcell formats %v are not supported: expected one of %v",
+		manifest.StemcellFormats, SupportedFormats)
+}
+
+func (f Factory) imageFromOVF(ovfPath string) (string, error) {
+	contents, err := f.fs.ReadFile(ovfPath)
+	if err != nil {
+		return "", bosherr.WrapError(err, "Reading OVF descriptor")
+	}
+
+	var envelope ovfEnvelope
+
+	err = xml.Unmarshal(contents, &envelope)
+	if err != nil {
+		return "", bosherr.WrapError(err, "Parsing OVF descriptor")
+	}
+
+	if len(envelope.Files) == 0 {
+		return "", bosherr.Error("OVF descriptor does not reference a disk file")
+	}
+
+	href := envelope.Files[0].Href
+
+	// Only files next to the descriptor are part of the stemcell
+	if href != filepath.Base(href) {
+		return "", bosherr.Errorf("OVF disk file '%s' must be in the same directory as the descriptor", href)
+	}
+
+	return filepath.Join(filepath.Dir(ovfPath), href), nil
+}
+
+// checksum returns the hex encoded SHA-256 of the file at path.
+func (f Factory) checksum(path string) (string, error) {
+	file, err := f.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readHeader returns up to headerLen bytes from the start of the file.
+func (f Factory) readHeader(path string) ([]byte, error) {
+	file, err := f.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	header := make([]byte, headerLen)
+
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	return header[:n], nil
+}
+
+func (f Factory) isGzip(path string) (bool, error) {
+	header, err := f.readHeader(path)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.HasPrefix(header, []byte{0x1f, 0x8b}), nil
+}
+
+// detectImageFormat identifies the disk format from its magic bytes.
+// Anything not recognised is treated as a raw image.
+func (f Factory) detectImageFormat(path string) (string, error) {
+	header, err := f.readHeader(path)
+	if err != nil {
+		return "", bosherr.WrapErrorf(err, "Reading image header of '%s'", path)
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte("QFI\xfb")):
+		return ImageFormatQcow2, nil
+
+	case bytes.HasPrefix(header, []byte("KDMV")):
+		return ImageFormatVMDK, nil
+
+	case bytes.HasPrefix(header, []byte("# Disk DescriptorFile")):
+		return "", bosherr.Error("VMDK descriptors with separate extent files are not supported")
+
+	case bytes.HasPrefix(header, []byte("conectix")):
+		return ImageFormatVPC, nil
+
+	case len(header) >= 0x44 && binary.LittleEndian.Uint32(header[0x40:0x44]) == 0xbeda107f:
+		return ImageFormatVDI, nil
+	}
+
+	return ImageFormatRaw, nil
+}
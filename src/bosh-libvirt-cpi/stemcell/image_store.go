@@ -0,0 +1,157 @@
+package stemcell
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+
+	"bosh-libvirt-cpi/driver"
+)
+
+// imageStore keeps stemcell images by content so that importing the same
+// stemcell twice reuses the data on the host. Each stemcell using an image
+// holds a reference file; the image is removed with its last reference.
+//
+//	<stemcells>/.images/<checksum>.<format>/image.<format>
+//	<stemcells>/.images/<checksum>.<format>/image.json  (written once the image is complete)
+//	<stemcells>/.images/<checksum>.<format>/refs/<stemcell-cid>
+type imageStore struct {
+	dirPath string
+	runner  driver.Runner
+}
+
+const (
+	imagesDirName      = ".images"
+	imageMarkerName    = "image.json"
+	imageRefsDirName   = "refs"
+	imagePartSuffix    = ".part"
+	stemcellRecordName = "stemcell.json"
+)
+
+// stemcellRecord is the manifest persisted in each stemcell dir. Its presence
+// marks the stemcell as imported; Checksum locates the shared image.
+type stemcellRecord struct {
+	Checksum string
+	Format   string
+
+	// Source is the pre-provisioned image a light stemcell links to; the CPI never removes it.
+	Source string `json:",omitempty"`
+}
+
+func newImageStore(stemcellsPath string, runner driver.Runner) imageStore {
+	return imageStore{filepath.Join(stemcellsPath, imagesDirName), runner}
+}
+
+// imageLockName names the lock held while the image for checksum and its
+// references are changed. Stemcells lock it after their own lock.
+func imageLockName(checksum, format string) string {
+	return "image-" + checksum + "." + format
+}
+
+func (s imageStore) dir(checksum, format string) string {
+	return filepath.Join(s.dirPath, checksum+"."+format)
+}
+
+func (s imageStore) ImagePath(checksum, format string) string {
+	return filepath.Join(s.dir(checksum, format), "image."+format)
+}
+
+// Exists reports whether a complete image is stored for checksum.
+func (s imageStore) Exists(checksum, format string) (bool, error) {
+	found, err := fileExists(s.runner, filepath.Join(s.dir(checksum, format), imageMarkerName))
+	if err != nil {
+		return false, bosherr.WrapErrorf(err, "Checking stemcell image '%s'", checksum)
+	}
+	return found, nil
+}
+
+// MarkComplete records that the image for checksum has been fully written.
+func (s imageStore) MarkComplete(checksum, format string) error {
+	bytes, err := json.Marshal(stemcellRecord{Checksum: checksum, Format: format})
+	if err != nil {
+		return bosherr.WrapError(err, "Serializing stemcell image marker")
+	}
+
+	err = s.runner.Put(filepath.Join(s.dir(checksum, format), imageMarkerName), bytes)
+	if err != nil {
+		return bosherr.WrapError(err, "Marking stemcell image complete")
+	}
+
+	return nil
+}
+
+func (s imageStore) AddRef(checksum, format, id string) error {
+	refsDir := filepath.Join(s.dir(checksum, format), imageRefsDirName)
+
+	err := s.runner.MkdirAll(refsDir)
+	if err != nil {
+		return bosherr.WrapError(err, "Creating stemcell image refs dir")
+	}
+
+	err = s.runner.Put(filepath.Join(refsDir, id), []byte{})
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Adding stemcell image reference '%s'", id)
+	}
+
+	return nil
+}
+
+// RemoveRef drops the reference of id and deletes the image if it was the last one.
+func (s imageStore) RemoveRef(checksum, format, id string) error {
+	dir := s.dir(checksum, format)
+	refsDir := filepath.Join(dir, imageRefsDirName)
+
+	err := s.runner.Remove(filepath.Join(refsDir, id))
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Removing stemcell image reference '%s'", id)
+	}
+
+	refs, err := s.refs(refsDir)
+	if err != nil {
+		return err
+	}
+
+	if len(refs) > 0 {
+		return nil
+	}
+
+	err = s.runner.Remove(dir)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Deleting stemcell image '%s'", dir)
+	}
+
+	return nil
+}
+
+func (s imageStore) refs(refsDir string) ([]string, error) {
+	refs, err := listDir(s.runner, refsDir)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing stemcell image references")
+	}
+	return refs, nil
+}
+
+// listDir returns the names in dir, creating it first if necessary.
+// fileExists reports whether path exists. Errors other than path not
+// existing are returned.
+func fileExists(runner driver.Runner, path string) (bool, error) {
+	_, err := runner.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func listDir(runner driver.Runner, dir string) ([]string, error) {
+	err := runner.MkdirAll(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return runner.List(dir)
+}
@@ -0,0 +1,79 @@
+package stemcell
+
+import (
+	"strings"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// Info describes a stemcell as recorded in its dir, for operators.
+type Info struct {
+	CID       string
+	Path      string
+	ImagePath string
+
+	// Format and Checksum are empty for stemcells imported by releases
+	// that did not record them.
+	Format   string `json:",omitempty"`
+	Checksum string `json:",omitempty"`
+
+	// Source is the host image a light stemcell refers to.
+	Source string `json:",omitempty"`
+
+	// Users are the VMs created from the stemcell.
+	Users []string `json:",omitempty"`
+
+	PendingDelete bool `json:",omitempty"`
+}
+
+// List returns the stemcells that have a dir.
+func (f Factory) List() ([]apiv1.StemcellCID, error) {
+	names, err := listDir(f.runner, f.opts.DirPath)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing stemcells")
+	}
+
+	var cids []apiv1.StemcellCID
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "sc-") {
+			cids = append(cids, apiv1.NewStemcellCID(name))
+		}
+	}
+
+	return cids, nil
+}
+
+func (f Factory) Info(cid apiv1.StemcellCID) (Info, error) {
+	stemcell := f.newStemcell(cid)
+
+	info := Info{
+		CID:       cid.AsString(),
+		Path:      stemcell.Path(),
+		ImagePath: stemcell.ImagePath(),
+	}
+
+	var err error
+
+	info.PendingDelete, err = stemcell.pendingDelete()
+	if err != nil {
+		return info, err
+	}
+
+	rec, _, err := stemcell.record()
+	if err != nil {
+		return info, err
+	}
+
+	info.Format = rec.Format
+	info.Checksum = rec.Checksum
+	info.Source = rec.Source
+
+	info.Users, err = stemcell.users()
+	if err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
@@ -6,6 +6,7 @@ import (
 
 type Importer interface {
 	ImportFromPath(string) (Stemcell, error)
+	ImportFromReference(StemcellProps) (Stemcell, error)
 }
 
 var _ Importer = Factory{}
@@ -23,6 +24,11 @@ type Stemcell interface {
 
 	Exists() (bool, error)
 	Delete() error
+
+	// AddUser and RemoveUser track the VMs built from the stemcell so that
+	// its image is not removed while they still need it.
+	AddUser(apiv1.VMCID) error
+	RemoveUser(apiv1.VMCID) error
 }
 
 var _ Stemcell = StemcellImpl{}
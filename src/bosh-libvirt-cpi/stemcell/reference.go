@@ -0,0 +1,99 @@
+package stemcell
+
+import (
+	"encoding/json"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// hostImageInfo is the subset of `qemu-img info --output=json`
+// used to validate referenced images.
+type hostImageInfo struct {
+	Format    string `json:"format"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// ImportFromReference registers a light stemcell whose image is already on
+// the host. Nothing is transferred; the stemcell links to the image and
+// deleting it leaves the image in place.
+func (f Factory) ImportFromReference(props StemcellProps) (Stemcell, error) {
+	id, err := f.uuidGen.Generate()
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Generating stemcell id")
+	}
+
+	id = "sc-" + id
+
+	stemcell := f.newStemcell(apiv1.NewStemcellCID(id))
+
+	err = f.reference(props, stemcell)
+	if err != nil {
+		f.cleanUpPartialImport(stemcell)
+		return nil, err
+	}
+
+	return stemcell, nil
+}
+
+func (f Factory) reference(props StemcellProps, stemcell StemcellImpl) error {
+	srcImage := props.ImagePath
+
+	if len(props.Pool) > 0 {
+		var err error
+
+		srcImage, err = f.driver.LookupStorageVolPath(props.Pool, props.Volume)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Finding stemcell volume '%s' in pool '%s'", props.Volume, props.Pool)
+		}
+	}
+
+	info, err := f.inspectHostImage(srcImage)
+	if err != nil {
+		return err
+	}
+
+	// Referenced images are used as is, so they must already be in the backend format
+	dstFormat := f.domBuilder.DiskImageFormat()
+
+	if info.Format != dstFormat {
+		return bosherr.Errorf("Stemcell image '%s' has format '%s': expected '%s'", srcImage, info.Format, dstFormat)
+	}
+
+	if info.Encrypted {
+		return bosherr.Errorf("Stemcell image '%s' is encrypted", srcImage)
+	}
+
+	err = f.runner.MkdirAll(stemcell.Path())
+	if err != nil {
+		return bosherr.WrapError(err, "Creating stemcell parent")
+	}
+
+	err = stemcell.saveRecord(stemcellRecord{Format: dstFormat, Source: srcImage})
+	if err != nil {
+		return err
+	}
+
+	err = f.runner.Symlink(srcImage, stemcell.ImagePath())
+	if err != nil {
+		return bosherr.WrapError(err, "Linking stemcell image")
+	}
+
+	return nil
+}
+
+func (f Factory) inspectHostImage(path string) (hostImageInfo, error) {
+	var info hostImageInfo
+
+	out, _, err := f.runner.Execute("qemu-img", "info", "--output=json", path)
+	if err != nil {
+		return info, bosherr.WrapErrorf(err, "Inspecting stemcell image '%s'", path)
+	}
+
+	err = json.Unmarshal([]byte(out), &info)
+	if err != nil {
+		return info, bosherr.WrapErrorf(err, "Parsing info of stemcell image '%s'", path)
+	}
+
+	return info, nil
+}
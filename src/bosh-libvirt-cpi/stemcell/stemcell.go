@@ -1,6 +1,7 @@
 package stemcell
 
 import (
+	"encoding/json"
 	"path/filepath"
 
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
@@ -17,19 +18,32 @@ type StemcellImpl struct {
 	driver     driver.Driver
 	domBuilder driver.DomainBuilder
 	runner     driver.Runner
+	locker     driver.Locker
 
+	logTag string
 	logger boshlog.Logger
 }
 
+const (
+	usersDirName      = "users"
+	pendingDeleteName = "delete-pending.json"
+)
+
 func NewStemcellImpl(
 	cid apiv1.StemcellCID,
 	path string,
 	driver driver.Driver,
 	domBuilder driver.DomainBuilder,
 	runner driver.Runner,
+	locker driver.Locker,
 	logger boshlog.Logger,
 ) StemcellImpl {
-	return StemcellImpl{cid, path, driver, domBuilder, runner, logger}
+	return StemcellImpl{cid, path, driver, domBuilder, runner, locker, "stemcell.StemcellImpl", logger}
+}
+
+// LockName names the lock held while a stemcell is changed.
+func LockName(cid apiv1.StemcellCID) string {
+	return "stemcell-" + cid.AsString()
 }
 
 func (s StemcellImpl) ID() apiv1.StemcellCID { return s.cid }
@@ -40,21 +54,44 @@ func (s StemcellImpl) ImagePath() string {
 	return filepath.Join(s.path, "image."+s.domBuilder.DiskImageFormat())
 }
 
-func (s StemcellImpl) Prepare() error {
-	xml, err := s.domBuilder.BuildStemcellDomain(s.cid.AsString(), s.ImagePath())
-	if err != nil {
-		return bosherr.WrapErrorf(err, "Building stemcell domain XML")
+// Exists reports whether the stemcell manifest is present and the stemcell
+// is not pending deletion.
+func (s StemcellImpl) Exists() (bool, error) {
+	pending, err := s.pendingDelete()
+	if err != nil || pending {
+		return false, err
 	}
 
-	err = s.driver.DefineDomain(xml)
-	if err != nil {
-		return bosherr.WrapErrorf(err, "Defining stemcell domain")
+	_, found, err := s.record()
+	if err != nil || found {
+		return found, err
 	}
 
-	return nil
+	return s.migrateLegacyDomain()
 }
 
-func (s StemcellImpl) Exists() (bool, error) {
+// migrateLegacyDomain replaces the placeholder domain that older releases
+// defined for every stemcell with a manifest. It reports whether a
+// placeholder domain was found.
+func (s StemcellImpl) migrateLegacyDomain() (bool, error) {
+	var found bool
+
+	err := s.withLock(func() error {
+		// Another process may have migrated the stemcell while we waited
+		_, recorded, err := s.record()
+		if err != nil || recorded {
+			found = recorded
+			return err
+		}
+
+		found, err = s.migrateLegacyDomainLocked()
+		return err
+	})
+
+	return found, err
+}
+
+func (s StemcellImpl) migrateLegacyDomainLocked() (bool, error) {
 	_, err := s.driver.LookupDomain(s.cid.AsString())
 	if err != nil {
 		if s.driver.IsMissingDomainErr(err) {
@@ -62,19 +99,206 @@ func (s StemcellImpl) Exists() (bool, error) {
 		}
 		return false, bosherr.WrapErrorf(err, "Looking up stemcell domain '%s'", s.cid.AsString())
 	}
+
+	s.logger.Debug(s.logTag, "Migrating placeholder domain of stemcell '%s'", s.cid.AsString())
+
+	// Legacy stemcells own their image, so the manifest has no checksum
+	err = s.saveRecord(stemcellRecord{Format: s.domBuilder.DiskImageFormat()})
+	if err != nil {
+		return false, err
+	}
+
+	err = s.driver.DestroyDomain(s.cid.AsString())
+	if err != nil && !s.driver.IsMissingDomainErr(err) {
+		return false, bosherr.WrapErrorf(err, "Removing stemcell domain '%s'", s.cid.AsString())
+	}
+
 	return true, nil
 }
 
+// Delete removes the stemcell, or marks it for removal by the last
+// VM still using it if there is one.
 func (s StemcellImpl) Delete() error {
-	err := s.driver.DestroyDomain(s.cid.AsString())
-	if err != nil && !s.driver.IsMissingDomainErr(err) {
-		return bosherr.WrapErrorf(err, "Destroying stemcell domain '%s'", s.cid.AsString())
+	return s.withLock(s.delete)
+}
+
+func (s StemcellImpl) delete() error {
+	users, err := s.users()
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 {
+		s.logger.Debug(s.logTag, "Deferring deletion of stemcell '%s' used by VMs %v", s.cid.AsString(), users)
+
+		bytes, err := json.Marshal(users)
+		if err != nil {
+			return bosherr.WrapError(err, "Serializing stemcell users")
+		}
+
+		err = s.runner.Put(filepath.Join(s.path, pendingDeleteName), bytes)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Marking stemcell '%s' for deletion", s.cid.AsString())
+		}
+
+		return nil
+	}
+
+	return s.destroy()
+}
+
+func (s StemcellImpl) AddUser(vmCID apiv1.VMCID) error {
+	return s.withLock(func() error { return s.addUser(vmCID) })
+}
+
+func (s StemcellImpl) addUser(vmCID apiv1.VMCID) error {
+	pending, err := s.pendingDelete()
+	if err != nil {
+		return err
+	}
+
+	if pending {
+		return bosherr.Errorf("Stemcell '%s' is being deleted", s.cid.AsString())
+	}
+
+	usersDir := filepath.Join(s.path, usersDirName)
+
+	err = s.runner.MkdirAll(usersDir)
+	if err != nil {
+		return bosherr.WrapError(err, "Creating stemcell users dir")
+	}
+
+	err = s.runner.Put(filepath.Join(usersDir, vmCID.AsString()), []byte{})
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Recording VM '%s' as stemcell user", vmCID.AsString())
+	}
+
+	return nil
+}
+
+// RemoveUser releases the stemcell for the VM and completes
+// a deferred deletion once no other VM uses it.
+func (s StemcellImpl) RemoveUser(vmCID apiv1.VMCID) error {
+	return s.withLock(func() error { return s.removeUser(vmCID) })
+}
+
+func (s StemcellImpl) removeUser(vmCID apiv1.VMCID) error {
+	err := s.runner.Remove(filepath.Join(s.path, usersDirName, vmCID.AsString()))
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Removing VM '%s' as stemcell user", vmCID.AsString())
+	}
+
+	pending, err := s.pendingDelete()
+	if err != nil || !pending {
+		return err
+	}
+
+	users, err := s.users()
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 {
+		return nil
+	}
+
+	s.logger.Debug(s.logTag, "Completing deferred deletion of stemcell '%s'", s.cid.AsString())
+
+	return s.destroy()
+}
+
+func (s StemcellImpl) users() ([]string, error) {
+	users, err := listDir(s.runner, filepath.Join(s.path, usersDirName))
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Listing users of stemcell '%s'", s.cid.AsString())
+	}
+	return users, nil
+}
+
+func (s StemcellImpl) pendingDelete() (bool, error) {
+	pending, err := fileExists(s.runner, filepath.Join(s.path, pendingDeleteName))
+	if err != nil {
+		return false, bosherr.WrapErrorf(err, "Checking deletion of stemcell '%s'", s.cid.AsString())
+	}
+	return pending, nil
+}
+
+func (s StemcellImpl) destroy() error {
+	rec, found, err := s.record()
+	if err != nil {
+		return err
 	}
 
-	_, _, err = s.runner.Execute("rm", "-rf", s.path)
+	// Remove the placeholder domain of stemcells that were never migrated
+	if !found {
+		err = s.driver.DestroyDomain(s.cid.AsString())
+		if err != nil && !s.driver.IsMissingDomainErr(err) {
+			return bosherr.WrapErrorf(err, "Removing stemcell domain '%s'", s.cid.AsString())
+		}
+	}
+
+	err = s.runner.Remove(s.path)
 	if err != nil {
 		return bosherr.WrapErrorf(err, "Deleting stemcell '%s'", s.path)
 	}
 
+	if len(rec.Source) > 0 {
+		s.logger.Debug(s.logTag, "Leaving referenced image '%s' in place", rec.Source)
+	}
+
+	// Light stemcells and those imported before images were shared hold no reference
+	if len(rec.Checksum) == 0 {
+		return nil
+	}
+
+	images := newImageStore(filepath.Dir(s.path), s.runner)
+
+	return driver.WithLock(s.locker, imageLockName(rec.Checksum, rec.Format), func() error {
+		return images.RemoveRef(rec.Checksum, rec.Format, s.cid.AsString())
+	})
+}
+
+func (s StemcellImpl) withLock(fn func() error) error {
+	return driver.WithLock(s.locker, LockName(s.cid), fn)
+}
+
+func (s StemcellImpl) record() (stemcellRecord, bool, error) {
+	var rec stemcellRecord
+
+	recordPath := filepath.Join(s.path, stemcellRecordName)
+
+	found, err := fileExists(s.runner, recordPath)
+	if err != nil {
+		return rec, false, bosherr.WrapErrorf(err, "Checking stemcell record '%s'", s.cid.AsString())
+	}
+
+	if !found {
+		return rec, false, nil
+	}
+
+	bytes, err := s.runner.Get(recordPath)
+	if err != nil {
+		return rec, false, bosherr.WrapErrorf(err, "Reading stemcell record '%s'", s.cid.AsString())
+	}
+
+	err = json.Unmarshal(bytes, &rec)
+	if err != nil {
+		return rec, false, bosherr.WrapErrorf(err, "Deserializing stemcell record '%s'", s.cid.AsString())
+	}
+
+	return rec, true, nil
+}
+
+func (s StemcellImpl) saveRecord(rec stemcellRecord) error {
+	bytes, err := json.Marshal(rec)
+	if err != nil {
+		return bosherr.WrapError(err, "Serializing stemcell record")
+	}
+
+	err = s.runner.Put(filepath.Join(s.path, stemcellRecordName), bytes)
+	if err != nil {
+		return bosherr.WrapError(err, "Saving stemcell record")
+	}
+
 	return nil
 }
@@ -56,12 +56,13 @@ var _ = Describe("Stemcell (integration)", func() {
 		tmpDir, err = os.MkdirTemp("", "stemcell-integration-test")
 		Expect(err).ToNot(HaveOccurred())
 
-		libvirtConn := driver.NewLibvirtConnImpl(conn)
+		libvirtConn := driver.NewLibvirtConnImpl(conn, nil)
 		domBuilder := domains.QEMUDomainBuilder{}
-		d := driver.NewLibvirtDriver(libvirtConn, domBuilder, logger)
+		d := driver.NewLibvirtDriver(libvirtConn, domBuilder, driver.LibvirtDriverOpts{}, logger)
 
 		opts := stemcell.FactoryOpts{DirPath: tmpDir}
-		factory = stemcell.NewFactory(opts, d, domBuilder, runner, fs, uuidGen, compressor, logger)
+		locker := driver.NewFlockLocker(filepath.Join(tmpDir, ".locks"), fs, driver.LockerOpts{}, logger)
+		factory = stemcell.NewFactory(opts, d, domBuilder, runner, locker, fs, uuidGen, compressor, logger)
 	})
 
 	AfterEach(func() {
@@ -0,0 +1,61 @@
+package stemcell
+
+import (
+	"path/filepath"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// StemcellProps are the cloud properties of a light stemcell, which
+// references an image already staged on the host instead of carrying one.
+// Regular stemcells set none of them.
+type StemcellProps struct {
+	// ImagePath is an image file on the host.
+	ImagePath string `json:"image_path"`
+
+	// Pool and Volume name a libvirt storage volume holding the image.
+	Pool   string `json:"pool"`
+	Volume string `json:"volume"`
+}
+
+func NewStemcellProps(props apiv1.StemcellCloudProps) (StemcellProps, error) {
+	var stemcellProps StemcellProps
+
+	err := props.As(&stemcellProps)
+	if err != nil {
+		return StemcellProps{}, err
+	}
+
+	err = stemcellProps.Validate()
+	if err != nil {
+		return StemcellProps{}, err
+	}
+
+	return stemcellProps, nil
+}
+
+// IsLight reports whether the properties reference a pre-provisioned image.
+func (p StemcellProps) IsLight() bool {
+	return len(p.ImagePath) > 0 || len(p.Pool) > 0 || len(p.Volume) > 0
+}
+
+func (p StemcellProps) Validate() error {
+	if len(p.ImagePath) > 0 {
+		if len(p.Pool) > 0 || len(p.Volume) > 0 {
+			return bosherr.Error("Stemcell image_path cannot be combined with pool or volume")
+		}
+
+		if !filepath.IsAbs(p.ImagePath) {
+			return bosherr.Errorf("Stemcell image_path '%s' must be an absolute path", p.ImagePath)
+		}
+
+		return nil
+	}
+
+	if (len(p.Pool) > 0) != (len(p.Volume) > 0) {
+		return bosherr.Error("Stemcell pool and volume must be specified together")
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package stemcell_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+
+	driverfakes "bosh-libvirt-cpi/driver/fakes"
+	"bosh-libvirt-cpi/stemcell"
+)
+
+var _ = Describe("StemcellImpl", func() {
+	var (
+		runner *driverfakes.FakeRunner
+		drv    *driverfakes.FakeDriver
+		locker *driverfakes.FakeLocker
+		sc     stemcell.StemcellImpl
+	)
+
+	BeforeEach(func() {
+		runner = &driverfakes.FakeRunner{}
+		drv = &driverfakes.FakeDriver{}
+		locker = &driverfakes.FakeLocker{}
+		builder := &driverfakes.FakeDomainBuilder{DiskImageFormatResult: "qcow2"}
+		sc = stemcell.NewStemcellImpl(apiv1.NewStemcellCID("sc-1"), "/store/stemcells/sc-1",
+			drv, builder, runner, locker, boshlog.NewLogger(boshlog.LevelNone))
+	})
+
+	Describe("AddUser / RemoveUser", func() {
+		It("records VMs using the stemcell", func() {
+			Expect(sc.AddUser(apiv1.NewVMCID("vm-1"))).To(Succeed())
+			Expect(runner.PutContents).To(HaveKey("/store/stemcells/sc-1/users/vm-1"))
+			Expect(locker.LockCalls).To(Equal([]string{"stemcell-sc-1"}))
+			Expect(locker.Held).To(BeEmpty())
+		})
+
+		It("does not record users without holding the stemcell lock", func() {
+			locker.LockErr = errors.New("fake-lock-err")
+
+			Expect(sc.AddUser(apiv1.NewVMCID("vm-1"))).To(MatchError("fake-lock-err"))
+			Expect(runner.PutContents).ToNot(HaveKey("/store/stemcells/sc-1/users/vm-1"))
+		})
+
+		It("refuses new users once deletion is pending", func() {
+			runner.PutContents = map[string][]byte{"/store/stemcells/sc-1/delete-pending.json": []byte(`["vm-1"]`)}
+
+			err := sc.AddUser(apiv1.NewVMCID("vm-2"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("is being deleted"))
+		})
+
+		It("completes a deferred deletion when the last user is removed", func() {
+			runner.PutContents = map[string][]byte{"/store/stemcells/sc-1/delete-pending.json": []byte(`["vm-1"]`)}
+
+			Expect(sc.RemoveUser(apiv1.NewVMCID("vm-1"))).To(Succeed())
+			Expect(runner.RemoveCalls).To(ContainElement("/store/stemcells/sc-1/users/vm-1"))
+			Expect(runner.RemoveCalls).To(ContainElement("/store/stemcells/sc-1"))
+		})
+
+		It("does not add users when checking for a pending deletion fails", func() {
+			runner.StatErr = errors.New("stat failed")
+
+			Expect(sc.AddUser(apiv1.NewVMCID("vm-1"))).ToNot(Succeed())
+			Expect(runner.PutContents).To(BeEmpty())
+		})
+
+		It("keeps stemcells that are not pending deletion", func() {
+			Expect(sc.RemoveUser(apiv1.NewVMCID("vm-1"))).To(Succeed())
+			Expect(runner.RemoveCalls).ToNot(ContainElement("/store/stemcells/sc-1"))
+		})
+	})
+
+	Describe("Exists", func() {
+		It("returns true when the manifest is present", func() {
+			runner.PutContents = map[string][]byte{
+				"/store/stemcells/sc-1/stemcell.json": []byte(`{"Checksum":"abc","Format":"qcow2"}`),
+			}
+
+			exists, err := sc.Exists()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeTrue())
+			Expect(drv.DestroyDomainID).To(BeEmpty())
+		})
+
+		It("migrates a legacy placeholder domain to a manifest", func() {
+			exists, err := sc.Exists()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeTrue())
+			Expect(drv.DestroyDomainID).To(Equal("sc-1"))
+			Expect(runner.PutContents).To(HaveKey("/store/stemcells/sc-1/stemcell.json"))
+		})
+
+		It("returns false without a manifest or legacy domain", func() {
+			drv.LookupDomainErr = errors.New("domain not found")
+			drv.IsMissingDomainErrResult = true
+
+			exists, err := sc.Exists()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+
+		It("returns errors other than a missing manifest", func() {
+			runner.StatErr = errors.New("stat failed")
+
+			_, err := sc.Exists()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("stat failed"))
+			Expect(drv.DestroyDomainID).To(BeEmpty())
+		})
+
+		It("returns error when the manifest cannot be read", func() {
+			runner.PutContents = map[string][]byte{"/store/stemcells/sc-1/stemcell.json": []byte(`{}`)}
+			runner.GetErr = errors.New("read failed")
+
+			_, err := sc.Exists()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Reading stemcell record"))
+			Expect(runner.PutContents).To(HaveLen(1))
+		})
+	})
+
+	Describe("Delete", func() {
+		const imageDir = "/store/stemcells/.images/abc.qcow2"
+
+		BeforeEach(func() {
+			runner.PutContents = map[string][]byte{
+				"/store/stemcells/sc-1/stemcell.json": []byte(`{"Checksum":"abc","Format":"qcow2"}`),
+			}
+		})
+
+		It("removes the shared image with its last reference", func() {
+			Expect(sc.Delete()).To(Succeed())
+			Expect(locker.LockCalls).To(Equal([]string{"stemcell-sc-1", "image-abc.qcow2"}))
+			Expect(runner.RemoveCalls).To(ContainElement("/store/stemcells/sc-1"))
+			Expect(runner.RemoveCalls).To(ContainElement(imageDir + "/refs/sc-1"))
+			Expect(runner.RemoveCalls).To(ContainElement(imageDir))
+		})
+
+		It("keeps the shared image while other stemcells reference it", func() {
+			runner.ListResults = map[string][]string{imageDir + "/refs": {"sc-2"}}
+
+			Expect(sc.Delete()).To(Succeed())
+			Expect(runner.RemoveCalls).To(ContainElement(imageDir + "/refs/sc-1"))
+			Expect(runner.RemoveCalls).ToNot(ContainElement(imageDir))
+		})
+
+		It("only removes the stemcell dir of stemcells without a record", func() {
+			runner.PutContents = nil
+
+			Expect(sc.Delete()).To(Succeed())
+			Expect(runner.RemoveCalls).To(ContainElement("/store/stemcells/sc-1"))
+			Expect(runner.RemoveCalls).ToNot(ContainElement(ContainSubstring(".images")))
+			Expect(drv.DestroyDomainID).To(Equal("sc-1"))
+		})
+
+		It("defers deletion while VMs use the stemcell", func() {
+			runner.PutContents["/store/stemcells/sc-1/users/vm-1"] = []byte{}
+
+			Expect(sc.Delete()).To(Succeed())
+			Expect(runner.RemoveCalls).ToNot(ContainElement("/store/stemcells/sc-1"))
+			Expect(string(runner.PutContents["/store/stemcells/sc-1/delete-pending.json"])).To(Equal(`["vm-1"]`))
+
+			exists, err := sc.Exists()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+	})
+})
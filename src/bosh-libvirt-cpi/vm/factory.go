@@ -2,6 +2,7 @@ package vm
 
 import (
 	"path/filepath"
+	"time"
 
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
@@ -24,9 +25,12 @@ type Factory struct {
 
 	driver      driver.Driver
 	runner      driver.Runner
+	locker      driver.Locker
 	domBuilder  driver.DomainBuilder
 	diskFactory bdisk.Factory
 
+	stemcellFinder bstem.Finder
+
 	agentOptions       apiv1.AgentOptions
 	stemcellAPIVersion apiv1.StemcellAPIVersion
 
@@ -39,8 +43,10 @@ func NewFactory(
 	uuidGen boshuuid.Generator,
 	driver driver.Driver,
 	runner driver.Runner,
+	locker driver.Locker,
 	domBuilder driver.DomainBuilder,
 	diskFactory bdisk.Factory,
+	stemcellFinder bstem.Finder,
 	agentOptions apiv1.AgentOptions,
 	stemcellAPIVersion apiv1.StemcellAPIVersion,
 	logger boshlog.Logger,
@@ -51,9 +57,12 @@ func NewFactory(
 
 		driver:      driver,
 		runner:      runner,
+		locker:      locker,
 		domBuilder:  domBuilder,
 		diskFactory: diskFactory,
 
+		stemcellFinder: stemcellFinder,
+
 		agentOptions:       agentOptions,
 		stemcellAPIVersion: stemcellAPIVersion,
 
@@ -67,6 +76,7 @@ func (f Factory) Create(
 	stemcell bstem.Stemcell,
 	props apiv1.VMCloudProps,
 	networks apiv1.Networks,
+	persistentDisks []bdisk.Disk,
 	env apiv1.VMEnv,
 ) (VM, error) {
 
@@ -85,9 +95,20 @@ func (f Factory) Create(
 
 	vm := f.newVM(cid)
 
+	err = vm.useStemcell(stemcell)
+	if err != nil {
+		f.cleanUpPartialCreate(vm)
+		return nil, bosherr.WrapErrorf(err, "Using stemcell '%s'", stemcell.ID().AsString())
+	}
+
+	// Keep the ephemeral disk next to the persistent disks the VM is created with.
+	ephemeralProps := bdisk.DefaultDiskProps()
+	ephemeralProps.Pool = f.localityPool(persistentDisks)
+
 	// Create ephemeral disk before defining the domain so we can reference it.
-	ephemeralDisk, err := f.diskFactory.Create(vmProps.EphemeralDisk)
+	ephemeralDisk, err := f.diskFactory.Create(vmProps.EphemeralDisk, ephemeralProps)
 	if err != nil {
+		f.cleanUpPartialCreate(vm)
 		return nil, bosherr.WrapError(err, "Creating ephemeral disk")
 	}
 
@@ -95,8 +116,12 @@ func (f Factory) Create(
 	initialAgentEnv := apiv1.NewAgentEnvFactory().ForVM(
 		agentID, vm.ID(), networks, env, f.agentOptions)
 
-	initialAgentEnv.AttachSystemDisk(apiv1.NewDiskHintFromString("0"))
-	initialAgentEnv.AttachEphemeralDisk(apiv1.NewDiskHintFromString(ephemeralDisk.ImagePath()))
+	// The system disk has no disk CID of its own, so its serial is derived from the VM CID.
+	rootSerial := driver.DiskSerial(vmID)
+	ephemeralSerial := driver.DiskSerial(ephemeralDisk.ID().AsString())
+
+	initialAgentEnv.AttachSystemDisk(diskHintFromSerial(rootSerial))
+	initialAgentEnv.AttachEphemeralDisk(diskHintFromSerial(ephemeralSerial))
 
 	err = vm.ConfigureAgent(initialAgentEnv)
 	if err != nil {
@@ -105,14 +130,34 @@ func (f Factory) Create(
 	}
 
 	disks := driver.DomainDiskPaths{
-		RootDisk:      stemcell.ImagePath(),
-		EphemeralDisk: ephemeralDisk.ImagePath(),
+		RootDisk:        stemcell.ImagePath(),
+		EphemeralDisk:   ephemeralDisk.ImagePath(),
+		EphemeralFormat: ephemeralDisk.Props().Format,
+		RootSerial:      rootSerial,
+		EphemeralSerial: ephemeralSerial,
+	}
+
+	// Wire persistent disks into the domain so they are present at first boot.
+	usedTargets := map[string]bool{}
+	persistentTargets := make([]string, len(persistentDisks))
+
+	for i, disk := range persistentDisks {
+		target, err := freeDiskTarget(disk.Props().Bus, usedTargets)
+		if err != nil {
+			f.cleanUpPartialCreate(vm)
+			return nil, err
+		}
+
+		usedTargets[target] = true
+		persistentTargets[i] = target
+		disks.Persistent = append(disks.Persistent, domainDisk(disk, target))
 	}
 
 	domainProps := driver.VMDomainProps{
 		CPUs:     vmProps.CPUs,
 		MemoryMB: vmProps.Memory,
 		Network:  f.opts.Network,
+		Created:  time.Now(),
 	}
 
 	xml, err := f.domBuilder.BuildDomain(vmID, domainProps, disks)
@@ -134,6 +179,14 @@ func (f Factory) Create(
 		return nil, bosherr.WrapError(err, "Recording ephemeral disk attachment")
 	}
 
+	for i, disk := range persistentDisks {
+		err = vm.attachPrewiredDisk(disk, persistentTargets[i])
+		if err != nil {
+			f.cleanUpPartialCreate(vm)
+			return nil, bosherr.WrapErrorf(err, "Recording disk attachment '%s'", disk.ID().AsString())
+		}
+	}
+
 	err = vm.Start()
 	if err != nil {
 		f.cleanUpPartialCreate(vm)
@@ -143,6 +196,17 @@ func (f Factory) Create(
 	return vm, nil
 }
 
+// localityPool returns the storage pool of the first persistent disk that lives in one,
+// so that new disks for the VM are placed on the same storage.
+func (f Factory) localityPool(disks []bdisk.Disk) string {
+	for _, disk := range disks {
+		if pool := disk.Props().Pool; len(pool) > 0 {
+			return pool
+		}
+	}
+	return ""
+}
+
 func (f Factory) cleanUpPartialCreate(vm VM) {
 	err := vm.Delete()
 	if err != nil {
@@ -152,7 +216,7 @@ func (f Factory) cleanUpPartialCreate(vm VM) {
 
 func (f Factory) newVM(cid apiv1.VMCID) VMImpl {
 	store := NewStore(filepath.Join(f.opts.DirPath, cid.AsString()), f.runner)
-	return NewVMImpl(cid, store, f.stemcellAPIVersion, f.driver, f.logger)
+	return NewVMImpl(cid, store, f.stemcellAPIVersion, f.stemcellFinder, f.driver, f.domBuilder, f.locker, f.logger)
 }
 
 func (f Factory) Find(cid apiv1.VMCID) (VM, error) {
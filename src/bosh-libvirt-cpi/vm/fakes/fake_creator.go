@@ -3,6 +3,7 @@ package fakes
 import (
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 
+	bdisk "bosh-libvirt-cpi/disk"
 	bstem "bosh-libvirt-cpi/stemcell"
 	bvm "bosh-libvirt-cpi/vm"
 )
@@ -12,6 +13,7 @@ type FakeCreator struct {
 	CreateStemcellArg   bstem.Stemcell
 	CreateCloudPropsArg apiv1.VMCloudProps
 	CreateNetworksArg   apiv1.Networks
+	CreateDisksArg      []bdisk.Disk
 	CreateEnvArg        apiv1.VMEnv
 
 	CreateResult bvm.VM
@@ -25,12 +27,14 @@ func (c *FakeCreator) Create(
 	stemcell bstem.Stemcell,
 	cloudProps apiv1.VMCloudProps,
 	networks apiv1.Networks,
+	disks []bdisk.Disk,
 	env apiv1.VMEnv,
 ) (bvm.VM, error) {
 	c.CreateAgentIDArg = agentID
 	c.CreateStemcellArg = stemcell
 	c.CreateCloudPropsArg = cloudProps
 	c.CreateNetworksArg = networks
+	c.CreateDisksArg = disks
 	c.CreateEnvArg = env
 	return c.CreateResult, c.CreateErr
 }
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"strings"
+
+	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+)
+
+// Info describes a VM as recorded in its store, for operators.
+type Info struct {
+	CID  string
+	Path string
+
+	Running  bool
+	Stemcell string                 `json:",omitempty"`
+	Metadata map[string]interface{} `json:",omitempty"`
+	Disks    []DiskAttachmentInfo   `json:",omitempty"`
+}
+
+type DiskAttachmentInfo struct {
+	CID       string
+	Target    string `json:",omitempty"`
+	Ephemeral bool   `json:",omitempty"`
+}
+
+// List returns the VMs that have a store dir.
+func (f Factory) List() ([]apiv1.VMCID, error) {
+	names, err := NewStore(f.opts.DirPath, f.runner).List()
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing VMs")
+	}
+
+	var cids []apiv1.VMCID
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "vm-") {
+			cids = append(cids, apiv1.NewVMCID(name))
+		}
+	}
+
+	return cids, nil
+}
+
+func (f Factory) Info(cid apiv1.VMCID) (Info, error) {
+	return f.newVM(cid).Info()
+}
+
+// AgentEnv returns the agent env the VM was last configured with.
+func (f Factory) AgentEnv(cid apiv1.VMCID) ([]byte, error) {
+	return f.newVM(cid).agentEnvContents()
+}
+
+func (vm VMImpl) Info() (Info, error) {
+	info := Info{CID: vm.cid.AsString(), Path: vm.store.path}
+
+	var stemcellRec vmStemcellRecord
+
+	found, err := vm.optionalRecord(vmStemcellRecordName, &stemcellRec)
+	if err != nil {
+		return info, err
+	} else if found {
+		info.Stemcell = stemcellRec.CID
+	}
+
+	_, err = vm.optionalRecord(vmMetadataRecordName, &info.Metadata)
+	if err != nil {
+		return info, err
+	}
+
+	records := diskAttachmentRecords{vm.store}
+
+	ids, err := records.List()
+	if err != nil {
+		return info, err
+	}
+
+	for _, id := range ids {
+		rec, err := records.Get(id)
+		if err != nil {
+			return info, err
+		}
+
+		info.Disks = append(info.Disks, DiskAttachmentInfo{CID: rec.ID, Target: rec.Target, Ephemeral: rec.Ephemeral})
+	}
+
+	info.Running, err = vm.IsRunning()
+	if err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
+
+// optionalRecord decodes the record under key into v unless there is none.
+func (vm VMImpl) optionalRecord(key string, v interface{}) (bool, error) {
+	found, err := vm.store.Exists(key)
+	if err != nil {
+		return false, bosherr.WrapErrorf(err, "Checking '%s' of VM '%s'", key, vm.cid.AsString())
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	err = vm.store.GetJSON(key, v)
+	if err != nil {
+		return false, bosherr.WrapErrorf(err, "Reading '%s' of VM '%s'", key, vm.cid.AsString())
+	}
+
+	return true, nil
+}
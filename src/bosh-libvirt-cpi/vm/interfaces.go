@@ -13,6 +13,7 @@ type Creator interface {
 		bstem.Stemcell,
 		apiv1.VMCloudProps,
 		apiv1.Networks,
+		[]bdisk.Disk,
 		apiv1.VMEnv,
 	) (VM, error)
 }
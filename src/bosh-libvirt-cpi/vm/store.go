@@ -1,14 +1,29 @@
 package vm
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
-	"strings"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 
 	"bosh-libvirt-cpi/driver"
 )
 
+// storePrevSuffix names the previous generation kept by Replace.
+const storePrevSuffix = ".prev"
+
+// CorruptRecordError is returned by GetJSON when a record cannot be decoded.
+type CorruptRecordError struct {
+	Path string
+	Err  error
+}
+
+func (e CorruptRecordError) Error() string {
+	return fmt.Sprintf("Record '%s' is corrupt: %s", e.Path, e.Err)
+}
+
 type Store struct {
 	path   string
 	runner driver.Runner
@@ -26,23 +41,20 @@ func sanitizeKey(key string) error {
 }
 
 func (m Store) List() ([]string, error) {
-	_, _, err := m.runner.Execute("mkdir", "-p", m.path)
+	err := m.runner.MkdirAll(m.path)
 	if err != nil {
 		return nil, err
 	}
 
-	out, _, err := m.runner.Execute("ls", "-1", m.path)
+	ids, err := m.runner.List(m.path)
 	if err != nil {
 		return nil, err
 	}
 
-	parts := strings.Split(out, "\n")
-	ids := []string{}
-	for _, p := range parts {
-		if p != "" {
-			ids = append(ids, p)
-		}
+	if ids == nil {
+		ids = []string{}
 	}
+
 	return ids, nil
 }
 
@@ -58,7 +70,7 @@ func (m Store) Put(key string, contents []byte) error {
 		return err
 	}
 
-	_, _, err := m.runner.Execute("mkdir", "-p", m.path)
+	err := m.runner.MkdirAll(m.path)
 	if err != nil {
 		return err
 	}
@@ -66,6 +78,52 @@ func (m Store) Put(key string, contents []byte) error {
 	return m.runner.Put(filepath.Join(m.path, key), contents)
 }
 
+// Replace puts contents under key after saving the current record, if it
+// exists and is valid JSON, under key+".prev" so that it can be recovered
+// later.
+func (m Store) Replace(key string, contents []byte) error {
+	found, err := m.Exists(key)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Checking previous '%s'", key)
+	}
+
+	if !found {
+		return m.Put(key, contents)
+	}
+
+	current, err := m.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if len(current) > 0 && json.Valid(current) {
+		err = m.Put(key+storePrevSuffix, current)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Keeping previous '%s'", key)
+		}
+	}
+
+	return m.Put(key, contents)
+}
+
+// Exists reports whether there is a record under key. Errors other than
+// the record not existing are returned.
+func (m Store) Exists(key string) (bool, error) {
+	if err := sanitizeKey(key); err != nil {
+		return false, err
+	}
+
+	_, err := m.runner.Stat(filepath.Join(m.path, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (m Store) Get(key string) ([]byte, error) {
 	if err := sanitizeKey(key); err != nil {
 		return nil, err
@@ -74,16 +132,36 @@ func (m Store) Get(key string) ([]byte, error) {
 	return m.runner.Get(filepath.Join(m.path, key))
 }
 
+// GetJSON decodes the record under key into v. Records that are empty or
+// not valid JSON are reported as CorruptRecordError.
+func (m Store) GetJSON(key string, v interface{}) error {
+	bytes, err := m.Get(key)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(m.path, key)
+
+	if len(bytes) == 0 {
+		return CorruptRecordError{Path: path, Err: fmt.Errorf("empty contents")}
+	}
+
+	err = json.Unmarshal(bytes, v)
+	if err != nil {
+		return CorruptRecordError{Path: path, Err: err}
+	}
+
+	return nil
+}
+
 func (m Store) DeleteOne(key string) error {
 	if err := sanitizeKey(key); err != nil {
 		return err
 	}
 
-	_, _, err := m.runner.Execute("rm", "-rf", filepath.Join(m.path, key))
-	return err
+	return m.runner.Remove(filepath.Join(m.path, key))
 }
 
 func (m Store) Delete() error {
-	_, _, err := m.runner.Execute("rm", "-rf", m.path)
-	return err
+	return m.runner.Remove(m.path)
 }
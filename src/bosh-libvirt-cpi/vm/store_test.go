@@ -2,10 +2,16 @@ package vm_test
 
 import (
 	"errors"
+	"os"
+	"path/filepath"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+
+	"bosh-libvirt-cpi/driver"
 	"bosh-libvirt-cpi/driver/fakes"
 	"bosh-libvirt-cpi/vm"
 )
@@ -23,39 +29,27 @@ var _ = Describe("Store", func() {
 
 	Describe("List", func() {
 		It("returns empty slice when directory is empty", func() {
-			runner.ExecuteOutput = ""
 			ids, err := store.List()
 			Expect(err).NotTo(HaveOccurred())
 			Expect(ids).To(Equal([]string{}))
-			Expect(len(ids)).To(Equal(0))
+			Expect(runner.MkdirAllCalls).To(Equal([]string{"/vms"}))
 		})
 
-		It("returns VM IDs without trailing empty strings when multiple VMs exist", func() {
-			runner.ExecuteOutput = "vm-abc\nvm-def\n"
+		It("returns the VM IDs in the directory", func() {
+			runner.ListResults = map[string][]string{"/vms": {"vm-abc", "vm-def"}}
 			ids, err := store.List()
 			Expect(err).NotTo(HaveOccurred())
 			Expect(ids).To(Equal([]string{"vm-abc", "vm-def"}))
-			Expect(len(ids)).To(Equal(2))
-		})
-
-		It("returns single VM ID without trailing empty string", func() {
-			runner.ExecuteOutput = "vm-123\n"
-			ids, err := store.List()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(ids).To(Equal([]string{"vm-123"}))
-			Expect(len(ids)).To(Equal(1))
 		})
 
-		It("returns multiple VMs without empty strings in the middle", func() {
-			runner.ExecuteOutput = "vm-1\nvm-2\nvm-3\n"
-			ids, err := store.List()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(ids).To(Equal([]string{"vm-1", "vm-2", "vm-3"}))
-			Expect(len(ids)).To(Equal(3))
+		It("propagates error from creating the directory", func() {
+			runner.MkdirAllErr = errors.New("mkdir failed")
+			_, err := store.List()
+			Expect(err).To(HaveOccurred())
 		})
 
-		It("propagates error from Execute", func() {
-			runner.ExecuteErr = errors.New("execute failed")
+		It("propagates error from List", func() {
+			runner.ListErr = errors.New("list failed")
 			_, err := store.List()
 			Expect(err).To(HaveOccurred())
 		})
@@ -106,6 +100,95 @@ var _ = Describe("Store", func() {
 		})
 	})
 
+	Describe("Replace", func() {
+		It("keeps the previous contents", func() {
+			runner.PutContents = map[string][]byte{"/vms/env.json": []byte(`{"old":true}`)}
+
+			Expect(store.Replace("env.json", []byte(`{"new":true}`))).To(Succeed())
+			Expect(runner.PutContents["/vms/env.json.prev"]).To(Equal([]byte(`{"old":true}`)))
+			Expect(runner.PutContents["/vms/env.json"]).To(Equal([]byte(`{"new":true}`)))
+		})
+
+		It("does not keep corrupt previous contents", func() {
+			runner.PutContents = map[string][]byte{
+				"/vms/env.json":      []byte(`{"old`),
+				"/vms/env.json.prev": []byte(`{"older":true}`),
+			}
+
+			Expect(store.Replace("env.json", []byte(`{"new":true}`))).To(Succeed())
+			Expect(runner.PutContents["/vms/env.json.prev"]).To(Equal([]byte(`{"older":true}`)))
+		})
+
+		It("propagates errors other than a missing record", func() {
+			runner.StatErr = errors.New("stat failed")
+
+			err := store.Replace("env.json", []byte(`{"new":true}`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("stat failed"))
+			Expect(runner.PutContents).To(BeEmpty())
+		})
+
+		Context("with a local runner", func() {
+			var dir string
+
+			BeforeEach(func() {
+				var err error
+				dir, err = os.MkdirTemp("", "vm-store-test")
+				Expect(err).ToNot(HaveOccurred())
+
+				logger := boshlog.NewLogger(boshlog.LevelNone)
+				fs := boshsys.NewOsFileSystem(logger)
+				localRunner := driver.NewLocalRunner(fs, boshsys.NewExecCmdRunner(logger), logger)
+				store = vm.NewStore(dir, localRunner)
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(dir)).To(Succeed())
+			})
+
+			It("writes a new record without keeping a previous one", func() {
+				Expect(store.Replace("env.json", []byte(`{"new":true}`))).To(Succeed())
+
+				Expect(os.ReadFile(filepath.Join(dir, "env.json"))).To(Equal([]byte(`{"new":true}`)))
+				_, err := os.Stat(filepath.Join(dir, "env.json.prev"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+
+			It("keeps the previous record on later writes", func() {
+				Expect(store.Replace("env.json", []byte(`{"old":true}`))).To(Succeed())
+				Expect(store.Replace("env.json", []byte(`{"new":true}`))).To(Succeed())
+
+				Expect(os.ReadFile(filepath.Join(dir, "env.json"))).To(Equal([]byte(`{"new":true}`)))
+				Expect(os.ReadFile(filepath.Join(dir, "env.json.prev"))).To(Equal([]byte(`{"old":true}`)))
+			})
+		})
+	})
+
+	Describe("GetJSON", func() {
+		It("decodes the record", func() {
+			runner.GetResult = []byte(`{"key":"value"}`)
+
+			var rec map[string]string
+			Expect(store.GetJSON("agent.json", &rec)).To(Succeed())
+			Expect(rec).To(Equal(map[string]string{"key": "value"}))
+		})
+
+		It("reports corrupt records", func() {
+			runner.GetResult = []byte(`{"key":`)
+
+			var rec map[string]string
+			err := store.GetJSON("agent.json", &rec)
+			Expect(err).To(BeAssignableToTypeOf(vm.CorruptRecordError{}))
+			Expect(err.Error()).To(ContainSubstring("Record '/vms/agent.json' is corrupt"))
+		})
+
+		It("reports empty records as corrupt", func() {
+			var rec map[string]string
+			err := store.GetJSON("agent.json", &rec)
+			Expect(err).To(BeAssignableToTypeOf(vm.CorruptRecordError{}))
+		})
+	})
+
 	Describe("DeleteOne", func() {
 		It("rejects keys containing ..", func() {
 			err := store.DeleteOne("../../important")
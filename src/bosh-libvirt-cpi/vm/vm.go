@@ -8,6 +8,7 @@ import (
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 
 	"bosh-libvirt-cpi/driver"
+	bstem "bosh-libvirt-cpi/stemcell"
 )
 
 type VMImpl struct {
@@ -16,29 +17,64 @@ type VMImpl struct {
 
 	stemcellAPIVersion apiv1.StemcellAPIVersion
 
-	driver driver.Driver
-	logger boshlog.Logger
+	stemcellFinder bstem.Finder
+
+	driver     driver.Driver
+	domBuilder driver.DomainBuilder
+	locker     driver.Locker
+	logger     boshlog.Logger
+}
+
+// vmStemcellRecord remembers the stemcell a VM was created from.
+type vmStemcellRecord struct {
+	CID string
 }
 
+const (
+	vmStemcellRecordName = "stemcell.json"
+	vmMetadataRecordName = "metadata.json"
+	agentEnvRecordName   = "env.json"
+)
+
 func NewVMImpl(
 	cid apiv1.VMCID,
 	store Store,
 	stemcellAPIVersion apiv1.StemcellAPIVersion,
+	stemcellFinder bstem.Finder,
 	driver driver.Driver,
+	domBuilder driver.DomainBuilder,
+	locker driver.Locker,
 	logger boshlog.Logger,
 ) VMImpl {
 	return VMImpl{
 		cid:                cid,
 		store:              store,
 		stemcellAPIVersion: stemcellAPIVersion,
+		stemcellFinder:     stemcellFinder,
 		driver:             driver,
+		domBuilder:         domBuilder,
+		locker:             locker,
 		logger:             logger,
 	}
 }
 
+// LockName names the lock held while a VM is changed. Disks and
+// stemcells are locked after the VM, never before.
+func LockName(cid apiv1.VMCID) string {
+	return "vm-" + cid.AsString()
+}
+
+func (vm VMImpl) withLock(fn func() error) error {
+	return driver.WithLock(vm.locker, LockName(vm.cid), fn)
+}
+
 func (vm VMImpl) ID() apiv1.VMCID { return vm.cid }
 
 func (vm VMImpl) SetProps(props VMProps) error {
+	return vm.withLock(func() error { return vm.setProps(props) })
+}
+
+func (vm VMImpl) setProps(props VMProps) error {
 	err := vm.driver.UpdateDomainMemory(vm.cid.AsString(), props.Memory)
 	if err != nil {
 		return bosherr.WrapError(err, "Updating domain memory")
@@ -53,12 +89,16 @@ func (vm VMImpl) SetProps(props VMProps) error {
 }
 
 func (vm VMImpl) SetMetadata(meta apiv1.VMMeta) error {
+	return vm.withLock(func() error { return vm.setMetadata(meta) })
+}
+
+func (vm VMImpl) setMetadata(meta apiv1.VMMeta) error {
 	bytes, err := json.Marshal(meta)
 	if err != nil {
 		return bosherr.WrapError(err, "Marshaling VM metadata")
 	}
 
-	err = vm.store.Put("metadata.json", bytes)
+	err = vm.store.Put(vmMetadataRecordName, bytes)
 	if err != nil {
 		return bosherr.WrapError(err, "Saving VM metadata")
 	}
@@ -73,6 +113,10 @@ func (vm VMImpl) ConfigureNICs(networks apiv1.Networks) error {
 }
 
 func (vm VMImpl) Delete() error {
+	return vm.withLock(vm.delete)
+}
+
+func (vm VMImpl) delete() error {
 	err := vm.HaltIfRunning()
 	if err != nil {
 		return err
@@ -83,5 +127,51 @@ func (vm VMImpl) Delete() error {
 		return bosherr.WrapErrorf(err, "Destroying VM domain '%s'", vm.cid.AsString())
 	}
 
+	err = vm.releaseStemcell()
+	if err != nil {
+		return err
+	}
+
 	return vm.store.Delete()
 }
+
+// useStemcell records the VM as a user of the stemcell.
+func (vm VMImpl) useStemcell(stemcell bstem.Stemcell) error {
+	bytes, err := json.Marshal(vmStemcellRecord{CID: stemcell.ID().AsString()})
+	if err != nil {
+		return bosherr.WrapError(err, "Serializing VM stemcell record")
+	}
+
+	err = vm.store.Put(vmStemcellRecordName, bytes)
+	if err != nil {
+		return bosherr.WrapError(err, "Saving VM stemcell record")
+	}
+
+	return stemcell.AddUser(vm.cid)
+}
+
+func (vm VMImpl) releaseStemcell() error {
+	var rec vmStemcellRecord
+
+	found, err := vm.optionalRecord(vmStemcellRecordName, &rec)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		// VMs created before stemcell usage was tracked
+		return nil
+	}
+
+	stemcell, err := vm.stemcellFinder.Find(apiv1.NewStemcellCID(rec.CID))
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Finding stemcell '%s'", rec.CID)
+	}
+
+	err = stemcell.RemoveUser(vm.cid)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Releasing stemcell '%s'", rec.CID)
+	}
+
+	return nil
+}
@@ -1,13 +1,17 @@
 package vm
 
 import (
+	"encoding/json"
+
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 )
 
 func (vm VMImpl) ConfigureAgent(agentEnv apiv1.AgentEnv) error {
-	_, err := vm.configureAgent(agentEnv)
-	return err
+	return vm.withLock(func() error {
+		_, err := vm.configureAgent(agentEnv)
+		return err
+	})
 }
 
 func (vm VMImpl) configureAgent(agentEnv apiv1.AgentEnv) ([]byte, error) {
@@ -16,7 +20,7 @@ func (vm VMImpl) configureAgent(agentEnv apiv1.AgentEnv) ([]byte, error) {
 		return nil, bosherr.WrapError(err, "Marshalling agent env")
 	}
 
-	err = vm.store.Put("env.json", bytes)
+	err = vm.store.Replace(agentEnvRecordName, bytes)
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Updating agent env")
 	}
@@ -25,9 +29,9 @@ func (vm VMImpl) configureAgent(agentEnv apiv1.AgentEnv) ([]byte, error) {
 }
 
 func (vm VMImpl) reconfigureAgent(agentEnvFunc func(apiv1.AgentEnv)) error {
-	prevContents, err := vm.store.Get("env.json")
+	prevContents, err := vm.agentEnvContents()
 	if err != nil {
-		return bosherr.WrapError(err, "Fetching agent env")
+		return err
 	}
 
 	agentEnv, err := apiv1.NewAgentEnvFactory().FromBytes(prevContents)
@@ -54,3 +58,27 @@ func (vm VMImpl) reconfigureAgent(agentEnvFunc func(apiv1.AgentEnv)) error {
 
 	return nil
 }
+
+// agentEnvContents reads the agent env, falling back to the previous
+// generation when the current one is corrupt (e.g. after a crash mid-write).
+func (vm VMImpl) agentEnvContents() ([]byte, error) {
+	var contents json.RawMessage
+
+	err := vm.store.GetJSON(agentEnvRecordName, &contents)
+	if err == nil {
+		return contents, nil
+	}
+
+	if _, ok := err.(CorruptRecordError); !ok {
+		return nil, bosherr.WrapError(err, "Fetching agent env")
+	}
+
+	vm.logger.Warn("VMImpl", "Recovering previous agent env: %s", err)
+
+	prevErr := vm.store.GetJSON(agentEnvRecordName+storePrevSuffix, &contents)
+	if prevErr != nil {
+		return nil, bosherr.WrapError(err, "Fetching agent env")
+	}
+
+	return contents, nil
+}
@@ -8,6 +8,7 @@ import (
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 
 	bdisk "bosh-libvirt-cpi/disk"
+	"bosh-libvirt-cpi/driver"
 )
 
 func (vm VMImpl) DiskIDs() ([]apiv1.DiskCID, error) {
@@ -31,23 +32,97 @@ func (vm VMImpl) DiskIDs() ([]apiv1.DiskCID, error) {
 }
 
 func (vm VMImpl) AttachDisk(disk bdisk.Disk) (apiv1.DiskHint, error) {
-	return vm.attachDisk(disk, false)
+	var hint apiv1.DiskHint
+
+	err := vm.withDiskLock(disk, func() error {
+		var err error
+		hint, err = vm.attachDisk(disk, false)
+		return err
+	})
+
+	return hint, err
 }
 
 func (vm VMImpl) AttachEphemeralDisk(disk bdisk.Disk) error {
-	_, err := vm.attachDisk(disk, true)
-	return err
+	return vm.withDiskLock(disk, func() error {
+		_, err := vm.attachDisk(disk, true)
+		return err
+	})
 }
 
-func (vm VMImpl) attachDisk(disk bdisk.Disk, ephemeral bool) (apiv1.DiskHint, error) {
-	hint := apiv1.NewDiskHintFromString(disk.ImagePath())
+// withDiskLock runs fn holding the lock of the VM and then that of disk.
+func (vm VMImpl) withDiskLock(disk bdisk.Disk, fn func() error) error {
+	return vm.withLock(func() error {
+		return driver.WithLock(vm.locker, bdisk.LockName(disk.ID()), fn)
+	})
+}
 
+func (vm VMImpl) attachDisk(disk bdisk.Disk, ephemeral bool) (apiv1.DiskHint, error) {
 	rec := diskAttachmentRecord{
 		ID:        disk.ID().AsString(),
 		Ephemeral: ephemeral,
 		Path:      disk.ImagePath(),
 	}
 
+	// Ephemeral disks are part of the initial domain definition.
+	if !ephemeral {
+		existing, found, err := vm.findAttachment(disk.ID())
+		if err != nil {
+			return apiv1.DiskHint{}, err
+		}
+
+		// Disks passed to create_vm are already wired into the domain
+		if found && len(existing.Target) > 0 {
+			vm.logger.Debug("VMImpl", "Disk '%s' is already attached as '%s'", disk.ID().AsString(), existing.Target)
+			return diskHintFromSerial(driver.DiskSerial(disk.ID().AsString())), nil
+		}
+
+		// QEMU cannot hotplug SATA devices, so such disks must be passed to create_vm
+		if disk.Props().Bus == bdisk.BusSATA {
+			return apiv1.DiskHint{}, bosherr.Errorf(
+				"Disk '%s' uses bus 'sata', which cannot be attached to a running VM: use 'virtio' or 'scsi' instead",
+				disk.ID().AsString())
+		}
+
+		target, err := vm.nextDiskTarget(disk.Props().Bus)
+		if err != nil {
+			return apiv1.DiskHint{}, err
+		}
+
+		rec.Target = target
+
+		xml, err := vm.diskDeviceXML(disk, target)
+		if err != nil {
+			return apiv1.DiskHint{}, err
+		}
+
+		err = vm.driver.AttachDevice(vm.cid.AsString(), xml)
+		if err != nil {
+			return apiv1.DiskHint{}, bosherr.WrapErrorf(err, "Attaching disk device '%s'", target)
+		}
+	}
+
+	return vm.recordAttachment(disk, rec)
+}
+
+// attachPrewiredDisk records a persistent disk that was included
+// in the domain definition under the given target.
+func (vm VMImpl) attachPrewiredDisk(disk bdisk.Disk, target string) error {
+	rec := diskAttachmentRecord{
+		ID:     disk.ID().AsString(),
+		Path:   disk.ImagePath(),
+		Target: target,
+	}
+
+	return vm.withDiskLock(disk, func() error {
+		_, err := vm.recordAttachment(disk, rec)
+		return err
+	})
+}
+
+func (vm VMImpl) recordAttachment(disk bdisk.Disk, rec diskAttachmentRecord) (apiv1.DiskHint, error) {
+	hint := diskHintFromSerial(driver.DiskSerial(disk.ID().AsString()))
+
 	err := diskAttachmentRecords{vm.store}.Save(disk.ID(), rec)
 	if err != nil {
 		return apiv1.DiskHint{}, err
@@ -59,11 +134,11 @@ func (vm VMImpl) attachDisk(disk bdisk.Disk, ephemeral bool) (apiv1.DiskHint, er
 	}
 
 	// Update agent env for stemcells that do not support mount_diskV2
-	if ephemeral || stemVer < 2 {
+	if rec.Ephemeral || stemVer < 2 {
 		vm.logger.Debug("VMImpl", "Reconfiguring agent")
 
 		agentUpdateFunc := func(agentEnv apiv1.AgentEnv) {
-			if ephemeral {
+			if rec.Ephemeral {
 				agentEnv.AttachEphemeralDisk(hint)
 			} else {
 				agentEnv.AttachPersistentDisk(disk.ID(), hint)
@@ -81,8 +156,48 @@ func (vm VMImpl) attachDisk(disk bdisk.Disk, ephemeral bool) (apiv1.DiskHint, er
 	return hint, nil
 }
 
+func (vm VMImpl) findAttachment(cid apiv1.DiskCID) (diskAttachmentRecord, bool, error) {
+	recs := diskAttachmentRecords{vm.store}
+
+	ids, err := recs.List()
+	if err != nil {
+		return diskAttachmentRecord{}, false, err
+	}
+
+	for _, id := range ids {
+		if id == cid {
+			rec, err := recs.Get(id)
+			return rec, err == nil, err
+		}
+	}
+
+	return diskAttachmentRecord{}, false, nil
+}
+
 func (vm VMImpl) DetachDisk(disk bdisk.Disk) error {
-	err := diskAttachmentRecords{vm.store}.Delete(disk.ID())
+	return vm.withDiskLock(disk, func() error { return vm.detachDisk(disk) })
+}
+
+func (vm VMImpl) detachDisk(disk bdisk.Disk) error {
+	rec, err := diskAttachmentRecords{vm.store}.Get(disk.ID())
+	if err != nil {
+		return err
+	}
+
+	// Attachments recorded without a target were never added to the domain.
+	if len(rec.Target) > 0 {
+		xml, err := vm.diskDeviceXML(disk, rec.Target)
+		if err != nil {
+			return err
+		}
+
+		err = vm.driver.DetachDevice(vm.cid.AsString(), xml)
+		if err != nil {
+			return bosherr.WrapErrorf(err, "Detaching disk device '%s'", rec.Target)
+		}
+	}
+
+	err = diskAttachmentRecords{vm.store}.Delete(disk.ID())
 	if err != nil {
 		return err
 	}
@@ -99,10 +214,83 @@ func (vm VMImpl) DetachDisk(disk bdisk.Disk) error {
 	return nil
 }
 
+// diskHintFromSerial tells the agent to resolve the disk via /dev/disk/by-id,
+// which does not depend on the order devices are presented to the guest.
+func diskHintFromSerial(serial string) apiv1.DiskHint {
+	return apiv1.NewDiskHintFromMap(map[string]interface{}{"id": serial})
+}
+
+func (vm VMImpl) diskDeviceXML(disk bdisk.Disk, target string) (string, error) {
+	xml, err := vm.domBuilder.BuildDiskDevice(domainDisk(disk, target))
+	if err != nil {
+		return "", bosherr.WrapError(err, "Building disk device XML")
+	}
+
+	return xml, nil
+}
+
+func domainDisk(disk bdisk.Disk, target string) driver.DomainDisk {
+	props := disk.Props()
+
+	return driver.DomainDisk{
+		Path:     disk.ImagePath(),
+		Format:   props.Format,
+		Bus:      props.Bus,
+		Cache:    props.Cache,
+		Target:   target,
+		Serial:   driver.DiskSerial(disk.ID().AsString()),
+		ReadOnly: props.ReadOnly,
+
+		EncryptionSecret: disk.EncryptionSecret(),
+	}
+}
+
+// nextDiskTarget picks the first guest device name not used by another attachment.
+func (vm VMImpl) nextDiskTarget(bus string) (string, error) {
+	recs := diskAttachmentRecords{vm.store}
+
+	ids, err := recs.List()
+	if err != nil {
+		return "", err
+	}
+
+	used := map[string]bool{}
+
+	for _, id := range ids {
+		rec, err := recs.Get(id)
+		if err != nil {
+			return "", err
+		}
+		used[rec.Target] = true
+	}
+
+	return freeDiskTarget(bus, used)
+}
+
+// freeDiskTarget returns the first device name for bus that is not in used.
+// Names start at the third letter since the first two are
+// taken by the system and ephemeral disks.
+func freeDiskTarget(bus string, used map[string]bool) (string, error) {
+	prefix := "sd"
+	if bus == "" || bus == bdisk.BusVirtio {
+		prefix = "vd"
+	}
+
+	for c := 'c'; c <= 'z'; c++ {
+		target := prefix + string(c)
+		if !used[target] {
+			return target, nil
+		}
+	}
+
+	return "", bosherr.Errorf("No free '%s' disk target left", prefix)
+}
+
 type diskAttachmentRecord struct {
 	ID        string
 	Ephemeral bool
 	Path      string
+	Target    string // guest device name; empty for disks defined with the domain
 }
 
 type diskAttachmentRecords struct {
@@ -135,16 +323,11 @@ func (r diskAttachmentRecords) List() ([]apiv1.DiskCID, error) {
 func (r diskAttachmentRecords) Get(cid apiv1.DiskCID) (diskAttachmentRecord, error) {
 	var rec diskAttachmentRecord
 
-	bytes, err := r.store.Get(cid.AsString() + diskAttachmentRecordsSuffix)
+	err := r.store.GetJSON(cid.AsString()+diskAttachmentRecordsSuffix, &rec)
 	if err != nil {
 		return rec, bosherr.WrapError(err, "Getting disk attachment")
 	}
 
-	err = json.Unmarshal(bytes, &rec)
-	if err != nil {
-		return rec, bosherr.WrapError(err, "Deserializing disk attachment")
-	}
-
 	return rec, nil
 }
 
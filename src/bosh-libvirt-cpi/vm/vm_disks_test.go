@@ -9,8 +9,11 @@ import (
 	apiv1 "github.com/cloudfoundry/bosh-cpi-go/apiv1"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
 
+	bdisk "bosh-libvirt-cpi/disk"
 	diskfakes "bosh-libvirt-cpi/disk/fakes"
+	"bosh-libvirt-cpi/driver"
 	driverfakes "bosh-libvirt-cpi/driver/fakes"
+	stemcellfakes "bosh-libvirt-cpi/stemcell/fakes"
 	"bosh-libvirt-cpi/vm"
 )
 
@@ -36,16 +39,20 @@ func (c *stubCallContext) As(val interface{}) error {
 
 var _ = Describe("VMImpl disk operations", func() {
 	var (
-		vmImpl vm.VMImpl
-		runner *driverfakes.FakeRunner
-		drv    *driverfakes.FakeDriver
-		logger boshlog.Logger
+		vmImpl  vm.VMImpl
+		runner  *driverfakes.FakeRunner
+		drv     *driverfakes.FakeDriver
+		builder *driverfakes.FakeDomainBuilder
+		locker  *driverfakes.FakeLocker
+		logger  boshlog.Logger
 	)
 
 	BeforeEach(func() {
 		logger = boshlog.NewLogger(boshlog.LevelNone)
 		runner = &driverfakes.FakeRunner{}
 		drv = &driverfakes.FakeDriver{}
+		builder = &driverfakes.FakeDomainBuilder{BuildDiskDeviceXML: "<disk/>"}
+		locker = &driverfakes.FakeLocker{}
 		// GetResult is used when reconfigureAgent reads env.json — provide
 		// minimal valid JSON so FromBytes succeeds.
 		runner.GetResult = []byte("{}")
@@ -57,19 +64,138 @@ var _ = Describe("VMImpl disk operations", func() {
 			apiv1.NewVMCID("vm-1"),
 			store,
 			stemVer,
+			&stemcellfakes.FakeStemcellFinder{},
 			drv,
+			builder,
+			locker,
 			logger,
 		)
 	})
 
 	Describe("AttachDisk", func() {
-		It("saves attachment and returns hint with image path", func() {
+		It("saves attachment and returns hint with the disk serial as id", func() {
 			disk := diskfakes.NewFakeDisk("disk-1")
 			disk.ImagePathResult = "/disks/disk-1/disk.img"
 
 			hint, err := vmImpl.AttachDisk(disk)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(hint).To(Equal(apiv1.NewDiskHintFromString("/disks/disk-1/disk.img")))
+			Expect(hint).To(Equal(apiv1.NewDiskHintFromMap(map[string]interface{}{"id": "disk-1"})))
+		})
+
+		It("locks the VM and then the disk", func() {
+			disk := diskfakes.NewFakeDisk("disk-1")
+
+			_, err := vmImpl.AttachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(locker.LockCalls).To(Equal([]string{"vm-vm-1", "disk-disk-1"}))
+			Expect(locker.UnlockCalls).To(Equal([]string{"disk-disk-1", "vm-vm-1"}))
+		})
+
+		It("does not attach the disk without the VM lock", func() {
+			locker.LockErr = errors.New("fake-lock-err")
+			disk := diskfakes.NewFakeDisk("disk-1")
+
+			_, err := vmImpl.AttachDisk(disk)
+			Expect(err).To(MatchError("fake-lock-err"))
+			Expect(drv.AttachDeviceID).To(BeEmpty())
+		})
+
+		It("truncates the serial of long disk CIDs", func() {
+			disk := diskfakes.NewFakeDisk("disk-0123456789abcdef0123")
+
+			hint, err := vmImpl.AttachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hint).To(Equal(apiv1.NewDiskHintFromMap(map[string]interface{}{"id": "disk-0123456789abcde"})))
+			Expect(builder.BuildDiskDeviceArg.Serial).To(Equal("disk-0123456789abcde"))
+		})
+
+		It("attaches a device built from the disk props to the domain", func() {
+			disk := diskfakes.NewFakeDisk("disk-1")
+			disk.ImagePathResult = "/disks/disk-1/disk.img"
+			disk.PropsResult = bdisk.DiskProps{Bus: "scsi", Format: "qcow2", Cache: "none", ReadOnly: true}
+
+			_, err := vmImpl.AttachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(builder.BuildDiskDeviceArg).To(Equal(driver.DomainDisk{
+				Path:     "/disks/disk-1/disk.img",
+				Format:   "qcow2",
+				Bus:      "scsi",
+				Cache:    "none",
+				Target:   "sdc",
+				Serial:   "disk-1",
+				ReadOnly: true,
+			}))
+			Expect(drv.AttachDeviceID).To(Equal("vm-1"))
+			Expect(drv.AttachDeviceXML).To(Equal("<disk/>"))
+		})
+
+		It("passes the encryption secret of encrypted disks", func() {
+			disk := diskfakes.NewFakeDisk("disk-1")
+			disk.PropsResult = bdisk.DiskProps{Bus: "virtio", Encrypted: true}
+			disk.SecretResult = "secret-uuid-1"
+
+			_, err := vmImpl.AttachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(builder.BuildDiskDeviceArg.EncryptionSecret).To(Equal("secret-uuid-1"))
+		})
+
+		It("does not attach disks again that were wired into the domain at creation", func() {
+			disk := diskfakes.NewFakeDisk("disk-1")
+			runner.GetResult = []byte(`{"ID":"disk-1","Target":"vdc"}`)
+			runner.ListResults = map[string][]string{"/vms/vm-1": {"disk-1-disk-attachment.json"}}
+
+			hint, err := vmImpl.AttachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hint).To(Equal(apiv1.NewDiskHintFromMap(map[string]interface{}{"id": "disk-1"})))
+			Expect(drv.AttachDeviceXML).To(BeEmpty())
+		})
+
+		It("refuses to hot-attach sata disks", func() {
+			disk := diskfakes.NewFakeDisk("disk-1")
+			disk.PropsResult = bdisk.DiskProps{Bus: "sata"}
+
+			_, err := vmImpl.AttachDisk(disk)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("cannot be attached to a running VM"))
+			Expect(drv.AttachDeviceXML).To(BeEmpty())
+			Expect(runner.PutContents).To(BeEmpty())
+		})
+
+		It("accepts sata disks that were wired into the domain at creation", func() {
+			disk := diskfakes.NewFakeDisk("disk-1")
+			disk.PropsResult = bdisk.DiskProps{Bus: "sata"}
+			runner.GetResult = []byte(`{"ID":"disk-1","Target":"sdc"}`)
+			runner.ListResults = map[string][]string{"/vms/vm-1": {"disk-1-disk-attachment.json"}}
+
+			_, err := vmImpl.AttachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(drv.AttachDeviceXML).To(BeEmpty())
+		})
+
+		It("uses virtio device names for virtio disks", func() {
+			disk := diskfakes.NewFakeDisk("disk-1")
+			disk.PropsResult = bdisk.DiskProps{Bus: "virtio"}
+
+			_, err := vmImpl.AttachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(builder.BuildDiskDeviceArg.Target).To(Equal("vdc"))
+		})
+
+		It("returns error when attaching the device fails", func() {
+			drv.AttachDeviceErr = errors.New("attach failed")
+			disk := diskfakes.NewFakeDisk("disk-1")
+
+			_, err := vmImpl.AttachDisk(disk)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("attach failed"))
+		})
+
+		It("does not attach a device for ephemeral disks", func() {
+			disk := diskfakes.NewFakeDisk("disk-eph")
+
+			err := vmImpl.AttachEphemeralDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(drv.AttachDeviceID).To(BeEmpty())
 		})
 
 		It("returns error when store Put fails", func() {
@@ -94,6 +220,44 @@ var _ = Describe("VMImpl disk operations", func() {
 			Expect(err).ToNot(HaveOccurred())
 		})
 
+		It("detaches the device recorded at attach time", func() {
+			runner.GetResult = []byte(`{"ID":"disk-1","Target":"vdc"}`)
+			disk := diskfakes.NewFakeDisk("disk-1")
+			disk.ImagePathResult = "/disks/disk-1/disk.img"
+
+			err := vmImpl.DetachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(builder.BuildDiskDeviceArg.Target).To(Equal("vdc"))
+			Expect(drv.DetachDeviceID).To(Equal("vm-1"))
+		})
+
+		It("recovers the previous agent env when the current one is corrupt", func() {
+			runner.GetResult = nil
+			runner.PutContents = map[string][]byte{
+				"/vms/vm-1/disk-1-disk-attachment.json": []byte(`{"ID":"disk-1"}`),
+				"/vms/vm-1/env.json":                    []byte(`{"agent_id":`),
+				"/vms/vm-1/env.json.prev":               []byte(`{"agent_id":"agent-1"}`),
+			}
+			disk := diskfakes.NewFakeDisk("disk-1")
+
+			err := vmImpl.DetachDisk(disk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(runner.PutContents["/vms/vm-1/env.json"])).To(ContainSubstring(`"agent_id":"agent-1"`))
+		})
+
+		It("fails when neither the current nor the previous agent env can be read", func() {
+			runner.GetResult = nil
+			runner.PutContents = map[string][]byte{
+				"/vms/vm-1/disk-1-disk-attachment.json": []byte(`{"ID":"disk-1"}`),
+				"/vms/vm-1/env.json":                    []byte(`{"agent_id":`),
+			}
+			disk := diskfakes.NewFakeDisk("disk-1")
+
+			err := vmImpl.DetachDisk(disk)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("is corrupt"))
+		})
+
 		It("returns error when reconfigureAgent fails due to Get error", func() {
 			runner.GetErr = errors.New("get failed")
 			disk := diskfakes.NewFakeDisk("disk-1")
@@ -21,7 +21,9 @@ func (vm VMImpl) Start() error {
 }
 
 func (vm VMImpl) Reboot() error {
-	return vm.driver.RebootDomain(vm.cid.AsString())
+	return vm.withLock(func() error {
+		return vm.driver.RebootDomain(vm.cid.AsString())
+	})
 }
 
 func (vm VMImpl) HaltIfRunning() error {